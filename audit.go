@@ -0,0 +1,496 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/user"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/JoshuaDoes/tensor-usbdl/tensorutils"
+	"github.com/spf13/pflag"
+)
+
+const (
+	AUDIT_FILE  = "audit.jsonl" // Default audit log, next to the config file
+	AUDIT_QUEUE = 1024          // Events queued for a session until its receiver takes them
+)
+
+// AuditRecord is what the audit log keeps about a flash session, written as one JSON line once it ends
+type AuditRecord struct {
+	Session   string               `json:"session"`
+	Time      time.Time            `json:"time"`
+	Host      string               `json:"host"`
+	Operator  string               `json:"operator"`
+	Batch     string               `json:"batch,omitempty"` // Recovery batch the session is part of
+	Version   string               `json:"version"`
+	Source    string               `json:"source"` // Image, factory image or manifest given to flash
+	Mode      string               `json:"mode"`
+	Simulated bool                 `json:"simulated,omitempty"`
+	Profile   string               `json:"profile,omitempty"`
+	Transport string               `json:"transport,omitempty"` // Transport of the last stage
+	Device    string               `json:"device,omitempty"`
+	Serial    string               `json:"serial,omitempty"`  // USB serial number
+	ChipID    string               `json:"chip_id,omitempty"` // As announced by the device in its stage requests
+	Stages    []AuditStage         `json:"stages"`
+	Dropped   uint64               `json:"events_dropped,omitempty"` // Events the session fell behind on, its stages miss them
+	Duration  tensorutils.Duration `json:"duration"`
+	Outcome   string               `json:"outcome"`
+	ExitCode  int                  `json:"exit_code"`
+	Error     string               `json:"error,omitempty"`
+}
+
+// AuditStage is one image sent during a session
+type AuditStage struct {
+	Stage     string               `json:"stage"`
+	SHA256    string               `json:"sha256"`
+	Bytes     int64                `json:"bytes"`
+	Sent      int64                `json:"sent"` // Bytes of the image actually sent, less than Bytes if the write failed
+	Time      time.Time            `json:"time"`
+	Duration  tensorutils.Duration `json:"duration"`
+	Transport string               `json:"transport,omitempty"`
+	Device    string               `json:"device,omitempty"`
+	Outcome   string               `json:"outcome"`
+	Message   string               `json:"message,omitempty"` // The message that decided the outcome
+	Error     string               `json:"error,omitempty"`
+	Responses []string             `json:"responses,omitempty"` // Every message the device sent during the stage
+	Events    []string             `json:"events,omitempty"`    // Stalls, recovery actions and disconnects
+}
+
+// auditSession records a flash session from the flash command until it ends
+type auditSession struct {
+	record AuditRecord
+	opts   *FlashOptions
+	file   *os.File
+	sub    *tensorutils.Subscription[tensorutils.Event]
+	flush  chan chan []tensorutils.Event // Asks the receiver for the events since the last stage, closed by finish
+	sent   int64                         // Bytes of the current stage sent, as reported by the transport
+}
+
+// auditPath returns the audit log to use, audit.jsonl in the config directory unless one is configured
+func auditPath(cfg *Config) (string, error) {
+	if cfg.AuditLog != "" {
+		return os.ExpandEnv(cfg.AuditLog), nil
+	}
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", fmt.Errorf("no audit log, set audit_log in the config: %w", err)
+	}
+	return filepath.Join(dir, CONFIG_DIR, AUDIT_FILE), nil
+}
+
+// operatorName returns the operator given, or the user running the tool
+func operatorName(operator string) string {
+	if operator != "" {
+		return operator
+	}
+	if u, err := user.Current(); err == nil && u.Username != "" {
+		return u.Username
+	}
+	if name := os.Getenv("USER"); name != "" {
+		return name
+	}
+	return os.Getenv("USERNAME")
+}
+
+// startAudit opens the audit log and starts recording a session. The log is opened up front so a session that
+// can't be recorded never reaches the device.
+func startAudit(cfg *Config, source string, opts *FlashOptions) (*auditSession, error) {
+	path, err := auditPath(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("failed to open the audit log: %w", err)
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open the audit log: %w", err)
+	}
+	id := make([]byte, 6)
+	rand.Read(id)
+	host, _ := os.Hostname()
+	session := &auditSession{
+		record: AuditRecord{
+			Session:   hex.EncodeToString(id),
+			Time:      time.Now(),
+			Host:      host,
+			Operator:  operatorName(opts.Operator),
+			Batch:     opts.Batch,
+			Version:   VERSION,
+			Source:    source,
+			Mode:      opts.Mode.String(),
+			Simulated: opts.Simulate,
+			Stages:    []AuditStage{},
+		},
+		opts:  opts,
+		file:  file,
+		sub:   tensorutils.DefaultBus.Subscribe(AUDIT_QUEUE, tensorutils.OverflowDropOldest),
+		flush: make(chan chan []tensorutils.Event),
+	}
+	go session.receive()
+	if selectedProfile != nil {
+		session.record.Profile = selectedProfile.Name
+	}
+	return session, nil
+}
+
+// beginStage hashes an image before it is sent, the returned func records how the stage went
+func (session *auditSession) beginStage(img *tensorutils.Image) func(res *tensorutils.Result, err error) {
+	stage := AuditStage{Stage: img.Name, Bytes: img.Size}
+	hash := sha256.New()
+	if _, err := io.Copy(hash, img.Reader()); err == nil {
+		stage.SHA256 = hex.EncodeToString(hash.Sum(nil))
+	} else {
+		fmt.Fprintf(stdout, "⚠️  Failed to hash %s for the audit log: %v\n", img.Name, err)
+	}
+	stage.Time = time.Now()
+	session.sent = 0
+
+	return func(res *tensorutils.Result, err error) {
+		stage.Duration = tensorutils.Duration(time.Since(stage.Time))
+		stage.Sent = min(session.sent, stage.Bytes)
+		summary := newFlashSummary("", img.Name, res, err)
+		stage.Outcome, stage.Message, stage.Error = summary.Outcome, summary.Message, summary.Error
+		session.collect(&stage)
+		session.record.Stages = append(session.record.Stages, stage)
+	}
+}
+
+// setSent records how many bytes of the current stage the transport sent, it does nothing without an audit session
+func (session *auditSession) setSent(n int64) {
+	if session != nil {
+		session.sent = n
+	}
+}
+
+// receive takes events off the subscription as they are published, so a long or noisy stage doesn't overflow it,
+// and hands them over whenever a stage is collected
+func (session *auditSession) receive() {
+	var events []tensorutils.Event
+	for {
+		select {
+		case event := <-session.sub.C():
+			events = append(events, event)
+		case reply, ok := <-session.flush:
+			if !ok {
+				return
+			}
+			for queued := true; queued; {
+				select {
+				case event := <-session.sub.C():
+					events = append(events, event)
+				default:
+					queued = false
+				}
+			}
+			reply <- events
+			events = nil
+		}
+	}
+}
+
+// collect takes the events published while a stage was flashed, they are all queued by the time it returns
+func (session *auditSession) collect(stage *AuditStage) {
+	record := &session.record
+	reply := make(chan []tensorutils.Event)
+	session.flush <- reply
+	for _, event := range <-reply {
+		stage.Transport = event.Transport
+		if event.Serial != "" {
+			record.Serial = event.Serial
+		}
+		if event.Chip != "" {
+			record.ChipID = event.Chip
+		}
+		switch event.Kind {
+		case tensorutils.EventConnected:
+			stage.Device = event.Device
+			record.Device = event.Device
+		case tensorutils.EventMessage:
+			stage.Responses = append(stage.Responses, event.Message.String())
+		case tensorutils.EventClosed:
+		default:
+			stage.Events = append(stage.Events, event.String())
+		}
+		record.Transport = stage.Transport
+	}
+}
+
+// finish appends the session to the audit log
+func (session *auditSession) finish(res *tensorutils.Result, err error) {
+	session.sub.Close()
+	close(session.flush)
+	defer session.file.Close()
+	record := &session.record
+	if record.Dropped = session.sub.Dropped(); record.Dropped > 0 {
+		fmt.Fprintf(stdout, "⚠️  The audit log missed %d events of session %s\n", record.Dropped, record.Session)
+	}
+	record.Duration = tensorutils.Duration(time.Since(record.Time))
+	summary := newFlashSummary(record.Source, "", res, err)
+	record.Outcome, record.ExitCode, record.Error = summary.Outcome, summary.ExitCode, summary.Error
+	if session.opts.Profile != nil {
+		record.Profile = session.opts.Profile.Name
+	}
+
+	p, err := json.Marshal(record)
+	if err == nil {
+		_, err = session.file.Write(append(p, '\n'))
+	}
+	if err != nil {
+		fmt.Fprintf(stdout, "❌ Failed to append session %s to the audit log: %v\n", record.Session, err)
+		return
+	}
+	fmt.Fprintf(stdout, "Session %s recorded in the audit log\n", record.Session)
+}
+
+// readAudit reads every record of an audit log, oldest first
+func readAudit(path string) ([]*AuditRecord, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	var records []*AuditRecord
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(nil, 16*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		if len(strings.TrimSpace(scanner.Text())) == 0 {
+			continue
+		}
+		record := new(AuditRecord)
+		if err := json.Unmarshal(scanner.Bytes(), record); err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, line, err)
+		}
+		records = append(records, record)
+	}
+	return records, scanner.Err()
+}
+
+// auditFilter selects sessions from the audit log
+type auditFilter struct {
+	Sessions []string // Matches any of the session IDs by prefix
+	Device   string   // Matches the serial number or the chip ID by prefix
+	Stage    string
+	SHA256   string // Matches an image digest by prefix
+	Outcome  string
+	Operator string
+	Batch    string
+	Since    time.Time
+	Until    time.Time
+}
+
+func (filter *auditFilter) match(record *AuditRecord) bool {
+	if len(filter.Sessions) > 0 && !slices.ContainsFunc(filter.Sessions, func(id string) bool { return strings.HasPrefix(record.Session, id) }) {
+		return false
+	}
+	switch {
+	case filter.Device != "" && !hasPrefixFold(record.Serial, filter.Device) && !hasPrefixFold(record.ChipID, filter.Device),
+		filter.Outcome != "" && !strings.EqualFold(record.Outcome, filter.Outcome),
+		filter.Operator != "" && !strings.EqualFold(record.Operator, filter.Operator),
+		filter.Batch != "" && record.Batch != filter.Batch,
+		!filter.Since.IsZero() && record.Time.Before(filter.Since),
+		!filter.Until.IsZero() && !record.Time.Before(filter.Until):
+		return false
+	}
+	if filter.Stage == "" && filter.SHA256 == "" {
+		return true
+	}
+	for _, stage := range record.Stages {
+		if (filter.Stage == "" || strings.EqualFold(stage.Stage, filter.Stage)) &&
+			(filter.SHA256 == "" || hasPrefixFold(stage.SHA256, filter.SHA256)) {
+			return true
+		}
+	}
+	return false
+}
+
+func hasPrefixFold(s, prefix string) bool {
+	return len(s) >= len(prefix) && strings.EqualFold(s[:len(prefix)], prefix)
+}
+
+// parseSince parses a point in time given as a date, an RFC 3339 time or a duration back from now
+func parseSince(value string) (time.Time, error) {
+	if d, err := time.ParseDuration(value); err == nil {
+		return time.Now().Add(-d), nil
+	}
+	for _, layout := range []string{time.RFC3339, "2006-01-02T15:04", "2006-01-02"} {
+		if t, err := time.ParseInLocation(layout, value, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid time '%s', use a date, an RFC 3339 time or a duration such as 24h", value)
+}
+
+// auditQuery selects sessions from an audit log for the history and report commands
+type auditQuery struct {
+	filter       auditFilter
+	since, until string
+	limit        int
+	file         string
+}
+
+// flags adds the selection flags to a command's flag set
+func (query *auditQuery) flags(fs *pflag.FlagSet) {
+	fs.StringVar(&query.filter.Device, "device", "", "only sessions with a device whose serial number or chip ID starts with this")
+	fs.StringVar(&query.filter.Stage, "stage", "", "only sessions that flashed this stage")
+	fs.StringVar(&query.filter.SHA256, "sha256", "", "only sessions that flashed an image with this digest (prefix)")
+	fs.StringVar(&query.filter.Outcome, "outcome", "", "only sessions with this outcome: accepted, rejected header, boot failure, disconnected, unknown or error")
+	fs.StringVar(&query.filter.Operator, "operator", "", "only sessions of this operator")
+	fs.StringVar(&query.filter.Batch, "batch", "", "only sessions of this batch")
+	fs.StringVar(&query.since, "since", "", "only sessions started at or after this date, time or duration ago")
+	fs.StringVar(&query.until, "until", "", "only sessions started before this date, time or duration ago")
+	fs.IntVar(&query.limit, "limit", 0, "only the most recent sessions (0 for all)")
+	fs.StringVar(&query.file, "file", "", "audit log to read (default: the configured one)")
+}
+
+// run reads the audit log and returns its path and the selected sessions, oldest first
+func (query *auditQuery) run(cfg *Config) (string, []*AuditRecord, error) {
+	var err error
+	if query.since != "" {
+		if query.filter.Since, err = parseSince(query.since); err != nil {
+			return "", nil, err
+		}
+	}
+	if query.until != "" {
+		if query.filter.Until, err = parseSince(query.until); err != nil {
+			return "", nil, err
+		}
+	}
+	path := query.file
+	if path == "" {
+		if path, err = auditPath(cfg); err != nil {
+			return "", nil, err
+		}
+	}
+	records, err := readAudit(path)
+	if os.IsNotExist(err) {
+		records, err = nil, nil
+	}
+	if err != nil {
+		return "", nil, err
+	}
+	var matched []*AuditRecord
+	for _, record := range records {
+		if query.filter.match(record) {
+			matched = append(matched, record)
+		}
+	}
+	if query.limit > 0 && len(matched) > query.limit {
+		matched = matched[len(matched)-query.limit:]
+	}
+	return path, matched, nil
+}
+
+// runHistory implements the history command
+func runHistory(arguments []string, cfg *Config) error {
+	var query auditQuery
+	fs := pflag.NewFlagSet("history", pflag.ContinueOnError)
+	query.flags(fs)
+	asJSON := fs.Bool("json", false, "print the records as JSON")
+	if err := fs.Parse(arguments); err != nil {
+		return err
+	}
+	if fs.NArg() > 1 {
+		return fmt.Errorf("history takes at most one session ID")
+	}
+	query.filter.Sessions = fs.Args()
+	path, matched, err := query.run(cfg)
+	if err != nil {
+		return err
+	}
+
+	if *asJSON || outputJSON {
+		if matched == nil {
+			matched = []*AuditRecord{}
+		}
+		return printJSON(matched)
+	}
+	if len(query.filter.Sessions) > 0 && len(matched) == 1 {
+		printSession(matched[0])
+		return nil
+	}
+	fmt.Fprintf(stdout, "=== Flash History (%s) ===\n", path)
+	if len(matched) == 0 {
+		fmt.Fprintln(stdout, "No sessions found")
+		return nil
+	}
+	for _, record := range matched {
+		stages := make([]string, len(record.Stages))
+		for i, stage := range record.Stages {
+			stages[i] = stage.Stage
+		}
+		fmt.Fprintf(stdout, "%s  %s  %-16s  %-6s  %-10s  %-15s  %s\n", record.Session, record.Time.Local().Format("2006-01-02 15:04:05"),
+			orNone(deviceID(record)), orNone(record.Transport), record.Operator, record.Outcome, orNone(strings.Join(stages, " → ")))
+	}
+	fmt.Fprintf(stdout, "%d sessions, show one with: history <session>\n", len(matched))
+	return nil
+}
+
+// printSession prints everything recorded about a session
+func printSession(record *AuditRecord) {
+	fmt.Fprintf(stdout, "=== Session %s ===\n", record.Session)
+	fmt.Fprintf(stdout, "Time: %s (%s)\n", record.Time.Local().Format(time.RFC3339), record.Duration)
+	fmt.Fprintf(stdout, "Host: %s, operator: %s, version: %s\n", record.Host, record.Operator, record.Version)
+	if record.Batch != "" {
+		fmt.Fprintf(stdout, "Batch: %s\n", record.Batch)
+	}
+	fmt.Fprintf(stdout, "Source: %s (mode %s)\n", record.Source, record.Mode)
+	if record.Simulated {
+		fmt.Fprintln(stdout, "Simulated: yes")
+	}
+	fmt.Fprintf(stdout, "Device: %s\n", orNone(record.Device))
+	if record.Dropped > 0 {
+		fmt.Fprintf(stdout, "⚠️  %d events were dropped, the stages below are incomplete\n", record.Dropped)
+	}
+	fmt.Fprintf(stdout, "Serial: %s, chip ID: %s, transport: %s, profile: %s\n",
+		orNone(record.Serial), orNone(record.ChipID), orNone(record.Transport), orNone(record.Profile))
+	for i, stage := range record.Stages {
+		fmt.Fprintf(stdout, "\n--- Stage %s (%d/%d) ---\n", stage.Stage, i+1, len(record.Stages))
+		fmt.Fprintf(stdout, "Image: %d bytes, sha256 %s\n", stage.Bytes, orNone(stage.SHA256))
+		if stage.Sent != stage.Bytes && stage.Outcome != tensorutils.OutcomeAccepted.String() {
+			fmt.Fprintf(stdout, "Only %d bytes were sent\n", stage.Sent)
+		}
+		fmt.Fprintf(stdout, "Sent: %s over %s in %s\n", stage.Time.Local().Format("15:04:05.000"), orNone(stage.Transport), stage.Duration)
+		fmt.Fprintf(stdout, "Outcome: %s\n", stage.Outcome)
+		if stage.Message != "" {
+			fmt.Fprintf(stdout, "Message: %s\n", stage.Message)
+		}
+		if stage.Error != "" {
+			fmt.Fprintf(stdout, "Error: %s\n", stage.Error)
+		}
+		for _, response := range stage.Responses {
+			fmt.Fprintf(stdout, "  ← %s\n", response)
+		}
+		for _, event := range stage.Events {
+			fmt.Fprintf(stdout, "  ⚠️  %s\n", event)
+		}
+	}
+	fmt.Fprintf(stdout, "\nOutcome: %s (exit code %d)\n", record.Outcome, record.ExitCode)
+	if record.Error != "" {
+		fmt.Fprintf(stdout, "Error: %s\n", record.Error)
+	}
+}
+
+// deviceID returns the best identifier recorded for the device of a session
+func deviceID(record *AuditRecord) string {
+	if record.ChipID != "" {
+		return record.ChipID
+	}
+	return record.Serial
+}
+
+func orNone(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/JoshuaDoes/tensor-usbdl/tensorutils"
+)
+
+const auditFixture = "testdata/audit.jsonl"
+
+// sessionIDs returns the session IDs of records, in order
+func sessionIDs(records []*AuditRecord) []string {
+	var ids []string
+	for _, record := range records {
+		ids = append(ids, record.Session)
+	}
+	return ids
+}
+
+func TestReadAudit(t *testing.T) {
+	records, err := readAudit(auditFixture)
+	if err != nil {
+		t.Fatalf("readAudit failed: %v", err)
+	}
+	want := []string{"3f4953356839", "7c1e0a22b5d4", "9d2f7b3318aa", "e0b1c2d3e4f5"}
+	if ids := sessionIDs(records); !slices.Equal(ids, want) {
+		t.Fatalf("sessions %q, want %q", ids, want)
+	}
+	first := records[0]
+	if first.Operator != "alice" || first.ChipID != "09845001cddf16d0" || len(first.Stages) != 2 || first.Stages[1].Sent != 65536 {
+		t.Errorf("first record read as %+v", first)
+	}
+	if d := time.Duration(first.Stages[1].Duration); d != 1500*time.Millisecond {
+		t.Errorf("stage duration = %s, want 1.5s", d)
+	}
+
+	dir := t.TempDir()
+	broken := filepath.Join(dir, "audit.jsonl")
+	os.WriteFile(broken, []byte(`{"session":"a"}`+"\n{not json\n"), 0o644)
+	if _, err := readAudit(broken); err == nil || !strings.Contains(err.Error(), "audit.jsonl:2:") {
+		t.Errorf("readAudit of a broken log = %v, want the line of the error", err)
+	}
+	if _, err := readAudit(filepath.Join(dir, "missing.jsonl")); !os.IsNotExist(err) {
+		t.Errorf("readAudit of a missing log = %v, want a not exist error", err)
+	}
+}
+
+func TestAuditFilter(t *testing.T) {
+	records, err := readAudit(auditFixture)
+	if err != nil {
+		t.Fatalf("readAudit failed: %v", err)
+	}
+	tests := []struct {
+		name   string
+		filter auditFilter
+		want   []string
+	}{
+		{"everything", auditFilter{}, []string{"3f4953356839", "7c1e0a22b5d4", "9d2f7b3318aa", "e0b1c2d3e4f5"}},
+		{"session prefixes", auditFilter{Sessions: []string{"3f49", "e0"}}, []string{"3f4953356839", "e0b1c2d3e4f5"}},
+		{"serial prefix", auditFilter{Device: "0984"}, []string{"3f4953356839", "9d2f7b3318aa"}},
+		{"chip ID in another case", auditFilter{Device: "0a1234567890abcd"}, []string{"7c1e0a22b5d4"}},
+		{"stage", auditFilter{Stage: "PBL"}, []string{"3f4953356839"}},
+		{"digest prefix", auditFilter{SHA256: "CC33"}, []string{"7c1e0a22b5d4"}},
+		{"stage and digest of different stages", auditFilter{Stage: "pbl", SHA256: "aa11"}, nil},
+		{"outcome", auditFilter{Outcome: "Rejected Header"}, []string{"7c1e0a22b5d4"}},
+		{"operator", auditFilter{Operator: "ALICE"}, []string{"3f4953356839", "9d2f7b3318aa"}},
+		{"batch", auditFilter{Batch: "rma-42"}, []string{"3f4953356839", "7c1e0a22b5d4"}},
+		{"since is inclusive", auditFilter{Since: time.Date(2026, 10, 12, 8, 15, 0, 0, time.UTC)}, []string{"9d2f7b3318aa", "e0b1c2d3e4f5"}},
+		{"until is exclusive", auditFilter{Until: time.Date(2026, 10, 12, 8, 15, 0, 0, time.UTC)}, []string{"3f4953356839", "7c1e0a22b5d4"}},
+		{"combined", auditFilter{Operator: "alice", Batch: "rma-42", Stage: "bl1"}, []string{"3f4953356839"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var matched []*AuditRecord
+			for _, record := range records {
+				if test.filter.match(record) {
+					matched = append(matched, record)
+				}
+			}
+			if ids := sessionIDs(matched); !slices.Equal(ids, test.want) {
+				t.Errorf("matched %q, want %q", ids, test.want)
+			}
+		})
+	}
+}
+
+func TestParseSince(t *testing.T) {
+	tests := []struct {
+		value string
+		want  time.Time
+	}{
+		{"2026-10-01", time.Date(2026, 10, 1, 0, 0, 0, 0, time.Local)},
+		{"2026-10-01T09:30", time.Date(2026, 10, 1, 9, 30, 0, 0, time.Local)},
+		{"2026-10-01T09:30:15Z", time.Date(2026, 10, 1, 9, 30, 15, 0, time.UTC)},
+	}
+	for _, test := range tests {
+		if got, err := parseSince(test.value); err != nil || !got.Equal(test.want) {
+			t.Errorf("parseSince(%q) = %v, %v, want %v", test.value, got, err, test.want)
+		}
+	}
+	before := time.Now()
+	got, err := parseSince("24h")
+	after := time.Now()
+	if err != nil || got.Before(before.Add(-24*time.Hour)) || got.After(after.Add(-24*time.Hour)) {
+		t.Errorf("parseSince(24h) = %v, %v, want a day ago", got, err)
+	}
+	for _, value := range []string{"yesterday", "2026-13-01", "01/10/2026"} {
+		if _, err := parseSince(value); err == nil {
+			t.Errorf("parseSince(%q) succeeded", value)
+		}
+	}
+}
+
+func TestAuditQuery(t *testing.T) {
+	tests := []struct {
+		name  string
+		query auditQuery
+		want  []string
+		err   string
+	}{
+		{"since and until", auditQuery{since: "2026-10-02", until: "2026-10-15"}, []string{"7c1e0a22b5d4", "9d2f7b3318aa"}, ""},
+		{"limit keeps the most recent", auditQuery{limit: 2}, []string{"9d2f7b3318aa", "e0b1c2d3e4f5"}, ""},
+		{"filter then limit", auditQuery{filter: auditFilter{Operator: "alice"}, limit: 1}, []string{"9d2f7b3318aa"}, ""},
+		{"invalid since", auditQuery{since: "last week"}, nil, "invalid time 'last week'"},
+		{"invalid until", auditQuery{until: "soon"}, nil, "invalid time 'soon'"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			test.query.file = auditFixture
+			path, matched, err := test.query.run(&Config{})
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Errorf("error = %v, want %q", err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("run failed: %v", err)
+			}
+			if path != auditFixture {
+				t.Errorf("path = %s, want %s", path, auditFixture)
+			}
+			if ids := sessionIDs(matched); !slices.Equal(ids, test.want) {
+				t.Errorf("matched %q, want %q", ids, test.want)
+			}
+		})
+	}
+
+	//The configured log is used without --file, and one that doesn't exist yet has no sessions
+	query := auditQuery{}
+	path, matched, err := query.run(&Config{AuditLog: filepath.Join(t.TempDir(), "audit.jsonl")})
+	if err != nil || len(matched) != 0 || filepath.Base(path) != "audit.jsonl" {
+		t.Errorf("run on a new log = %s, %d sessions, %v", path, len(matched), err)
+	}
+}
+
+func TestAuditSessionNoisyStage(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	session, err := startAudit(&Config{AuditLog: path}, "bl1.img", &FlashOptions{Operator: "tester"})
+	if err != nil {
+		t.Fatalf("startAudit failed: %v", err)
+	}
+	done := session.beginStage(tensorutils.NewImageBytes("bl1", make([]byte, 512)))
+
+	//A stage publishing several times the queue size, at a pace the receiver keeps up with
+	tensorutils.DefaultBus.Publish(tensorutils.Event{Kind: tensorutils.EventConnected, Transport: "usb", Device: "GS101 Device", Serial: "09845001"})
+	responses := 4 * AUDIT_QUEUE
+	for i := 0; i < responses; i++ {
+		msg := tensorutils.NewMessage([]byte(fmt.Sprintf("eub:log:%d", i)))
+		tensorutils.DefaultBus.Publish(tensorutils.Event{Kind: tensorutils.EventMessage, Transport: "usb", Message: msg})
+		if i%(AUDIT_QUEUE/2) == 0 {
+			time.Sleep(20 * time.Millisecond)
+		}
+	}
+	res := &tensorutils.Result{Stage: "bl1", Outcome: tensorutils.OutcomeAccepted}
+	done(res, nil)
+	session.finish(res, nil)
+
+	records, err := readAudit(path)
+	if err != nil || len(records) != 1 {
+		t.Fatalf("readAudit = %d records, %v", len(records), err)
+	}
+	record := records[0]
+	if record.Dropped != 0 || record.Device != "GS101 Device" || record.Serial != "09845001" {
+		t.Errorf("record dropped %d events, device %q, serial %q", record.Dropped, record.Device, record.Serial)
+	}
+	if len(record.Stages) != 1 || len(record.Stages[0].Responses) != responses {
+		t.Fatalf("stage recorded %d responses, want %d", len(record.Stages[0].Responses), responses)
+	}
+	if first, last := record.Stages[0].Responses[0], record.Stages[0].Responses[responses-1]; first != "eub:log:0" || last != fmt.Sprintf("eub:log:%d", responses-1) {
+		t.Errorf("responses run from %s to %s", first, last)
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/JoshuaDoes/tensor-usbdl/tensorutils"
+)
+
+var modeNames = map[FlashMode]string{ModeSerial: "serial", ModeUSB: "USB", ModeAuto: "auto"}
+
+func (mode FlashMode) String() string {
+	return modeNames[mode]
+}
+
+// notSentError marks a flash that failed before any data reached the device, so another transport may still be tried
+type notSentError struct {
+	error
+}
+
+func (e notSentError) Unwrap() error {
+	return e.error
+}
+
+// TransportProbe is what a non-destructive look at one transport found
+type TransportProbe struct {
+	Mode      FlashMode
+	Available bool
+	Reason    string
+}
+
+func (probe TransportProbe) String() string {
+	icon := "❌"
+	if probe.Available {
+		icon = "✅"
+	}
+	return fmt.Sprintf("%s %s: %s", icon, probe.Mode, probe.Reason)
+}
+
+// probeUSB opens the USB path and reads the device descriptor, nothing is written to the bulk endpoint.
+// The device is returned open when it is usable.
+func probeUSB(opts *FlashOptions, stage string) (*tensorutils.GS101Device, TransportProbe) {
+	probe := TransportProbe{Mode: ModeUSB}
+	gs101, err := openFlashUSB(opts, stage)
+	switch {
+	case errors.Is(err, tensorutils.ErrBusy):
+		probe.Reason = "a kernel driver (usually cdc_acm) holds the bulk interface, --detach-kernel-driver frees it"
+		return nil, probe
+	case errors.Is(err, tensorutils.ErrNoDevice):
+		probe.Reason = "no USB device matches a profile"
+		return nil, probe
+	case err != nil:
+		probe.Reason = err.Error()
+		return nil, probe
+	}
+
+	if err := gs101.Ping(); err != nil {
+		gs101.Close()
+		probe.Reason = fmt.Sprintf("%s did not answer a descriptor request: %v", gs101.GetDeviceInfo(), err)
+		return nil, probe
+	}
+	probe.Available = true
+	probe.Reason = fmt.Sprintf("%s answered a descriptor request", gs101.GetDeviceInfo())
+	return gs101, probe
+}
+
+// probeSerial looks for the serial port of a compatible device without opening it
+func probeSerial() TransportProbe {
+	probe := TransportProbe{Mode: ModeSerial}
+	ports := tensorutils.FindDNW()
+	if len(ports) == 0 {
+		probe.Reason = "no serial port belongs to a compatible device"
+		return probe
+	}
+	probe.Available = true
+	probe.Reason = "found " + strings.Join(ports, ", ")
+	return probe
+}
+
+// flashAuto probes both transports, flashes over USB if it answered and serial otherwise, and only falls back
+// to the other transport when the first one failed before sending anything
+func flashAuto(img *tensorutils.Image, opts *FlashOptions) (*tensorutils.Result, error) {
+	fmt.Fprintln(stdout, "Auto-mode: Probing transports...")
+	//The serial port is looked up first, as claiming the USB interfaces may detach its driver
+	serialProbe := probeSerial()
+	gs101, usbProbe := probeUSB(opts, img.Name)
+	fmt.Fprintln(stdout, usbProbe)
+	fmt.Fprintln(stdout, serialProbe)
+
+	flash := map[FlashMode]func() (*tensorutils.Result, error){
+		ModeUSB:    func() (*tensorutils.Result, error) { return flashUSB(img, opts, gs101) },
+		ModeSerial: func() (*tensorutils.Result, error) { return flashSerial(img, opts) },
+	}
+	var order []TransportProbe
+	for _, probe := range []TransportProbe{usbProbe, serialProbe} {
+		if probe.Available {
+			order = append(order, probe)
+		}
+	}
+	if len(order) == 0 {
+		return nil, fmt.Errorf("no transport available: %s; %s", usbProbe.Reason, serialProbe.Reason)
+	}
+
+	fmt.Fprintf(stdout, "➡️  Using %s mode: %s\n", order[0].Mode, order[0].Reason)
+	res, err := flash[order[0].Mode]()
+	if err == nil || len(order) < 2 {
+		return res, err
+	}
+	var notSent notSentError
+	if !errors.As(err, &notSent) {
+		fmt.Fprintf(stdout, "⚠️  Not falling back to %s mode: %s mode failed after sending data, the device state is unknown\n", order[1].Mode, order[0].Mode)
+		return res, err
+	}
+	fmt.Fprintf(stdout, "%s mode failed before sending anything (%v), falling back to %s mode...\n", order[0].Mode, err, order[1].Mode)
+	return flash[order[1].Mode]()
+}
@@ -16,14 +16,14 @@ if [ $? -ne 0 ]; then
 fi
 
 echo "[3/4] Building release version..."
-go build -ldflags "-s -w" -o tensor-usbdl-gs101 main.go
+go build -ldflags "-s -w" -o tensor-usbdl-gs101 .
 if [ $? -ne 0 ]; then
     echo "ERROR: Release build failed"
     exit 1
 fi
 
 echo "[4/4] Building debug version..."
-go build -o tensor-usbdl-gs101-debug main.go
+go build -o tensor-usbdl-gs101-debug .
 if [ $? -ne 0 ]; then
     echo "ERROR: Debug build failed"
     exit 1
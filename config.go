@@ -0,0 +1,313 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/JoshuaDoes/tensor-usbdl/tensorutils"
+)
+
+const (
+	CONFIG_DIR  = "tensor-usbdl"
+	CONFIG_FILE = "config.json"
+	ENV_PREFIX  = "TENSOR_USBDL_"
+)
+
+var (
+	outputJSON bool                  // Machine readable output was asked for
+	stdout     io.Writer = os.Stdout // Where output for humans goes
+	jsonOut    io.Writer = os.Stdout // Where JSON output goes
+)
+
+// setupOutput prepares the output format. For JSON output, everything printed for humans goes to stderr
+// so stdout only carries JSON.
+func setupOutput(format string) {
+	outputJSON = format == "json"
+	if outputJSON {
+		stdout = os.Stderr
+	}
+}
+
+// printJSON writes a value as indented JSON to the JSON output
+func printJSON(v interface{}) error {
+	enc := json.NewEncoder(jsonOut)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+// Config holds the defaults read from the config file and the environment, command line flags override them
+type Config struct {
+	Mode         string                 `json:"mode"`                    // Default flash mode: serial, usb or auto
+	Output       string                 `json:"output"`                  // Output format: text or json
+	ImagePaths   []string               `json:"image_paths,omitempty"`   // Directories searched for images given without a path
+	Profile      string                 `json:"profile,omitempty"`       // Device profile to use instead of selecting one from the device
+	ProfilesFile string                 `json:"profiles_file,omitempty"` // JSON file with additional device profiles
+	Profiles     []*tensorutils.Profile `json:"profiles,omitempty"`      // Additional device profiles
+	Detach       bool                   `json:"detach_kernel_driver"`    // Detach kernel drivers while the USB path is in use
+	CacheDir     string                 `json:"cache_dir,omitempty"`     // Where fetched images and manifests are cached
+	Offline      bool                   `json:"offline"`                 // Only use cached images and manifests
+	TrustedKeys  []string               `json:"trusted_keys,omitempty"`  // Public keys, as files or inline, trusted to sign manifests
+	RequireSig   bool                   `json:"require_signature"`       // Refuse manifests without a valid signature
+	AuditLog     string                 `json:"audit_log,omitempty"`     // JSON lines file every flash session is appended to
+	Operator     string                 `json:"operator,omitempty"`      // Operator recorded in the audit log, the current user if empty
+	Batch        string                 `json:"batch,omitempty"`         // Batch the flash sessions belong to, for reports
+	Retry        RetryConfig            `json:"retry"`
+	Log          LogConfig              `json:"log"`
+
+	path string // File the config was read from, empty if none
+}
+
+// RetryConfig is the flash retry policy as written in the config file
+type RetryConfig struct {
+	Attempts   int                  `json:"attempts"`
+	Backoff    tensorutils.Duration `json:"backoff"`
+	MaxBackoff tensorutils.Duration `json:"max_backoff"`
+	Recovery   []string             `json:"recovery"`
+	Resume     bool                 `json:"resume"`
+}
+
+// LogConfig mirrors the logging and trace flags
+type LogConfig struct {
+	Verbosity  int    `json:"verbosity"`
+	Quiet      bool   `json:"quiet"`
+	File       string `json:"file,omitempty"`
+	Trace      bool   `json:"trace"`
+	TraceFile  string `json:"trace_file,omitempty"`
+	TraceLimit int    `json:"trace_limit"`
+	EventsFile string `json:"events_file,omitempty"`
+}
+
+// defaultConfig returns the built-in defaults
+func defaultConfig() *Config {
+	policy := tensorutils.DefaultRetryPolicy
+	cfg := &Config{
+		Mode:   "auto",
+		Output: "text",
+		Retry: RetryConfig{
+			Attempts:   policy.MaxAttempts,
+			Backoff:    tensorutils.Duration(policy.Backoff),
+			MaxBackoff: tensorutils.Duration(policy.MaxBackoff),
+			Resume:     policy.Resume,
+		},
+	}
+	for _, action := range policy.Actions {
+		cfg.Retry.Recovery = append(cfg.Retry.Recovery, action.String())
+	}
+	return cfg
+}
+
+// configPath returns the config file to read and whether it was asked for explicitly.
+// Without --config or TENSOR_USBDL_CONFIG this is config.json in the user config directory,
+// which is $XDG_CONFIG_HOME/tensor-usbdl (default ~/.config/tensor-usbdl) on Linux.
+func configPath(flagPath string) (string, bool) {
+	if flagPath != "" {
+		return flagPath, true
+	}
+	if path := os.Getenv(ENV_PREFIX + "CONFIG"); path != "" {
+		return path, true
+	}
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", false
+	}
+	return filepath.Join(dir, CONFIG_DIR, CONFIG_FILE), false
+}
+
+// loadConfig merges the defaults, the config file and the environment, in that order
+func loadConfig(flagPath string) (*Config, error) {
+	cfg := defaultConfig()
+	path, explicit := configPath(flagPath)
+	if path != "" {
+		p, err := os.ReadFile(path)
+		switch {
+		case err == nil:
+			dec := json.NewDecoder(strings.NewReader(string(p)))
+			dec.DisallowUnknownFields()
+			if err := dec.Decode(cfg); err != nil {
+				return nil, fmt.Errorf("config %s: %w", path, err)
+			}
+			cfg.path = path
+		case explicit || !errors.Is(err, fs.ErrNotExist):
+			return nil, fmt.Errorf("failed to read config: %w", err)
+		}
+	}
+	if err := cfg.applyEnv(os.Getenv); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// envOverrides maps each environment variable, without the TENSOR_USBDL_ prefix, to the setting it overrides
+var envOverrides = map[string]func(cfg *Config, value string) error{
+	"MODE":                 func(cfg *Config, value string) error { cfg.Mode = value; return nil },
+	"OUTPUT":               func(cfg *Config, value string) error { cfg.Output = value; return nil },
+	"IMAGE_PATH":           func(cfg *Config, value string) error { cfg.ImagePaths = filepath.SplitList(value); return nil },
+	"PROFILE":              func(cfg *Config, value string) error { cfg.Profile = value; return nil },
+	"PROFILES_FILE":        func(cfg *Config, value string) error { cfg.ProfilesFile = value; return nil },
+	"DETACH_KERNEL_DRIVER": func(cfg *Config, value string) error { return parseEnvBool(value, &cfg.Detach) },
+	"CACHE_DIR":            func(cfg *Config, value string) error { cfg.CacheDir = value; return nil },
+	"OFFLINE":              func(cfg *Config, value string) error { return parseEnvBool(value, &cfg.Offline) },
+	"TRUSTED_KEYS":         func(cfg *Config, value string) error { cfg.TrustedKeys = filepath.SplitList(value); return nil },
+	"REQUIRE_SIGNATURE":    func(cfg *Config, value string) error { return parseEnvBool(value, &cfg.RequireSig) },
+	"AUDIT_LOG":            func(cfg *Config, value string) error { cfg.AuditLog = value; return nil },
+	"OPERATOR":             func(cfg *Config, value string) error { cfg.Operator = value; return nil },
+	"BATCH":                func(cfg *Config, value string) error { cfg.Batch = value; return nil },
+	"RETRIES":              func(cfg *Config, value string) error { return parseEnvInt(value, &cfg.Retry.Attempts) },
+	"BACKOFF":              func(cfg *Config, value string) error { return parseEnvDuration(value, &cfg.Retry.Backoff) },
+	"MAX_BACKOFF":          func(cfg *Config, value string) error { return parseEnvDuration(value, &cfg.Retry.MaxBackoff) },
+	"RECOVERY":             func(cfg *Config, value string) error { cfg.Retry.Recovery = strings.Split(value, ","); return nil },
+	"RESUME":               func(cfg *Config, value string) error { return parseEnvBool(value, &cfg.Retry.Resume) },
+	"VERBOSE":              func(cfg *Config, value string) error { return parseEnvInt(value, &cfg.Log.Verbosity) },
+	"QUIET":                func(cfg *Config, value string) error { return parseEnvBool(value, &cfg.Log.Quiet) },
+	"LOG_FILE":             func(cfg *Config, value string) error { cfg.Log.File = value; return nil },
+	"TRACE":                func(cfg *Config, value string) error { return parseEnvBool(value, &cfg.Log.Trace) },
+	"TRACE_FILE":           func(cfg *Config, value string) error { cfg.Log.TraceFile = value; return nil },
+	"TRACE_LIMIT":          func(cfg *Config, value string) error { return parseEnvInt(value, &cfg.Log.TraceLimit) },
+	"EVENTS_FILE":          func(cfg *Config, value string) error { cfg.Log.EventsFile = value; return nil },
+}
+
+func (cfg *Config) applyEnv(getenv func(string) string) error {
+	for name, apply := range envOverrides {
+		value := getenv(ENV_PREFIX + name)
+		if value == "" {
+			continue
+		}
+		if err := apply(cfg, value); err != nil {
+			return fmt.Errorf("%s%s: %w", ENV_PREFIX, name, err)
+		}
+	}
+	return nil
+}
+
+func parseEnvInt(value string, dst *int) error {
+	v, err := strconv.Atoi(value)
+	if err != nil {
+		return err
+	}
+	*dst = v
+	return nil
+}
+
+func parseEnvBool(value string, dst *bool) error {
+	v, err := strconv.ParseBool(value)
+	if err != nil {
+		return err
+	}
+	*dst = v
+	return nil
+}
+
+func parseEnvDuration(value string, dst *tensorutils.Duration) error {
+	v, err := time.ParseDuration(value)
+	if err != nil {
+		return err
+	}
+	*dst = tensorutils.Duration(v)
+	return nil
+}
+
+func (cfg *Config) validate() error {
+	if _, err := parseMode(cfg.Mode); err != nil {
+		return fmt.Errorf("config: %w", err)
+	}
+	switch cfg.Output {
+	case "text", "json":
+	default:
+		return fmt.Errorf("config: unknown output format '%s'", cfg.Output)
+	}
+	if _, err := cfg.retryPolicy(); err != nil {
+		return fmt.Errorf("config: %w", err)
+	}
+	return nil
+}
+
+// retryPolicy converts the retry settings into the policy used by tensorutils
+func (cfg *Config) retryPolicy() (tensorutils.RetryPolicy, error) {
+	policy := tensorutils.RetryPolicy{
+		MaxAttempts: cfg.Retry.Attempts,
+		Backoff:     time.Duration(cfg.Retry.Backoff),
+		MaxBackoff:  time.Duration(cfg.Retry.MaxBackoff),
+		Resume:      cfg.Retry.Resume,
+	}
+	for _, name := range cfg.Retry.Recovery {
+		action, err := tensorutils.ParseRecoveryAction(strings.TrimSpace(name))
+		if err != nil {
+			return policy, err
+		}
+		policy.Actions = append(policy.Actions, action)
+	}
+	return policy, nil
+}
+
+// merge reconciles the global flags with the config: flags given on the command line override the config,
+// every other flag takes its value from the config
+func (cfg *Config) merge(opts *GlobalOptions) {
+	pick(opts.set["verbose"], &opts.Verbosity, &cfg.Log.Verbosity)
+	pick(opts.set["quiet"], &opts.Quiet, &cfg.Log.Quiet)
+	pick(opts.set["log-file"], &opts.File, &cfg.Log.File)
+	pick(opts.set["trace"], &opts.Trace, &cfg.Log.Trace)
+	pick(opts.set["trace-file"], &opts.TraceFile, &cfg.Log.TraceFile)
+	pick(opts.set["trace-limit"], &opts.TraceLimit, &cfg.Log.TraceLimit)
+	pick(opts.set["events"], &opts.Events, &cfg.Log.EventsFile)
+	pick(opts.set["profile"], &opts.Profile, &cfg.Profile)
+	pick(opts.set["profiles"], &opts.ProfilesFile, &cfg.ProfilesFile)
+	pick(opts.set["output"], &opts.Output, &cfg.Output)
+	pick(opts.set["detach-kernel-driver"], &opts.Detach, &cfg.Detach)
+}
+
+func pick[T any](set bool, flag, conf *T) {
+	if set {
+		*conf = *flag
+	} else {
+		*flag = *conf
+	}
+}
+
+// findImage resolves an image path, looking through the image search paths for relative paths that don't exist.
+// A bare stage name such as bl1 also matches bl1.img.
+func findImage(path string, searchPaths []string) (string, error) {
+	if _, err := os.Stat(path); err == nil || filepath.IsAbs(path) {
+		return path, nil
+	}
+	names := []string{path}
+	if filepath.Ext(path) == "" {
+		names = append(names, path+".img")
+	}
+	for _, dir := range searchPaths {
+		for _, name := range names {
+			candidate := filepath.Join(os.ExpandEnv(dir), name)
+			if _, err := os.Stat(candidate); err == nil {
+				return candidate, nil
+			}
+		}
+	}
+	return "", fmt.Errorf("bootloader file not found: %s", path)
+}
+
+// runConfig implements the config command
+func runConfig(arguments []string, cfg *Config) error {
+	sub := "show"
+	if len(arguments) > 0 {
+		sub = arguments[0]
+	}
+	switch sub {
+	case "show":
+		return printJSON(cfg)
+	case "path":
+		path, _ := configPath(cfg.path)
+		if cfg.path == "" {
+			path += " (not found, using defaults)"
+		}
+		fmt.Fprintln(stdout, path)
+		return nil
+	}
+	return fmt.Errorf("unknown config command '%s'", sub)
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/JoshuaDoes/tensor-usbdl/tensorutils"
+)
+
+// writeConfig writes a config file to a temporary directory, returning its path
+func writeConfig(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), CONFIG_FILE)
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatalf("failed to write config: %v", err)
+	}
+	return path
+}
+
+func TestConfigPrecedence(t *testing.T) {
+	path := writeConfig(t, `{
+		"mode": "serial",
+		"output": "json",
+		"profile": "file",
+		"operator": "alice",
+		"retry": {"attempts": 7, "backoff": "2s"},
+		"log": {"verbosity": 1, "trace_limit": 64}
+	}`)
+	t.Setenv(ENV_PREFIX+"MODE", "usb")
+	t.Setenv(ENV_PREFIX+"PROFILE", "env")
+	t.Setenv(ENV_PREFIX+"RETRIES", "9")
+
+	opts, args, err := parseGlobalFlags([]string{"--config", path, "--profile", "flag", "-vv", "flash", "--retries", "3"})
+	if err != nil {
+		t.Fatalf("parseGlobalFlags failed: %v", err)
+	}
+	if !slices.Equal(args, []string{"flash", "--retries", "3"}) {
+		t.Errorf("command arguments = %q", args)
+	}
+	cfg, err := loadConfig(opts.Config)
+	if err != nil {
+		t.Fatalf("loadConfig failed: %v", err)
+	}
+	cfg.merge(opts)
+	if err := cfg.validate(); err != nil {
+		t.Fatalf("validate failed: %v", err)
+	}
+
+	tests := []struct {
+		setting   string
+		got, want interface{}
+	}{
+		{"mode, from the environment over the file", cfg.Mode, "usb"},
+		{"output, from the file", cfg.Output, "json"},
+		{"profile, from the flag over the environment", cfg.Profile, "flag"},
+		{"profile flag", opts.Profile, "flag"},
+		{"operator, from the file", cfg.Operator, "alice"},
+		{"retries, from the environment", cfg.Retry.Attempts, 9},
+		{"backoff, from the file", time.Duration(cfg.Retry.Backoff), 2 * time.Second},
+		{"max backoff, the default", time.Duration(cfg.Retry.MaxBackoff), tensorutils.DefaultRetryPolicy.MaxBackoff},
+		{"verbosity, from the flag", cfg.Log.Verbosity, 2},
+		{"trace limit, from the file", cfg.Log.TraceLimit, 64},
+		{"trace limit flag, from the config", opts.TraceLimit, 64},
+		{"output flag, from the config", opts.Output, "json"},
+	}
+	for _, test := range tests {
+		if test.got != test.want {
+			t.Errorf("%s = %v, want %v", test.setting, test.got, test.want)
+		}
+	}
+
+	//The flash flags take their defaults from the config and override it in turn
+	flash, _, err := parseFlashFlags(args[1:], cfg)
+	if err != nil {
+		t.Fatalf("parseFlashFlags failed: %v", err)
+	}
+	if flash.Mode != ModeUSB || flash.Retry.MaxAttempts != 3 || flash.Retry.Backoff != 2*time.Second || flash.Operator != "alice" {
+		t.Errorf("flash options = %+v", flash)
+	}
+}
+
+func TestConfigEnv(t *testing.T) {
+	tests := []struct {
+		name, value string
+		check       func(cfg *Config) bool
+	}{
+		{"MODE", "serial", func(cfg *Config) bool { return cfg.Mode == "serial" }},
+		{"IMAGE_PATH", "/srv/images" + string(os.PathListSeparator) + "/tmp", func(cfg *Config) bool {
+			return slices.Equal(cfg.ImagePaths, []string{"/srv/images", "/tmp"})
+		}},
+		{"DETACH_KERNEL_DRIVER", "1", func(cfg *Config) bool { return cfg.Detach }},
+		{"OFFLINE", "true", func(cfg *Config) bool { return cfg.Offline }},
+		{"REQUIRE_SIGNATURE", "T", func(cfg *Config) bool { return cfg.RequireSig }},
+		{"RETRIES", "5", func(cfg *Config) bool { return cfg.Retry.Attempts == 5 }},
+		{"BACKOFF", "250ms", func(cfg *Config) bool { return time.Duration(cfg.Retry.Backoff) == 250*time.Millisecond }},
+		{"MAX_BACKOFF", "1m", func(cfg *Config) bool { return time.Duration(cfg.Retry.MaxBackoff) == time.Minute }},
+		{"RECOVERY", "clear-halt,port-reset", func(cfg *Config) bool {
+			return slices.Equal(cfg.Retry.Recovery, []string{"clear-halt", "port-reset"})
+		}},
+		{"RESUME", "false", func(cfg *Config) bool { return !cfg.Retry.Resume }},
+		{"VERBOSE", "2", func(cfg *Config) bool { return cfg.Log.Verbosity == 2 }},
+		{"TRACE_LIMIT", "128", func(cfg *Config) bool { return cfg.Log.TraceLimit == 128 }},
+		{"EVENTS_FILE", "events.jsonl", func(cfg *Config) bool { return cfg.Log.EventsFile == "events.jsonl" }},
+	}
+	for _, test := range tests {
+		cfg := defaultConfig()
+		cfg.Retry.Resume = true
+		env := map[string]string{ENV_PREFIX + test.name: test.value}
+		if err := cfg.applyEnv(func(key string) string { return env[key] }); err != nil || !test.check(cfg) {
+			t.Errorf("%s%s=%s applied as %+v, %v", ENV_PREFIX, test.name, test.value, cfg, err)
+		}
+	}
+
+	//Empty variables are ignored
+	cfg := defaultConfig()
+	if err := cfg.applyEnv(func(string) string { return "" }); err != nil || cfg.Mode != "auto" || cfg.Retry.Attempts != tensorutils.DefaultRetryPolicy.MaxAttempts {
+		t.Errorf("empty environment applied as %+v, %v", cfg, err)
+	}
+
+	for _, failure := range []struct{ name, value string }{
+		{"RETRIES", "many"},
+		{"OFFLINE", "yes"},
+		{"BACKOFF", "5"},
+		{"VERBOSE", "1.5"},
+	} {
+		env := map[string]string{ENV_PREFIX + failure.name: failure.value}
+		err := defaultConfig().applyEnv(func(key string) string { return env[key] })
+		if err == nil || !strings.HasPrefix(err.Error(), ENV_PREFIX+failure.name+":") {
+			t.Errorf("%s%s=%s = %v, want an error naming the variable", ENV_PREFIX, failure.name, failure.value, err)
+		}
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	t.Setenv("HOME", t.TempDir())
+	t.Setenv(ENV_PREFIX+"CONFIG", "")
+
+	//Without a config file the defaults are used
+	cfg, err := loadConfig("")
+	if err != nil || cfg.path != "" || cfg.Mode != "auto" || cfg.Output != "text" {
+		t.Fatalf("loadConfig without a file = %+v, %v", cfg, err)
+	}
+
+	//TENSOR_USBDL_CONFIG names the file, --config wins over it
+	env := writeConfig(t, `{"mode": "usb"}`)
+	flag := writeConfig(t, `{"mode": "serial"}`)
+	t.Setenv(ENV_PREFIX+"CONFIG", env)
+	if cfg, err := loadConfig(""); err != nil || cfg.path != env || cfg.Mode != "usb" {
+		t.Errorf("loadConfig from %sCONFIG = %+v, %v", ENV_PREFIX, cfg, err)
+	}
+	if cfg, err := loadConfig(flag); err != nil || cfg.path != flag || cfg.Mode != "serial" {
+		t.Errorf("loadConfig from --config = %+v, %v", cfg, err)
+	}
+
+	failures := []struct {
+		name, path, err string
+	}{
+		{"missing explicit file", filepath.Join(t.TempDir(), "missing.json"), "failed to read config"},
+		{"unknown field", writeConfig(t, `{"mode": "usb", "retires": 3}`), "unknown field"},
+		{"syntax error", writeConfig(t, `{"mode": }`), "config "},
+	}
+	for _, failure := range failures {
+		if _, err := loadConfig(failure.path); err == nil || !strings.Contains(err.Error(), failure.err) {
+			t.Errorf("loadConfig with a %s = %v, want %q", failure.name, err, failure.err)
+		}
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(cfg *Config)
+		err    string
+	}{
+		{"defaults", func(cfg *Config) {}, ""},
+		{"mode in another case", func(cfg *Config) { cfg.Mode = "USB" }, ""},
+		{"unknown mode", func(cfg *Config) { cfg.Mode = "jtag" }, "config: unknown mode 'jtag'"},
+		{"unknown output", func(cfg *Config) { cfg.Output = "yaml" }, "config: unknown output format 'yaml'"},
+		{"unknown recovery", func(cfg *Config) { cfg.Retry.Recovery = []string{"clear-halt", "power-cycle"} }, "config: "},
+	}
+	for _, test := range tests {
+		cfg := defaultConfig()
+		test.modify(cfg)
+		err := cfg.validate()
+		if test.err == "" && err != nil || test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)) {
+			t.Errorf("validate with %s = %v, want %q", test.name, err, test.err)
+		}
+	}
+}
@@ -0,0 +1,557 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/JoshuaDoes/tensor-usbdl/tensorutils"
+	"github.com/spf13/pflag"
+	"golang.org/x/term"
+)
+
+const (
+	CONSOLE_PROMPT       = "tensor> "
+	CONSOLE_READ_TIMEOUT = time.Second            // How long read waits for the requested bytes
+	CONSOLE_WATCH_POLL   = 100 * time.Millisecond // How long the watcher holds the device per poll
+)
+
+// consoleDevice is what the console needs from either transport
+type consoleDevice interface {
+	Write(p []byte) (int, error)
+	Read(p []byte) (int, error)
+	ReadMsg(timeout time.Duration) (*tensorutils.Message, error)
+	Close() error
+}
+
+// dnwConsole adapts a DNW serial device to consoleDevice
+type dnwConsole struct {
+	*tensorutils.DNW
+}
+
+func (d dnwConsole) ReadMsg(timeout time.Duration) (*tensorutils.Message, error) {
+	return d.DNW.ReadMsgTimeout(timeout)
+}
+
+// Console is an interactive protocol console, every device access is serialized through mutex
+type Console struct {
+	dev     consoleDevice
+	usb     *tensorutils.GS101Device // nil on the serial transport
+	out     io.Writer
+	history []string
+
+	mutex    sync.Mutex
+	watching bool
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+type consoleCmd struct {
+	usage string
+	help  string
+	run   func(c *Console, args []string, rest string) error
+}
+
+var consoleCmds map[string]consoleCmd
+
+func init() {
+	consoleCmds = map[string]consoleCmd{
+		"hex":     {"hex <bytes>", "send raw bytes, i.e. hex 1b 44 4e 57", (*Console).cmdHex},
+		"text":    {"text <string>", "send text, Go escapes such as \\n are allowed", (*Console).cmdText},
+		"frame":   {"frame <file>", "send a file wrapped in a DNW frame", (*Console).cmdFrame},
+		"stop":    {"stop [stage]", "send the stop frame for a stage", (*Console).cmdStop},
+		"read":    {"read [n]", "read up to n bytes from bulk IN 0x81 (default 512)", (*Console).cmdRead},
+		"msg":     {"msg [timeout]", "wait for the next message (default 1s)", (*Console).cmdMsg},
+		"poll":    {"poll", "poll interrupt IN 0x83 (usb)", (*Console).cmdPoll},
+		"control": {"control <type> <req> <val> <idx> [hex | len]", "issue a control transfer (usb)", (*Console).cmdControl},
+		"clear":   {"clear <ep>", "clear the halt on an endpoint, i.e. clear 0x02 (usb)", (*Console).cmdClear},
+		"reset":   {"reset", "reset the port (usb)", (*Console).cmdReset},
+		"watch":   {"watch on|off", "print incoming messages and interrupt notifications live, turn off before raw reads", (*Console).cmdWatch},
+		"sleep":   {"sleep <duration>", "wait, i.e. sleep 500ms", (*Console).cmdSleep},
+		"source":  {"source <file>", "run commands from a file", (*Console).cmdSource},
+		"history": {"history", "list previous commands, run one again with !n", (*Console).cmdHistory},
+		"help":    {"help", "show this help", (*Console).cmdHelp},
+	}
+}
+
+// errQuit ends the console
+var errQuit = errors.New("quit")
+
+// runConsole parses the console command's arguments, opens the transport and runs the REPL or a script
+func runConsole(arguments []string) error {
+	fs := pflag.NewFlagSet("console", pflag.ContinueOnError)
+	script := fs.String("script", "", "run commands from this file instead of reading them interactively")
+	simulate := fs.Bool("simulate", false, "open the built-in device simulator instead of a real device")
+	if err := fs.Parse(arguments); err != nil {
+		return err
+	}
+	mode := "usb"
+	if fs.NArg() > 0 {
+		mode = strings.ToLower(fs.Arg(0))
+	}
+
+	c := &Console{out: stdout}
+	switch mode {
+	case "usb":
+		var sim *tensorutils.Simulator
+		if *simulate {
+			sim = tensorutils.NewSimulator("bl1")
+		}
+		gs101, err := openUSB(sim)
+		if err != nil {
+			return fmt.Errorf("failed to open USB device: %w", err)
+		}
+		gs101.Retry = tensorutils.RetryPolicy{MaxAttempts: 1} // Show every failure as it happens
+		c.dev, c.usb = gs101, gs101
+		fmt.Fprintf(stdout, "✅ Connected: %s\n", gs101.GetDeviceInfo())
+	case "serial":
+		dnw, err := tensorutils.GetDNW()
+		if err != nil {
+			return fmt.Errorf("failed to open DNW device: %w", err)
+		}
+		c.dev = dnwConsole{dnw}
+		fmt.Fprintf(stdout, "✅ Connected: %s (VID:PID = %s, Serial: %s)\n", dnw.GetPort(), dnw.GetID(), dnw.GetSerial())
+	default:
+		return fmt.Errorf("unknown transport '%s'", mode)
+	}
+	defer c.Close()
+
+	if *script != "" {
+		return c.Source(*script)
+	}
+	return c.Interact()
+}
+
+// Close stops the watcher and closes the device
+func (c *Console) Close() error {
+	c.setWatch(false)
+	return c.dev.Close()
+}
+
+// Interact reads commands from stdin until quit or EOF, with line editing and history on a terminal
+func (c *Console) Interact() error {
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		return c.run(os.Stdin, false)
+	}
+
+	state, err := term.MakeRaw(fd)
+	if err != nil {
+		return c.run(os.Stdin, false)
+	}
+	defer term.Restore(fd, state)
+
+	t := term.NewTerminal(struct {
+		io.Reader
+		io.Writer
+	}{os.Stdin, stdout}, CONSOLE_PROMPT)
+	c.out = t
+	defer func() { c.out = stdout }()
+
+	c.setWatch(true)
+	defer c.setWatch(false) // Before the output goes back to stdout
+	fmt.Fprintln(c.out, "Type help for commands, quit to leave.")
+	for {
+		line, err := t.ReadLine()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := c.Exec(line); err != nil {
+			if err == errQuit {
+				return nil
+			}
+			fmt.Fprintf(c.out, "❌ %v\n", err)
+		}
+	}
+}
+
+// Source runs the commands in a script file, stopping at the first failure
+func (c *Console) Source(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return c.run(f, true)
+}
+
+// run executes one command per line, echoing them when running a script
+func (c *Console) run(r io.Reader, script bool) error {
+	scanner := bufio.NewScanner(r)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if script {
+			fmt.Fprintf(c.out, "%s%s\n", CONSOLE_PROMPT, line)
+		}
+		if err := c.Exec(line); err != nil {
+			if err == errQuit {
+				return nil
+			}
+			if script {
+				return fmt.Errorf("line %d: %w", lineNo, err)
+			}
+			fmt.Fprintf(c.out, "❌ %v\n", err)
+		}
+	}
+	return scanner.Err()
+}
+
+// Exec runs a single console command
+func (c *Console) Exec(line string) error {
+	line = strings.TrimSpace(line)
+	if line == "" || strings.HasPrefix(line, "#") {
+		return nil
+	}
+	if strings.HasPrefix(line, "!") {
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 1 || n > len(c.history) {
+			return fmt.Errorf("no command %s in history", line)
+		}
+		line = c.history[n-1]
+		fmt.Fprintf(c.out, "%s%s\n", CONSOLE_PROMPT, line)
+	}
+	c.history = append(c.history, line)
+
+	name, rest, _ := strings.Cut(line, " ")
+	rest = strings.TrimSpace(rest)
+	name = strings.ToLower(name)
+	if name == "quit" || name == "exit" {
+		return errQuit
+	}
+	cmd, exists := consoleCmds[name]
+	if !exists {
+		return fmt.Errorf("unknown command '%s', type help for a list", name)
+	}
+	return cmd.run(c, strings.Fields(rest), rest)
+}
+
+// lock waits for the watcher to release the device
+func (c *Console) lock() func() {
+	c.mutex.Lock()
+	return c.mutex.Unlock
+}
+
+// requireUSB fails commands that only exist on the USB transport
+func (c *Console) requireUSB() error {
+	if c.usb == nil {
+		return fmt.Errorf("only available on the usb transport")
+	}
+	return nil
+}
+
+func (c *Console) send(p []byte) error {
+	defer c.lock()()
+	n, err := c.dev.Write(p)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(c.out, "✅ Sent %d bytes\n", n)
+	return nil
+}
+
+func (c *Console) cmdHex(args []string, rest string) error {
+	p, err := parseHex(args)
+	if err != nil {
+		return err
+	}
+	if len(p) == 0 {
+		return fmt.Errorf("usage: %s", consoleCmds["hex"].usage)
+	}
+	return c.send(p)
+}
+
+func (c *Console) cmdText(args []string, rest string) error {
+	text, err := strconv.Unquote(`"` + strings.ReplaceAll(rest, `"`, `\"`) + `"`)
+	if err != nil {
+		text = rest
+	}
+	return c.send([]byte(text))
+}
+
+func (c *Console) cmdFrame(args []string, rest string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: %s", consoleCmds["frame"].usage)
+	}
+	data, err := ioutil.ReadFile(args[0])
+	if err != nil {
+		return err
+	}
+	frame, err := tensorutils.NewFrame(data).Bytes()
+	if err != nil {
+		return err
+	}
+	return c.send(frame)
+}
+
+func (c *Console) cmdStop(args []string, rest string) error {
+	stop, err := tensorutils.GetStopCmd(rest).Bytes()
+	if err != nil {
+		return err
+	}
+	return c.send(stop)
+}
+
+func (c *Console) cmdRead(args []string, rest string) error {
+	size := 512
+	if len(args) > 0 {
+		n, err := strconv.ParseUint(args[0], 0, 31)
+		if err != nil {
+			return err
+		}
+		size = int(n)
+	}
+	defer c.lock()()
+
+	buf := make([]byte, size)
+	got := 0
+	deadline := time.Now().Add(CONSOLE_READ_TIMEOUT)
+	for got < size && time.Now().Before(deadline) {
+		n, err := c.dev.Read(buf[got:])
+		got += n
+		if errors.Is(err, tensorutils.ErrTimeout) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			time.Sleep(time.Millisecond)
+		}
+	}
+	fmt.Fprintf(c.out, "Read %d bytes\n%s", got, tensorutils.HexDump(buf[:got], "  "))
+	for _, note := range tensorutils.Annotate(buf[:got]) {
+		fmt.Fprintln(c.out, "  =", note)
+	}
+	return nil
+}
+
+func (c *Console) cmdMsg(args []string, rest string) error {
+	timeout := time.Second
+	if len(args) > 0 {
+		var err error
+		if timeout, err = time.ParseDuration(args[0]); err != nil {
+			return err
+		}
+	}
+	defer c.lock()()
+	msg, err := c.dev.ReadMsg(timeout)
+	if err != nil {
+		return err
+	}
+	if msg != nil {
+		fmt.Fprintln(c.out, "📨", msg.String())
+	}
+	return nil
+}
+
+func (c *Console) cmdPoll(args []string, rest string) error {
+	if err := c.requireUSB(); err != nil {
+		return err
+	}
+	defer c.lock()()
+	data, err := c.usb.ReadInterrupt()
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(c.out, "Interrupt %d bytes\n%s", len(data), tensorutils.HexDump(data, "  "))
+	return nil
+}
+
+func (c *Console) cmdControl(args []string, rest string) error {
+	if err := c.requireUSB(); err != nil {
+		return err
+	}
+	if len(args) < 4 {
+		return fmt.Errorf("usage: %s", consoleCmds["control"].usage)
+	}
+	var setup [4]uint64
+	for i, bits := range []int{8, 8, 16, 16} {
+		v, err := strconv.ParseUint(args[i], 0, bits)
+		if err != nil {
+			return fmt.Errorf("invalid setup value '%s': %w", args[i], err)
+		}
+		setup[i] = v
+	}
+	rType := uint8(setup[0])
+
+	var data []byte
+	if rType&0x80 != 0 {
+		size := uint64(64)
+		if len(args) > 4 {
+			var err error
+			if size, err = strconv.ParseUint(args[4], 0, 16); err != nil {
+				return err
+			}
+		}
+		data = make([]byte, size)
+	} else {
+		var err error
+		if data, err = parseHex(args[4:]); err != nil {
+			return err
+		}
+	}
+
+	defer c.lock()()
+	n, err := c.usb.Control(rType, uint8(setup[1]), uint16(setup[2]), uint16(setup[3]), data)
+	if err != nil {
+		return err
+	}
+	if rType&0x80 != 0 {
+		fmt.Fprintf(c.out, "Control IN %d bytes\n%s", n, tensorutils.HexDump(data[:n], "  "))
+	} else {
+		fmt.Fprintf(c.out, "✅ Control OUT %d bytes\n", n)
+	}
+	return nil
+}
+
+func (c *Console) cmdClear(args []string, rest string) error {
+	if err := c.requireUSB(); err != nil {
+		return err
+	}
+	if len(args) != 1 {
+		return fmt.Errorf("usage: %s", consoleCmds["clear"].usage)
+	}
+	ep, err := strconv.ParseUint(args[0], 0, 8)
+	if err != nil {
+		return err
+	}
+	defer c.lock()()
+	if err := c.usb.ClearHalt(uint8(ep)); err != nil {
+		return err
+	}
+	fmt.Fprintf(c.out, "✅ Cleared halt on endpoint 0x%02x\n", ep)
+	return nil
+}
+
+func (c *Console) cmdReset(args []string, rest string) error {
+	if err := c.requireUSB(); err != nil {
+		return err
+	}
+	defer c.lock()()
+	if err := c.usb.ResetPort(); err != nil {
+		return err
+	}
+	fmt.Fprintln(c.out, "✅ Port reset")
+	return nil
+}
+
+func (c *Console) cmdWatch(args []string, rest string) error {
+	switch strings.ToLower(rest) {
+	case "on":
+		c.setWatch(true)
+	case "off":
+		c.setWatch(false)
+	case "":
+		if c.watching {
+			fmt.Fprintln(c.out, "watch is on")
+		} else {
+			fmt.Fprintln(c.out, "watch is off")
+		}
+	default:
+		return fmt.Errorf("usage: %s", consoleCmds["watch"].usage)
+	}
+	return nil
+}
+
+func (c *Console) cmdSleep(args []string, rest string) error {
+	d, err := time.ParseDuration(rest)
+	if err != nil {
+		return err
+	}
+	time.Sleep(d)
+	return nil
+}
+
+func (c *Console) cmdSource(args []string, rest string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: %s", consoleCmds["source"].usage)
+	}
+	return c.Source(args[0])
+}
+
+func (c *Console) cmdHistory(args []string, rest string) error {
+	for i, line := range c.history {
+		fmt.Fprintf(c.out, "%4d  %s\n", i+1, line)
+	}
+	return nil
+}
+
+func (c *Console) cmdHelp(args []string, rest string) error {
+	for _, name := range []string{"hex", "text", "frame", "stop", "read", "msg", "poll", "control", "clear", "reset", "watch", "sleep", "source", "history", "help"} {
+		cmd := consoleCmds[name]
+		fmt.Fprintf(c.out, "  %-46s %s\n", cmd.usage, cmd.help)
+	}
+	fmt.Fprintf(c.out, "  %-46s %s\n", "quit", "leave the console")
+	return nil
+}
+
+// setWatch starts or stops the background goroutine printing incoming messages
+func (c *Console) setWatch(on bool) {
+	if on == c.watching {
+		return
+	}
+	c.watching = on
+	if !on {
+		close(c.stop)
+		<-c.done
+		return
+	}
+
+	c.stop, c.done = make(chan struct{}), make(chan struct{})
+	go func(stop, done chan struct{}) {
+		defer close(done)
+		if c.usb != nil {
+			//Interrupt notifications arrive on their own endpoint, so they are listened to without the lock
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			c.usb.ListenInterrupt(ctx, func(status []byte, err error) {
+				if err != nil {
+					fmt.Fprintf(c.out, "⚠️ Interrupt: %v\n", err)
+					return
+				}
+				fmt.Fprintf(c.out, "🔔 Interrupt %d bytes\n%s", len(status), tensorutils.HexDump(status, "  "))
+			})
+		}
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			unlock := c.lock()
+			msg, err := c.dev.ReadMsg(CONSOLE_WATCH_POLL)
+			unlock()
+			if msg != nil {
+				fmt.Fprintln(c.out, "📨", msg.String())
+			}
+			if errors.Is(err, tensorutils.ErrClosed) || errors.Is(err, tensorutils.ErrNoDevice) {
+				fmt.Fprintf(c.out, "⚠️ Stopped watching: %v\n", err)
+				return
+			}
+		}
+	}(c.stop, c.done)
+}
+
+// parseHex decodes hex bytes given as separate fields or one string, optionally prefixed with 0x
+func parseHex(fields []string) ([]byte, error) {
+	var sb strings.Builder
+	for _, field := range fields {
+		sb.WriteString(strings.TrimPrefix(strings.ToLower(field), "0x"))
+	}
+	return hex.DecodeString(sb.String())
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/JoshuaDoes/tensor-usbdl/tensorutils"
+	"github.com/spf13/pflag"
+)
+
+// CheckStatus is the verdict of a single doctor check
+type CheckStatus string
+
+const (
+	CheckOK   CheckStatus = "ok"
+	CheckInfo CheckStatus = "info"
+	CheckWarn CheckStatus = "warn"
+	CheckFail CheckStatus = "fail"
+)
+
+var checkIcons = map[CheckStatus]string{CheckOK: "✅", CheckInfo: "ℹ️ ", CheckWarn: "⚠️ ", CheckFail: "❌"}
+
+// Check is one finding of the doctor command, with a suggested fix when something is wrong
+type Check struct {
+	Name   string      `json:"name"`
+	Status CheckStatus `json:"status"`
+	Detail string      `json:"detail"`
+	Fix    string      `json:"fix,omitempty"`
+}
+
+// UDEV_RULES_PATH is where the generated rules are meant to be installed
+const UDEV_RULES_PATH = "/etc/udev/rules.d/51-tensor-usbdl.rules"
+
+// udevRules generates rules granting the logged in user, and optionally a group, access to the USB node and tty
+// of every registered profile, and keeping ModemManager away from the tty
+func udevRules(group string) string {
+	access := `TAG+="uaccess"`
+	if group != "" {
+		access = fmt.Sprintf(`MODE="0660", GROUP="%s", TAG+="uaccess"`, group)
+	}
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "# tensor-usbdl: boot ROM download mode devices, install as %s\n", UDEV_RULES_PATH)
+	sb.WriteString("# then run: sudo udevadm control --reload-rules && sudo udevadm trigger\n")
+	seen := make(map[string]bool)
+	for _, profile := range tensorutils.Profiles() {
+		vid, pid := strings.ToLower(fmt.Sprintf("%04x", uint16(profile.VID))), strings.ToLower(fmt.Sprintf("%04x", uint16(profile.PID)))
+		if seen[vid+pid] {
+			continue
+		}
+		seen[vid+pid] = true
+
+		var names []string
+		for _, other := range tensorutils.Profiles() {
+			if uint16(other.VID) == uint16(profile.VID) && uint16(other.PID) == uint16(profile.PID) {
+				names = append(names, other.Name)
+			}
+		}
+		fmt.Fprintf(&sb, "\n# %s:%s (%s)\n", vid, pid, strings.Join(names, ", "))
+		fmt.Fprintf(&sb, "SUBSYSTEM==\"usb\", ATTR{idVendor}==\"%s\", ATTR{idProduct}==\"%s\", %s, ENV{ID_MM_DEVICE_IGNORE}=\"1\"\n", vid, pid, access)
+		fmt.Fprintf(&sb, "SUBSYSTEM==\"tty\", ATTRS{idVendor}==\"%s\", ATTRS{idProduct}==\"%s\", %s, ENV{ID_MM_DEVICE_IGNORE}=\"1\"\n", vid, pid, access)
+	}
+	return sb.String()
+}
+
+// runDoctor checks whether this machine can talk to the device and prints what to fix, reporting false if a check failed
+func runDoctor(arguments []string) (bool, error) {
+	fs := pflag.NewFlagSet("doctor", pflag.ContinueOnError)
+	udev := fs.Bool("udev", false, "print udev rules for the registered profiles instead of running the checks")
+	udevFile := fs.String("udev-file", "", "write the udev rules to this file instead of stdout")
+	group := fs.String("group", "", "also grant this group access in the udev rules, i.e. plugdev")
+	if err := fs.Parse(arguments); err != nil {
+		return false, err
+	}
+
+	if *udev || *udevFile != "" {
+		rules := udevRules(*group)
+		if *udevFile == "" {
+			_, err := io.WriteString(jsonOut, rules)
+			return err == nil, err
+		}
+		if err := os.WriteFile(*udevFile, []byte(rules), 0644); err != nil {
+			return false, fmt.Errorf("failed to write udev rules: %w", err)
+		}
+		fmt.Fprintf(stdout, "✅ Wrote udev rules to %s\n", *udevFile)
+		return true, nil
+	}
+
+	checks := platformChecks()
+	if outputJSON {
+		return passed(checks), printJSON(checks)
+	}
+	fmt.Fprintln(stdout, "=== Doctor ===")
+	for _, check := range checks {
+		fmt.Fprintf(stdout, "%s %s: %s\n", checkIcons[check.Status], check.Name, check.Detail)
+		if check.Fix != "" {
+			fmt.Fprintf(stdout, "      Fix: %s\n", check.Fix)
+		}
+	}
+	return passed(checks), nil
+}
+
+func passed(checks []Check) bool {
+	for _, check := range checks {
+		if check.Status == CheckFail {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,270 @@
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/JoshuaDoes/tensor-usbdl/tensorutils"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	SYSFS_USB_DEVICES = "/sys/bus/usb/devices"
+	SYSFS_TTY_CLASS   = "/sys/class/tty"
+	UDEV_DATA_DIR     = "/run/udev/data"
+)
+
+var udevRulesDirs = []string{"/etc/udev/rules.d", "/run/udev/rules.d", "/usr/lib/udev/rules.d", "/lib/udev/rules.d"}
+
+// sysfsDevice is a USB device as described in sysfs
+type sysfsDevice struct {
+	path    string //i.e. /sys/bus/usb/devices/1-2
+	id      tensorutils.DeviceIdentity
+	node    string //i.e. /dev/bus/usb/001/004
+	profile *tensorutils.Profile
+}
+
+// platformChecks inspects sysfs, device nodes and running services for everything that keeps the tool from the device
+func platformChecks() []Check {
+	var checks []Check
+	if os.Geteuid() == 0 {
+		checks = append(checks, Check{Name: "User", Status: CheckInfo, Detail: "running as root, permission problems of other users won't show"})
+	}
+	checks = append(checks, udevRulesCheck())
+
+	devs := findSysfsDevices()
+	if len(devs) == 0 {
+		return append(checks, Check{
+			Name:   "Device",
+			Status: CheckWarn,
+			Detail: "no device matching a profile is connected",
+			Fix:    "connect the device in download mode and run doctor again to check its permissions and drivers",
+		})
+	}
+
+	var ttys []string
+	for _, dev := range devs {
+		checks = append(checks, Check{
+			Name:   "Device",
+			Status: CheckOK,
+			Detail: fmt.Sprintf("%04X:%04X serial %s at %s, profile %s", dev.id.VID, dev.id.PID, dev.id.Serial, filepath.Base(dev.path), dev.profile.Name),
+		})
+		checks = append(checks, accessCheck("USB node", dev.node, "install the udev rules (see doctor --udev) or run as root"))
+
+		ifaceChecks, devTTYs := interfaceChecks(dev)
+		checks = append(checks, ifaceChecks...)
+		for _, tty := range devTTYs {
+			checks = append(checks, accessCheck("Serial port", "/dev/"+tty, "add yourself to the group owning the port, i.e. sudo usermod -aG dialout $USER, then log in again"))
+		}
+		ttys = append(ttys, devTTYs...)
+	}
+	return append(checks, modemManagerCheck(ttys))
+}
+
+// findSysfsDevices lists the connected USB devices that belong to a registered profile
+func findSysfsDevices() []sysfsDevice {
+	entries, err := os.ReadDir(SYSFS_USB_DEVICES)
+	if err != nil {
+		return nil
+	}
+	var devs []sysfsDevice
+	for _, entry := range entries {
+		path := filepath.Join(SYSFS_USB_DEVICES, entry.Name())
+		vid, errVID := strconv.ParseUint(readAttr(path, "idVendor"), 16, 16)
+		pid, errPID := strconv.ParseUint(readAttr(path, "idProduct"), 16, 16)
+		if errVID != nil || errPID != nil {
+			continue //Interfaces and root hubs without IDs
+		}
+		bcd, _ := strconv.ParseUint(readAttr(path, "bcdDevice"), 16, 16)
+		id := tensorutils.DeviceIdentity{
+			VID:       uint16(vid),
+			PID:       uint16(pid),
+			BcdDevice: uint16(bcd),
+			Product:   readAttr(path, "product"),
+			Serial:    readAttr(path, "serial"),
+		}
+		profile := selectedProfile
+		if profile == nil || uint16(profile.VID) != id.VID || uint16(profile.PID) != id.PID {
+			profile = tensorutils.SelectProfile(id)
+		}
+		if profile == nil {
+			continue
+		}
+		bus, _ := strconv.Atoi(readAttr(path, "busnum"))
+		num, _ := strconv.Atoi(readAttr(path, "devnum"))
+		devs = append(devs, sysfsDevice{path: path, id: id, node: fmt.Sprintf("/dev/bus/usb/%03d/%03d", bus, num), profile: profile})
+	}
+	return devs
+}
+
+// readAttr reads a sysfs or procfs attribute without its trailing newline
+func readAttr(dir, name string) string {
+	p, err := os.ReadFile(filepath.Join(dir, name))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(p))
+}
+
+// accessCheck reports whether the current user can open a device node for reading and writing
+func accessCheck(name, node, fix string) Check {
+	if err := unix.Access(node, unix.R_OK|unix.W_OK); err != nil {
+		return Check{Name: name, Status: CheckFail, Detail: fmt.Sprintf("%s is not accessible (%s): %v", node, nodeOwner(node), err), Fix: fix}
+	}
+	return Check{Name: name, Status: CheckOK, Detail: fmt.Sprintf("%s is readable and writable (%s)", node, nodeOwner(node))}
+}
+
+// nodeOwner describes the mode, owner and group of a file
+func nodeOwner(path string) string {
+	var st unix.Stat_t
+	if err := unix.Stat(path, &st); err != nil {
+		return "missing"
+	}
+	owner := strconv.Itoa(int(st.Uid))
+	if u, err := user.LookupId(owner); err == nil {
+		owner = u.Username
+	}
+	group := strconv.Itoa(int(st.Gid))
+	if g, err := user.LookupGroupId(group); err == nil {
+		group = g.Name
+	}
+	return fmt.Sprintf("%s %s:%s", os.FileMode(st.Mode&0777), owner, group)
+}
+
+// interfaceChecks reports the kernel driver bound to each interface and whether it is in the way of the bulk path,
+// returning the ttys created for the device
+func interfaceChecks(dev sysfsDevice) ([]Check, []string) {
+	var checks []Check
+	var ttys []string
+	ifaces, _ := filepath.Glob(dev.path + ":*")
+	for _, iface := range ifaces {
+		num, err := strconv.ParseUint(readAttr(iface, "bInterfaceNumber"), 16, 8)
+		if err != nil {
+			continue
+		}
+		driver := ""
+		if link, err := os.Readlink(filepath.Join(iface, "driver")); err == nil {
+			driver = filepath.Base(link)
+		}
+		names, _ := filepath.Glob(filepath.Join(iface, "tty", "*"))
+		for _, name := range names {
+			ttys = append(ttys, filepath.Base(name))
+		}
+
+		name := fmt.Sprintf("Interface %d", num)
+		bulk := int(num) == dev.profile.Layout.BulkIface
+		switch {
+		case driver == "":
+			checks = append(checks, Check{Name: name, Status: CheckOK, Detail: "no kernel driver bound"})
+		case driver == "usbfs":
+			checks = append(checks, Check{Name: name, Status: CheckInfo, Detail: "claimed by a userspace program through usbfs"})
+		case driver == "cdc_acm" && bulk:
+			checks = append(checks, Check{
+				Name:   name,
+				Status: CheckWarn,
+				Detail: "cdc_acm is bound to the bulk data interface, so the USB path fails with busy errors while the serial path works",
+				Fix:    fmt.Sprintf("use serial mode, run with --detach-kernel-driver, or unbind it: echo -n %s | sudo tee /sys/bus/usb/drivers/cdc_acm/unbind", filepath.Base(iface)),
+			})
+		default:
+			checks = append(checks, Check{Name: name, Status: CheckInfo, Detail: "bound to " + driver})
+		}
+	}
+	return checks, ttys
+}
+
+// udevRulesCheck looks for installed rules mentioning the VID:PID of a registered profile
+func udevRulesCheck() Check {
+	for _, dir := range udevRulesDirs {
+		files, _ := filepath.Glob(filepath.Join(dir, "*.rules"))
+		for _, file := range files {
+			p, err := os.ReadFile(file)
+			if err != nil {
+				continue
+			}
+			rules := strings.ToLower(string(p))
+			for _, profile := range tensorutils.Profiles() {
+				if strings.Contains(rules, fmt.Sprintf("%04x", uint16(profile.VID))) && strings.Contains(rules, fmt.Sprintf("%04x", uint16(profile.PID))) {
+					return Check{Name: "udev rules", Status: CheckOK, Detail: fmt.Sprintf("%s covers %s", file, profile.Name)}
+				}
+			}
+		}
+	}
+	return Check{
+		Name:   "udev rules",
+		Status: CheckWarn,
+		Detail: "no udev rules for the boot ROM devices are installed, only root can open them",
+		Fix:    "tensor-usbdl doctor --udev-file 51-tensor-usbdl.rules && sudo cp 51-tensor-usbdl.rules " + UDEV_RULES_PATH + " && sudo udevadm control --reload-rules && sudo udevadm trigger",
+	}
+}
+
+// modemManagerCheck reports whether ModemManager is running and whether it has, or may grab, one of the ttys
+func modemManagerCheck(ttys []string) Check {
+	pids := processesNamed("ModemManager")
+	if len(pids) == 0 {
+		return Check{Name: "ModemManager", Status: CheckOK, Detail: "not running"}
+	}
+	for _, pid := range pids {
+		fds, _ := filepath.Glob(filepath.Join("/proc", pid, "fd", "*"))
+		for _, fd := range fds {
+			target, err := os.Readlink(fd)
+			if err != nil {
+				continue
+			}
+			for _, tty := range ttys {
+				if target == "/dev/"+tty {
+					return Check{
+						Name:   "ModemManager",
+						Status: CheckFail,
+						Detail: fmt.Sprintf("ModemManager (pid %s) has /dev/%s open and will corrupt DNW transfers", pid, tty),
+						Fix:    "install the udev rules (see doctor --udev), which set ID_MM_DEVICE_IGNORE, or run: sudo systemctl stop ModemManager",
+					}
+				}
+			}
+		}
+	}
+	for _, tty := range ttys {
+		if !udevIgnoredByMM(tty) {
+			return Check{
+				Name:   "ModemManager",
+				Status: CheckWarn,
+				Detail: fmt.Sprintf("ModemManager is running and may probe /dev/%s", tty),
+				Fix:    "install the udev rules (see doctor --udev), which set ID_MM_DEVICE_IGNORE, or run: sudo systemctl stop ModemManager",
+			}
+		}
+	}
+	return Check{Name: "ModemManager", Status: CheckOK, Detail: "running, but ignores the device"}
+}
+
+// udevIgnoredByMM reports whether udev tagged a tty with ID_MM_DEVICE_IGNORE
+func udevIgnoredByMM(tty string) bool {
+	dev := readAttr(filepath.Join(SYSFS_TTY_CLASS, tty), "dev")
+	if dev == "" {
+		return false
+	}
+	p, err := os.ReadFile(filepath.Join(UDEV_DATA_DIR, "c"+dev))
+	return err == nil && strings.Contains(string(p), "E:ID_MM_DEVICE_IGNORE=1")
+}
+
+// processesNamed returns the PIDs of running processes with the given command name
+func processesNamed(name string) []string {
+	entries, err := os.ReadDir("/proc")
+	if err != nil {
+		return nil
+	}
+	var pids []string
+	for _, entry := range entries {
+		if _, err := strconv.Atoi(entry.Name()); err != nil {
+			continue
+		}
+		if readAttr(filepath.Join("/proc", entry.Name()), "comm") == name {
+			pids = append(pids, entry.Name())
+		}
+	}
+	return pids
+}
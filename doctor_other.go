@@ -0,0 +1,15 @@
+//go:build !linux
+
+package main
+
+import "runtime"
+
+// platformChecks has nothing to inspect outside Linux, where access is handled by the driver installation
+func platformChecks() []Check {
+	return []Check{{
+		Name:   "Platform",
+		Status: CheckInfo,
+		Detail: "permission checks are only available on Linux, this is " + runtime.GOOS,
+		Fix:    "on Windows check the Device Manager for driver issues, see Troubleshooting in the README",
+	}}
+}
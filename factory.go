@@ -0,0 +1,100 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/JoshuaDoes/tensor-usbdl/tensorutils"
+)
+
+// flashFactory flashes the boot chain of the profile, or the stage chosen with --stage, straight out of a factory
+// image zip. The profile is the one of the connected device, which must be one the bootloader pack was built for.
+func flashFactory(path string, opts *FlashOptions) (*tensorutils.Result, error) {
+	factory, err := tensorutils.OpenFactory(path)
+	if err != nil {
+		return nil, err
+	}
+	defer factory.Close()
+
+	pack := factory.Pack
+	fmt.Fprintf(stdout, "Factory image: %s\n", filepath.Base(path))
+	fmt.Fprintf(stdout, "Bootloader: %s (platform %s, version %s)\n", factory.Bootloader, pack.Platform, pack.Version)
+	fmt.Fprintf(stdout, "Bootloader stages: %s\n", strings.Join(pack.Stages(), ", "))
+
+	var images []*tensorutils.Image
+	if opts.Stage != "" {
+		img, err := pack.Stage(opts.Stage)
+		if err != nil {
+			return nil, err
+		}
+		images = []*tensorutils.Image{img}
+	}
+
+	// Nothing is sent before the device's profile is known to be one the pack supports
+	first := opts.Stage
+	if first == "" && len(pack.Stages()) > 0 {
+		first = pack.Stages()[0]
+	}
+	profile, err := deviceProfile(opts, first)
+	if err != nil {
+		return nil, err
+	}
+	fmt.Fprintln(stdout, "Device profile:", profile.Name)
+	if !pack.Supports(profile) {
+		return nil, fmt.Errorf("the bootloader is built for %s, but the device uses the %s profile", pack.Platform, profile.Name)
+	}
+	opts.Profile = profile
+
+	if images == nil {
+		if images, err = pack.StagesFor(profile); err != nil {
+			return nil, err
+		}
+	}
+	names := make([]string, len(images))
+	for i, img := range images {
+		names[i] = img.Name
+	}
+	fmt.Fprintf(stdout, "Flashing %s for profile %s\n", strings.Join(names, " → "), profile.Name)
+
+	var res *tensorutils.Result
+	for i, img := range images {
+		fmt.Fprintf(stdout, "\n--- Stage %s (%d/%d, %d bytes) ---\n", img.Name, i+1, len(images), img.Size)
+		if res, err = flashImage(img, opts); err != nil {
+			return res, fmt.Errorf("stage %s: %w", img.Name, err)
+		}
+	}
+	return res, nil
+}
+
+// deviceProfile opens the device that is about to be flashed to learn its profile, without sending anything.
+// The profile chosen with --profile is forced on the device as it is when flashing. stage is only used by the simulator.
+func deviceProfile(opts *FlashOptions, stage string) (*tensorutils.Profile, error) {
+	var errs []error
+	//The serial port is looked up first, as claiming the USB interfaces may detach its driver
+	if opts.Mode != ModeUSB && !opts.Simulate {
+		dnw, err := tensorutils.GetDNW()
+		if err == nil {
+			defer dnw.Close()
+			profile := selectedProfile
+			if profile == nil {
+				profile = dnw.Profile()
+			}
+			if profile == nil {
+				return nil, fmt.Errorf("no profile matches the DNW device %s (%s), choose one with --profile", dnw.GetPort(), dnw.GetID())
+			}
+			return profile, nil
+		}
+		errs = append(errs, err)
+	}
+	if opts.Mode != ModeSerial {
+		gs101, err := openFlashUSB(opts, stage)
+		if err == nil {
+			defer gs101.Close()
+			return gs101.Profile(), nil
+		}
+		errs = append(errs, err)
+	}
+	return nil, fmt.Errorf("no device to check the bootloader against: %w", errors.Join(errs...))
+}
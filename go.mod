@@ -6,7 +6,10 @@ require (
 	github.com/JoshuaDoes/crunchio v0.0.4
 	github.com/JoshuaDoes/logger v0.0.1
 	github.com/google/gousb v1.1.3
+	github.com/sirupsen/logrus v1.9.3
 	go.bug.st/serial v1.6.2
+	golang.org/x/crypto v0.28.0
+	golang.org/x/term v0.25.0
 )
 
 require (
@@ -14,15 +17,12 @@ require (
 	github.com/mattn/go-isatty v0.0.16 // indirect
 	github.com/mgutz/ansi v0.0.0-20200706080929-d51e80ef957d // indirect
 	github.com/nxadm/tail v1.4.11 // indirect
-	github.com/sirupsen/logrus v1.9.3 // indirect
 	github.com/superwhiskers/crunch/v3 v3.5.7 // indirect
 	github.com/x-cray/logrus-prefixed-formatter v0.5.2 // indirect
-	golang.org/x/crypto v0.28.0 // indirect
-	golang.org/x/term v0.25.0 // indirect
 )
 
 require (
 	github.com/creack/goselect v0.1.2 // indirect
 	github.com/spf13/pflag v1.0.6
-	golang.org/x/sys v0.26.0 // indirect
+	golang.org/x/sys v0.26.0
 )
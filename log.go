@@ -0,0 +1,170 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/JoshuaDoes/logger"
+	"github.com/JoshuaDoes/tensor-usbdl/tensorutils"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/pflag"
+)
+
+// EVENTS_QUEUE is how many events the recorder queues before it slows the transports down
+const EVENTS_QUEUE = 1024
+
+// GlobalOptions holds the flags given before the command: where library logs and protocol traces go,
+// how much of them is shown, which device profile is used and where the config file is
+type GlobalOptions struct {
+	Config       string // Config file to read instead of the default one
+	Verbosity    int    // 0 = info, 1 = debug, 2 = trace
+	Quiet        bool   // Only show errors
+	File         string // Also append logs to this file
+	Trace        bool   // Dump every transfer to stderr
+	TraceFile    string // Dump every transfer to this file instead
+	TraceLimit   int    // Bytes dumped per transfer, 0 for all of them
+	Events       string // Record every transport event to this file as JSON lines
+	Profile      string // Device profile to use instead of selecting one from the device
+	ProfilesFile string // JSON file with user profiles to register
+	Output       string // Output format, text or json
+	Detach       bool   // Detach kernel drivers from the interfaces while the USB path uses them
+
+	set map[string]bool // Flags given on the command line, these override the config
+}
+
+// parseGlobalFlags parses the flags given before the command, returning the command and its arguments
+func parseGlobalFlags(arguments []string) (*GlobalOptions, []string, error) {
+	opts := &GlobalOptions{set: make(map[string]bool)}
+	fs := pflag.NewFlagSet("tensor-usbdl", pflag.ContinueOnError)
+	fs.SetInterspersed(false) // Everything from the command on belongs to the command
+	fs.StringVar(&opts.Config, "config", "", "config file to read (default: tensor-usbdl/config.json in the user config directory)")
+	fs.CountVarP(&opts.Verbosity, "verbose", "v", "increase log verbosity, repeat for trace logs")
+	fs.BoolVarP(&opts.Quiet, "quiet", "q", false, "only log errors")
+	fs.StringVar(&opts.File, "log-file", "", "also append logs to this file")
+	fs.BoolVar(&opts.Trace, "trace", false, "dump every USB and serial transfer with decoded frames and messages")
+	fs.StringVar(&opts.TraceFile, "trace-file", "", "write the transfer dump to this file instead of stderr, implies --trace")
+	fs.IntVar(&opts.TraceLimit, "trace-limit", 0, "bytes dumped per transfer (0 for all)")
+	fs.StringVar(&opts.Events, "events", "", "record every device message and transport event to this file as JSON lines")
+	fs.StringVar(&opts.Profile, "profile", "", "device profile to use, see the profiles command (default: selected from the device)")
+	fs.StringVar(&opts.ProfilesFile, "profiles", "", "JSON file with additional device profiles")
+	fs.StringVarP(&opts.Output, "output", "o", "text", "output format: text or json")
+	fs.BoolVar(&opts.Detach, "detach-kernel-driver", false, "detach kernel drivers such as cdc_acm while the USB path is in use, reattaching them afterwards (Linux)")
+	if err := fs.Parse(arguments); err != nil {
+		return nil, nil, err
+	}
+	fs.Visit(func(flag *pflag.Flag) {
+		opts.set[flag.Name] = true
+	})
+	return opts, fs.Args(), nil
+}
+
+// cliLogger forwards tensorutils log entries to a logrus based logger, fields included
+type cliLogger struct {
+	log *logger.Logger
+}
+
+var logrusLevels = map[tensorutils.LogLevel]logrus.Level{
+	tensorutils.LogTrace: logrus.TraceLevel,
+	tensorutils.LogDebug: logrus.DebugLevel,
+	tensorutils.LogInfo:  logrus.InfoLevel,
+	tensorutils.LogWarn:  logrus.WarnLevel,
+	tensorutils.LogError: logrus.ErrorLevel,
+}
+
+func (l cliLogger) Log(level tensorutils.LogLevel, msg string, fields tensorutils.Fields) {
+	lvl, exists := logrusLevels[level]
+	if !exists {
+		lvl = logrus.InfoLevel
+	}
+	l.log.WithField("prefix", "tensorutils").WithFields(logrus.Fields(fields)).Log(lvl, msg)
+}
+
+// setupLogging installs the CLI logger and tracer into tensorutils, the returned func closes any files
+func setupLogging(opts *GlobalOptions) (func(), error) {
+	verbosity := opts.Verbosity
+	if verbosity > 2 {
+		verbosity = 2
+	}
+	log := logger.NewLogger("tensorutils", verbosity)
+	if opts.Quiet {
+		log.SetLevel(logrus.ErrorLevel)
+	}
+	log.SetOutput(os.Stderr)
+
+	var files []*os.File
+	var stopRecording func()
+	closeFiles := func() {
+		if stopRecording != nil {
+			stopRecording()
+		}
+		for _, file := range files {
+			file.Close()
+		}
+	}
+	if opts.File != "" {
+		file, err := os.OpenFile(opts.File, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open log file: %w", err)
+		}
+		files = append(files, file)
+		log.SetOutput(io.MultiWriter(os.Stderr, file))
+	}
+	tensorutils.SetLogger(cliLogger{log})
+
+	if opts.TraceFile != "" {
+		file, err := os.Create(opts.TraceFile)
+		if err != nil {
+			closeFiles()
+			return nil, fmt.Errorf("failed to create trace file: %w", err)
+		}
+		files = append(files, file)
+		tensorutils.SetTracer(tensorutils.NewHexTracer(file, opts.TraceLimit))
+	} else if opts.Trace {
+		tensorutils.SetTracer(tensorutils.NewHexTracer(os.Stderr, opts.TraceLimit))
+	}
+
+	if opts.Events != "" {
+		file, err := os.Create(opts.Events)
+		if err != nil {
+			closeFiles()
+			return nil, fmt.Errorf("failed to create events file: %w", err)
+		}
+		files = append(files, file)
+		stopRecording = recordEvents(file)
+	}
+	return closeFiles, nil
+}
+
+// recordEvents writes every event published on the default bus to w as JSON lines, until the returned func
+// is called. The recorder blocks the transports rather than lose events.
+func recordEvents(w io.Writer) func() {
+	sub := tensorutils.DefaultBus.Subscribe(EVENTS_QUEUE, tensorutils.OverflowBlock)
+	enc := json.NewEncoder(w)
+	stop, done := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			select {
+			case event := <-sub.C():
+				enc.Encode(event)
+			case <-stop:
+				//Write what was queued before stopping
+				for {
+					select {
+					case event := <-sub.C():
+						enc.Encode(event)
+					default:
+						return
+					}
+				}
+			}
+		}
+	}()
+	return func() {
+		sub.Close()
+		close(stop)
+		<-done
+	}
+}
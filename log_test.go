@@ -0,0 +1,53 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/JoshuaDoes/logger"
+	"github.com/JoshuaDoes/tensor-usbdl/tensorutils"
+	"github.com/sirupsen/logrus"
+)
+
+func TestCLILogger(t *testing.T) {
+	var out bytes.Buffer
+	log := logger.NewLogger("tensorutils", 2)
+	log.SetOutput(&out)
+	log.Formatter = &logrus.JSONFormatter{}
+	l := cliLogger{log}
+
+	tests := []struct {
+		level tensorutils.LogLevel
+		want  string
+	}{
+		{tensorutils.LogTrace, "trace"},
+		{tensorutils.LogDebug, "debug"},
+		{tensorutils.LogInfo, "info"},
+		{tensorutils.LogWarn, "warning"},
+		{tensorutils.LogError, "error"},
+		{tensorutils.LogLevel(9), "info"},
+	}
+	for _, test := range tests {
+		out.Reset()
+		l.Log(test.level, "stage sent", tensorutils.Fields{tensorutils.FieldStage: "bl1", tensorutils.FieldEndpoint: "0x02"})
+		var entry map[string]interface{}
+		if err := json.Unmarshal(out.Bytes(), &entry); err != nil {
+			t.Fatalf("log entry %q isn't JSON: %v", out.String(), err)
+		}
+		if entry["level"] != test.want || entry["msg"] != "stage sent" || entry["prefix"] != "tensorutils" ||
+			entry["stage"] != "bl1" || entry["endpoint"] != "0x02" {
+			t.Errorf("%s entry = %v, want level %s with the fields", test.level, entry, test.want)
+		}
+	}
+
+	//Entries below the logger's level are left out
+	out.Reset()
+	log.SetLevel(logrus.ErrorLevel)
+	l.Log(tensorutils.LogWarn, "quiet", nil)
+	l.Log(tensorutils.LogError, "loud", nil)
+	if logged := out.String(); strings.Contains(logged, "quiet") || !strings.Contains(logged, "loud") {
+		t.Errorf("quiet logger wrote %q", logged)
+	}
+}
@@ -1,15 +1,15 @@
 package main
 
 import (
+	"errors"
 	"fmt"
-	"io/ioutil"
 	"os"
 	"path/filepath"
 	"strings"
 	"time"
 
 	"github.com/JoshuaDoes/tensor-usbdl/tensorutils"
-	"github.com/google/gousb"
+	"github.com/spf13/pflag"
 )
 
 const (
@@ -29,82 +29,383 @@ Based on keyholes.txt endpoint analysis - First successful Pixel 6a unbrick!
 
 type FlashMode int
 
+// Exit codes for each flash outcome, so automation can tell a rejected stage from a vanished device
+const (
+	ExitAccepted       = 0
+	ExitError          = 1 // Failed before the device could respond, i.e. no device or unreadable image
+	ExitRejectedHeader = 2
+	ExitBootFailure    = 3
+	ExitDisconnected   = 4
+	ExitUnknown        = 5
+)
+
 const (
 	ModeSerial FlashMode = iota // Original DNW serial mode
 	ModeUSB                     // New USB bulk transfer mode  
 	ModeAuto                    // Auto-detect best mode
 )
 
+// FlashOptions holds everything that controls a flash besides the image itself
+type FlashOptions struct {
+	Mode           FlashMode
+	Retry          tensorutils.RetryPolicy
+	Simulate       bool                 // Flash against the in-memory simulator instead of a real device
+	SimulateStalls []int                // Bulk OUT transfers the simulator stalls on
+	SimulateResume bool                 // The simulator keeps partial stages across re-enumeration
+	Stage          string               // Stage name of the image, derived from its file name if empty
+	Profile        *tensorutils.Profile // Profile the images were chosen for, the device must use it too
+	Cache          *ImageCache          // Where images given as URIs are fetched to
+	TrustedKeys    []string             // Public keys trusted to sign manifests
+	RequireSig     bool                 // Refuse manifests without a valid signature
+	Operator       string               // Operator recorded in the audit log, the current user if empty
+	Batch          string               // Batch recorded in the audit log
+	Audit          *auditSession        // Session every stage is recorded in
+}
+
+// stage returns the stage name of the image at path
+func (opts *FlashOptions) stage(path string) string {
+	if opts.Stage != "" {
+		return opts.Stage
+	}
+	return stageName(path)
+}
+
+// parseMode parses a flash mode name
+func parseMode(name string) (FlashMode, error) {
+	switch strings.ToLower(name) {
+	case "serial":
+		return ModeSerial, nil
+	case "usb":
+		return ModeUSB, nil
+	case "auto":
+		return ModeAuto, nil
+	}
+	return ModeAuto, fmt.Errorf("unknown mode '%s'", name)
+}
+
+// parseFlashFlags parses the flash command's flags with defaults from the config, returning the remaining positional arguments
+func parseFlashFlags(arguments []string, cfg *Config) (*FlashOptions, []string, error) {
+	mode, err := parseMode(cfg.Mode)
+	if err != nil {
+		return nil, nil, err
+	}
+	policy, err := cfg.retryPolicy()
+	if err != nil {
+		return nil, nil, err
+	}
+	opts := &FlashOptions{Mode: mode, Retry: policy, TrustedKeys: cfg.TrustedKeys}
+	defaultActions := make([]string, len(opts.Retry.Actions))
+	for i, action := range opts.Retry.Actions {
+		defaultActions[i] = action.String()
+	}
+
+	fs := pflag.NewFlagSet("flash", pflag.ContinueOnError)
+	fs.IntVar(&opts.Retry.MaxAttempts, "retries", opts.Retry.MaxAttempts, "attempts per USB transfer, including the first")
+	fs.DurationVar(&opts.Retry.Backoff, "backoff", opts.Retry.Backoff, "delay before the first retry, doubled for every following retry")
+	fs.DurationVar(&opts.Retry.MaxBackoff, "max-backoff", opts.Retry.MaxBackoff, "upper bound for the retry delay (0 for none)")
+	actions := fs.StringSlice("recovery", defaultActions, "recovery actions between attempts: clear-halt, port-reset, reenumerate")
+	fs.BoolVar(&opts.Retry.Resume, "resume", opts.Retry.Resume, "resume a stage from the last sent offset after re-enumeration if the device allows it (best-effort)")
+	fs.BoolVar(&opts.Simulate, "simulate", false, "flash against the built-in device simulator")
+	fs.IntSliceVar(&opts.SimulateStalls, "simulate-stall", nil, "bulk OUT transfers the simulator stalls on, counted from 0")
+	fs.BoolVar(&opts.SimulateResume, "simulate-resumable", false, "the simulator keeps partial stages across re-enumeration")
+	fs.StringVar(&opts.Stage, "stage", "", "stage name of the image, required when reading it from stdin (-)")
+	offline := fs.Bool("offline", cfg.Offline, "only use cached images and manifests")
+	fs.BoolVar(&opts.RequireSig, "require-signature", cfg.RequireSig, "refuse manifests without a valid signature from a trusted key")
+	fs.StringVar(&opts.Operator, "operator", cfg.Operator, "operator recorded in the audit log (default: the current user)")
+	fs.StringVar(&opts.Batch, "batch", cfg.Batch, "batch the session belongs to, recorded in the audit log for reports")
+	if err := fs.Parse(arguments); err != nil {
+		return nil, nil, err
+	}
+
+	opts.Retry.Actions = nil
+	for _, name := range *actions {
+		action, err := tensorutils.ParseRecoveryAction(name)
+		if err != nil {
+			return nil, nil, err
+		}
+		opts.Retry.Actions = append(opts.Retry.Actions, action)
+	}
+	opts.Cache = newImageCache(cfg.CacheDir, *offline)
+	return opts, fs.Args(), nil
+}
+
+// closeLogs closes the log, trace and events files once logging is set up
+var closeLogs = func() {}
+
+// exit closes the log files and exits with code
+func exit(code int) {
+	closeLogs()
+	os.Exit(code)
+}
+
 func main() {
-	fmt.Printf(BANNER, VERSION)
+	globalOpts, cmdArgs, err := parseGlobalFlags(os.Args[1:])
+	if err != nil {
+		fmt.Fprintf(stdout, BANNER, VERSION)
+		fmt.Fprintf(stdout, "Error: %v\n", err)
+		printUsage()
+		exit(1)
+	}
+	cfg, err := loadConfig(globalOpts.Config)
+	if err == nil {
+		cfg.merge(globalOpts)
+		err = cfg.validate()
+	}
+	if err != nil {
+		fmt.Fprintf(stdout, "Error: %v\n", err)
+		exit(1)
+	}
+	setupOutput(cfg.Output)
+	fmt.Fprintf(stdout, BANNER, VERSION)
 	
-	if len(os.Args) < 2 {
+	if len(cmdArgs) < 1 {
 		printUsage()
-		os.Exit(1)
+		exit(1)
+	}
+	closeFiles, err := setupLogging(globalOpts)
+	if err != nil {
+		fmt.Fprintf(stdout, "Error: %v\n", err)
+		exit(1)
+	}
+	closeLogs = closeFiles
+	if err := setupProfiles(globalOpts, cfg); err != nil {
+		fmt.Fprintf(stdout, "Error: %v\n", err)
+		exit(1)
 	}
+	tensorutils.SetAutoDetach(globalOpts.Detach)
 	
-	command := os.Args[1]
+	command := cmdArgs[0]
 	
 	switch command {
 	case "flash":
-		if len(os.Args) < 3 {
-			fmt.Println("Error: flash command requires bootloader path")
+		opts, args, err := parseFlashFlags(cmdArgs[1:], cfg)
+		if err != nil {
+			fmt.Fprintf(stdout, "Error: %v\n", err)
+			printUsage()
+			exit(1)
+		}
+		if len(args) < 1 {
+			fmt.Fprintln(stdout, "Error: flash command requires bootloader path")
 			printUsage()
-			os.Exit(1)
+			exit(1)
+		}
+		bootloaderPath := args[0]
+		switch {
+		case bootloaderPath == "-":
+		case isRemote(bootloaderPath):
+			if !isManifest(bootloaderPath) {
+				bootloaderPath, err = opts.Cache.Fetch(bootloaderPath, "")
+			}
+		default:
+			bootloaderPath, err = findImage(bootloaderPath, cfg.ImagePaths)
+		}
+		if err != nil {
+			fmt.Fprintf(stdout, "Error: %v\n", err)
+			exit(1)
 		}
-		bootloaderPath := os.Args[2]
 		
-		mode := ModeAuto
-		if len(os.Args) > 3 {
-			switch strings.ToLower(os.Args[3]) {
-			case "serial":
-				mode = ModeSerial
-			case "usb":
-				mode = ModeUSB  
-			case "auto":
-				mode = ModeAuto
-			default:
-				fmt.Printf("Error: unknown mode '%s'\n", os.Args[3])
+		if len(args) > 1 {
+			if opts.Mode, err = parseMode(args[1]); err != nil {
+				fmt.Fprintf(stdout, "Error: %v\n", err)
 				printUsage()
-				os.Exit(1)
+				exit(1)
 			}
 		}
 		
-		err := flashBootloader(bootloaderPath, mode)
+		if opts.Audit, err = startAudit(cfg, args[0], opts); err != nil {
+			fmt.Fprintf(stdout, "Error: %v\n", err)
+			exit(1)
+		}
+		res, err := flashBootloader(bootloaderPath, opts)
+		opts.Audit.finish(res, err)
+		if outputJSON {
+			summary := newFlashSummary(args[0], opts.stage(bootloaderPath), res, err)
+			summary.Session = opts.Audit.record.Session
+			printJSON(summary)
+		}
 		if err != nil {
-			fmt.Printf("Flash failed: %v\n", err)
-			os.Exit(1)
+			fmt.Fprintf(stdout, "Flash failed: %v\n", err)
+			exit(exitCode(res))
 		}
 		
 	case "detect":
 		detectDevices()
 		
+	case "descriptors":
+		fs := pflag.NewFlagSet("descriptors", pflag.ContinueOnError)
+		all := fs.Bool("all", false, "dump every USB device, not just those matching a profile")
+		if err := fs.Parse(cmdArgs[1:]); err != nil {
+			fmt.Fprintf(stdout, "Error: %v\n", err)
+			printUsage()
+			exit(1)
+		}
+		if _, err := tensorutils.DumpDescriptors(stdout, *all); err != nil {
+			fmt.Fprintf(stdout, "❌ Failed to read descriptors: %v\n", err)
+			exit(1)
+		}
+		
 	case "test":
-		testEndpoints()
+		passed, err := testEndpoints(cmdArgs[1:])
+		if err != nil {
+			fmt.Fprintf(stdout, "Test failed: %v\n", err)
+		}
+		if err != nil || !passed {
+			exit(1)
+		}
+		
+	case "console":
+		if err := runConsole(cmdArgs[1:]); err != nil {
+			fmt.Fprintf(stdout, "Console failed: %v\n", err)
+			exit(1)
+		}
+		
+	case "doctor":
+		passed, err := runDoctor(cmdArgs[1:])
+		if err != nil {
+			fmt.Fprintf(stdout, "Doctor failed: %v\n", err)
+		}
+		if err != nil || !passed {
+			exit(1)
+		}
+		
+	case "config":
+		if err := runConfig(cmdArgs[1:], cfg); err != nil {
+			fmt.Fprintf(stdout, "Error: %v\n", err)
+			exit(1)
+		}
+		
+	case "profiles":
+		if err := listProfiles(cmdArgs[1:]); err != nil {
+			fmt.Fprintf(stdout, "Error: %v\n", err)
+			exit(1)
+		}
+		
+	case "manifest":
+		if err := runManifest(cmdArgs[1:], cfg); err != nil {
+			fmt.Fprintf(stdout, "Error: %v\n", err)
+			exit(1)
+		}
+		
+	case "history":
+		if err := runHistory(cmdArgs[1:], cfg); err != nil {
+			fmt.Fprintf(stdout, "Error: %v\n", err)
+			exit(1)
+		}
+		
+	case "report":
+		if err := runReport(cmdArgs[1:], cfg); err != nil {
+			fmt.Fprintf(stdout, "Error: %v\n", err)
+			exit(1)
+		}
 		
 	default:
-		fmt.Printf("Error: unknown command '%s'\n", command)
+		fmt.Fprintf(stdout, "Error: unknown command '%s'\n", command)
 		printUsage()
-		os.Exit(1)
+		exit(1)
 	}
+	closeLogs()
 }
 
 func printUsage() {
-	fmt.Println(`
-Usage: tensor-usbdl <command> [options]
+	fmt.Fprint(stdout, `
+Usage: tensor-usbdl [global options] <command> [options]
+
+Global options:
+  -v, --verbose                   Show debug logs, repeat (-vv) for trace logs
+  -q, --quiet                     Only show errors
+  --log-file <path>               Also append logs to this file
+  --trace                         Dump every USB and serial transfer with decoded frames and messages
+  --trace-file <path>             Write the transfer dump to a file instead of stderr
+  --trace-limit <bytes>           Bytes dumped per transfer (default: all)
+  --events <path>                 Record every device message and transport event as JSON lines
+  --profile <name>                Device profile to use (default: selected from the device)
+  --profiles <file>               Register additional device profiles from a JSON file
+  --detach-kernel-driver          Detach cdc_acm from the interfaces while the USB path is in use and
+                                  reattach it afterwards, so serial mode works again without replugging (Linux)
+  -o, --output <format>           Output format: text or json, human readable output moves to stderr
+  --config <file>                 Config file (default: tensor-usbdl/config.json in the user config directory)
 
 Commands:
-  flash <bootloader_path> [mode]  Flash bootloader to GS101 device
+  flash <bootloader_path> [mode]  Flash bootloader to GS101 device, - reads it from stdin
+                                  A factory image zip flashes the profile's boot chain from its bootloader,
+                                  a manifest (.json) its images; http(s):// and file:// URIs are fetched
                                   Modes: serial, usb, auto (default: auto)
   detect                          Detect and list compatible devices
-  test                            Test USB endpoints communication
+  descriptors [--all]             Dump the USB descriptor tree and the endpoint layout in use
+  test                            Run the GS101 endpoint probe suite with a pass/fail report
+  console [usb|serial]            Interactive protocol console (default: usb)
+  profiles [--json]               List the device profiles, optionally as JSON
+  config [show|path]              Print the effective configuration or the config file path
+  doctor                          Check USB and serial permissions, kernel drivers and ModemManager (Linux)
+  manifest keygen <name>          Create a signing key pair, <name>.key and <name>.pub
+  manifest sign <manifest>        Write a detached signature, <manifest>.minisig, with --key <name>.key
+  manifest verify <manifest>      Check a manifest's signature against the trusted keys, or --key <name>.pub
+  history [session] [filters]     List the flash sessions in the audit log, or everything recorded about one
+  report [session...] [filters]   Render the latest session, the given ones or the filtered ones to HTML or Markdown
+
+Flash options (USB mode):
+  --retries <n>                   Attempts per transfer, including the first (default: 3)
+  --backoff <duration>            Delay before the first retry, doubled per retry (default: 0s)
+  --max-backoff <duration>        Upper bound for the retry delay (default: none)
+  --recovery <actions>            Recovery actions between attempts, the last one repeats:
+                                  clear-halt, port-reset, reenumerate (default: clear-halt,reenumerate)
+  --resume                        Resume a stage from the last sent offset after re-enumeration,
+                                  unless the device asks for the stage again (best-effort)
+  --simulate                      Flash against the built-in device simulator
+  --simulate-stall <n,...>        Bulk OUT transfers the simulator stalls on
+  --simulate-resumable            The simulator keeps partial stages across re-enumeration
+  --stage <name>                  Stage name of the image (default: from the file name, required for -),
+                                  or the only stage flashed from a factory image or manifest
+  --offline                       Only use cached images and manifests
+  --require-signature             Refuse manifests without a valid signature from a trusted key
+  --operator <name>               Operator recorded in the audit log (default: the current user)
+  --batch <name>                  Batch the session belongs to, for reports
+
+History and report options:
+  --device <id>                   Sessions with a device whose serial number or chip ID starts with this
+  --stage <name>, --sha256 <hex>  Sessions that flashed this stage, or an image with this digest (prefix)
+  --outcome <outcome>             Sessions with this outcome: accepted, "rejected header", "boot failure", ...
+  --operator <name>               Sessions of this operator
+  --batch <name>                  Sessions of this batch
+  --since <time>, --until <time>  Sessions started in this range, as a date, RFC 3339 time or duration ago
+  --limit <n>                     Only the most recent sessions
+  --file <path>                   Audit log to read (default: the configured one)
+  --json                          Print the records as JSON (history)
+  --format <html|markdown>        Report format (default: from the --out extension, else markdown)
+  --out <file>                    Report file, - for stdout (default: report-<time>.md or .html)
+  --title <text>                  Report title
+
+Test options:
+  --script <file>                 Run a probe script (JSON) instead of the bundled GS101 suite
+  --simulate                      Run against the built-in device simulator
+
+Console options:
+  --script <file>                 Run console commands from a file, stopping at the first failure
+  --simulate                      Open the built-in device simulator (usb)
+
+Doctor options:
+  --udev                          Print udev rules for the registered profiles
+  --udev-file <file>              Write the udev rules to a file
+  --group <name>                  Also grant this group access in the udev rules
 
 Examples:
   tensor-usbdl flash pbl.img              # Auto-detect mode
   tensor-usbdl flash pbl.img usb          # Force USB bulk mode  
   tensor-usbdl flash pbl.img serial       # Force serial DNW mode
+  tensor-usbdl flash abl.img usb --retries 5 --backoff 200ms --recovery clear-halt,port-reset,reenumerate
+  tensor-usbdl -v --log-file flash.log flash abl.img usb
+  tensor-usbdl --trace-file bl1.trace --trace-limit 64 flash bl1.img usb
+  cat bl1.img | tensor-usbdl flash - usb --stage bl1
+  tensor-usbdl flash bluejay-factory.zip usb --stage bl2
+  tensor-usbdl flash https://artifacts.example/bluejay/manifest.json usb
+  tensor-usbdl manifest sign manifest.json --key release.key
+  tensor-usbdl history --device 09845001 --since 720h
+  tensor-usbdl report --batch rma-42 --out rma-42.html
   tensor-usbdl detect                     # List devices
   tensor-usbdl test                       # Test endpoints
+  tensor-usbdl console usb                # Poke the device by hand
+  tensor-usbdl doctor                     # Why can't I open the device?
+  tensor-usbdl --profiles my.json --profile zuma-dev flash bl1.img usb
 
 Supported bootloader files:
   - pbl.img (Primary bootloader)
@@ -112,240 +413,326 @@ Supported bootloader files:
   - abl.img (Android bootloader)
   - tzsw.img (TrustZone)
   - ldfw.img, gsa.img
+
+Exit codes (flash):
+  0  Stage accepted (eub:ack or next eub:req)
+  1  Failed before the device responded (nothing was sent)
+  2  Stage rejected (eub:nak or header fail)
+  3  Boot failure reported by the device
+  4  Device disconnected
+  5  No conclusive response
 `)
 }
 
-func flashBootloader(bootloaderPath string, mode FlashMode) error {
-	// Check if file exists
-	if _, err := os.Stat(bootloaderPath); os.IsNotExist(err) {
-		return fmt.Errorf("bootloader file not found: %s", bootloaderPath)
+// FlashSummary is the machine readable result of a flash, printed with --output json
+type FlashSummary struct {
+	Image    string `json:"image"`
+	Stage    string `json:"stage"`
+	Outcome  string `json:"outcome"`
+	Message  string `json:"message,omitempty"`
+	Error    string `json:"error,omitempty"`
+	ExitCode int    `json:"exit_code"`
+	Session  string `json:"session,omitempty"` // Audit log session
+}
+
+func newFlashSummary(image, stage string, res *tensorutils.Result, err error) *FlashSummary {
+	summary := &FlashSummary{Image: image, Stage: stage, Outcome: "error", ExitCode: exitCode(res)}
+	if res != nil {
+		if res.Stage != "" {
+			summary.Stage = res.Stage
+		}
+		summary.Outcome = res.Outcome.String()
+		if res.Message != nil {
+			summary.Message = res.Message.String()
+		}
+	}
+	if err != nil {
+		summary.Error = err.Error()
+	}
+	return summary
+}
+
+// exitCode maps the result of a flash to the process exit code
+func exitCode(res *tensorutils.Result) int {
+	if res == nil {
+		return ExitError
+	}
+	switch res.Outcome {
+	case tensorutils.OutcomeAccepted:
+		return ExitAccepted
+	case tensorutils.OutcomeRejectedHeader:
+		return ExitRejectedHeader
+	case tensorutils.OutcomeBootFailure:
+		return ExitBootFailure
+	case tensorutils.OutcomeDisconnected:
+		return ExitDisconnected
+	}
+	return ExitUnknown
+}
+
+func flashBootloader(bootloaderPath string, opts *FlashOptions) (*tensorutils.Result, error) {
+	if isManifest(bootloaderPath) {
+		return flashManifest(bootloaderPath, opts)
+	}
+	if bootloaderPath != "-" && tensorutils.IsFactoryImage(bootloaderPath) {
+		return flashFactory(bootloaderPath, opts)
+	}
+	
+	name := filepath.Base(bootloaderPath)
+	if bootloaderPath == "-" {
+		if opts.Stage == "" {
+			return nil, fmt.Errorf("reading the bootloader from stdin requires --stage")
+		}
+		name = "stdin"
 	}
 	
-	// Read bootloader data
-	data, err := ioutil.ReadFile(bootloaderPath)
+	// Open bootloader, it is read as it is sent
+	img, err := tensorutils.OpenImage(bootloaderPath)
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("bootloader file not found: %s", bootloaderPath)
+	}
 	if err != nil {
-		return fmt.Errorf("failed to read bootloader: %v", err)
+		return nil, fmt.Errorf("failed to open bootloader: %v", err)
 	}
+	defer img.Close()
+	img.Name = opts.stage(bootloaderPath)
 	
-	fmt.Printf("Loaded bootloader: %s (%d bytes)\n", filepath.Base(bootloaderPath), len(data))
+	fmt.Fprintf(stdout, "Loaded bootloader: %s (%d bytes)\n", name, img.Size)
+	return flashImage(img, opts)
+}
+
+// flashImage flashes a stage over the transport chosen by the mode, recording it in the audit session
+func flashImage(img *tensorutils.Image, opts *FlashOptions) (res *tensorutils.Result, err error) {
+	if opts.Audit != nil {
+		done := opts.Audit.beginStage(img)
+		defer func() { done(res, err) }()
+	}
 	
 	// Try flashing based on mode
-	switch mode {
+	switch opts.Mode {
 	case ModeUSB:
-		return flashUSB(data, bootloaderPath)
+		return flashUSB(img, opts, nil)
 		
 	case ModeSerial:
-		return flashSerial(data, bootloaderPath)
+		return flashSerial(img, opts)
 		
 	case ModeAuto:
-		// Try USB first (more direct), then fallback to serial
-		fmt.Println("Auto-mode: Trying USB bulk transfer first...")
-		err := flashUSB(data, bootloaderPath)
-		if err != nil {
-			fmt.Printf("USB mode failed (%v), trying serial mode...\n", err)
-			return flashSerial(data, bootloaderPath)  
-		}
-		return nil
+		// Probe both transports without sending anything, then flash over the better one
+		return flashAuto(img, opts)
 		
 	default:
-		return fmt.Errorf("unknown flash mode")
+		return nil, fmt.Errorf("unknown flash mode")
 	}
 }
 
-// resetAndReconnect attempts to reset the device and re-establish a connection.
-func resetAndReconnect() (*tensorutils.GS101Device, error) {
-	ctx := gousb.NewContext()
-	
-	devs, err := ctx.OpenDevices(func(desc *gousb.DeviceDesc) bool {
-		return desc.Vendor == gousb.ID(tensorutils.GS101_VID) && desc.Product == gousb.ID(tensorutils.GS101_PID)
-	})
-	if err != nil {
-		ctx.Close()
-		return nil, fmt.Errorf("error opening devices for reset: %w", err)
-	}
-	if len(devs) == 0 {
-		ctx.Close()
-		return nil, fmt.Errorf("no GS101 device found for reset")
-	}
-	dev := devs[0]
-	for _, d := range devs[1:] {
-		d.Close()
-	}
+// stageName derives the boot stage name from an image path, i.e. ../gs101/bl1.img -> bl1
+func stageName(path string) string {
+	base := filepath.Base(path)
+	return strings.TrimSuffix(base, filepath.Ext(base))
+}
 
-	fmt.Println("Attempting a full USB device reset...")
-	if err := dev.Reset(); err != nil {
-		dev.Close()
-		ctx.Close()
-		return nil, fmt.Errorf("failed to reset device: %w", err)
+// openFlashUSB opens the USB device for flashing a stage, or a simulator if the options ask for one
+func openFlashUSB(opts *FlashOptions, stage string) (*tensorutils.GS101Device, error) {
+	var sim *tensorutils.Simulator
+	if opts.Simulate {
+		sim = tensorutils.NewSimulator(stage)
+		sim.StallAt = opts.SimulateStalls
+		sim.Resumable = opts.SimulateResume
 	}
-	dev.Close() // Close the device after reset
-	ctx.Close() // Close the context
-
-	// Wait for the device to re-enumerate
-	time.Sleep(2 * time.Second)
-
-	fmt.Println("✅ Device reset successful. Reconnecting...")
-	return tensorutils.NewGS101Device()
+	return openUSB(sim)
 }
 
-func flashUSB(data []byte, bootloaderPath string) error {
-	fmt.Println("=== USB Bulk Transfer Mode ===")
-	fmt.Println("Using endpoints from keyholes.txt analysis:")
-	fmt.Println("- OUT: 0x02 (Bulk, 512 bytes)")  
-	fmt.Println("- IN:  0x81 (Bulk, 512 bytes)")
-	fmt.Println("- INT: 0x83 (Interrupt, 10 bytes)")
+// flashUSB flashes a stage over the USB bulk path, using gs101 if it was already opened
+func flashUSB(img *tensorutils.Image, opts *FlashOptions, gs101 *tensorutils.GS101Device) (*tensorutils.Result, error) {
+	fmt.Fprintln(stdout, "=== USB Bulk Transfer Mode ===")
 	
 	// Create GS101 USB device
-	gs101, err := tensorutils.NewGS101Device()
-	if err != nil {
-		return fmt.Errorf("failed to connect to GS101 device: %v", err)
+	stage := img.Name
+	if gs101 == nil {
+		var err error
+		if gs101, err = openFlashUSB(opts, stage); err != nil {
+			if errors.Is(err, tensorutils.ErrBusy) {
+				fmt.Fprintln(stdout, "❌ A kernel driver (usually cdc_acm) holds the interface, rerun with --detach-kernel-driver or use serial mode")
+			}
+			return nil, notSentError{fmt.Errorf("failed to connect to GS101 device: %w", err)}
+		}
 	}
 	defer gs101.Close()
 	
-	fmt.Println("Connected to:", gs101.GetDeviceInfo())
+	fmt.Fprintln(stdout, "Connected to:", gs101.GetDeviceInfo())
+	profile := gs101.Profile()
+	fmt.Fprintln(stdout, "Profile:", profile)
+	if opts.Audit != nil {
+		opts.Audit.record.Profile = profile.Name
+	}
+	fmt.Fprintln(stdout, "Endpoints:", gs101.Layout())
+	if opts.Profile != nil && profile != opts.Profile {
+		return nil, notSentError{fmt.Errorf("the device uses the %s profile but the image is for %s", profile.Name, opts.Profile.Name)}
+	}
+	if !profile.HasStage(stage) {
+		fmt.Fprintf(stdout, "⚠️  Stage %s is not part of the %s boot chain (%s)\n", stage, profile.Name, strings.Join(profile.Stages, ", "))
+	}
+	gs101.Retry = opts.Retry
+	fmt.Fprintln(stdout, "Retry policy:", gs101.Retry)
 	
-	// Send bootloader  
-	err = gs101.WriteBootloader(data)
+	// Only look at responses to this stage
+	if err := gs101.Skip(); err != nil {
+		return nil, notSentError{fmt.Errorf("failed to discard stale messages: %w", err)}
+	}
+	
+	// Send bootloader, recovering from stalls according to the retry policy
+	err := gs101.WriteStageFrom(stage, img, img.Size)
+	progress := gs101.Progress()
+	fmt.Fprintln(stdout, "Progress:", progress)
+	opts.Audit.setSent(int64(progress.Sent))
 	if err != nil {
-		// Check if the error is a severe stall
-		if err == tensorutils.ErrStall {
-			fmt.Println("A severe stall was detected. Attempting to reset the device and retry.")
-			gs101.Close() // Must close the device before resetting
-			
-			gs101, err = resetAndReconnect()
-			if err != nil {
-				return fmt.Errorf("failed to reset and reconnect: %w", err)
-			}
-			defer gs101.Close() // Defer closing the new device
-
-			// Retry the bootloader write on the new connection
-			fmt.Println("Retrying bootloader flash on the reset device...")
-			if err := gs101.WriteBootloader(data); err != nil {
-				return fmt.Errorf("failed to write bootloader after reset: %w", err)
-			}
-		} else {
-			return fmt.Errorf("failed to write bootloader: %w", err)
+		var requestErr *tensorutils.StageRequestError
+		if errors.As(err, &requestErr) {
+			fmt.Fprintf(stdout, "❌ The device restarted its boot chain and now wants stage %s, flash that stage first\n", requestErr.Requested)
 		}
+		err = fmt.Errorf("failed to write bootloader: %w", err)
+		res := tensorutils.Classify(stage, nil, err)
+		if res.Outcome == tensorutils.OutcomeUnknown && progress.Sent == 0 && progress.Restarts == 0 && progress.Resumes == 0 {
+			// Nothing reached the device, so this is a failure before it could respond and another transport may be tried
+			return nil, notSentError{err}
+		}
+		return res, err
 	}
 	
-	// Read response/status
-	fmt.Println("Reading device response...")
-	status, err := gs101.ReadInterrupt()
-	if err != nil {
-		fmt.Printf("Warning: could not read status: %v\n", err)
-	} else {
-		fmt.Printf("Device response (%d bytes): %x\n", len(status), status)
+	// Finalize the stage and evaluate the device's response
+	fmt.Fprintf(stdout, "Sending stop frame for stage %s...\n", stage)
+	res := gs101.Finalize(stage)
+	if res.Notification != nil {
+		fmt.Fprintf(stdout, "Device status (%d bytes): %x\n", len(res.Notification), res.Notification)
+	}
+	if !res.Accepted() {
+		fmt.Fprintf(stdout, "❌ USB flash failed: %s\n", res)
+		return res, res.Err
 	}
 	
-	fmt.Println("✅ USB flash completed successfully!")
-	return nil
+	fmt.Fprintf(stdout, "✅ USB flash completed successfully! %s\n", res)
+	return res, nil
 }
 
-func flashSerial(data []byte, bootloaderPath string) error {
-	fmt.Println("=== Serial DNW Mode ===")
-	fmt.Println("Using CDC-ACM serial communication (115200 baud)")
+func flashSerial(img *tensorutils.Image, opts *FlashOptions) (*tensorutils.Result, error) {
+	fmt.Fprintln(stdout, "=== Serial DNW Mode ===")
+	fmt.Fprintln(stdout, "Using CDC-ACM serial communication (115200 baud)")
 	
 	// Get DNW device (original implementation)
 	dnw, err := tensorutils.GetDNW()
 	if err != nil {
-		return fmt.Errorf("failed to get DNW device: %v", err)
+		return nil, notSentError{fmt.Errorf("failed to get DNW device: %w", err)}
 	}
 	defer dnw.Close()
 	
-	fmt.Printf("Connected to DNW device: %s (VID:PID = %s)\n", dnw.GetPort(), dnw.GetID())
+	fmt.Fprintf(stdout, "Connected to DNW device: %s (VID:PID = %s)\n", dnw.GetPort(), dnw.GetID())
 	
-	// Create DNW command with bootloader data
-	cmd := tensorutils.NewCommand(tensorutils.OpDNW, nil, data, nil)
+	// Create DNW command streaming the bootloader data
+	cmd := tensorutils.NewCommandFrom(tensorutils.OpDNW, nil, img, img.Size, nil)
 	
+	// Only look at responses to this stage
+	if err := dnw.Skip(); err != nil {
+		return nil, notSentError{fmt.Errorf("failed to discard stale DNW messages: %w", err)}
+	}
+
 	// Send command
+	stage := img.Name
 	err = dnw.WriteCmd(cmd)
+	// Only count the image, not the command header around it
+	header := int64(cmd.Len() - cmd.DataLen() - cmd.CRCLen())
+	opts.Audit.setSent(min(max(dnw.Sent()-header, 0), img.Size))
 	if err != nil {
-		return fmt.Errorf("failed to send DNW command: %v", err)
+		err = fmt.Errorf("failed to send DNW command: %v", err)
+		res := tensorutils.Classify(stage, nil, err)
+		if dnw.Closed() {
+			res.Outcome = tensorutils.OutcomeDisconnected
+		}
+		return res, err
 	}
 	
-	// Read response
-	fmt.Println("Reading DNW response...")
-	msg, err := dnw.ReadMsg()
-	if err != nil {
-		fmt.Printf("Warning: could not read DNW response: %v\n", err)
-	} else if msg != nil {
-		fmt.Printf("DNW response: %s\n", msg.String())
+	// Finalize the stage and evaluate the device's response
+	fmt.Fprintf(stdout, "Sending stop frame for stage %s...\n", stage)
+	res := dnw.Finalize(stage)
+	if !res.Accepted() {
+		fmt.Fprintf(stdout, "❌ Serial flash failed: %s\n", res)
+		return res, res.Err
 	}
 	
-	fmt.Println("✅ Serial flash completed successfully!")
-	return nil
+	fmt.Fprintf(stdout, "✅ Serial flash completed successfully! %s\n", res)
+	return res, nil
 }
 
 func detectDevices() {
-	fmt.Println("=== Device Detection ===")
+	fmt.Fprintln(stdout, "=== Device Detection ===")
 	
 	// Try USB detection
-	fmt.Println("\nScanning for GS101 USB devices...")
-	gs101, err := tensorutils.NewGS101Device()
+	fmt.Fprintln(stdout, "\nScanning for USB boot ROM devices...")
+	gs101, err := openUSB(nil)
 	if err != nil {
-		fmt.Printf("❌ GS101 USB device not found: %v\n", err)
+		fmt.Fprintf(stdout, "❌ USB boot ROM device not found: %v\n", err)
 	} else {
-		fmt.Printf("✅ Found GS101 USB device: %s\n", gs101.GetDeviceInfo())
+		fmt.Fprintf(stdout, "✅ Found USB boot ROM device: %s (profile %s)\n", gs101.GetDeviceInfo(), gs101.Profile().Name)
 		gs101.Close()
 	}
 	
 	// Try serial detection  
-	fmt.Println("\nScanning for DNW serial devices...")
+	fmt.Fprintln(stdout, "\nScanning for DNW serial devices...")
 	dnw, err := tensorutils.GetDNW()
 	if err != nil {
-		fmt.Printf("❌ DNW serial device not found: %v\n", err)
+		fmt.Fprintf(stdout, "❌ DNW serial device not found: %v\n", err)
 	} else {
-		fmt.Printf("✅ Found DNW device: %s (VID:PID = %s, Serial: %s)\n", 
+		fmt.Fprintf(stdout, "✅ Found DNW device: %s (VID:PID = %s, Serial: %s)\n", 
 			dnw.GetPort(), dnw.GetID(), dnw.GetSerial())
 		dnw.Close()
 	}
 }
 
-func testEndpoints() {
-	fmt.Println("=== USB Endpoints Test ===")
-	fmt.Println("Testing endpoints discovered in keyholes.txt analysis")
-	
-	gs101, err := tensorutils.NewGS101Device()
-	if err != nil {
-		fmt.Printf("❌ Cannot connect to GS101 device: %v\n", err)
-		return
+// testEndpoints runs a probe script, or the bundled GS101 suite, and prints a pass/fail report
+func testEndpoints(arguments []string) (bool, error) {
+	fs := pflag.NewFlagSet("test", pflag.ContinueOnError)
+	script := fs.String("script", "", "probe script to run instead of the bundled GS101 suite")
+	simulate := fs.Bool("simulate", false, "run against the built-in device simulator")
+	if err := fs.Parse(arguments); err != nil {
+		return false, err
+	}
+
+	probe, err := tensorutils.DefaultProbe()
+	if *script != "" {
+		probe, err = tensorutils.LoadProbe(*script)
 	}
-	defer gs101.Close()
-	
-	fmt.Printf("✅ Connected: %s\n", gs101.GetDeviceInfo())
-	
-	// Test write
-	fmt.Println("\nTesting Bulk OUT (0x02)...")
-	testData := []byte("TENSOR-TEST-PACKET")
-	n, err := gs101.Write(testData)
 	if err != nil {
-		fmt.Printf("❌ Write test failed: %v\n", err)
-		if err == tensorutils.ErrStall {
-			fmt.Println("Write failed due to severe stall. Please re-run the test to see if a device reset is required.")
-			return
-		}
-	} else {
-		fmt.Printf("✅ Write test passed: %d bytes sent\n", n)
+		return false, fmt.Errorf("failed to load probe script: %w", err)
 	}
+	fmt.Fprintf(stdout, "=== %s ===\n", probe.Name)
 	
-	// Test read
-	fmt.Println("\nTesting Bulk IN (0x81)...")
-	buf := make([]byte, 512)
-	n, err = gs101.Read(buf)
+	var sim *tensorutils.Simulator
+	if *simulate {
+		sim = tensorutils.NewSimulator("bl1")
+	}
+	gs101, err := openUSB(sim)
 	if err != nil {
-		fmt.Printf("⚠️  Read test failed (may be normal): %v\n", err)
-	} else {
-		fmt.Printf("✅ Read test passed: %d bytes received: %x\n", n, buf[:n])
+		return false, fmt.Errorf("cannot connect to GS101 device: %w", err)
 	}
+	defer gs101.Close()
 	
-	// Test interrupt
-	fmt.Println("\nTesting Interrupt IN (0x83)...")
-	intData, err := gs101.ReadInterrupt()
-	if err != nil {
-		fmt.Printf("⚠️  Interrupt test failed (may be normal): %v\n", err)
-	} else {
-		fmt.Printf("✅ Interrupt test passed: %d bytes received: %x\n", len(intData), intData)
+	fmt.Fprintf(stdout, "✅ Connected: %s\n\n", gs101.GetDeviceInfo())
+	
+	gs101.Retry = tensorutils.ProbeRetryPolicy
+	report := gs101.RunProbe(probe)
+	for i, res := range report.Results {
+		icon := map[tensorutils.ProbeStatus]string{tensorutils.ProbePass: "✅", tensorutils.ProbeWarn: "⚠️ ", tensorutils.ProbeFail: "❌"}[res.Status]
+		fmt.Fprintf(stdout, "%s %s  %d. %s (%s)\n", icon, res.Status, i+1, res.Step.Name, res.Elapsed.Round(time.Millisecond))
+		if res.Reason != "" {
+			fmt.Fprintf(stdout, "      %s\n", res.Reason)
+		}
+		if len(res.Data) > 0 && res.Step.Op != tensorutils.ProbeWrite {
+			fmt.Fprint(stdout, tensorutils.HexDump(res.Data, "      "))
+			for _, note := range tensorutils.Annotate(res.Data) {
+				fmt.Fprintln(stdout, "      =", note)
+			}
+		}
 	}
 	
-	fmt.Println("\n🎯 Endpoints test completed.")
+	fmt.Fprintf(stdout, "\n🎯 %d passed, %d warnings, %d failed\n", report.Count(tensorutils.ProbePass), report.Count(tensorutils.ProbeWarn), report.Count(tensorutils.ProbeFail))
+	return report.Passed(), nil
 }
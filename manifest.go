@@ -0,0 +1,300 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/JoshuaDoes/tensor-usbdl/tensorutils"
+	"github.com/spf13/pflag"
+)
+
+// Manifest describes a vetted set of images with their digests, published next to them on an artifact server
+type Manifest struct {
+	Name    string          `json:"name,omitempty"`
+	Profile string          `json:"profile,omitempty"` // Profile the images are built for
+	Images  []ManifestImage `json:"images"`            // In flashing order
+
+	source string // Where the manifest was read from, relative image URIs are resolved against it
+	raw    []byte // The manifest as read, which is what gets signed
+}
+
+// ManifestImage is one stage of a manifest
+type ManifestImage struct {
+	Stage  string `json:"stage"`
+	URI    string `json:"uri"` // http(s)://, file:// or a path, relative ones are resolved against the manifest
+	SHA256 string `json:"sha256"`
+	Size   int64  `json:"size,omitempty"`
+}
+
+// isManifest reports whether an image source is a manifest rather than an image
+func isManifest(source string) bool {
+	if u, err := url.Parse(source); err == nil && isRemote(source) {
+		source = u.Path
+	}
+	return strings.EqualFold(filepath.Ext(source), ".json")
+}
+
+// loadManifest reads a manifest from a path or a URI, fetching it through the cache
+func loadManifest(source string, cache *ImageCache) (*Manifest, error) {
+	path, err := cache.Resolve(source, "")
+	if err != nil {
+		return nil, err
+	}
+	p, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	manifest := &Manifest{source: source, raw: p}
+	dec := json.NewDecoder(strings.NewReader(string(p)))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(manifest); err != nil {
+		return nil, fmt.Errorf("manifest %s: %w", source, err)
+	}
+	if err := manifest.validate(); err != nil {
+		return nil, fmt.Errorf("manifest %s: %w", source, err)
+	}
+	return manifest, nil
+}
+
+func (manifest *Manifest) validate() error {
+	if len(manifest.Images) == 0 {
+		return fmt.Errorf("no images")
+	}
+	for i, image := range manifest.Images {
+		if image.Stage == "" || image.URI == "" {
+			return fmt.Errorf("image %d needs a stage and a uri", i+1)
+		}
+		if digest, err := hex.DecodeString(image.SHA256); err != nil || len(digest) != 32 {
+			return fmt.Errorf("image %s: sha256 must be 64 hex digits", image.Stage)
+		}
+	}
+	return nil
+}
+
+// resolve returns the URI or path of an image, resolving relative references against the manifest
+func (manifest *Manifest) resolve(ref string) (string, error) {
+	if isRemote(ref) || filepath.IsAbs(ref) {
+		return ref, nil
+	}
+	if isRemote(manifest.source) {
+		base, err := url.Parse(manifest.source)
+		if err != nil {
+			return "", err
+		}
+		rel, err := url.Parse(ref)
+		if err != nil {
+			return "", err
+		}
+		return base.ResolveReference(rel).String(), nil
+	}
+	return filepath.Join(filepath.Dir(manifest.source), filepath.FromSlash(ref)), nil
+}
+
+// flashManifest fetches every image of a manifest and verifies its digest before flashing the images in order,
+// or only the one named with --stage
+func flashManifest(source string, opts *FlashOptions) (*tensorutils.Result, error) {
+	manifest, err := loadManifest(source, opts.Cache)
+	if err != nil {
+		return nil, err
+	}
+	name := manifest.Name
+	if name == "" {
+		name = source
+	}
+	fmt.Fprintf(stdout, "Manifest: %s (%d images)\n", name, len(manifest.Images))
+	if err := verifyManifest(manifest, opts.Cache, opts.TrustedKeys, opts.RequireSig); err != nil {
+		return nil, err
+	}
+
+	profile := selectedProfile
+	if manifest.Profile != "" {
+		if profile == nil {
+			profile = tensorutils.GetProfile(manifest.Profile)
+		}
+		if profile == nil || !strings.EqualFold(profile.Name, manifest.Profile) {
+			return nil, fmt.Errorf("the manifest is for the %s profile", manifest.Profile)
+		}
+	}
+	opts.Profile = profile
+
+	images := manifest.Images
+	if opts.Stage != "" {
+		images = nil
+		for _, image := range manifest.Images {
+			if strings.EqualFold(image.Stage, opts.Stage) {
+				images = append(images, image)
+			}
+		}
+		if len(images) == 0 {
+			return nil, fmt.Errorf("no stage %s in the manifest", opts.Stage)
+		}
+	}
+
+	// Fetch and verify everything before talking to the device
+	paths := make([]string, len(images))
+	for i, image := range images {
+		uri, err := manifest.resolve(image.URI)
+		if err != nil {
+			return nil, fmt.Errorf("stage %s: %w", image.Stage, err)
+		}
+		if paths[i], err = opts.Cache.Resolve(uri, image.SHA256); err != nil {
+			return nil, fmt.Errorf("stage %s: %w", image.Stage, err)
+		}
+		if image.Size > 0 {
+			if stat, err := os.Stat(paths[i]); err != nil || stat.Size() != image.Size {
+				return nil, fmt.Errorf("stage %s: size mismatch, expected %d bytes", image.Stage, image.Size)
+			}
+		}
+		fmt.Fprintf(stdout, "✅ %s verified (sha256 %s)\n", image.Stage, strings.ToLower(image.SHA256))
+	}
+
+	var res *tensorutils.Result
+	for i, image := range images {
+		img, err := tensorutils.OpenImage(paths[i])
+		if err != nil {
+			return res, fmt.Errorf("stage %s: %w", image.Stage, err)
+		}
+		img.Name = image.Stage
+		fmt.Fprintf(stdout, "\n--- Stage %s (%d/%d, %d bytes) ---\n", img.Name, i+1, len(images), img.Size)
+		res, err = flashImage(img, opts)
+		img.Close()
+		if err != nil {
+			return res, fmt.Errorf("stage %s: %w", image.Stage, err)
+		}
+	}
+	return res, nil
+}
+
+// verifyManifest checks the detached signature next to a manifest against the trusted keys, before anything is
+// fetched for it or sent to the device. Unsigned manifests are only accepted if no signature is required.
+func verifyManifest(manifest *Manifest, cache *ImageCache, trusted []string, require bool) error {
+	sig, err := readSignature(manifest.source+SIGNATURE_SUFFIX, cache)
+	if errors.Is(err, fs.ErrNotExist) {
+		if require {
+			return fmt.Errorf("the manifest is not signed and a signature is required")
+		}
+		fmt.Fprintln(stdout, "⚠️  The manifest is not signed")
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	keys, err := loadTrustedKeys(trusted)
+	if err != nil {
+		return err
+	}
+	if len(keys) == 0 {
+		return fmt.Errorf("the manifest is signed by key %s but no trusted keys are configured", keyID(sig.keyID))
+	}
+	pk, err := sig.verify(manifest.raw, keys)
+	if err != nil {
+		return fmt.Errorf("manifest signature: %w", err)
+	}
+	fmt.Fprintf(stdout, "🔏 Manifest signed by trusted key %s (%s)\n", pk.ID(), sig.trustedComment)
+	return nil
+}
+
+// readSignature reads a detached signature from a path or a URI
+func readSignature(source string, cache *ImageCache) (*signature, error) {
+	path, err := cache.Resolve(source, "")
+	if err != nil {
+		return nil, err
+	}
+	p, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	sig, err := parseSignature(string(p))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", source, err)
+	}
+	return sig, nil
+}
+
+// runManifest implements the manifest command
+func runManifest(arguments []string, cfg *Config) error {
+	if len(arguments) < 1 {
+		return fmt.Errorf("usage: manifest keygen <name> | sign <manifest> --key <secret key> | verify <manifest> [--key <public key>]")
+	}
+	fs := pflag.NewFlagSet("manifest", pflag.ContinueOnError)
+	keys := fs.StringSlice("key", nil, "secret key to sign with, or public keys to verify against instead of the trusted keys")
+	offline := fs.Bool("offline", cfg.Offline, "only use cached manifests")
+	if err := fs.Parse(arguments[1:]); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return fmt.Errorf("manifest %s takes exactly one argument", arguments[0])
+	}
+	arg := fs.Arg(0)
+
+	switch arguments[0] {
+	case "keygen":
+		sk, err := generateKey()
+		if err != nil {
+			return err
+		}
+		if err := writeNew(arg+".key", sk.encode(), 0600); err != nil {
+			return err
+		}
+		if err := writeNew(arg+".pub", sk.public().encode(), 0644); err != nil {
+			return err
+		}
+		fmt.Fprintf(stdout, "✅ Key %s written to %s.key, add %s.pub to trusted_keys to trust it\n", keyID(sk.id), arg, arg)
+		return nil
+
+	case "sign":
+		if len(*keys) != 1 {
+			return fmt.Errorf("manifest sign needs the secret key to sign with, given with --key")
+		}
+		p, err := os.ReadFile((*keys)[0])
+		if err != nil {
+			return err
+		}
+		sk, err := parseSecretKey(string(p))
+		if err != nil {
+			return fmt.Errorf("%s: %w", (*keys)[0], err)
+		}
+		manifest, err := loadManifest(arg, newImageCache(cfg.CacheDir, true))
+		if err != nil {
+			return err
+		}
+		sig := sk.sign(manifest.raw, trustedComment(filepath.Base(arg)))
+		if err := os.WriteFile(arg+SIGNATURE_SUFFIX, sig, 0644); err != nil {
+			return err
+		}
+		fmt.Fprintf(stdout, "✅ Signed %s with key %s, signature written to %s\n", arg, keyID(sk.id), arg+SIGNATURE_SUFFIX)
+		return nil
+
+	case "verify":
+		trusted := cfg.TrustedKeys
+		if len(*keys) > 0 {
+			trusted = *keys
+		}
+		manifest, err := loadManifest(arg, newImageCache(cfg.CacheDir, *offline))
+		if err != nil {
+			return err
+		}
+		return verifyManifest(manifest, newImageCache(cfg.CacheDir, *offline), trusted, true)
+	}
+	return fmt.Errorf("unknown manifest command '%s'", arguments[0])
+}
+
+// writeNew writes a file that must not exist yet
+func writeNew(path string, p []byte, perm os.FileMode) error {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(p); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
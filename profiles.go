@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/JoshuaDoes/tensor-usbdl/tensorutils"
+	"github.com/spf13/pflag"
+)
+
+// selectedProfile is the profile chosen with --profile, nil to select one from the device
+var selectedProfile *tensorutils.Profile
+
+// setupProfiles registers user profiles and resolves the profile chosen on the command line or in the config
+func setupProfiles(opts *GlobalOptions, cfg *Config) error {
+	for i := len(cfg.Profiles) - 1; i >= 0; i-- {
+		if err := tensorutils.RegisterProfile(cfg.Profiles[i]); err != nil {
+			return fmt.Errorf("failed to register profile from config: %w", err)
+		}
+	}
+	if opts.ProfilesFile != "" {
+		if _, err := tensorutils.LoadProfiles(opts.ProfilesFile); err != nil {
+			return fmt.Errorf("failed to load profiles: %w", err)
+		}
+	}
+	if opts.Profile != "" {
+		selectedProfile = tensorutils.GetProfile(opts.Profile)
+		if selectedProfile == nil {
+			return fmt.Errorf("unknown profile '%s', see the profiles command", opts.Profile)
+		}
+	}
+	return nil
+}
+
+// openUSB opens the USB device with the selected profile, or the simulator if one is given
+func openUSB(sim *tensorutils.Simulator) (*tensorutils.GS101Device, error) {
+	if sim != nil {
+		sim.Profile = selectedProfile
+		return sim.Open()
+	}
+	return tensorutils.NewDeviceWithProfile(selectedProfile)
+}
+
+// listProfiles prints every registered profile, or dumps them as JSON to use as a starting point for user profiles
+func listProfiles(arguments []string) error {
+	fs := pflag.NewFlagSet("profiles", pflag.ContinueOnError)
+	asJSON := fs.Bool("json", false, "print the profiles in the format read by --profiles")
+	if err := fs.Parse(arguments); err != nil {
+		return err
+	}
+
+	profiles := tensorutils.Profiles()
+	if *asJSON || outputJSON {
+		return printJSON(profiles)
+	}
+
+	fmt.Fprintln(stdout, "=== Device Profiles ===")
+	for _, profile := range profiles {
+		marker := " "
+		if profile == selectedProfile {
+			marker = "*"
+		}
+		fmt.Fprintf(stdout, "%s %s\n", marker, profile)
+		if profile.Explicit {
+			fmt.Fprintln(stdout, "    Matches: only when picked with --profile")
+		} else if len(profile.ChipIDs) > 0 || profile.Product != "" || profile.BcdDevice != 0 {
+			fmt.Fprintf(stdout, "    Matches: chip IDs %v, product %q, bcdDevice %04x\n", profile.ChipIDs, profile.Product, uint16(profile.BcdDevice))
+		}
+		fmt.Fprintf(stdout, "    Framing: %s, timeout %s, announce %s, re-enumerate %s\n",
+			profile.Framing, profile.Timeout, profile.AnnounceTimeout, profile.ReenumerateDelay)
+		fmt.Fprintf(stdout, "    Layout: %s\n", profile.Layout)
+		fmt.Fprintf(stdout, "    Stages: %s\n", strings.Join(profile.Stages, " → "))
+	}
+	return nil
+}
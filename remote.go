@@ -0,0 +1,254 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	CACHE_HEADER_TIMEOUT = 30 * time.Second // How long a server may take to start answering
+)
+
+// ImageCache downloads images and manifests from http(s):// and file:// URIs into a local cache keyed by SHA-256.
+// Images with a known digest are taken from the cache without asking the server, anything else is fetched again
+// unless offline, when the last copy fetched from the same URI is used.
+type ImageCache struct {
+	Dir     string // Cache directory, blobs live in sha256/<digest>/<name> and URIs are indexed in uris/
+	Offline bool   // Never fetch, only use what is cached
+
+	client *http.Client
+}
+
+// cacheEntry records which blob a URI was last fetched into
+type cacheEntry struct {
+	URI     string    `json:"uri"`
+	SHA256  string    `json:"sha256"`
+	Name    string    `json:"name"`
+	Fetched time.Time `json:"fetched"`
+}
+
+// newImageCache returns a cache in dir, or tensor-usbdl in the user cache directory if dir is empty
+func newImageCache(dir string, offline bool) *ImageCache {
+	if dir == "" {
+		if base, err := os.UserCacheDir(); err == nil {
+			dir = filepath.Join(base, CONFIG_DIR)
+		}
+	}
+	return &ImageCache{
+		Dir:     os.ExpandEnv(dir),
+		Offline: offline,
+		client:  &http.Client{Transport: &http.Transport{Proxy: http.ProxyFromEnvironment, ResponseHeaderTimeout: CACHE_HEADER_TIMEOUT}},
+	}
+}
+
+// isRemote reports whether an image source is a URI fetched through the cache
+func isRemote(source string) bool {
+	lower := strings.ToLower(source)
+	return strings.HasPrefix(lower, "http://") || strings.HasPrefix(lower, "https://") || strings.HasPrefix(lower, "file://")
+}
+
+// Resolve returns a local path holding the source, fetching URIs through the cache. If digest is given,
+// the content is verified against it, local files in place.
+func (cache *ImageCache) Resolve(source, digest string) (string, error) {
+	digest = strings.ToLower(digest)
+	if isRemote(source) {
+		return cache.Fetch(source, digest)
+	}
+	if digest != "" {
+		got, err := hashFile(source)
+		if err != nil {
+			return "", err
+		}
+		if got != digest {
+			return "", fmt.Errorf("digest mismatch for %s: expected sha256 %s, got %s", source, digest, got)
+		}
+	}
+	return source, nil
+}
+
+// Fetch returns the cached copy of a URI, downloading it first if needed. With a digest, a cached blob with that
+// digest is used as is and a download must match it.
+func (cache *ImageCache) Fetch(uri, digest string) (string, error) {
+	if cache.Dir == "" {
+		return "", fmt.Errorf("no cache directory, set cache_dir in the config")
+	}
+	if digest != "" {
+		if path, err := cache.blob(digest); err == nil {
+			return path, nil
+		}
+	}
+	entry, cached := cache.lookup(uri)
+	if cache.Offline {
+		if digest == "" && cached {
+			return cache.blob(entry.SHA256)
+		}
+		return "", notCachedError{uri}
+	}
+
+	fmt.Fprintf(stdout, "⬇️  Fetching %s...\n", uri)
+	path, got, err := cache.download(uri)
+	if err != nil {
+		if digest == "" && cached && !errors.Is(err, fs.ErrNotExist) {
+			//The cached copy may be stale, so it is only used when asked for
+			return "", fmt.Errorf("%w (use --offline for the copy cached %s)", err, entry.Fetched.Format(time.RFC3339))
+		}
+		return "", err
+	}
+	if digest != "" && got != digest {
+		return "", fmt.Errorf("digest mismatch for %s: expected sha256 %s, got %s", uri, digest, got)
+	}
+	cache.record(cacheEntry{URI: uri, SHA256: got, Name: filepath.Base(path), Fetched: time.Now()})
+	fmt.Fprintf(stdout, "Fetched %s (sha256 %s)\n", filepath.Base(path), got)
+	return path, nil
+}
+
+// download stores a URI in the cache and returns the blob path and its digest
+func (cache *ImageCache) download(uri string) (string, string, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return "", "", err
+	}
+	var body io.ReadCloser
+	switch strings.ToLower(u.Scheme) {
+	case "file":
+		if u.Host != "" {
+			return "", "", fmt.Errorf("unsupported file URI %s: only local paths without a host are supported", uri)
+		}
+		if body, err = os.Open(filepath.FromSlash(u.Path)); err != nil {
+			return "", "", err
+		}
+	default:
+		resp, err := cache.client.Get(uri)
+		if err != nil {
+			return "", "", err
+		}
+		if resp.StatusCode == http.StatusNotFound {
+			resp.Body.Close()
+			return "", "", &fs.PathError{Op: "fetch", Path: uri, Err: fs.ErrNotExist}
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return "", "", fmt.Errorf("failed to fetch %s: %s", uri, resp.Status)
+		}
+		body = resp.Body
+	}
+	defer body.Close()
+
+	if err := os.MkdirAll(filepath.Join(cache.Dir, "sha256"), 0755); err != nil {
+		return "", "", err
+	}
+	tmp, err := os.CreateTemp(filepath.Join(cache.Dir, "sha256"), ".fetch-*")
+	if err != nil {
+		return "", "", err
+	}
+	defer os.Remove(tmp.Name()) //Only left behind if the download failed
+	hash := sha256.New()
+	_, err = io.Copy(io.MultiWriter(tmp, hash), body)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return "", "", fmt.Errorf("failed to fetch %s: %w", uri, err)
+	}
+
+	digest := hex.EncodeToString(hash.Sum(nil))
+	name := path.Base(u.Path)
+	if name == "." || name == "/" {
+		name = "image"
+	}
+	dir := filepath.Join(cache.Dir, "sha256", digest)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", "", err
+	}
+	blob := filepath.Join(dir, name)
+	if err := os.Rename(tmp.Name(), blob); err != nil {
+		return "", "", err
+	}
+	return blob, digest, nil
+}
+
+// blob returns the path of a cached blob after checking it still has its digest
+func (cache *ImageCache) blob(digest string) (string, error) {
+	dir := filepath.Join(cache.Dir, "sha256", digest)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return "", err
+	}
+	for _, entry := range entries {
+		path := filepath.Join(dir, entry.Name())
+		if got, err := hashFile(path); err == nil && got == digest {
+			return path, nil
+		}
+		os.Remove(path) //Corrupted, fetch it again
+	}
+	return "", fs.ErrNotExist
+}
+
+// lookup returns the index entry of a URI
+func (cache *ImageCache) lookup(uri string) (cacheEntry, bool) {
+	var entry cacheEntry
+	p, err := os.ReadFile(cache.indexPath(uri))
+	if err != nil || json.Unmarshal(p, &entry) != nil || entry.URI != uri {
+		return entry, false
+	}
+	return entry, true
+}
+
+// record indexes the blob a URI was fetched into, a failure only costs offline use
+func (cache *ImageCache) record(entry cacheEntry) {
+	path := cache.indexPath(entry.URI)
+	p, err := json.MarshalIndent(entry, "", "  ")
+	if err == nil {
+		err = os.MkdirAll(filepath.Dir(path), 0755)
+	}
+	if err == nil {
+		err = os.WriteFile(path, p, 0644)
+	}
+	if err != nil {
+		fmt.Fprintf(stdout, "⚠️  Failed to index %s in the cache: %v\n", entry.URI, err)
+	}
+}
+
+func (cache *ImageCache) indexPath(uri string) string {
+	sum := sha256.Sum256([]byte(uri))
+	return filepath.Join(cache.Dir, "uris", hex.EncodeToString(sum[:])+".json")
+}
+
+// notCachedError is returned for URIs that aren't cached in offline mode, it counts as a missing file
+type notCachedError struct {
+	uri string
+}
+
+func (err notCachedError) Error() string {
+	return fmt.Sprintf("%s is not cached and offline mode is on", err.uri)
+}
+
+func (err notCachedError) Is(target error) bool {
+	return target == fs.ErrNotExist
+}
+
+// hashFile returns the hex SHA-256 digest of a file
+func hashFile(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
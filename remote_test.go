@@ -0,0 +1,180 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// imageServer serves a single image whose content and status can be changed, counting the requests
+type imageServer struct {
+	*httptest.Server
+	mutex    sync.Mutex
+	content  []byte
+	status   int
+	requests int
+}
+
+func newImageServer(t *testing.T, content string) *imageServer {
+	server := &imageServer{content: []byte(content), status: http.StatusOK}
+	server.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		server.mutex.Lock()
+		defer server.mutex.Unlock()
+		server.requests++
+		if server.status != http.StatusOK {
+			w.WriteHeader(server.status)
+			return
+		}
+		w.Write(server.content)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func (server *imageServer) set(content string, status int) {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	server.content, server.status = []byte(content), status
+}
+
+func (server *imageServer) count() int {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	return server.requests
+}
+
+func sha256Hex(content string) string {
+	sum := sha256.Sum256([]byte(content))
+	return hex.EncodeToString(sum[:])
+}
+
+func readFetched(t *testing.T, path string) string {
+	t.Helper()
+	p, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read %s: %v", path, err)
+	}
+	return string(p)
+}
+
+func TestImageCacheDigest(t *testing.T) {
+	server := newImageServer(t, "bl1 image")
+	cache := newImageCache(t.TempDir(), false)
+	uri := server.URL + "/images/bl1.img"
+
+	path, err := cache.Fetch(uri, sha256Hex("bl1 image"))
+	if err != nil {
+		t.Fatalf("Fetch failed: %v", err)
+	}
+	if filepath.Base(path) != "bl1.img" || readFetched(t, path) != "bl1 image" {
+		t.Errorf("fetched %s holding %q", path, readFetched(t, path))
+	}
+
+	//A cached blob with the digest is used without asking the server
+	again, err := cache.Fetch(uri, sha256Hex("bl1 image"))
+	if err != nil || again != path {
+		t.Errorf("cached Fetch = %s, %v, want %s", again, err, path)
+	}
+	if server.count() != 1 {
+		t.Errorf("server saw %d requests, want 1", server.count())
+	}
+
+	//A cached blob that was tampered with is fetched again
+	os.WriteFile(path, []byte("tampered"), 0644)
+	if path, err := cache.Fetch(uri, sha256Hex("bl1 image")); err != nil || readFetched(t, path) != "bl1 image" {
+		t.Errorf("Fetch after tampering = %s, %v", path, err)
+	}
+	if server.count() != 2 {
+		t.Errorf("server saw %d requests, want 2", server.count())
+	}
+
+	_, err = cache.Fetch(server.URL+"/images/bl2.img", sha256Hex("another image"))
+	if err == nil || !strings.Contains(err.Error(), "digest mismatch") {
+		t.Errorf("Fetch with the wrong digest = %v, want a digest mismatch", err)
+	}
+}
+
+func TestImageCacheRefetch(t *testing.T) {
+	server := newImageServer(t, "manifest v1")
+	cache := newImageCache(t.TempDir(), false)
+	uri := server.URL + "/manifest.json"
+
+	first, err := cache.Fetch(uri, "")
+	if err != nil {
+		t.Fatalf("Fetch failed: %v", err)
+	}
+	//Without a digest the URI is fetched every time and picks up changes
+	server.set("manifest v2", http.StatusOK)
+	second, err := cache.Fetch(uri, "")
+	if err != nil {
+		t.Fatalf("second Fetch failed: %v", err)
+	}
+	if readFetched(t, first) != "manifest v1" || readFetched(t, second) != "manifest v2" {
+		t.Errorf("fetched %q then %q", readFetched(t, first), readFetched(t, second))
+	}
+	if server.count() != 2 {
+		t.Errorf("server saw %d requests, want 2", server.count())
+	}
+
+	//A failing server is an error rather than a silent fallback to the stale copy
+	server.set("", http.StatusInternalServerError)
+	if path, err := cache.Fetch(uri, ""); err == nil || !strings.Contains(err.Error(), "--offline") {
+		t.Errorf("Fetch from a failing server = %q, %v, want an error suggesting --offline", path, err)
+	}
+	server.set("", http.StatusNotFound)
+	if _, err := cache.Fetch(uri, ""); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Fetch of a missing image = %v, want fs.ErrNotExist", err)
+	}
+}
+
+func TestImageCacheOffline(t *testing.T) {
+	server := newImageServer(t, "abl image")
+	dir := t.TempDir()
+	uri := server.URL + "/abl.img"
+	path, err := newImageCache(dir, false).Fetch(uri, "")
+	if err != nil {
+		t.Fatalf("Fetch failed: %v", err)
+	}
+
+	offline := newImageCache(dir, true)
+	if cached, err := offline.Fetch(uri, ""); err != nil || cached != path {
+		t.Errorf("offline Fetch = %s, %v, want %s", cached, err, path)
+	}
+	if cached, err := offline.Fetch(server.URL+"/other.img", sha256Hex("abl image")); err != nil || cached != path {
+		t.Errorf("offline Fetch by digest = %s, %v, want %s", cached, err, path)
+	}
+	_, err = offline.Fetch(server.URL+"/bl1.img", "")
+	var notCached notCachedError
+	if !errors.As(err, &notCached) || !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("offline Fetch of an uncached URI = %v, want notCachedError", err)
+	}
+	if server.count() != 1 {
+		t.Errorf("server saw %d requests, want 1", server.count())
+	}
+}
+
+func TestImageCacheFileURI(t *testing.T) {
+	dir := t.TempDir()
+	image := filepath.Join(dir, "bl2.img")
+	os.WriteFile(image, []byte("bl2 image"), 0644)
+	cache := newImageCache(filepath.Join(dir, "cache"), false)
+
+	path, err := cache.Fetch("file://"+filepath.ToSlash(image), sha256Hex("bl2 image"))
+	if err != nil {
+		t.Fatalf("Fetch of a file URI failed: %v", err)
+	}
+	if readFetched(t, path) != "bl2 image" {
+		t.Errorf("fetched %q", readFetched(t, path))
+	}
+	if _, err := cache.Fetch("file://fileserver/share/bl2.img", ""); err == nil || !strings.Contains(err.Error(), "without a host") {
+		t.Errorf("Fetch of a file URI with a host = %v, want it rejected", err)
+	}
+}
@@ -0,0 +1,507 @@
+package main
+
+import (
+	"fmt"
+	htmltemplate "html/template"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/JoshuaDoes/tensor-usbdl/tensorutils"
+	"github.com/spf13/pflag"
+)
+
+const (
+	REPORT_WIDTH       = 720 // Width of the SVG graphs
+	REPORT_LABEL_WIDTH = 90  // Room for the stage names left of the timelines
+	REPORT_ROW_HEIGHT  = 22
+	REPORT_GRAPH_LABEL = 40 // Most bars in a throughput graph that still get a label
+)
+
+// Report is a summary of flash sessions from the audit log, rendered to HTML or Markdown
+type Report struct {
+	Title     string
+	Generated time.Time
+	Log       string
+	Sessions  []*reportSession
+	Devices   []*reportDevice
+	Errors    []*reportError
+	Accepted  int // Sessions whose outcome was accepted
+	Bytes     int64
+	Duration  time.Duration // Time spent flashing, summed over the stages
+	Span      [2]time.Time  // First and last session
+	Batches   []string
+}
+
+type reportSession struct {
+	*AuditRecord
+	Device string
+	Stages []reportStage
+}
+
+type reportStage struct {
+	AuditStage
+	Offset     time.Duration // From the start of the session
+	Throughput float64       // Bytes per second
+}
+
+// reportDevice is a device and how its sessions went
+type reportDevice struct {
+	ID       string
+	Serial   string
+	Sessions int
+	Stages   int
+	Failed   int // Sessions that didn't end accepted
+	Last     *AuditRecord
+}
+
+// reportError is a stage or session that didn't end accepted, with the device's messages explained
+type reportError struct {
+	Session string
+	Time    time.Time
+	Device  string
+	Stage   string
+	Outcome string
+	Error   string
+	Decoded []string
+}
+
+// newReport summarises sessions, oldest first
+func newReport(title, log string, records []*AuditRecord) *Report {
+	report := &Report{Title: title, Generated: time.Now(), Log: log}
+	devices := make(map[string]*reportDevice)
+	batches := make(map[string]bool)
+	for _, record := range records {
+		session := &reportSession{AuditRecord: record, Device: deviceName(record)}
+		for _, stage := range record.Stages {
+			if stage.Sent == 0 && stage.Outcome == tensorutils.OutcomeAccepted.String() {
+				stage.Sent = stage.Bytes // Recorded before the bytes sent were, an accepted stage was sent in full
+			}
+			rs := reportStage{AuditStage: stage, Offset: stage.Time.Sub(record.Time)}
+			if seconds := time.Duration(stage.Duration).Seconds(); seconds > 0 {
+				rs.Throughput = float64(stage.Sent) / seconds
+			}
+			session.Stages = append(session.Stages, rs)
+			report.Bytes += stage.Sent
+			report.Duration += time.Duration(stage.Duration)
+			if stage.Outcome != tensorutils.OutcomeAccepted.String() {
+				report.Errors = append(report.Errors, &reportError{Session: record.Session, Time: stage.Time, Device: session.Device,
+					Stage: stage.Stage, Outcome: stage.Outcome, Error: stage.Error, Decoded: decodeResponses(stage)})
+			}
+		}
+		accepted := record.Outcome == tensorutils.OutcomeAccepted.String()
+		if accepted {
+			report.Accepted++
+		} else if len(record.Stages) == 0 {
+			report.Errors = append(report.Errors, &reportError{Session: record.Session, Time: record.Time, Device: session.Device,
+				Outcome: record.Outcome, Error: record.Error})
+		}
+		report.Sessions = append(report.Sessions, session)
+
+		device := devices[session.Device]
+		if device == nil {
+			device = &reportDevice{ID: session.Device, Serial: record.Serial}
+			devices[session.Device] = device
+			report.Devices = append(report.Devices, device)
+		}
+		device.Sessions++
+		device.Stages += len(record.Stages)
+		if !accepted {
+			device.Failed++
+		}
+		device.Last = record
+
+		if record.Batch != "" && !batches[record.Batch] {
+			batches[record.Batch] = true
+			report.Batches = append(report.Batches, record.Batch)
+		}
+	}
+	sort.SliceStable(report.Devices, func(i, j int) bool { return report.Devices[i].ID < report.Devices[j].ID })
+	if len(records) > 0 {
+		report.Span = [2]time.Time{records[0].Time, records[len(records)-1].Time}
+	}
+	return report
+}
+
+// deviceName returns how a session's device is listed, sessions that never reached a device share one entry
+func deviceName(record *AuditRecord) string {
+	if id := deviceID(record); id != "" {
+		return id
+	}
+	return "no device"
+}
+
+// decodeResponses explains the messages behind a stage's outcome, the deciding one and any failures
+func decodeResponses(stage AuditStage) []string {
+	var decoded []string
+	seen := make(map[string]bool)
+	add := func(text string) {
+		if text == "" || seen[text] {
+			return
+		}
+		seen[text] = true
+		msg := tensorutils.NewMessage([]byte(text))
+		decoded = append(decoded, fmt.Sprintf("%s: %s", text, msg.Describe()))
+	}
+	add(stage.Message)
+	for _, response := range stage.Responses {
+		if msg := tensorutils.NewMessage([]byte(response)); msg != nil && (msg.IsNak() || msg.IsFailure()) {
+			add(response)
+		}
+	}
+	return decoded
+}
+
+// Failed returns how many sessions didn't end accepted
+func (report *Report) Failed() int {
+	return len(report.Sessions) - report.Accepted
+}
+
+// Throughput returns the bytes per second over all stages
+func (report *Report) Throughput() float64 {
+	if report.Duration <= 0 {
+		return 0
+	}
+	return float64(report.Bytes) / report.Duration.Seconds()
+}
+
+// ThroughputSVG graphs the throughput of every stage in the report as bars, colored by outcome
+func (report *Report) ThroughputSVG() string {
+	type bar struct {
+		label, title string
+		value        float64
+		outcome      string
+	}
+	var bars []bar
+	peak := 0.0
+	for _, session := range report.Sessions {
+		for _, stage := range session.Stages {
+			bars = append(bars, bar{
+				label:   stage.Stage,
+				title:   fmt.Sprintf("%s %s on %s: %s, %s", session.Session, stage.Stage, session.Device, formatRate(stage.Throughput), stage.Outcome),
+				value:   stage.Throughput,
+				outcome: stage.Outcome,
+			})
+			peak = max(peak, stage.Throughput)
+		}
+	}
+	if len(bars) == 0 {
+		return ""
+	}
+
+	const top, bottom, left = 20, 30, 70
+	height := 200
+	plot := float64(REPORT_WIDTH - left - 10)
+	step := plot / float64(len(bars))
+	var sb strings.Builder
+	fmt.Fprintf(&sb, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d" font-family="sans-serif" font-size="11">`,
+		REPORT_WIDTH, height, REPORT_WIDTH, height)
+	fmt.Fprintf(&sb, `<text x="%d" y="12">Throughput per stage</text>`, left)
+	fmt.Fprintf(&sb, `<line x1="%d" y1="%d" x2="%d" y2="%d" stroke="#888"/>`, left, height-bottom, REPORT_WIDTH-10, height-bottom)
+	fmt.Fprintf(&sb, `<text x="%d" y="%d" text-anchor="end">%s</text>`, left-4, top+4, xmlEscape(formatRate(peak)))
+	fmt.Fprintf(&sb, `<text x="%d" y="%d" text-anchor="end">0</text>`, left-4, height-bottom)
+	for i, b := range bars {
+		h := 0.0
+		if peak > 0 {
+			h = b.value / peak * float64(height-top-bottom)
+		}
+		x := float64(left) + float64(i)*step
+		fmt.Fprintf(&sb, `<rect x="%.1f" y="%.1f" width="%.1f" height="%.1f" fill="%s"><title>%s</title></rect>`,
+			x+step*0.1, float64(height-bottom)-h, step*0.8, h, outcomeColor(b.outcome), xmlEscape(b.title))
+		if len(bars) <= REPORT_GRAPH_LABEL {
+			fmt.Fprintf(&sb, `<text x="%.1f" y="%d" text-anchor="middle">%s</text>`, x+step/2, height-bottom+14, xmlEscape(b.label))
+		}
+	}
+	sb.WriteString(`</svg>`)
+	return sb.String()
+}
+
+// TimelineSVG draws when each stage of the session was sent and how long it took
+func (session *reportSession) TimelineSVG() string {
+	if len(session.Stages) == 0 {
+		return ""
+	}
+	span := time.Duration(session.Duration)
+	for _, stage := range session.Stages {
+		span = max(span, stage.Offset+time.Duration(stage.Duration))
+	}
+	if span <= 0 {
+		span = time.Millisecond
+	}
+
+	height := REPORT_ROW_HEIGHT*len(session.Stages) + 24
+	plot := float64(REPORT_WIDTH - REPORT_LABEL_WIDTH - 10)
+	scale := plot / float64(span)
+	var sb strings.Builder
+	fmt.Fprintf(&sb, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d" font-family="sans-serif" font-size="11">`,
+		REPORT_WIDTH, height, REPORT_WIDTH, height)
+	for i, stage := range session.Stages {
+		y := i * REPORT_ROW_HEIGHT
+		x := float64(REPORT_LABEL_WIDTH) + float64(stage.Offset)*scale
+		w := max(float64(stage.Duration)*scale, 1)
+		fmt.Fprintf(&sb, `<text x="%d" y="%d" text-anchor="end">%s</text>`, REPORT_LABEL_WIDTH-6, y+15, xmlEscape(stage.Stage))
+		fmt.Fprintf(&sb, `<rect x="%.1f" y="%d" width="%.1f" height="%d" fill="%s"><title>%s</title></rect>`,
+			x, y+4, w, REPORT_ROW_HEIGHT-8, outcomeColor(stage.Outcome),
+			xmlEscape(fmt.Sprintf("%s: %s after %s, %s", stage.Stage, stage.Outcome, roundDuration(stage.Offset), stage.Duration)))
+		label := fmt.Sprintf("%s, %s", roundDuration(time.Duration(stage.Duration)), formatRate(stage.Throughput))
+		if x+w+160 < REPORT_WIDTH {
+			fmt.Fprintf(&sb, `<text x="%.1f" y="%d">%s</text>`, x+w+4, y+15, xmlEscape(label))
+		} else {
+			fmt.Fprintf(&sb, `<text x="%.1f" y="%d" text-anchor="end" fill="#fff">%s</text>`, x+w-4, y+15, xmlEscape(label))
+		}
+	}
+	axis := REPORT_ROW_HEIGHT * len(session.Stages)
+	fmt.Fprintf(&sb, `<line x1="%d" y1="%d" x2="%d" y2="%d" stroke="#888"/>`, REPORT_LABEL_WIDTH, axis+2, REPORT_WIDTH-10, axis+2)
+	fmt.Fprintf(&sb, `<text x="%d" y="%d">0s</text>`, REPORT_LABEL_WIDTH, axis+16)
+	fmt.Fprintf(&sb, `<text x="%d" y="%d" text-anchor="end">%s</text>`, REPORT_WIDTH-10, axis+16, roundDuration(span))
+	sb.WriteString(`</svg>`)
+	return sb.String()
+}
+
+func outcomeColor(outcome string) string {
+	switch outcome {
+	case tensorutils.OutcomeAccepted.String():
+		return "#2e7d32"
+	case tensorutils.OutcomeUnknown.String():
+		return "#f9a825"
+	}
+	return "#c62828"
+}
+
+// markdownEscape keeps text on one line of a Markdown table or paragraph and out of its HTML
+func markdownEscape(s string) string {
+	return strings.NewReplacer("|", `\|`, "<", "&lt;", ">", "&gt;", "\n", " ", "\r", "").Replace(s)
+}
+
+func xmlEscape(s string) string {
+	return htmltemplate.HTMLEscapeString(s)
+}
+
+// formatRate formats bytes per second
+func formatRate(rate float64) string {
+	switch {
+	case rate >= 1024*1024:
+		return fmt.Sprintf("%.1f MiB/s", rate/(1024*1024))
+	case rate >= 1024:
+		return fmt.Sprintf("%.1f KiB/s", rate/1024)
+	}
+	return fmt.Sprintf("%.0f B/s", rate)
+}
+
+func roundDuration(d time.Duration) time.Duration {
+	if d >= time.Second {
+		return d.Round(10 * time.Millisecond)
+	}
+	return d.Round(time.Millisecond)
+}
+
+// reportFuncs are shared by both templates
+var reportFuncs = map[string]any{
+	"time":     func(t time.Time) string { return t.Local().Format("2006-01-02 15:04:05") },
+	"clock":    func(d time.Duration) string { return roundDuration(d).String() },
+	"duration": func(d tensorutils.Duration) string { return roundDuration(time.Duration(d)).String() },
+	"rate":     formatRate,
+	"short":    func(digest string) string { return digest[:min(len(digest), 16)] },
+	"join":     strings.Join,
+	"none":     orNone,
+	"sent": func(sent, size int64) string {
+		if sent == size {
+			return fmt.Sprint(size)
+		}
+		return fmt.Sprintf("%d/%d", sent, size)
+	},
+	"cell": markdownEscape,
+}
+
+var markdownReport = template.Must(template.New("markdown").Funcs(reportFuncs).Funcs(template.FuncMap{
+	"svg":      func(svg string) string { return svg },
+	"timeline": func(session *reportSession) string { return session.TimelineSVG() },
+}).Parse(`# {{cell .Title}}
+
+Generated {{time .Generated}} from {{cell .Log}}.
+{{if .Sessions}}{{len .Sessions}} sessions on {{len .Devices}} devices between {{time (index .Span 0)}} and {{time (index .Span 1)}}: {{.Accepted}} accepted, {{.Failed}} failed. {{.Bytes}} bytes sent in {{clock .Duration}} ({{rate .Throughput}}).{{if .Batches}} Batch: {{cell (join .Batches ", ")}}.{{end}}
+{{else}}No sessions matched.
+{{end}}{{if .Devices}}
+## Devices
+
+| Device | Serial | Sessions | Stages | Failed | Last session | Last outcome |
+|--------|--------|----------|--------|--------|--------------|--------------|
+{{range .Devices}}| {{cell .ID}} | {{cell (none .Serial)}} | {{.Sessions}} | {{.Stages}} | {{.Failed}} | {{.Last.Session}} ({{time .Last.Time}}) | {{.Last.Outcome}} |
+{{end}}{{end}}{{with svg .ThroughputSVG}}
+## Throughput
+
+{{.}}
+{{end}}{{if .Errors}}
+## Errors
+
+| Session | Time | Device | Stage | Outcome | Error | Device messages |
+|---------|------|--------|-------|---------|-------|-----------------|
+{{range .Errors}}| {{.Session}} | {{time .Time}} | {{cell .Device}} | {{cell (none .Stage)}} | {{.Outcome}} | {{cell (none .Error)}} | {{cell (none (join .Decoded "; "))}} |
+{{end}}{{end}}{{if .Sessions}}
+## Sessions
+{{range .Sessions}}
+### {{.Session}}: {{cell .Device}}, {{.Outcome}}
+
+{{time .Time}} on {{cell .Host}} by {{cell .Operator}}{{if .Batch}} (batch {{cell .Batch}}){{end}}, {{cell .Source}} over {{cell (none .Transport)}}{{if .Simulated}} (simulated){{end}}, {{duration .Duration}}.{{if .Error}}
+Error: {{cell .Error}}{{end}}
+{{if .Stages}}
+| Stage | SHA-256 | Bytes | Start | Duration | Throughput | Outcome | Message |
+|-------|---------|-------|-------|----------|------------|---------|---------|
+{{range .Stages}}| {{cell .Stage}} | ` + "`{{short .SHA256}}`" + ` | {{sent .Sent .Bytes}} | +{{clock .Offset}} | {{duration .Duration}} | {{rate .Throughput}} | {{.Outcome}} | {{cell (none .Message)}} |
+{{end}}{{range .Stages}}{{range .Events}}
+- {{cell .}}{{end}}{{end}}
+{{timeline .}}
+{{end}}{{end}}{{end}}`))
+
+var htmlReport = htmltemplate.Must(htmltemplate.New("html").Funcs(reportFuncs).Funcs(htmltemplate.FuncMap{
+	"svg":      func(svg string) htmltemplate.HTML { return htmltemplate.HTML(svg) },
+	"timeline": func(session *reportSession) htmltemplate.HTML { return htmltemplate.HTML(session.TimelineSVG()) },
+	"status": func(outcome string) string {
+		if outcome == tensorutils.OutcomeAccepted.String() {
+			return "ok"
+		}
+		return "failed"
+	},
+}).Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>{{.Title}}</title>
+<style>
+body { font-family: sans-serif; margin: 2em auto; max-width: 960px; color: #222; }
+table { border-collapse: collapse; margin: 1em 0; width: 100%; }
+th, td { border: 1px solid #ccc; padding: 4px 8px; text-align: left; font-size: 0.9em; }
+th { background: #f2f2f2; }
+code { font-size: 0.9em; }
+.ok { color: #2e7d32; }
+.failed { color: #c62828; }
+.session { border-top: 1px solid #ccc; margin-top: 2em; }
+</style>
+</head>
+<body>
+<h1>{{.Title}}</h1>
+<p>Generated {{time .Generated}} from <code>{{.Log}}</code>.</p>
+{{if .Sessions}}<p>{{len .Sessions}} sessions on {{len .Devices}} devices between {{time (index .Span 0)}} and {{time (index .Span 1)}}:
+<span class="ok">{{.Accepted}} accepted</span>, <span class="failed">{{.Failed}} failed</span>.
+{{.Bytes}} bytes sent in {{clock .Duration}} ({{rate .Throughput}}).{{if .Batches}} Batch: {{join .Batches ", "}}.{{end}}</p>
+{{else}}<p>No sessions matched.</p>
+{{end}}{{if .Devices}}
+<h2>Devices</h2>
+<table>
+<tr><th>Device</th><th>Serial</th><th>Sessions</th><th>Stages</th><th>Failed</th><th>Last session</th><th>Last outcome</th></tr>
+{{range .Devices}}<tr><td>{{.ID}}</td><td>{{none .Serial}}</td><td>{{.Sessions}}</td><td>{{.Stages}}</td><td>{{.Failed}}</td><td><a href="#{{.Last.Session}}">{{.Last.Session}}</a> ({{time .Last.Time}})</td><td class="{{status .Last.Outcome}}">{{.Last.Outcome}}</td></tr>
+{{end}}</table>
+{{end}}{{with svg .ThroughputSVG}}
+<h2>Throughput</h2>
+{{.}}
+{{end}}{{if .Errors}}
+<h2>Errors</h2>
+<table>
+<tr><th>Session</th><th>Time</th><th>Device</th><th>Stage</th><th>Outcome</th><th>Error</th><th>Device messages</th></tr>
+{{range .Errors}}<tr><td><a href="#{{.Session}}">{{.Session}}</a></td><td>{{time .Time}}</td><td>{{.Device}}</td><td>{{none .Stage}}</td><td class="failed">{{.Outcome}}</td><td>{{none .Error}}</td><td>{{range .Decoded}}{{.}}<br>{{else}}-{{end}}</td></tr>
+{{end}}</table>
+{{end}}{{if .Sessions}}
+<h2>Sessions</h2>
+{{range .Sessions}}<div class="session" id="{{.Session}}">
+<h3>{{.Session}}: {{.Device}}, <span class="{{status .Outcome}}">{{.Outcome}}</span></h3>
+<p>{{time .Time}} on {{.Host}} by {{.Operator}}{{if .Batch}} (batch {{.Batch}}){{end}}, <code>{{.Source}}</code> over {{none .Transport}}{{if .Simulated}} (simulated){{end}}, {{duration .Duration}}.{{if .Error}}<br>
+<span class="failed">Error: {{.Error}}</span>{{end}}</p>
+{{if .Stages}}<table>
+<tr><th>Stage</th><th>SHA-256</th><th>Bytes</th><th>Start</th><th>Duration</th><th>Throughput</th><th>Outcome</th><th>Message</th></tr>
+{{range .Stages}}<tr><td>{{.Stage}}</td><td><code title="{{.SHA256}}">{{short .SHA256}}</code></td><td>{{sent .Sent .Bytes}}</td><td>+{{clock .Offset}}</td><td>{{duration .Duration}}</td><td>{{rate .Throughput}}</td><td class="{{status .Outcome}}">{{.Outcome}}</td><td>{{none .Message}}</td></tr>
+{{end}}</table>
+{{range .Stages}}{{range .Events}}<p class="failed">{{.}}</p>
+{{end}}{{end}}{{timeline .}}
+{{end}}</div>
+{{end}}{{end}}</body>
+</html>
+`))
+
+// runReport implements the report command
+func runReport(arguments []string, cfg *Config) error {
+	var query auditQuery
+	fs := pflag.NewFlagSet("report", pflag.ContinueOnError)
+	query.flags(fs)
+	format := fs.String("format", "", "report format: html or markdown (default: from the --out extension, else markdown)")
+	out := fs.String("out", "", "file to write the report to, - for stdout (default: report-<time>.md or .html)")
+	title := fs.String("title", "", "report title")
+	if err := fs.Parse(arguments); err != nil {
+		return err
+	}
+	query.filter.Sessions = fs.Args()
+	//Without a selection, report on the latest session
+	if len(query.filter.Sessions) == 0 && query.limit == 0 && !fs.Changed("batch") && !fs.Changed("device") &&
+		!fs.Changed("since") && !fs.Changed("until") && !fs.Changed("stage") && !fs.Changed("sha256") &&
+		!fs.Changed("outcome") && !fs.Changed("operator") {
+		query.limit = 1
+	}
+
+	if *format == "" {
+		switch strings.ToLower(filepath.Ext(*out)) {
+		case ".html", ".htm":
+			*format = "html"
+		default:
+			*format = "markdown"
+		}
+	}
+	if *format == "md" {
+		*format = "markdown"
+	}
+	if *format != "html" && *format != "markdown" {
+		return fmt.Errorf("unknown report format '%s', use html or markdown", *format)
+	}
+
+	path, records, err := query.run(cfg)
+	if err != nil {
+		return err
+	}
+	if *title == "" {
+		switch {
+		case query.filter.Batch != "":
+			*title = "Flash report: batch " + query.filter.Batch
+		case len(records) == 1:
+			*title = "Flash report: session " + records[0].Session
+		default:
+			*title = "Flash report"
+		}
+	}
+	report := newReport(*title, path, records)
+
+	if *out == "" {
+		ext := ".md"
+		if *format == "html" {
+			ext = ".html"
+		}
+		*out = "report-" + report.Generated.Format("20060102-150405") + ext
+	}
+	var w io.Writer = jsonOut //Stdout, even when human readable output goes to stderr
+	var file *os.File
+	if *out != "-" {
+		if file, err = os.Create(*out); err != nil {
+			return err
+		}
+		w = file
+	}
+	if *format == "html" {
+		err = htmlReport.Execute(w, report)
+	} else {
+		err = markdownReport.Execute(w, report)
+	}
+	if err != nil {
+		if file != nil {
+			file.Close()
+		}
+		return fmt.Errorf("failed to render the report: %w", err)
+	}
+	if file != nil {
+		if err := file.Close(); err != nil {
+			return fmt.Errorf("failed to write the report: %w", err)
+		}
+		fmt.Fprintf(stdout, "✅ Report on %d sessions written to %s\n", len(records), *out)
+	}
+	return nil
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/JoshuaDoes/tensor-usbdl/tensorutils"
+)
+
+// fixtureReport reports on every session of the audit fixture
+func fixtureReport(t *testing.T, title string) *Report {
+	t.Helper()
+	records, err := readAudit(auditFixture)
+	if err != nil {
+		t.Fatalf("readAudit failed: %v", err)
+	}
+	report := newReport(title, auditFixture, records)
+	report.Generated = time.Date(2026, 10, 21, 12, 0, 0, 0, time.UTC)
+	return report
+}
+
+// render executes the template of a format on a report
+func render(t *testing.T, format string, report *Report) string {
+	t.Helper()
+	var buf bytes.Buffer
+	var err error
+	if format == "html" {
+		err = htmlReport.Execute(&buf, report)
+	} else {
+		err = markdownReport.Execute(&buf, report)
+	}
+	if err != nil {
+		t.Fatalf("failed to render the %s report: %v", format, err)
+	}
+	return buf.String()
+}
+
+func TestNewReport(t *testing.T) {
+	report := fixtureReport(t, "Fixture")
+	if len(report.Sessions) != 4 || report.Accepted != 1 || report.Failed() != 3 {
+		t.Errorf("%d sessions, %d accepted, %d failed, want 4, 1 and 3", len(report.Sessions), report.Accepted, report.Failed())
+	}
+	if report.Bytes != 16384+65536+16384+1536 || report.Duration != 4*time.Second {
+		t.Errorf("%d bytes in %s", report.Bytes, report.Duration)
+	}
+	if want := float64(report.Bytes) / 4; report.Throughput() != want {
+		t.Errorf("throughput = %f, want %f", report.Throughput(), want)
+	}
+	if !report.Span[0].Equal(time.Date(2026, 10, 1, 9, 0, 0, 0, time.UTC)) || !report.Span[1].Equal(time.Date(2026, 10, 20, 10, 0, 0, 0, time.UTC)) {
+		t.Errorf("span = %v", report.Span)
+	}
+	if !slices.Equal(report.Batches, []string{"rma-42"}) {
+		t.Errorf("batches = %q", report.Batches)
+	}
+
+	var devices []string
+	for _, device := range report.Devices {
+		devices = append(devices, fmt.Sprintf("%s:%d/%d/%d", device.ID, device.Sessions, device.Stages, device.Failed))
+	}
+	if want := []string{"09845001:1/1/1", "09845001cddf16d0:1/2/0", "0A1234567890ABCD:1/1/1", "no device:1/0/1"}; !slices.Equal(devices, want) {
+		t.Errorf("devices = %q, want %q", devices, want)
+	}
+
+	var errors []string
+	for _, e := range report.Errors {
+		errors = append(errors, e.Session+"/"+e.Stage+"/"+e.Outcome)
+	}
+	if want := []string{"7c1e0a22b5d4/bl1/rejected header", "9d2f7b3318aa/abl/unknown", "e0b1c2d3e4f5//error"}; !slices.Equal(errors, want) {
+		t.Errorf("errors = %q, want %q", errors, want)
+	}
+	if decoded := report.Errors[0].Decoded; len(decoded) != 1 || !strings.HasPrefix(decoded[0], "bl1 header fail: the device rejected the bl1 header") {
+		t.Errorf("decoded = %q", decoded)
+	}
+
+	pbl := report.Sessions[0].Stages[1]
+	if pbl.Offset != 2*time.Second || pbl.Throughput != 65536/1.5 {
+		t.Errorf("pbl at +%s at %f B/s", pbl.Offset, pbl.Throughput)
+	}
+	if abl := report.Sessions[2].Stages[0]; abl.Throughput != 0 || abl.Sent != 1536 {
+		t.Errorf("zero duration stage at %f B/s with %d bytes sent", abl.Throughput, abl.Sent)
+	}
+
+	//Stages recorded before the bytes sent were count in full when accepted, and only then
+	old := newReport("Old", "audit.jsonl", []*AuditRecord{{Session: "a", Outcome: "accepted", Stages: []AuditStage{
+		{Stage: "bl1", Bytes: 1000, Duration: tensorutils.Duration(time.Second), Outcome: "accepted"},
+		{Stage: "pbl", Bytes: 500, Outcome: "unknown"},
+	}}})
+	if old.Bytes != 1000 || old.Sessions[0].Stages[0].Throughput != 1000 {
+		t.Errorf("old record counted %d bytes at %f B/s", old.Bytes, old.Sessions[0].Stages[0].Throughput)
+	}
+}
+
+func TestNewReportEmpty(t *testing.T) {
+	report := newReport("Empty", "audit.jsonl", nil)
+	if len(report.Sessions) != 0 || report.Failed() != 0 || report.Throughput() != 0 || !report.Span[0].IsZero() {
+		t.Errorf("empty report = %+v", report)
+	}
+	if svg := report.ThroughputSVG(); svg != "" {
+		t.Errorf("throughput graph of no sessions = %q", svg)
+	}
+	for _, format := range []string{"html", "markdown"} {
+		out := render(t, format, report)
+		if !strings.Contains(out, "No sessions matched.") || strings.Contains(out, "Devices") || strings.Contains(out, "Throughput") {
+			t.Errorf("%s report of no sessions:\n%s", format, out)
+		}
+	}
+}
+
+func TestDecodeResponses(t *testing.T) {
+	stage := AuditStage{
+		Message:   "eub:nak",
+		Responses: []string{"eub:req:0984:bl1", "eub:nak", "eub:irom_auth_failure", "eub:log:retrying", "eub:irom_auth_failure"},
+	}
+	decoded := decodeResponses(stage)
+	want := []string{"eub:nak: the device refused the stage", "eub:irom_auth_failure: boot ROM auth failed"}
+	if !slices.Equal(decoded, want) {
+		t.Errorf("decodeResponses = %q, want %q", decoded, want)
+	}
+	if decoded := decodeResponses(AuditStage{Responses: []string{"eub:req:0984:bl1"}}); len(decoded) != 0 {
+		t.Errorf("decodeResponses without a deciding message or failure = %q", decoded)
+	}
+}
+
+func TestThroughputSVG(t *testing.T) {
+	report := fixtureReport(t, "Fixture")
+	report.Sessions[0].Stages[0].Stage = "<bl1>"
+	svg := report.ThroughputSVG()
+	if n := strings.Count(svg, "<rect"); n != 4 {
+		t.Errorf("%d bars, want one per stage", n)
+	}
+	if !strings.Contains(svg, ">&lt;bl1&gt;</text>") || strings.Contains(svg, "<bl1>") {
+		t.Error("stage label not escaped")
+	}
+	if !strings.Contains(svg, "on 0A1234567890ABCD: 8.0 KiB/s, rejected header</title>") {
+		t.Errorf("bar title missing:\n%s", svg)
+	}
+	if strings.Contains(svg, "NaN") || strings.Contains(svg, "Inf") {
+		t.Errorf("graph holds non-finite numbers:\n%s", svg)
+	}
+
+	//Too many bars to label
+	var stages []reportStage
+	for i := 0; i <= REPORT_GRAPH_LABEL; i++ {
+		stages = append(stages, reportStage{AuditStage: AuditStage{Stage: "bl1"}, Throughput: 1})
+	}
+	crowded := &Report{Sessions: []*reportSession{{AuditRecord: &AuditRecord{}, Stages: stages}}}
+	if svg := crowded.ThroughputSVG(); strings.Contains(svg, ">bl1</text>") {
+		t.Error("a crowded graph has bar labels")
+	}
+
+	//Only zero durations, so nothing to scale the bars by
+	still := &Report{Sessions: []*reportSession{{AuditRecord: &AuditRecord{}, Stages: []reportStage{{AuditStage: AuditStage{Stage: "abl"}}}}}}
+	if svg := still.ThroughputSVG(); !strings.Contains(svg, `height="0.0"`) || strings.Contains(svg, "NaN") {
+		t.Errorf("graph of a zero duration stage:\n%s", svg)
+	}
+}
+
+func TestTimelineSVG(t *testing.T) {
+	report := fixtureReport(t, "Fixture")
+	svg := report.Sessions[0].TimelineSVG()
+	if n := strings.Count(svg, "<rect"); n != 2 {
+		t.Errorf("%d rows, want one per stage", n)
+	}
+	if !strings.Contains(svg, "pbl: accepted after 2s, 1.5s</title>") || !strings.Contains(svg, ">3.5s</text>") {
+		t.Errorf("timeline misses the pbl row or the session span:\n%s", svg)
+	}
+
+	if svg := report.Sessions[3].TimelineSVG(); svg != "" {
+		t.Errorf("timeline of a session without stages = %q", svg)
+	}
+
+	//Zero durations everywhere still draw a visible bar
+	still := &reportSession{AuditRecord: &AuditRecord{}, Stages: []reportStage{{AuditStage: AuditStage{Stage: "<abl>", Outcome: "unknown"}}}}
+	svg = still.TimelineSVG()
+	if !strings.Contains(svg, `width="1.0"`) || !strings.Contains(svg, ">1ms</text>") || strings.Contains(svg, "NaN") || strings.Contains(svg, "Inf") {
+		t.Errorf("timeline of a zero duration session:\n%s", svg)
+	}
+	if strings.Contains(svg, "<abl>") || !strings.Contains(svg, "&lt;abl&gt;") {
+		t.Error("stage name not escaped")
+	}
+}
+
+func TestReportTemplates(t *testing.T) {
+	title := "Bench <1> | rma\nsecond line"
+	report := fixtureReport(t, title)
+
+	html := render(t, "html", report)
+	for _, want := range []string{
+		"<title>Bench &lt;1&gt; | rma\nsecond line</title>",
+		"failed to write &lt;abl&gt; | endpoint 0x02\nstalled",
+		"usb stalled endpoint 0x02 (halt | &lt;cleared&gt;\nagain)",
+		`<tr><td>0A1234567890ABCD</td><td>0A123456</td><td>1</td><td>1</td><td>1</td>`,
+		`<a href="#7c1e0a22b5d4">7c1e0a22b5d4</a>`,
+		`<td>1536/200000</td>`,
+		"Batch: rma-42.",
+		`<td class="failed">rejected header</td>`,
+		"<svg",
+	} {
+		if !strings.Contains(html, want) {
+			t.Errorf("HTML report lacks %q", want)
+		}
+	}
+	if strings.Contains(html, "<abl>") || strings.Contains(html, "<cleared>") || strings.Contains(html, "<1>") {
+		t.Error("HTML report holds unescaped text")
+	}
+
+	markdown := render(t, "markdown", report)
+	for _, want := range []string{
+		"# Bench &lt;1&gt; \\| rma second line\n",
+		"Generated " + report.Generated.Local().Format("2006-01-02 15:04:05") + " from testdata/audit.jsonl.",
+		"4 sessions on 4 devices",
+		"1 accepted, 3 failed. 99840 bytes sent in 4s (24.4 KiB/s). Batch: rma-42.",
+		"| 7c1e0a22b5d4 | ",
+		"| failed to write &lt;abl&gt; \\| endpoint 0x02 stalled |",
+		"- usb stalled endpoint 0x02 (halt \\| &lt;cleared&gt; again)",
+		"| abl | `dd44f6a4b4c3d0e5` | 1536/200000 | +1s | 0s | 0 B/s | unknown | - |",
+		"### e0b1c2d3e4f5: no device, error",
+	} {
+		if !strings.Contains(markdown, want) {
+			t.Errorf("Markdown report lacks %q", want)
+		}
+	}
+	//Every row of a table has as many cells as its header
+	columns := 0
+	for i, line := range strings.Split(markdown, "\n") {
+		if !strings.HasPrefix(line, "|") {
+			columns = 0
+			continue
+		}
+		separators := strings.Count(line, "|") - strings.Count(line, `\|`)
+		if columns == 0 {
+			columns = separators
+		} else if separators != columns {
+			t.Errorf("line %d has %d cell separators, want %d: %s", i+1, separators, columns, line)
+		}
+	}
+	if strings.Contains(markdown, "<abl>") || strings.Contains(markdown, "<1>") || strings.Contains(markdown, "<cleared>") {
+		t.Error("Markdown report holds raw HTML from the log")
+	}
+}
+
+func TestRunReport(t *testing.T) {
+	out := filepath.Join(t.TempDir(), "rma-42.html")
+	if err := runReport([]string{"--file", auditFixture, "--batch", "rma-42", "--out", out}, &Config{}); err != nil {
+		t.Fatalf("runReport failed: %v", err)
+	}
+	p, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatalf("report not written: %v", err)
+	}
+	if html := string(p); !strings.Contains(html, "<title>Flash report: batch rma-42</title>") || !strings.Contains(html, "2 sessions on 2 devices") {
+		t.Errorf("report of batch rma-42:\n%s", html)
+	}
+
+	if err := runReport([]string{"--file", auditFixture, "--format", "pdf"}, &Config{}); err == nil || !strings.Contains(err.Error(), "unknown report format 'pdf'") {
+		t.Errorf("runReport with an unknown format = %v", err)
+	}
+	if err := runReport([]string{"--file", auditFixture, "--out", filepath.Join(t.TempDir(), "missing", "report.md")}, &Config{}); err == nil {
+		t.Error("runReport into a missing directory succeeded")
+	}
+}
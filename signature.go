@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+// Signatures are detached minisign signatures, so manifests can be signed and checked with minisign as well
+const (
+	SIGNATURE_SUFFIX = ".minisig"
+
+	SIG_LEGACY    = "Ed" // Signature over the message itself
+	SIG_PREHASHED = "ED" // Signature over the BLAKE2b-512 hash of the message, what minisign and sign produce
+	KDF_NONE      = "\x00\x00"
+	CHECKSUM_ALG  = "B2"
+	KEY_ID_SIZE   = 8
+)
+
+// publicKey is an ed25519 key trusted to sign manifests
+type publicKey struct {
+	id  [KEY_ID_SIZE]byte
+	key ed25519.PublicKey
+}
+
+// secretKey is an ed25519 key to sign manifests with
+type secretKey struct {
+	id  [KEY_ID_SIZE]byte
+	key ed25519.PrivateKey
+}
+
+// signature is a parsed detached signature
+type signature struct {
+	alg            string
+	keyID          [KEY_ID_SIZE]byte
+	sig            []byte
+	trustedComment string
+	global         []byte //Signature over sig and the trusted comment
+}
+
+// ID returns the key ID as minisign prints it
+func (pk *publicKey) ID() string {
+	return keyID(pk.id)
+}
+
+func keyID(id [KEY_ID_SIZE]byte) string {
+	return fmt.Sprintf("%016X", binary.LittleEndian.Uint64(id[:]))
+}
+
+// generateKey returns a new key pair with a random key ID
+func generateKey() (*secretKey, error) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	sk := &secretKey{key: key}
+	if _, err := rand.Read(sk.id[:]); err != nil {
+		return nil, err
+	}
+	return sk, nil
+}
+
+func (sk *secretKey) public() *publicKey {
+	return &publicKey{id: sk.id, key: sk.key.Public().(ed25519.PublicKey)}
+}
+
+// encode returns the key in the minisign public key file format
+func (pk *publicKey) encode() []byte {
+	p := append([]byte(SIG_LEGACY), pk.id[:]...)
+	p = append(p, pk.key...)
+	return []byte(fmt.Sprintf("untrusted comment: minisign public key %s\n%s\n", pk.ID(), base64.StdEncoding.EncodeToString(p)))
+}
+
+// encode returns the key in the minisign secret key file format, unencrypted
+func (sk *secretKey) encode() []byte {
+	p := []byte(SIG_LEGACY + KDF_NONE + CHECKSUM_ALG)
+	p = append(p, make([]byte, 32+8+8)...) //No KDF salt and limits
+	p = append(p, sk.id[:]...)
+	p = append(p, sk.key...)
+	p = append(p, sk.checksum()...)
+	return []byte(fmt.Sprintf("untrusted comment: minisign secret key %s, unencrypted\n%s\n", keyID(sk.id), base64.StdEncoding.EncodeToString(p)))
+}
+
+func (sk *secretKey) checksum() []byte {
+	hash, _ := blake2b.New256(nil)
+	hash.Write([]byte(SIG_LEGACY))
+	hash.Write(sk.id[:])
+	hash.Write(sk.key)
+	return hash.Sum(nil)
+}
+
+// parsePublicKey reads a key as written to a minisign public key file, or just its base64 line
+func parsePublicKey(text string) (*publicKey, error) {
+	p, err := decodeKeyLine(text)
+	if err != nil {
+		return nil, err
+	}
+	if len(p) != 2+KEY_ID_SIZE+ed25519.PublicKeySize || string(p[:2]) != SIG_LEGACY {
+		return nil, fmt.Errorf("not an ed25519 public key")
+	}
+	pk := &publicKey{key: ed25519.PublicKey(p[2+KEY_ID_SIZE:])}
+	copy(pk.id[:], p[2:])
+	return pk, nil
+}
+
+// parseSecretKey reads an unencrypted minisign secret key file
+func parseSecretKey(text string) (*secretKey, error) {
+	p, err := decodeKeyLine(text)
+	if err != nil {
+		return nil, err
+	}
+	if len(p) != 158 || string(p[:2]) != SIG_LEGACY || string(p[4:6]) != CHECKSUM_ALG {
+		return nil, fmt.Errorf("not an ed25519 secret key")
+	}
+	if string(p[2:4]) != KDF_NONE {
+		return nil, fmt.Errorf("encrypted secret keys aren't supported, sign with minisign -S or use a key from manifest keygen")
+	}
+	sk := &secretKey{key: ed25519.PrivateKey(p[62:126])}
+	copy(sk.id[:], p[54:62])
+	if !bytes.Equal(sk.checksum(), p[126:]) {
+		return nil, fmt.Errorf("secret key checksum mismatch")
+	}
+	return sk, nil
+}
+
+// decodeKeyLine decodes the base64 line of a key file, skipping comments
+func decodeKeyLine(text string) ([]byte, error) {
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "untrusted comment:") {
+			continue
+		}
+		return base64.StdEncoding.DecodeString(line)
+	}
+	return nil, fmt.Errorf("no key found")
+}
+
+// loadTrustedKeys reads the trusted keys, each given as a public key file or inline as its base64 line
+func loadTrustedKeys(entries []string) ([]*publicKey, error) {
+	var keys []*publicKey
+	for _, entry := range entries {
+		text := entry
+		if p, err := os.ReadFile(os.ExpandEnv(entry)); err == nil {
+			text = string(p)
+		} else if !errors.Is(err, os.ErrNotExist) {
+			return nil, fmt.Errorf("trusted key %s: %w", entry, err)
+		}
+		pk, err := parsePublicKey(text)
+		if err != nil {
+			return nil, fmt.Errorf("trusted key %s: %w", entry, err)
+		}
+		keys = append(keys, pk)
+	}
+	return keys, nil
+}
+
+// sign returns a detached signature of message
+func (sk *secretKey) sign(message []byte, trustedComment string) []byte {
+	hash := blake2b.Sum512(message)
+	sig := ed25519.Sign(sk.key, hash[:])
+	global := ed25519.Sign(sk.key, append(append([]byte(nil), sig...), trustedComment...))
+	p := append([]byte(SIG_PREHASHED), sk.id[:]...)
+	p = append(p, sig...)
+	return []byte(fmt.Sprintf("untrusted comment: signature from tensor-usbdl secret key %s\n%s\ntrusted comment: %s\n%s\n",
+		keyID(sk.id), base64.StdEncoding.EncodeToString(p), trustedComment, base64.StdEncoding.EncodeToString(global)))
+}
+
+// parseSignature reads a detached signature file
+func parseSignature(text string) (*signature, error) {
+	lines := strings.Split(strings.ReplaceAll(text, "\r\n", "\n"), "\n")
+	if len(lines) < 4 || !strings.HasPrefix(lines[0], "untrusted comment:") || !strings.HasPrefix(lines[2], "trusted comment: ") {
+		return nil, fmt.Errorf("malformed signature")
+	}
+	p, err := base64.StdEncoding.DecodeString(strings.TrimSpace(lines[1]))
+	if err != nil || len(p) != 2+KEY_ID_SIZE+ed25519.SignatureSize {
+		return nil, fmt.Errorf("malformed signature")
+	}
+	global, err := base64.StdEncoding.DecodeString(strings.TrimSpace(lines[3]))
+	if err != nil || len(global) != ed25519.SignatureSize {
+		return nil, fmt.Errorf("malformed global signature")
+	}
+	sig := &signature{alg: string(p[:2]), sig: p[2+KEY_ID_SIZE:], trustedComment: strings.TrimPrefix(lines[2], "trusted comment: "), global: global}
+	copy(sig.keyID[:], p[2:])
+	return sig, nil
+}
+
+// verify checks the signature of message against the trusted keys and returns the key that made it
+func (sig *signature) verify(message []byte, keys []*publicKey) (*publicKey, error) {
+	var pk *publicKey
+	for _, key := range keys {
+		if key.id == sig.keyID {
+			pk = key
+			break
+		}
+	}
+	if pk == nil {
+		return nil, fmt.Errorf("signed with untrusted key %s", keyID(sig.keyID))
+	}
+	signed := message
+	switch sig.alg {
+	case SIG_PREHASHED:
+		hash := blake2b.Sum512(message)
+		signed = hash[:]
+	case SIG_LEGACY:
+	default:
+		return nil, fmt.Errorf("unsupported signature algorithm %q", sig.alg)
+	}
+	if !ed25519.Verify(pk.key, signed, sig.sig) {
+		return nil, fmt.Errorf("signature verification failed")
+	}
+	if !ed25519.Verify(pk.key, append(append([]byte(nil), sig.sig...), sig.trustedComment...), sig.global) {
+		return nil, fmt.Errorf("trusted comment verification failed")
+	}
+	return pk, nil
+}
+
+// trustedComment returns the comment signed along with a file, as minisign writes it
+func trustedComment(name string) string {
+	return fmt.Sprintf("timestamp:%d\tfile:%s", time.Now().Unix(), name)
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"strings"
+	"testing"
+)
+
+// fixedKey returns a key pair derived from a fixed seed, so signatures are reproducible
+func fixedKey(seed byte, id string) *secretKey {
+	sk := &secretKey{key: ed25519.NewKeyFromSeed(bytes.Repeat([]byte{seed}, ed25519.SeedSize))}
+	copy(sk.id[:], id)
+	return sk
+}
+
+// replaceLine replaces one line of a signature file
+func replaceLine(text string, i int, line string) string {
+	lines := strings.Split(text, "\n")
+	lines[i] = line
+	return strings.Join(lines, "\n")
+}
+
+func TestSignatureVerify(t *testing.T) {
+	trusted := fixedKey(1, "TRUSTED!")
+	untrusted := fixedKey(2, "STRANGER")
+	keys := []*publicKey{trusted.public()}
+	message := []byte(`{"images": [{"stage": "bl1", "sha256": "00"}]}`)
+	signed := string(trusted.sign(message, "timestamp:1700000000\tfile:manifest.json"))
+
+	//A legacy signature over the message itself, as older minisign versions produce
+	legacy := base64.StdEncoding.EncodeToString(append(append([]byte(SIG_LEGACY), trusted.id[:]...), ed25519.Sign(trusted.key, message)...))
+	legacySig, _ := base64.StdEncoding.DecodeString(legacy)
+	legacyGlobal := ed25519.Sign(trusted.key, append(bytes.Clone(legacySig[2+KEY_ID_SIZE:]), "legacy"...))
+
+	tests := []struct {
+		name    string
+		sig     string
+		message []byte
+		err     string // Expected error, empty for a valid signature
+	}{
+		{name: "valid", sig: signed, message: message},
+		{name: "valid with CRLF", sig: strings.ReplaceAll(signed, "\n", "\r\n"), message: message},
+		{name: "valid legacy", message: message, sig: "untrusted comment: legacy\n" + legacy + "\ntrusted comment: legacy\n" +
+			base64.StdEncoding.EncodeToString(legacyGlobal) + "\n"},
+		{name: "untrusted key", sig: string(untrusted.sign(message, "comment")), message: message, err: "signed with untrusted key 5245474E41525453"},
+		{name: "tampered message", sig: signed, message: append(bytes.Clone(message), ' '), err: "signature verification failed"},
+		{name: "tampered trusted comment", sig: replaceLine(signed, 2, "trusted comment: timestamp:1800000000\tfile:other.json"), message: message, err: "trusted comment verification failed"},
+		{name: "global signature by another key", sig: replaceLine(signed, 3, base64.StdEncoding.EncodeToString(ed25519.Sign(untrusted.key, []byte("x")))), message: message, err: "trusted comment verification failed"},
+		{name: "empty", sig: "", err: "malformed signature"},
+		{name: "missing untrusted comment", sig: replaceLine(signed, 0, "comment: none"), err: "malformed signature"},
+		{name: "missing trusted comment", sig: replaceLine(signed, 2, "trusted: comment"), err: "malformed signature"},
+		{name: "signature not base64", sig: replaceLine(signed, 1, "not base64!"), err: "malformed signature"},
+		{name: "short signature", sig: replaceLine(signed, 1, base64.StdEncoding.EncodeToString([]byte("EDshort"))), err: "malformed signature"},
+		{name: "short global signature", sig: replaceLine(signed, 3, base64.StdEncoding.EncodeToString([]byte("short"))), err: "malformed global signature"},
+		{name: "unknown algorithm", sig: replaceLine(signed, 1, base64.StdEncoding.EncodeToString(append([]byte("XX"), legacySig[2:]...))), message: message, err: `unsupported signature algorithm "XX"`},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			sig, err := parseSignature(test.sig)
+			var pk *publicKey
+			if err == nil {
+				pk, err = sig.verify(test.message, keys)
+			}
+			if test.err == "" {
+				if err != nil {
+					t.Fatalf("verification failed: %v", err)
+				}
+				if pk.ID() != trusted.public().ID() {
+					t.Errorf("verified with key %s, want %s", pk.ID(), trusted.public().ID())
+				}
+				return
+			}
+			if err == nil || err.Error() != test.err {
+				t.Errorf("error = %v, want %q", err, test.err)
+			}
+		})
+	}
+}
+
+func TestSignatureKeys(t *testing.T) {
+	sk := fixedKey(3, "KEYFILE!")
+	pk, err := parsePublicKey(string(sk.public().encode()))
+	if err != nil {
+		t.Fatalf("parsePublicKey failed: %v", err)
+	}
+	if pk.id != sk.id || !pk.key.Equal(sk.key.Public()) {
+		t.Error("public key changed through encoding")
+	}
+	parsed, err := parseSecretKey(string(sk.encode()))
+	if err != nil {
+		t.Fatalf("parseSecretKey failed: %v", err)
+	}
+	if parsed.id != sk.id || !parsed.key.Equal(sk.key) {
+		t.Error("secret key changed through encoding")
+	}
+
+	//The base64 line alone is accepted as a trusted key
+	line := strings.Split(string(sk.public().encode()), "\n")[1]
+	keys, err := loadTrustedKeys([]string{line})
+	if err != nil || len(keys) != 1 || keys[0].ID() != sk.public().ID() {
+		t.Errorf("loadTrustedKeys(inline) = %v, %v", keys, err)
+	}
+
+	//A secret key with a corrupted checksum
+	lines := strings.Split(string(sk.encode()), "\n")
+	p, _ := base64.StdEncoding.DecodeString(lines[1])
+	p[len(p)-1] ^= 0xff
+	lines[1] = base64.StdEncoding.EncodeToString(p)
+	for text, want := range map[string]string{
+		"":                           "no key found",
+		"untrusted comment: only\n":  "no key found",
+		"RWQ=":                       "not an ed25519 public key",
+		strings.Join(lines, "\n"):    "secret key checksum mismatch",
+		string(sk.public().encode()): "not an ed25519 secret key",
+	} {
+		_, errPublic := parsePublicKey(text)
+		_, errSecret := parseSecretKey(text)
+		if (errPublic == nil || errPublic.Error() != want) && (errSecret == nil || errSecret.Error() != want) {
+			t.Errorf("parsing %q = %v / %v, want %q", text, errPublic, errSecret, want)
+		}
+	}
+}
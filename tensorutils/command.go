@@ -1,15 +1,71 @@
 package tensorutils
 
-import "github.com/JoshuaDoes/crunchio"
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/JoshuaDoes/crunchio"
+)
 
 var (
 	OpDNW   = []byte("\x1BDNW")
 	CmdDNW  = NewCommand(OpDNW, nil, nil, nil)
 	CmdStop = NewCommand(OpDNW, make([]byte, 4), nil, []byte("\x01\x00"))
+
+	stopCmds = make(map[string]*Command) //Stage-specific stop frames, CmdStop is used otherwise
 )
 
+// GetStopCmd returns the stop frame that finalizes the given boot stage
+func GetStopCmd(stage string) *Command {
+	if cmd, exists := stopCmds[strings.ToLower(stage)]; exists {
+		return cmd
+	}
+	return CmdStop
+}
+
+// RegisterStopCmd overrides the stop frame sent after uploading the given boot stage
+func RegisterStopCmd(stage string, cmd *Command) {
+	stopCmds[strings.ToLower(stage)] = cmd
+}
+
+// NewFrame wraps data in a DNW frame: {ESC}DNW, the frame length, the data and a 16-bit sum of the data
+func NewFrame(data []byte) *Command {
+	var sum uint16
+	for _, b := range data {
+		sum += uint16(b)
+	}
+	return NewCommand(OpDNW, nil, data, []byte{byte(sum), byte(sum >> 8)})
+}
+
+// NewFrameFrom wraps size bytes read from r in a DNW frame like NewFrame without loading them into memory.
+// The data is read once up front to compute the sum, and again as the frame is sent.
+func NewFrameFrom(r io.ReaderAt, size int64) (*Command, error) {
+	var sum uint16
+	buf := make([]byte, 32*1024)
+	for offset := int64(0); offset < size; {
+		chunk := buf
+		if size-offset < int64(len(chunk)) {
+			chunk = chunk[:size-offset]
+		}
+		n, err := r.ReadAt(chunk, offset)
+		for _, b := range chunk[:n] {
+			sum += uint16(b)
+		}
+		offset += int64(n)
+		if err != nil && !(err == io.EOF && offset == size) {
+			return nil, fmt.Errorf("failed to read frame data at offset %d: %w", offset, err)
+		}
+	}
+	return NewCommandFrom(OpDNW, nil, r, size, []byte{byte(sum), byte(sum >> 8)}), nil
+}
+
 type Command struct {
 	cmd, arg, data, crc []byte
+
+	body io.ReaderAt //Streamed data, used instead of data if set
+	size int64       //Length of body
 }
 
 func NewCommand(cmd, arg, data, crc []byte) *Command {
@@ -21,7 +77,19 @@ func NewCommand(cmd, arg, data, crc []byte) *Command {
 	}
 }
 
-func (c *Command) Bytes() []byte {
+// NewCommandFrom returns a command whose data is size bytes read from body as the command is sent
+func NewCommandFrom(cmd, arg []byte, body io.ReaderAt, size int64, crc []byte) *Command {
+	return &Command{
+		cmd:  cmd,
+		arg:  arg,
+		body: body,
+		size: size,
+		crc:  crc,
+	}
+}
+
+// header returns the bytes preceding the data
+func (c *Command) header() []byte {
 	bytes := crunchio.NewBuffer(string(c.cmd))
 	if c.CmdLen() > 0 {
 		bytes.Write(c.Cmd()) //Usually 4 bytes, i.e. {ESC}DNW
@@ -31,13 +99,31 @@ func (c *Command) Bytes() []byte {
 			bytes.WriteAbstract(int32(4 + c.CmdLen() + c.CRCLen() + c.DataLen())) //Assume the argument is the command's byte length, including this
 		}
 	}
-	if c.DataLen() > 0 {
-		bytes.Write(c.Data())
+	return bytes.Bytes()
+}
+
+// Bytes returns the whole command, reading streamed data into memory. Use Reader to send large commands instead.
+func (c *Command) Bytes() ([]byte, error) {
+	p := make([]byte, c.Len())
+	if n, err := c.Reader().ReadAt(p, 0); n != len(p) {
+		return nil, fmt.Errorf("failed to read command data: read %d of %d bytes: %w", n, len(p), err)
 	}
-	if c.CRCLen() > 0 {
-		bytes.Write(c.CRC())
+	return p, nil
+}
+
+// Reader returns a reader over the whole command that reads streamed data as it goes
+func (c *Command) Reader() *io.SectionReader {
+	header := c.header()
+	var data io.ReaderAt = bytes.NewReader(c.data)
+	if c.body != nil {
+		data = c.body
 	}
-	return bytes.Bytes()
+	parts := joinedReaderAt{
+		io.NewSectionReader(bytes.NewReader(header), 0, int64(len(header))),
+		io.NewSectionReader(data, 0, int64(c.DataLen())),
+		io.NewSectionReader(bytes.NewReader(c.crc), 0, int64(c.CRCLen())),
+	}
+	return io.NewSectionReader(parts, 0, parts.size())
 }
 
 func (c *Command) Cmd() []byte {
@@ -48,8 +134,16 @@ func (c *Command) Arg() []byte {
 	return c.arg
 }
 
-func (c *Command) Data() []byte {
-	return c.data
+// Data returns the data of the command, reading streamed data into memory
+func (c *Command) Data() ([]byte, error) {
+	if c.body == nil {
+		return c.data, nil
+	}
+	data := make([]byte, c.size)
+	if n, err := io.NewSectionReader(c.body, 0, c.size).ReadAt(data, 0); n != len(data) {
+		return nil, fmt.Errorf("failed to read command data: read %d of %d bytes: %w", n, len(data), err)
+	}
+	return data, nil
 }
 
 func (c *Command) CRC() []byte {
@@ -65,7 +159,10 @@ func (c *Command) ArgLen() int {
 }
 
 func (c *Command) DataLen() int {
-	return len(c.Data())
+	if c.body != nil {
+		return int(c.size)
+	}
+	return len(c.data)
 }
 
 func (c *Command) CRCLen() int {
@@ -73,5 +170,50 @@ func (c *Command) CRCLen() int {
 }
 
 func (c *Command) Len() int {
-	return len(c.Bytes())
+	n := c.DataLen() + c.CRCLen()
+	if c.CmdLen() > 0 {
+		n += c.CmdLen() + 4
+		if c.ArgLen() > 0 {
+			n += c.ArgLen() - 4
+		}
+	}
+	return n
+}
+
+// joinedReaderAt reads its parts one after the other as if they were one
+type joinedReaderAt []*io.SectionReader
+
+func (parts joinedReaderAt) size() int64 {
+	var size int64
+	for _, part := range parts {
+		size += part.Size()
+	}
+	return size
+}
+
+func (parts joinedReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	read := 0
+	for _, part := range parts {
+		if len(p) == 0 {
+			break
+		}
+		if off >= part.Size() {
+			off -= part.Size()
+			continue
+		}
+		n, err := part.ReadAt(p, off)
+		read += n
+		if err != nil && err != io.EOF {
+			return read, err
+		}
+		if n < len(p) && int64(n) < part.Size()-off {
+			return read, io.ErrUnexpectedEOF //The source ended before the part did
+		}
+		p = p[n:]
+		off = 0
+	}
+	if len(p) > 0 {
+		return read, io.EOF
+	}
+	return read, nil
 }
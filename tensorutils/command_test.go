@@ -0,0 +1,82 @@
+package tensorutils
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestJoinedReaderAt(t *testing.T) {
+	parts := joinedReaderAt{
+		io.NewSectionReader(strings.NewReader("head"), 0, 4),
+		io.NewSectionReader(strings.NewReader(""), 0, 0),
+		io.NewSectionReader(strings.NewReader("data"), 0, 4),
+		io.NewSectionReader(strings.NewReader("crc"), 0, 3),
+	}
+	if parts.size() != 11 {
+		t.Fatalf("size() = %d, want 11", parts.size())
+	}
+
+	tests := []struct {
+		off  int64
+		n    int
+		want string
+		err  error
+	}{
+		{0, 11, "headdatacrc", nil},
+		{0, 4, "head", nil},
+		{2, 4, "adda", nil}, //Across the empty part
+		{6, 4, "tacr", nil},
+		{7, 10, "acrc", io.EOF},
+		{11, 1, "", io.EOF},
+		{20, 1, "", io.EOF},
+	}
+	for _, test := range tests {
+		p := make([]byte, test.n)
+		n, err := parts.ReadAt(p, test.off)
+		if string(p[:n]) != test.want || err != test.err {
+			t.Errorf("ReadAt(%d bytes at %d) = %q, %v, want %q, %v", test.n, test.off, p[:n], err, test.want, test.err)
+		}
+	}
+
+	//A source shorter than its part ends the read early
+	short := joinedReaderAt{
+		io.NewSectionReader(strings.NewReader("head"), 0, 4),
+		io.NewSectionReader(strings.NewReader("da"), 0, 4),
+		io.NewSectionReader(strings.NewReader("crc"), 0, 3),
+	}
+	p := make([]byte, 11)
+	if n, err := short.ReadAt(p, 0); n != 6 || err != io.ErrUnexpectedEOF {
+		t.Errorf("ReadAt over a short part = %d, %v, want 6, %v", n, err, io.ErrUnexpectedEOF)
+	}
+}
+
+func TestCommandStreamed(t *testing.T) {
+	data := []byte("bootloader stage")
+	memory, err := NewFrame(data).Bytes()
+	if err != nil {
+		t.Fatalf("Bytes failed: %v", err)
+	}
+	cmd, err := NewFrameFrom(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatalf("NewFrameFrom failed: %v", err)
+	}
+	streamed, err := cmd.Bytes()
+	if err != nil || !bytes.Equal(streamed, memory) {
+		t.Errorf("streamed frame = %x, %v, want %x", streamed, err, memory)
+	}
+	if p, err := io.ReadAll(cmd.Reader()); err != nil || !bytes.Equal(p, memory) {
+		t.Errorf("Reader read %x, %v, want %x", p, err, memory)
+	}
+
+	//A source that ends early is an error rather than a panic or a short command
+	truncated := NewCommandFrom(OpDNW, nil, strings.NewReader("boot"), int64(len(data)), []byte{0, 0})
+	if _, err := truncated.Bytes(); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("Bytes of a truncated command = %v, want %v", err, io.ErrUnexpectedEOF)
+	}
+	if _, err := truncated.Data(); err == nil {
+		t.Error("Data of a truncated command succeeded")
+	}
+}
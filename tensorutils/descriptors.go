@@ -0,0 +1,235 @@
+package tensorutils
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/google/gousb"
+)
+
+// Layout describes where the boot ROM's endpoints live, as read from the configuration descriptor
+type Layout struct {
+	Config      int
+	BulkIface   int
+	BulkAlt     int
+	IntIface    int //-1 if the device has no interrupt endpoint
+	IntAlt      int
+	EpOut       uint8
+	EpIn        uint8
+	EpInt       uint8
+	BulkPktSize int
+	IntPktSize  int
+	Discovered  bool //False when the layout fell back to the GS101_* constants
+}
+
+// DefaultLayout is the layout captured from a GS101, used when discovery fails
+var DefaultLayout = Layout{
+	Config:      GS101_CONFIG,
+	BulkIface:   GS101_BULK_IFACE,
+	BulkAlt:     GS101_ALT,
+	IntIface:    GS101_INT_IFACE,
+	IntAlt:      GS101_ALT,
+	EpOut:       GS101_EP_OUT,
+	EpIn:        GS101_EP_IN,
+	EpInt:       GS101_EP_INT,
+	BulkPktSize: GS101_BULK_PKT_SIZE,
+	IntPktSize:  GS101_INT_PKT_SIZE,
+}
+
+func (layout Layout) String() string {
+	source := "constants"
+	if layout.Discovered {
+		source = "descriptors"
+	}
+	interrupt := "none"
+	if layout.IntIface >= 0 {
+		interrupt = fmt.Sprintf("iface %d alt %d in 0x%02x/%d", layout.IntIface, layout.IntAlt, layout.EpInt, layout.IntPktSize)
+	}
+	return fmt.Sprintf("config %d, bulk iface %d alt %d out 0x%02x in 0x%02x/%d, interrupt %s (from %s)",
+		layout.Config, layout.BulkIface, layout.BulkAlt, layout.EpOut, layout.EpIn, layout.BulkPktSize, interrupt, source)
+}
+
+// DiscoverLayout locates the CDC data interface with its bulk endpoints and the interrupt endpoint
+// of the communications interface. Without CDC classes the first interface with a bulk pair is used.
+func DiscoverLayout(desc *gousb.DeviceDesc) (Layout, error) {
+	layout := Layout{IntIface: -1, Discovered: true}
+	for _, num := range sortedConfigs(desc) {
+		cfg := desc.Configs[num]
+		var fallback *gousb.InterfaceSetting
+		found := false
+		for _, intf := range cfg.Interfaces {
+			for i := range intf.AltSettings {
+				alt := &intf.AltSettings[i]
+				out, in, ok := bulkPair(alt)
+				if ok && !found && (alt.Class == gousb.ClassData || fallback == nil) {
+					if alt.Class == gousb.ClassData {
+						found = true
+					} else {
+						fallback = alt
+					}
+					layout.Config, layout.BulkIface, layout.BulkAlt = num, alt.Number, alt.Alternate
+					layout.EpOut, layout.EpIn = uint8(out.Address), uint8(in.Address)
+					layout.BulkPktSize = min(out.MaxPacketSize, in.MaxPacketSize)
+				}
+			}
+		}
+		if !found && fallback == nil {
+			continue
+		}
+
+		//The interrupt endpoint belongs to the communications interface, or any interface in this configuration
+		for _, intf := range cfg.Interfaces {
+			for _, alt := range intf.AltSettings {
+				for _, ep := range sortedEndpoints(alt) {
+					if ep.TransferType == gousb.TransferTypeInterrupt && ep.Direction == gousb.EndpointDirectionIn &&
+						(layout.IntIface < 0 || alt.Class == gousb.ClassComm) {
+						layout.IntIface, layout.IntAlt = alt.Number, alt.Alternate
+						layout.EpInt, layout.IntPktSize = uint8(ep.Address), ep.MaxPacketSize
+					}
+				}
+			}
+		}
+		if layout.BulkPktSize <= 0 {
+			layout.BulkPktSize = GS101_BULK_PKT_SIZE
+		}
+		if layout.IntPktSize <= 0 {
+			layout.IntPktSize = GS101_INT_PKT_SIZE
+		}
+		return layout, nil
+	}
+	return DefaultLayout, fmt.Errorf("no interface with a bulk IN and OUT endpoint")
+}
+
+// bulkPair returns the first bulk OUT and IN endpoints of an interface setting
+func bulkPair(alt *gousb.InterfaceSetting) (out, in gousb.EndpointDesc, ok bool) {
+	var hasOut, hasIn bool
+	for _, ep := range sortedEndpoints(*alt) {
+		if ep.TransferType != gousb.TransferTypeBulk {
+			continue
+		}
+		if ep.Direction == gousb.EndpointDirectionIn && !hasIn {
+			in, hasIn = ep, true
+		} else if ep.Direction == gousb.EndpointDirectionOut && !hasOut {
+			out, hasOut = ep, true
+		}
+	}
+	return out, in, hasOut && hasIn
+}
+
+func sortedConfigs(desc *gousb.DeviceDesc) []int {
+	nums := make([]int, 0, len(desc.Configs))
+	for num := range desc.Configs {
+		nums = append(nums, num)
+	}
+	sort.Ints(nums)
+	return nums
+}
+
+func sortedEndpoints(alt gousb.InterfaceSetting) []gousb.EndpointDesc {
+	eps := make([]gousb.EndpointDesc, 0, len(alt.Endpoints))
+	for _, ep := range alt.Endpoints {
+		eps = append(eps, ep)
+	}
+	sort.Slice(eps, func(i, j int) bool { return eps[i].Address < eps[j].Address })
+	return eps
+}
+
+// DescribeDevice formats the full descriptor tree of a device
+func DescribeDevice(desc *gousb.DeviceDesc) string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "Device %04x:%04x on bus %d address %d, port path %v, %s speed\n",
+		uint16(desc.Vendor), uint16(desc.Product), desc.Bus, desc.Address, desc.Path, desc.Speed)
+	fmt.Fprintf(&sb, "  bcdUSB %s, bcdDevice %s, class %s, subclass 0x%02x, protocol 0x%02x, ep0 max packet %d\n",
+		desc.Spec, desc.Device, desc.Class, uint8(desc.SubClass), uint8(desc.Protocol), desc.MaxControlPacketSize)
+	for _, num := range sortedConfigs(desc) {
+		cfg := desc.Configs[num]
+		fmt.Fprintf(&sb, "  Configuration %d: self powered %t, remote wakeup %t, max power %dmA\n",
+			cfg.Number, cfg.SelfPowered, cfg.RemoteWakeup, cfg.MaxPower)
+		for _, intf := range cfg.Interfaces {
+			for _, alt := range intf.AltSettings {
+				fmt.Fprintf(&sb, "    Interface %d alt %d: class %s, subclass 0x%02x, protocol 0x%02x\n",
+					alt.Number, alt.Alternate, alt.Class, uint8(alt.SubClass), uint8(alt.Protocol))
+				for _, ep := range sortedEndpoints(alt) {
+					fmt.Fprintf(&sb, "      Endpoint 0x%02x: %s %s, max packet %d", uint8(ep.Address), ep.TransferType, ep.Direction, ep.MaxPacketSize)
+					if ep.TransferType == gousb.TransferTypeInterrupt {
+						fmt.Fprintf(&sb, ", interval %s", ep.PollInterval)
+					}
+					sb.WriteByte('\n')
+				}
+			}
+		}
+	}
+	if layout, err := DiscoverLayout(desc); err == nil {
+		fmt.Fprintf(&sb, "  Discovered layout: %s\n", layout)
+	} else {
+		fmt.Fprintf(&sb, "  Discovered layout: %v, using %s\n", err, layout)
+	}
+	return sb.String()
+}
+
+// Ping reads the device descriptor over the control endpoint, which the boot ROM answers without side effects,
+// and checks that it belongs to the device's profile
+func (gs101 *GS101Device) Ping() error {
+	desc := make([]byte, 18)
+	n, err := gs101.Control(0x80, 0x06, 0x0100, 0, desc) //GET_DESCRIPTOR, device
+	if err != nil {
+		return err
+	}
+	if n < len(desc) || desc[1] != 0x01 {
+		return fmt.Errorf("malformed device descriptor: % x", desc[:n])
+	}
+	vid, pid := uint16(desc[8])|uint16(desc[9])<<8, uint16(desc[10])|uint16(desc[11])<<8
+	if vid != uint16(gs101.profile.VID) || pid != uint16(gs101.profile.PID) {
+		return fmt.Errorf("device descriptor reports %04X:%04X, expected %04X:%04X", vid, pid, uint16(gs101.profile.VID), uint16(gs101.profile.PID))
+	}
+	return nil
+}
+
+// DumpDescriptors writes the descriptor tree of every device matching a registered profile, or of every USB device if all is set
+func DumpDescriptors(w io.Writer, all bool) (int, error) {
+	ctx := gousb.NewContext()
+	defer ctx.Close()
+
+	devs, err := ctx.OpenDevices(func(desc *gousb.DeviceDesc) bool {
+		return all || registeredID(uint16(desc.Vendor), uint16(desc.Product))
+	})
+	defer func() {
+		for _, dev := range devs {
+			dev.Close()
+		}
+	}()
+	if len(devs) == 0 {
+		if err != nil {
+			return 0, fmt.Errorf("error opening devices: %w", err)
+		}
+		return 0, fmt.Errorf("descriptors: %w", ErrNoDevice)
+	}
+
+	for _, dev := range devs {
+		io.WriteString(w, DescribeDevice(dev.Desc))
+		strs := make(map[string]string)
+		for _, str := range []struct {
+			name string
+			get  func() (string, error)
+		}{{"Manufacturer", dev.Manufacturer}, {"Product", dev.Product}, {"Serial", dev.SerialNumber}} {
+			if value, err := str.get(); err == nil {
+				strs[str.name] = value
+				fmt.Fprintf(w, "  %s: %s\n", str.name, value)
+			}
+		}
+		profile := SelectProfile(DeviceIdentity{
+			VID:       uint16(dev.Desc.Vendor),
+			PID:       uint16(dev.Desc.Product),
+			BcdDevice: uint16(dev.Desc.Device),
+			Product:   strs["Product"],
+			Serial:    strs["Serial"],
+		})
+		if profile != nil {
+			fmt.Fprintf(w, "  Profile: %s\n", profile)
+		}
+		io.WriteString(w, "\n")
+	}
+	return len(devs), nil
+}
@@ -0,0 +1,171 @@
+package tensorutils
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/google/gousb"
+)
+
+// endpoint describes an endpoint by address, the direction is taken from the address
+func endpoint(address uint8, transfer gousb.TransferType, size int) gousb.EndpointDesc {
+	direction := gousb.EndpointDirectionOut
+	if address&0x80 != 0 {
+		direction = gousb.EndpointDirectionIn
+	}
+	return gousb.EndpointDesc{Address: gousb.EndpointAddress(address), Number: int(address & 0x0f), Direction: direction,
+		MaxPacketSize: size, TransferType: transfer}
+}
+
+// setting describes an alternate setting of an interface
+func setting(number, alternate int, class gousb.Class, endpoints ...gousb.EndpointDesc) gousb.InterfaceSetting {
+	alt := gousb.InterfaceSetting{Number: number, Alternate: alternate, Class: class, Endpoints: map[gousb.EndpointAddress]gousb.EndpointDesc{}}
+	for _, ep := range endpoints {
+		alt.Endpoints[ep.Address] = ep
+	}
+	return alt
+}
+
+// config describes a configuration, grouping the settings into interfaces by number
+func config(number int, settings ...gousb.InterfaceSetting) gousb.ConfigDesc {
+	cfg := gousb.ConfigDesc{Number: number}
+	for _, alt := range settings {
+		if n := len(cfg.Interfaces); n > 0 && cfg.Interfaces[n-1].Number == alt.Number {
+			cfg.Interfaces[n-1].AltSettings = append(cfg.Interfaces[n-1].AltSettings, alt)
+			continue
+		}
+		cfg.Interfaces = append(cfg.Interfaces, gousb.InterfaceDesc{Number: alt.Number, AltSettings: []gousb.InterfaceSetting{alt}})
+	}
+	return cfg
+}
+
+func device(configs ...gousb.ConfigDesc) *gousb.DeviceDesc {
+	desc := &gousb.DeviceDesc{Vendor: GS101_VID, Product: GS101_PID, Configs: map[int]gousb.ConfigDesc{}}
+	for _, cfg := range configs {
+		desc.Configs[cfg.Number] = cfg
+	}
+	return desc
+}
+
+var (
+	bulkOut  = endpoint(0x02, gousb.TransferTypeBulk, 512)
+	bulkIn   = endpoint(0x81, gousb.TransferTypeBulk, 512)
+	notifyIn = endpoint(0x83, gousb.TransferTypeInterrupt, 10)
+)
+
+func TestDiscoverLayout(t *testing.T) {
+	discovered := DefaultLayout
+	discovered.Discovered = true
+
+	tests := []struct {
+		name string
+		desc *gousb.DeviceDesc
+		want Layout
+	}{
+		{
+			"CDC with the interrupt endpoint",
+			device(config(1, setting(0, 0, gousb.ClassComm, notifyIn), setting(1, 0, gousb.ClassData, bulkOut, bulkIn))),
+			discovered,
+		},
+		{
+			"CDC data interface listed first",
+			device(config(1, setting(0, 0, gousb.ClassData, bulkIn, bulkOut), setting(1, 0, gousb.ClassComm, notifyIn))),
+			Layout{Config: 1, BulkIface: 0, IntIface: 1, EpOut: 0x02, EpIn: 0x81, EpInt: 0x83, BulkPktSize: 512, IntPktSize: 10, Discovered: true},
+		},
+		{
+			"bulk-only fallback",
+			device(config(1, setting(0, 0, gousb.ClassVendorSpec,
+				endpoint(0x01, gousb.TransferTypeBulk, 64), endpoint(0x82, gousb.TransferTypeBulk, 64)))),
+			Layout{Config: 1, IntIface: -1, EpOut: 0x01, EpIn: 0x82, BulkPktSize: 64, IntPktSize: GS101_INT_PKT_SIZE, Discovered: true},
+		},
+		{
+			"bulk-only with an interrupt endpoint of its own",
+			device(config(1, setting(0, 0, gousb.ClassVendorSpec, bulkOut, bulkIn, endpoint(0x84, gousb.TransferTypeInterrupt, 16)))),
+			Layout{Config: 1, EpOut: 0x02, EpIn: 0x81, EpInt: 0x84, BulkPktSize: 512, IntPktSize: 16, Discovered: true},
+		},
+		{
+			"data class preferred over an earlier vendor interface",
+			device(config(1, setting(0, 0, gousb.ClassVendorSpec, endpoint(0x03, gousb.TransferTypeBulk, 64), endpoint(0x84, gousb.TransferTypeBulk, 64)),
+				setting(1, 0, gousb.ClassData, bulkOut, bulkIn))),
+			Layout{Config: 1, BulkIface: 1, IntIface: -1, EpOut: 0x02, EpIn: 0x81, BulkPktSize: 512, IntPktSize: GS101_INT_PKT_SIZE, Discovered: true},
+		},
+		{
+			"communications interrupt preferred over another interface's",
+			device(config(1, setting(0, 0, gousb.ClassVendorSpec, endpoint(0x85, gousb.TransferTypeInterrupt, 8)),
+				setting(1, 0, gousb.ClassComm, notifyIn), setting(2, 0, gousb.ClassData, bulkOut, bulkIn))),
+			Layout{Config: 1, BulkIface: 2, IntIface: 1, EpOut: 0x02, EpIn: 0x81, EpInt: 0x83, BulkPktSize: 512, IntPktSize: 10, Discovered: true},
+		},
+		{
+			"multiple alt settings",
+			device(config(1, setting(0, 0, gousb.ClassComm, notifyIn),
+				setting(1, 0, gousb.ClassData), setting(1, 1, gousb.ClassData, bulkOut, endpoint(0x81, gousb.TransferTypeBulk, 64)),
+				setting(1, 2, gousb.ClassData, endpoint(0x04, gousb.TransferTypeBulk, 1024), endpoint(0x86, gousb.TransferTypeBulk, 1024)))),
+			Layout{Config: 1, BulkIface: 1, BulkAlt: 1, EpOut: 0x02, EpIn: 0x81, EpInt: 0x83, BulkPktSize: 64, IntPktSize: 10, Discovered: true},
+		},
+		{
+			"interrupt endpoint on an alt setting",
+			device(config(1, setting(0, 0, gousb.ClassComm), setting(0, 1, gousb.ClassComm, notifyIn), setting(1, 0, gousb.ClassData, bulkOut, bulkIn))),
+			Layout{Config: 1, BulkIface: 1, IntAlt: 1, EpOut: 0x02, EpIn: 0x81, EpInt: 0x83, BulkPktSize: 512, IntPktSize: 10, Discovered: true},
+		},
+		{
+			"first configuration with a bulk pair",
+			device(config(1, setting(0, 0, gousb.ClassComm, notifyIn), setting(1, 0, gousb.ClassData, bulkOut)),
+				config(2, setting(0, 0, gousb.ClassData, bulkOut, bulkIn))),
+			Layout{Config: 2, IntIface: -1, EpOut: 0x02, EpIn: 0x81, BulkPktSize: 512, IntPktSize: GS101_INT_PKT_SIZE, Discovered: true},
+		},
+		{
+			"packet sizes missing from the descriptors",
+			device(config(1, setting(0, 0, gousb.ClassData, endpoint(0x02, gousb.TransferTypeBulk, 0), endpoint(0x81, gousb.TransferTypeBulk, 0)))),
+			Layout{Config: 1, IntIface: -1, EpOut: 0x02, EpIn: 0x81, BulkPktSize: GS101_BULK_PKT_SIZE, IntPktSize: GS101_INT_PKT_SIZE, Discovered: true},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			layout, err := DiscoverLayout(test.desc)
+			if err != nil {
+				t.Fatalf("DiscoverLayout failed: %v", err)
+			}
+			if layout != test.want {
+				t.Errorf("layout = %s\nwant %s", layout, test.want)
+			}
+		})
+	}
+}
+
+func TestDiscoverLayoutMissingBulkPair(t *testing.T) {
+	tests := []struct {
+		name string
+		desc *gousb.DeviceDesc
+	}{
+		{"only bulk OUT", device(config(1, setting(0, 0, gousb.ClassComm, notifyIn), setting(1, 0, gousb.ClassData, bulkOut)))},
+		{"only bulk IN", device(config(1, setting(0, 0, gousb.ClassData, bulkIn)))},
+		{"pair split across interfaces", device(config(1, setting(0, 0, gousb.ClassData, bulkOut), setting(1, 0, gousb.ClassData, bulkIn)))},
+		{"pair split across alt settings", device(config(1, setting(0, 0, gousb.ClassData, bulkOut), setting(0, 1, gousb.ClassData, bulkIn)))},
+		{"interrupt endpoints only", device(config(1, setting(0, 0, gousb.ClassComm, notifyIn, endpoint(0x04, gousb.TransferTypeInterrupt, 10))))},
+		{"no configurations", device()},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			layout, err := DiscoverLayout(test.desc)
+			if err == nil || !strings.Contains(err.Error(), "no interface with a bulk IN and OUT endpoint") {
+				t.Errorf("DiscoverLayout error = %v, want a missing bulk pair", err)
+			}
+			if layout != DefaultLayout {
+				t.Errorf("layout = %s, want the GS101 defaults", layout)
+			}
+		})
+	}
+}
+
+func TestDescribeDevice(t *testing.T) {
+	desc := device(config(1, setting(0, 0, gousb.ClassComm, notifyIn), setting(1, 0, gousb.ClassData, bulkOut, bulkIn)))
+	described := DescribeDevice(desc)
+	for _, want := range []string{"Device 18d1:4f00", "Interface 1 alt 0", "Endpoint 0x83", "Discovered layout: config 1, bulk iface 1 alt 0 out 0x02 in 0x81/512"} {
+		if !strings.Contains(described, want) {
+			t.Errorf("description lacks %q:\n%s", want, described)
+		}
+	}
+	if described := DescribeDevice(device()); !strings.Contains(described, "no interface with a bulk IN and OUT endpoint, using") {
+		t.Errorf("description of a device without a bulk pair:\n%s", described)
+	}
+}
@@ -1,39 +1,231 @@
 package tensorutils
 
 import (
+	"fmt"
+	"sort"
 	"strings"
 	"sync"
 
+	"github.com/google/gousb"
+	"go.bug.st/serial"
 	"go.bug.st/serial/enumerator"
 )
 
-var (
-	mutexDevices sync.Mutex
-	knownDevices []*enumerator.PortDetails
-)
+// Manager owns enumeration, claiming and release of USB and serial devices. It is safe for concurrent use,
+// so several goroutines, or a daemon serving several clients, can acquire devices without handing out one twice.
+// Devices release their claim when closed.
+type Manager struct {
+	mutex sync.Mutex
+	ports []*enumerator.PortDetails //Serial ports seen by the last enumeration
+	dnw   map[string]*DNW           //Claimed serial ports by name
+	usb   map[string]*GS101Device   //Claimed USB devices by bus and port path
 
-func refreshDevices() {
-	mutexDevices.Lock()
-	defer mutexDevices.Unlock()
+	// Events is the bus the manager's devices publish to, DefaultBus if nil
+	Events *Bus
 
-	ports, err := enumerator.GetDetailedPortsList()
-	if err != nil {
-		return
+	enumerate func() ([]*enumerator.PortDetails, error)
+	openPort  func(name string) (serial.Port, error)
+}
+
+// DefaultManager is used by GetDNW, FindDNW and NewDeviceWithProfile
+var DefaultManager = NewManager()
+
+// NewManager returns a manager that enumerates the serial ports and USB devices of this machine
+func NewManager() *Manager {
+	return &Manager{
+		dnw:       make(map[string]*DNW),
+		usb:       make(map[string]*GS101Device),
+		enumerate: enumerator.GetDetailedPortsList,
+		openPort: func(name string) (serial.Port, error) {
+			return serial.Open(name, &serial.Mode{BaudRate: 115200, Parity: serial.NoParity, DataBits: 8, StopBits: serial.OneStopBit})
+		},
 	}
-	knownDevices = ports
 }
 
-func getDevice(vid, pid string) *enumerator.PortDetails {
-	mutexDevices.Lock()
-	defer mutexDevices.Unlock()
+// Refresh enumerates the serial ports again and closes claimed ports that went away
+func (m *Manager) Refresh() error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.refresh()
+}
+
+// refresh is Refresh for callers holding the mutex
+func (m *Manager) refresh() error {
+	ports, err := m.enumerate()
+	if err != nil {
+		return err
+	}
+	m.ports = ports
+
+	//Close ghosts, ports claimed for DNW that no longer exist
+	for name, dnw := range m.dnw {
+		found := false
+		for _, port := range ports {
+			if port.Name == name {
+				found = true
+				break
+			}
+		}
+		if !found {
+			dnw.unplugged.Store(true) //Published as a disconnect by the reader thread
+			dnw.close()
+			delete(m.dnw, name)
+		}
+	}
+	return nil
+}
 
-	for i := 0; i < len(knownDevices); i++ {
-		dev := knownDevices[i]
+// findPort returns the first serial port with the given VID and PID that isn't claimed, the caller must hold the mutex
+func (m *Manager) findPort(vid, pid string, skip map[string]bool) *enumerator.PortDetails {
+	for _, port := range m.ports {
 		// On Linux the identifiers are lowercase, so uppercase everything before comparison
-		if strings.ToUpper(dev.VID) != strings.ToUpper(vid) || strings.ToUpper(dev.PID) != strings.ToUpper(pid) {
+		if strings.ToUpper(port.VID) != strings.ToUpper(vid) || strings.ToUpper(port.PID) != strings.ToUpper(pid) {
 			continue
 		}
-		return dev
+		if _, claimed := m.dnw[port.Name]; claimed || skip[port.Name] {
+			continue
+		}
+		return port
 	}
 	return nil
 }
+
+// availableDNW returns the ports of devices compatible with DNW that aren't claimed yet, in device pair order.
+// The caller must hold the mutex.
+func (m *Manager) availableDNW() []*enumerator.PortDetails {
+	m.refresh()
+
+	//Find matching device pairs available for DNW, including those of registered profiles
+	var ports []*enumerator.PortDetails
+	listed := make(map[string]bool)
+	for _, pair := range dnwPairs() {
+		for port := m.findPort(pair[0], pair[1], listed); port != nil; port = m.findPort(pair[0], pair[1], listed) {
+			listed[port.Name] = true
+			ports = append(ports, port)
+		}
+	}
+	return ports
+}
+
+// FindDNW lists the serial ports of unclaimed devices compatible with DNW without opening them
+func (m *Manager) FindDNW() []string {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	var names []string
+	for _, port := range m.availableDNW() {
+		names = append(names, port.Name)
+	}
+	return names
+}
+
+// GetDNW finds the next device known to be compatible with DNW and claims it
+func (m *Manager) GetDNW() (*DNW, error) {
+	dnw, err := m.claimDNW()
+	if err != nil {
+		return nil, err
+	}
+	dnw.publish(Event{Kind: EventConnected})
+	return dnw, nil
+}
+
+func (m *Manager) claimDNW() (*DNW, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	for _, info := range m.availableDNW() {
+		port, err := m.openPort(info.Name)
+		if err != nil {
+			return nil, fmt.Errorf("dnw: failed to claim '%s': %w", info.Name, err)
+		}
+		dnw := newDNW(port, info, m)
+		m.dnw[info.Name] = dnw
+		packageLogger().Log(LogInfo, "DNW device claimed", Fields{FieldDevice: info.Name})
+		return dnw, nil
+	}
+	return nil, fmt.Errorf("dnw: %w", ErrNoDevice)
+}
+
+// OpenUSB claims the first unclaimed USB device matching the profile, or any registered profile if nil
+func (m *Manager) OpenUSB(profile *Profile) (*GS101Device, error) {
+	gs101 := newDevice(hostBus{}, m, profile)
+	gs101.handles.Lock()
+	err := gs101.connect()
+	gs101.handles.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	gs101.identifyChip()
+
+	gs101.log(LogInfo, strings.ToUpper(gs101.profile.Name)+" device connected", Fields{FieldProfile: gs101.profile.Name})
+	gs101.log(LogDebug, "Endpoint layout: "+gs101.Layout().String(), nil)
+	gs101.publish(Event{Kind: EventConnected})
+
+	return gs101, nil
+}
+
+// Claimed lists the serial ports and USB devices currently claimed through the manager
+func (m *Manager) Claimed() []string {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	var claimed []string
+	for name := range m.dnw {
+		claimed = append(claimed, "serial:"+name)
+	}
+	for key := range m.usb {
+		claimed = append(claimed, "usb:"+key)
+	}
+	sort.Strings(claimed)
+	return claimed
+}
+
+// usbKey identifies a USB device by where it is plugged in, which survives re-enumeration
+func usbKey(desc *gousb.DeviceDesc) string {
+	path := make([]string, len(desc.Path))
+	for i, port := range desc.Path {
+		path[i] = fmt.Sprint(port)
+	}
+	return fmt.Sprintf("%d-%s", desc.Bus, strings.Join(path, "."))
+}
+
+// claimUSB claims a USB device for gs101 unless another device holds it, reporting whether gs101 holds it now
+// and whether it was free before
+func (m *Manager) claimUSB(key string, gs101 *GS101Device) (claimed, free bool) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if owner, exists := m.usb[key]; exists {
+		return owner == gs101, false
+	}
+	m.usb[key] = gs101
+	return true, true
+}
+
+// unclaimUSB drops the claim gs101 holds on a USB device that couldn't be opened
+func (m *Manager) unclaimUSB(key string, gs101 *GS101Device) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.usb[key] == gs101 {
+		delete(m.usb, key)
+	}
+}
+
+// releaseDNW drops the claim on a serial port
+func (m *Manager) releaseDNW(dnw *DNW) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	for name, claimed := range m.dnw {
+		if claimed == dnw {
+			delete(m.dnw, name)
+		}
+	}
+}
+
+// releaseUSB drops the claim on a USB device
+func (m *Manager) releaseUSB(gs101 *GS101Device) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	for key, claimed := range m.usb {
+		if claimed == gs101 {
+			delete(m.usb, key)
+		}
+	}
+}
@@ -0,0 +1,284 @@
+package tensorutils
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"go.bug.st/serial"
+	"go.bug.st/serial/enumerator"
+)
+
+// errPortGone is returned when a port is opened after it was unplugged
+var errPortGone = errors.New("no such port")
+
+// fakePort is a serial port that never receives anything until it is closed
+type fakePort struct {
+	name   string
+	bus    *fakeBus
+	once   sync.Once
+	closed chan struct{}
+}
+
+func (port *fakePort) Read(p []byte) (int, error) {
+	select {
+	case <-port.closed:
+		return 0, io.EOF
+	case <-time.After(10 * time.Millisecond):
+		return 0, nil //Read timeout
+	}
+}
+
+func (port *fakePort) Write(p []byte) (int, error) { return len(p), nil }
+func (port *fakePort) Close() error {
+	port.once.Do(func() {
+		close(port.closed)
+		port.bus.closed(port.name)
+	})
+	return nil
+}
+func (port *fakePort) SetMode(*serial.Mode) error { return nil }
+func (port *fakePort) Drain() error               { return nil }
+func (port *fakePort) ResetInputBuffer() error    { return nil }
+func (port *fakePort) ResetOutputBuffer() error   { return nil }
+func (port *fakePort) SetDTR(bool) error          { return nil }
+func (port *fakePort) SetRTS(bool) error          { return nil }
+func (port *fakePort) GetModemStatusBits() (*serial.ModemStatusBits, error) {
+	return &serial.ModemStatusBits{}, nil
+}
+func (port *fakePort) SetReadTimeout(time.Duration) error { return nil }
+func (port *fakePort) Break(time.Duration) error          { return nil }
+
+// fakeBus is the set of serial ports present on a fake machine, it fails the test if a port is opened twice
+type fakeBus struct {
+	t      *testing.T
+	mutex  sync.Mutex
+	ports  map[string]*enumerator.PortDetails
+	open   map[string]*fakePort
+	opened int
+}
+
+func newFakeBus(t *testing.T, names ...string) *fakeBus {
+	bus := &fakeBus{t: t, ports: make(map[string]*enumerator.PortDetails), open: make(map[string]*fakePort)}
+	for _, name := range names {
+		bus.plug(name, "18D1", "4F00")
+	}
+	return bus
+}
+
+// manager returns a manager enumerating and opening the ports of the bus
+func (bus *fakeBus) manager() *Manager {
+	m := NewManager()
+	m.Events = NewBus()
+	m.enumerate = bus.enumerate
+	m.openPort = bus.openPort
+	return m
+}
+
+func (bus *fakeBus) plug(name, vid, pid string) {
+	bus.mutex.Lock()
+	defer bus.mutex.Unlock()
+	bus.ports[name] = &enumerator.PortDetails{Name: name, IsUSB: true, VID: vid, PID: pid}
+}
+
+func (bus *fakeBus) unplug(name string) {
+	bus.mutex.Lock()
+	defer bus.mutex.Unlock()
+	delete(bus.ports, name)
+}
+
+func (bus *fakeBus) enumerate() ([]*enumerator.PortDetails, error) {
+	bus.mutex.Lock()
+	defer bus.mutex.Unlock()
+	var ports []*enumerator.PortDetails
+	for _, port := range bus.ports {
+		details := *port
+		ports = append(ports, &details)
+	}
+	slices.SortFunc(ports, func(a, b *enumerator.PortDetails) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+	return ports, nil
+}
+
+func (bus *fakeBus) openPort(name string) (serial.Port, error) {
+	bus.mutex.Lock()
+	defer bus.mutex.Unlock()
+	if _, present := bus.ports[name]; !present {
+		return nil, fmt.Errorf("%s: %w", name, errPortGone)
+	}
+	if _, open := bus.open[name]; open {
+		bus.t.Errorf("port %s opened while it is still open", name)
+		return nil, fmt.Errorf("%s: port busy", name)
+	}
+	port := &fakePort{name: name, bus: bus, closed: make(chan struct{})}
+	bus.open[name] = port
+	bus.opened++
+	return port, nil
+}
+
+func (bus *fakeBus) closed(name string) {
+	bus.mutex.Lock()
+	defer bus.mutex.Unlock()
+	delete(bus.open, name)
+}
+
+func (bus *fakeBus) isOpen(name string) bool {
+	bus.mutex.Lock()
+	defer bus.mutex.Unlock()
+	_, open := bus.open[name]
+	return open
+}
+
+func TestManagerClaims(t *testing.T) {
+	bus := newFakeBus(t, "ttyACM0", "ttyACM1")
+	bus.plug("ttyUSB0", "0403", "6001") //Not a DNW device
+	m := bus.manager()
+
+	if names := m.FindDNW(); !slices.Equal(names, []string{"ttyACM0", "ttyACM1"}) {
+		t.Fatalf("FindDNW() = %q, want both DNW ports", names)
+	}
+	first, err := m.GetDNW()
+	if err != nil {
+		t.Fatalf("GetDNW failed: %v", err)
+	}
+	defer first.Close()
+	second, err := m.GetDNW()
+	if err != nil {
+		t.Fatalf("GetDNW failed: %v", err)
+	}
+	if first.GetPort() == second.GetPort() {
+		t.Fatalf("both claims got port %s", first.GetPort())
+	}
+	if _, err := m.GetDNW(); !errors.Is(err, ErrNoDevice) {
+		t.Errorf("GetDNW with every port claimed = %v, want ErrNoDevice", err)
+	}
+	if names := m.FindDNW(); len(names) != 0 {
+		t.Errorf("FindDNW() with every port claimed = %q", names)
+	}
+	if claimed := m.Claimed(); !slices.Equal(claimed, []string{"serial:ttyACM0", "serial:ttyACM1"}) {
+		t.Errorf("Claimed() = %q", claimed)
+	}
+
+	name := second.GetPort()
+	second.Close()
+	if bus.isOpen(name) {
+		t.Errorf("port %s is still open after Close", name)
+	}
+	third, err := m.GetDNW()
+	if err != nil {
+		t.Fatalf("GetDNW after Close failed: %v", err)
+	}
+	defer third.Close()
+	if third.GetPort() != name {
+		t.Errorf("GetDNW after Close claimed %s, want %s", third.GetPort(), name)
+	}
+}
+
+func TestManagerRefreshReleases(t *testing.T) {
+	bus := newFakeBus(t, "ttyACM0")
+	m := bus.manager()
+
+	dnw, err := m.GetDNW()
+	if err != nil {
+		t.Fatalf("GetDNW failed: %v", err)
+	}
+	events := m.Events.Subscribe(8, OverflowDropOldest, EventDisconnected, EventClosed)
+	defer events.Close()
+	bus.unplug("ttyACM0")
+	if err := m.Refresh(); err != nil {
+		t.Fatalf("Refresh failed: %v", err)
+	}
+	if !dnw.Closed() {
+		t.Error("claimed port is not closed after it went away")
+	}
+	if event, err := events.Next(time.Second); err != nil || event.Kind != EventDisconnected || event.Device != "ttyACM0" {
+		t.Errorf("event after the port went away = %v, %v, want a disconnect of ttyACM0", event, err)
+	}
+	if bus.isOpen("ttyACM0") {
+		t.Error("handle of the dropped port is still open")
+	}
+	if claimed := m.Claimed(); len(claimed) != 0 {
+		t.Errorf("Claimed() after the port went away = %q", claimed)
+	}
+
+	//The port comes back and is claimed again, closing the stale handle must not release the new claim
+	bus.plug("ttyACM0", "18D1", "4F00")
+	again, err := m.GetDNW()
+	if err != nil {
+		t.Fatalf("GetDNW after the port came back failed: %v", err)
+	}
+	defer again.Close()
+	dnw.Close()
+	if claimed := m.Claimed(); !slices.Equal(claimed, []string{"serial:ttyACM0"}) {
+		t.Errorf("Claimed() after closing the stale handle = %q", claimed)
+	}
+	if !bus.isOpen("ttyACM0") {
+		t.Error("closing the stale handle closed the new one")
+	}
+}
+
+func TestManagerConcurrent(t *testing.T) {
+	names := []string{"ttyACM0", "ttyACM1", "ttyACM2", "ttyACM3"}
+	bus := newFakeBus(t, names...)
+	m := bus.manager()
+
+	var claimers, hotplug sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		claimers.Add(1)
+		go func() {
+			defer claimers.Done()
+			for j := 0; j < 50; j++ {
+				dnw, err := m.GetDNW()
+				if err != nil {
+					if !errors.Is(err, ErrNoDevice) && !errors.Is(err, errPortGone) {
+						t.Errorf("GetDNW failed: %v", err)
+					}
+					continue
+				}
+				m.FindDNW()
+				dnw.Close()
+			}
+		}()
+	}
+	stop := make(chan struct{})
+	hotplug.Add(1)
+	go func() {
+		defer hotplug.Done()
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			//Unplug and replug a port while the others are being claimed and released
+			name := names[i%len(names)]
+			bus.unplug(name)
+			if err := m.Refresh(); err != nil {
+				t.Errorf("Refresh failed: %v", err)
+			}
+			bus.plug(name, "18D1", "4F00")
+			m.Claimed()
+		}
+	}()
+	claimers.Wait()
+	close(stop)
+	hotplug.Wait()
+
+	if claimed := m.Claimed(); len(claimed) != 0 {
+		t.Errorf("Claimed() after every device was closed = %q", claimed)
+	}
+	for _, name := range names {
+		if bus.isOpen(name) {
+			t.Errorf("port %s was left open", name)
+		}
+	}
+	if bus.opened == 0 {
+		t.Error("no port was ever claimed")
+	}
+}
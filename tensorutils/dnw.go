@@ -1,64 +1,46 @@
 package tensorutils
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
 	"io"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
-	"github.com/JoshuaDoes/crunchio"
 	"go.bug.st/serial"
 	"go.bug.st/serial/enumerator"
 )
 
+const (
+	DNW_TIMEOUT       = 5 * time.Second
+	DNW_MESSAGE_QUEUE = 256 //Messages kept for ReadMsg before the oldest are dropped
+	DNW_RAW_QUEUE     = 64  //Chunks of up to DNW_READ_SIZE bytes kept for Read before the oldest are dropped
+	DNW_READ_SIZE     = 10240
+)
+
 var (
+	mutexPairsDNW  sync.Mutex
 	devicePairsDNW = [][]string{
 		{"18D1", "4F00"}, //Google Pixel 6/6a/6Pro
 	}
-	claimDNW = make(map[string]*DNW)
 )
 
-// GetDNW finds the next device known to be compatible with DNW and claims it
+// GetDNW finds the next device known to be compatible with DNW and claims it through the DefaultManager
 func GetDNW() (*DNW, error) {
-	closeGhostsDNW()
-
-	//Find a matching device pair available for DNW
-	for i := 0; i < len(devicePairsDNW); i++ {
-		devPair := devicePairsDNW[i]
-		dev := getDevice(devPair[0], devPair[1])
-		if dev == nil {
-			continue
-		}
-
-		//Skip the device if it was already claimed for DNW
-		if _, exists := claimDNW[dev.Name]; exists {
-			continue
-		}
-
-		port, err := serial.Open(dev.Name, &serial.Mode{BaudRate: 115200, Parity: serial.NoParity, DataBits: 8, StopBits: serial.OneStopBit})
-		if err != nil {
-			return nil, fmt.Errorf("dnw: failed to claim '%s': %v", dev.Name, err)
-		}
-		port.SetReadTimeout(time.Millisecond * 200)
-
-		//Claim the DNW device
-		dnw := new(DNW)
-		dnw.port = port
-		dnw.info = dev
-		claimDNW[dev.Name] = dnw
-
-		//Lock the device mutex until the reader thread is started
-		dnw.mutex.Lock()
-
-		//Start the reader thread
-		go dnw.readThread()
+	return DefaultManager.GetDNW()
+}
 
-		return dnw, nil
-	}
-	return nil, fmt.Errorf("dnw: no device found")
+// FindDNW lists the serial ports of devices compatible with DNW without opening them
+func FindDNW() []string {
+	return DefaultManager.FindDNW()
 }
 
 func RegisterDevicePairDNW(vid, pid string) {
+	mutexPairsDNW.Lock()
+	defer mutexPairsDNW.Unlock()
 	found := false
 	for _, pair := range devicePairsDNW {
 		if pair[0] == vid && pair[1] == pid {
@@ -71,215 +53,271 @@ func RegisterDevicePairDNW(vid, pid string) {
 	}
 }
 
-func closeGhostsDNW() {
-	refreshDevices()
-	for port, dnw := range claimDNW {
-		found := false
-		for i := 0; i < len(knownDevices); i++ {
-			if knownDevices[i].Name == port {
-				found = true
-				break
-			}
-		}
+// dnwPairs returns the registered device pairs followed by those of the registered profiles
+func dnwPairs() [][]string {
+	mutexPairsDNW.Lock()
+	pairs := append([][]string(nil), devicePairsDNW...)
+	mutexPairsDNW.Unlock()
+	return append(pairs, profilePairs()...)
+}
 
-		if !found {
-			dnw.close()
-			delete(claimDNW, port)
+// newDNW wraps an opened serial port and starts its reader thread
+func newDNW(port serial.Port, info *enumerator.PortDetails, manager *Manager) *DNW {
+	port.SetReadTimeout(time.Millisecond * 200)
+	dnw := &DNW{port: port, info: info, manager: manager, stream: NewStream()}
+	dnw.messages = dnw.stream.SubscribeMessages(DNW_MESSAGE_QUEUE, OverflowDropOldest)
+	dnw.raw = dnw.stream.SubscribeRaw(DNW_RAW_QUEUE, OverflowDropOldest)
+	dnw.stream.notify = func(msg *Message) {
+		if msg.IsRequest() && msg.Device() != "" {
+			dnw.chip.Store(msg.Device())
 		}
+		dnw.publish(Event{Kind: EventMessage, Message: msg})
 	}
+
+	//Start the reader thread
+	go dnw.readThread()
+	return dnw
 }
 
 type DNW struct {
-	port serial.Port
-	info *enumerator.PortDetails
-
-	buffer *crunchio.Buffer //Used for writing the message queue
-	reader *crunchio.Buffer //Clone for reading the message queue
-
-	mutex  sync.Mutex
-	closed bool
+	port    serial.Port
+	info    *enumerator.PortDetails
+	manager *Manager //Releases the claim on Close
+
+	stream   *Stream                 //Everything the reader thread receives
+	messages *Subscription[*Message] //Queue behind ReadMsg
+	raw      *Subscription[[]byte]   //Queue behind Read
+	rest     []byte                  //Bytes of a queued chunk not returned by Read yet
+
+	mutex     sync.Mutex
+	closed    atomic.Bool  //Set by whichever of Close, the reader thread or the manager gets there first
+	chip      atomic.Value //Chip ID from the last stage request, published with events
+	sent      atomic.Int64 //Bytes of the last command or message handed to the port so far
+	unplugged atomic.Bool  //Set by the manager before it closes a port that went away
 }
 
+// ReadMsg waits for the next complete message
 func (dnw *DNW) ReadMsg() (*Message, error) {
-	dnw.mutex.Lock()
-	defer dnw.mutex.Unlock()
-
-	//Read from a clone of the message queue
-	return dnw.readMsg(dnw.reader)
+	msg, ok := <-dnw.messages.C()
+	if !ok {
+		return nil, fmt.Errorf("dnw: %w", ErrClosed)
+	}
+	return msg, nil
 }
 
-func (dnw *DNW) readMsg(r *crunchio.Buffer) (*Message, error) {
-	if dnw.buffer == nil {
-		return nil, fmt.Errorf("dnw: buffer was freed")
+// ReadMsgTimeout waits up to timeout for the next complete message
+func (dnw *DNW) ReadMsgTimeout(timeout time.Duration) (*Message, error) {
+	msg, err := dnw.messages.Next(timeout)
+	if errors.Is(err, ErrTimeout) {
+		return nil, fmt.Errorf("dnw: %w waiting for message", ErrTimeout)
 	}
+	if err != nil {
+		return nil, fmt.Errorf("dnw: %w", err)
+	}
+	return msg, nil
+}
 
-	buf := make([]byte, 0)
-	for {
-		p := make([]byte, 1)
-		n, err := dnw.read(r, p)
-		if err != nil {
-			if len(buf) > 0 {
-				return NewMessage(buf), err
-			}
-			return nil, err
-		}
-		if n != 1 {
-			if len(buf) > 0 {
-				//We haven't read a full message yet, but we have some data!
-				//Seek backwards and return an empty message so caller can try again on loop
-				r.Seek(int64(-1*len(buf)), io.SeekCurrent)
-				return nil, nil
-			}
-
-			//Nothing was read yet
-			if dnw.Closed() {
-				break
-			}
-			continue
-		}
-		b := p[0]
+// Messages subscribes to every message received from now on, independently of ReadMsg and other subscribers.
+// The subscription queues up to size messages and handles a full queue according to overflow, Close it when done.
+func (dnw *DNW) Messages(size int, overflow Overflow) *Subscription[*Message] {
+	return dnw.stream.SubscribeMessages(size, overflow)
+}
 
-		if b == '\n' || b == '\r' {
-			if len(buf) > 0 {
-				break //Parse what we've read so far
-			}
-			continue //Skip empty queued messages
-		}
+// Raw subscribes to every chunk of bytes received from now on, independently of Read and other subscribers.
+// The subscription queues up to size chunks and handles a full queue according to overflow, Close it when done.
+func (dnw *DNW) Raw(size int, overflow Overflow) *Subscription[[]byte] {
+	return dnw.stream.SubscribeRaw(size, overflow)
+}
 
-		buf = append(buf, b)
-	}
+// Stats returns how much was received and how much subscribers dropped
+func (dnw *DNW) Stats() StreamStats {
+	return dnw.stream.Stats()
+}
 
-	if len(buf) > 0 {
-		return NewMessage(buf), nil
-	}
-	return nil, nil
+// Skip discards everything queued so far, so only responses to the next write are read
+func (dnw *DNW) Skip() error {
+	dnw.mutex.Lock()
+	defer dnw.mutex.Unlock()
+	dnw.stream.Skip()
+	dnw.messages.Drain()
+	dnw.raw.Drain()
+	dnw.rest = nil
+	return nil
 }
+
+// Read returns the bytes received so far without waiting, up to len(p)
 func (dnw *DNW) Read(p []byte) (int, error) {
 	dnw.mutex.Lock()
 	defer dnw.mutex.Unlock()
-	if dnw.Closed() {
-		return 0, fmt.Errorf("dnw: closed")
+	n := 0
+	for n < len(p) {
+		if len(dnw.rest) == 0 {
+			select {
+			case chunk, ok := <-dnw.raw.C():
+				if !ok {
+					if n == 0 {
+						return 0, fmt.Errorf("dnw: %w", ErrClosed)
+					}
+					return n, nil
+				}
+				dnw.rest = chunk
+			default:
+				return n, nil
+			}
+		}
+		copied := copy(p[n:], dnw.rest)
+		dnw.rest = dnw.rest[copied:]
+		n += copied
 	}
-
-	return dnw.read(dnw.reader, p)
-}
-func (dnw *DNW) read(r *crunchio.Buffer, p []byte) (int, error) {
-	return r.Read(p)
+	return n, nil
 }
-func (dnw *DNW) readThread() {
-	dnw.buffer = crunchio.NewBuffer("EUB Writer", nil)
-	dnw.buffer.SetStream(true) //Don't return an EOF when waiting on data
-	dnw.reader = dnw.buffer.Reference()
-	dnw.reader.SetName("EUB Reader")
-
-	//Unlock the device's mutex to allow I/O operations
-	dnw.mutex.Unlock()
 
+func (dnw *DNW) readThread() {
 	for {
 		//Read the next chunk of data
-		p := make([]byte, 10240)
+		p := make([]byte, DNW_READ_SIZE)
 		n, err := dnw.port.Read(p)
+		if n > 0 || err != nil {
+			trace(TraceEvent{Kind: TraceSerial, Port: dnw.info.Name, Data: p[:n], Err: err})
+		}
 		if err != nil {
+			packageLogger().Log(LogDebug, fmt.Sprintf("dnw: reader stopped: %v", err), Fields{FieldDevice: dnw.info.Name})
 			break
 		}
 		if n == 0 {
 			continue
 		}
 
-		//Write it to the message queue
-		p = p[:n]
-		_, err = dnw.buffer.Write(p)
-		if err != nil {
+		//Hand it to the parser and subscribers
+		if _, err := dnw.stream.Write(p[:n]); err != nil {
 			break
 		}
 	}
 
+	dnw.stream.Close()
+	if stats := dnw.stream.Stats(); stats.Dropped > 0 || stats.Discarded > 0 {
+		packageLogger().Log(LogDebug, "dnw: receive stream: "+stats.String(), Fields{FieldDevice: dnw.info.Name})
+	}
+	if !dnw.Closed() || dnw.unplugged.Load() {
+		//The port failed under us, or the manager closed it once it went away, rather than being closed by its owner
+		dnw.publish(Event{Kind: EventDisconnected})
+	}
 	dnw.close()
+	dnw.release()
 }
 
+// publish sends an event about the port to the bus of its manager, or DefaultBus
+func (dnw *DNW) publish(event Event) {
+	event.Transport = "serial"
+	event.Device, event.Serial = dnw.info.Name, dnw.info.SerialNumber
+	if chip, ok := dnw.chip.Load().(string); ok {
+		event.Chip = chip
+	}
+	bus := DefaultBus
+	if dnw.manager != nil && dnw.manager.Events != nil {
+		bus = dnw.manager.Events
+	}
+	bus.Publish(event)
+}
+
+// WriteCmd sends a command in blocks, reading streamed data as it goes
 func (dnw *DNW) WriteCmd(cmd *Command) error {
 	if cmd == nil {
 		return fmt.Errorf("dnw: nil command")
 	}
-	return dnw.WriteMsg(NewMessage(cmd.Bytes()))
+	dnw.mutex.Lock()
+	defer dnw.mutex.Unlock()
+	if dnw.Closed() {
+		return fmt.Errorf("dnw: %w", ErrClosed)
+	}
+	return dnw.writeFrom(cmd.Reader())
 }
 func (dnw *DNW) WriteMsg(msg *Message) error {
 	dnw.mutex.Lock()
 	defer dnw.mutex.Unlock()
 	if dnw.Closed() {
-		return fmt.Errorf("dnw: closed")
+		return fmt.Errorf("dnw: %w", ErrClosed)
 	}
 
 	p := msg.Bytes()
+	return dnw.writeFrom(io.NewSectionReader(bytes.NewReader(p), 0, int64(len(p))))
+}
 
-	/*r := dnw.buffer.Reference()
-	defer r.Close()
-	r.Seek(0, io.SeekEnd) //Seek to the end of the buffer to only process new responses after writing each block*/
+// Sent returns how many bytes of the last command or message were handed to the port, it may be polled while it is written
+func (dnw *DNW) Sent() int64 {
+	return dnw.sent.Load()
+}
 
+// writeFrom writes everything r holds in blocks of DNW_READ_SIZE bytes, the caller must hold the mutex
+func (dnw *DNW) writeFrom(r *io.SectionReader) error {
 	//Write on loop until the end of message or error
-	blockSize := 10240
-	left := blockSize
-	wrote := 0
-	for {
+	size := r.Size()
+	block := make([]byte, DNW_READ_SIZE)
+	var wrote int64
+	dnw.sent.Store(0)
+	for wrote < size {
 		if dnw.Closed() {
-			return fmt.Errorf("dnw: closed but only wrote %d/%d bytes", wrote, len(p))
-		}
-
-		/*msg, err := dnw.readMsg(r)
-		if err != nil {
-			return fmt.Errorf("dnw: failed to read message after writing %d/%d bytes: %v", wrote, len(p), err)
+			return fmt.Errorf("dnw: %w but only wrote %d/%d bytes", ErrClosed, wrote, size)
 		}
-		if msg != nil {
-			switch msg.Command() {
-			case "C":
-				return fmt.Errorf("dnw: %s control received after writing %d/%d bytes", msg.Command(), wrote, len(p))
-			case "\x00":
-				return fmt.Errorf("dnw: 0x%0X control received after writing %d/%d bytes", msg.Command(), wrote, len(p))
-			case "eub":
-				switch msg.SubCommand() {
-				case "req":
-					return fmt.Errorf("dnw: new request received after writing %d/%d bytes", wrote, len(p))
-				case "ack":
-					return fmt.Errorf("dnw: ack received after writing %d/%d bytes", wrote, len(p))
-				case "nak":
-					return fmt.Errorf("dnw: nak received after writing %d/%d bytes", wrote, len(p))
-				}
-			}
-			fmt.Printf("dnw: received message after writing %d/%d bytes: %s\n", wrote, len(p), msg.String())
-		}*/
 
 		//Keep leftover bytes within msg bounds
-		if wrote+left >= len(p) {
-			left -= (wrote + left) - len(p)
+		left := block
+		if wrote+int64(len(left)) > size {
+			left = left[:size-wrote]
 		}
-
-		n, err := dnw.write(p[wrote : wrote+left])
-		wrote += n
-		if err != nil {
-			return fmt.Errorf("dnw: failed to write after %d/%d bytes: %v", wrote, len(p), err)
+		if n, err := r.ReadAt(left, wrote); n != len(left) {
+			return fmt.Errorf("dnw: failed to read after %d/%d bytes: %w", wrote, size, err)
 		}
-		if wrote >= len(p) {
-			break
+
+		for len(left) > 0 {
+			n, err := dnw.write(left)
+			wrote += int64(n)
+			dnw.sent.Store(wrote)
+			if err != nil {
+				return fmt.Errorf("dnw: failed to write after %d/%d bytes: %w", wrote, size, err)
+			}
+			if n == 0 {
+				return fmt.Errorf("dnw: only wrote %d/%d bytes", wrote, size)
+			}
+			left = left[n:]
 		}
 	}
-	if wrote != len(p) {
-		return fmt.Errorf("dnw: only wrote %d/%d bytes", wrote, len(p))
-	}
 
 	time.Sleep(1)
 	return nil
 }
+
+// Finalize sends the stop frame for the given stage, waits for the device to respond and evaluates the outcome
+func (dnw *DNW) Finalize(stage string) *Result {
+	if err := dnw.WriteCmd(GetStopCmd(stage)); err != nil {
+		res := Classify(stage, nil, fmt.Errorf("dnw: failed to send stop frame: %w", err))
+		if dnw.Closed() {
+			res.Outcome = OutcomeDisconnected
+		}
+		return res
+	}
+	msg, err := waitFinalize(stage, dnw.ReadMsgTimeout, DNW_TIMEOUT)
+	res := Classify(stage, msg, err)
+	packageLogger().Log(LogDebug, "dnw: stage finalized: "+res.String(), Fields{FieldDevice: dnw.info.Name, FieldStage: stage})
+	if res.Outcome == OutcomeUnknown && dnw.Closed() {
+		//The reader thread closes the port once the device goes away
+		res.Outcome = OutcomeDisconnected
+	}
+	return res
+}
+
 func (dnw *DNW) Write(p []byte) (int, error) {
 	dnw.mutex.Lock()
 	defer dnw.mutex.Unlock()
 	if dnw.Closed() {
-		return 0, fmt.Errorf("dnw: closed")
+		return 0, fmt.Errorf("dnw: %w", ErrClosed)
 	}
 
 	return dnw.write(p)
 }
 func (dnw *DNW) write(p []byte) (int, error) {
 	n, err := dnw.port.Write(p)
+	trace(TraceEvent{Kind: TraceSerial, Out: true, Port: dnw.info.Name, Data: p[:n], Err: err})
 	if err != nil {
 		return n, err
 	}
@@ -292,34 +330,37 @@ func (dnw *DNW) write(p []byte) (int, error) {
 func (dnw *DNW) Close() error {
 	dnw.mutex.Lock()
 	defer dnw.mutex.Unlock()
-	return dnw.close()
-}
-func (dnw *DNW) close() error {
 	if dnw.Closed() {
 		return nil
 	}
-	if err := dnw.port.Close(); err != nil {
+	if err := dnw.close(); err != nil {
 		return err
 	}
-	dnw.closed = true
+	dnw.release()
+	dnw.publish(Event{Kind: EventClosed})
 	return nil
 }
+
+// release drops the port's claim so it can be acquired again
+func (dnw *DNW) release() {
+	if dnw.manager != nil {
+		dnw.manager.releaseDNW(dnw)
+	}
+}
+func (dnw *DNW) close() error {
+	if !dnw.closed.CompareAndSwap(false, true) {
+		return nil
+	}
+	return dnw.port.Close()
+}
 func (dnw *DNW) Closed() bool {
-	return dnw.closed
+	return dnw.closed.Load()
 }
 func (dnw *DNW) Free() {
 	dnw.close()
-	dnw.buffer.Reset()
-	dnw.buffer = nil
-	dnw.reader = nil
-	dnw.info = nil
-}
-
-func (dnw *DNW) GetBuffer() *crunchio.Buffer {
-	if dnw.buffer == nil {
-		return nil
-	}
-	return dnw.buffer.Reference()
+	dnw.messages.Close()
+	dnw.raw.Close()
+	dnw.rest = nil
 }
 
 func (dnw *DNW) GetPort() string {
@@ -360,3 +401,24 @@ func (dnw *DNW) GetUSB() bool {
 	}
 	return dnw.info.IsUSB
 }
+
+// Profile returns the registered profile matching the port's USB IDs, or nil. When a profile can only tell the
+// device apart by its chip ID, it waits up to the announce timeout for a stage request carrying it.
+func (dnw *DNW) Profile() *Profile {
+	vid, _ := strconv.ParseUint(dnw.info.VID, 16, 16)
+	pid, _ := strconv.ParseUint(dnw.info.PID, 16, 16)
+	id := DeviceIdentity{VID: uint16(vid), PID: uint16(pid), Serial: dnw.info.SerialNumber}
+	profile := SelectProfile(id)
+	if profile == nil || !needsChipID(id) {
+		return profile
+	}
+	deadline := time.Now().Add(profile.announceTimeout())
+	for !dnw.Closed() && time.Now().Before(deadline) {
+		if chip, ok := dnw.chip.Load().(string); ok {
+			id.ChipID = chip
+			return SelectProfile(id)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return profile
+}
@@ -0,0 +1,78 @@
+package tensorutils
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/google/gousb"
+)
+
+// Sentinel errors returned by both transports, test for them with errors.Is
+var (
+	ErrNoDevice    = errors.New("no device found")
+	ErrClosed      = errors.New("device closed")
+	ErrStall       = errors.New("severe stall") //An endpoint stalled and could not be recovered
+	ErrTimeout     = errors.New("timed out")
+	ErrNak         = errors.New("nak received")
+	ErrHeaderFail  = errors.New("header fail")
+	ErrBootFailure = errors.New("boot failure")
+	ErrRerequest   = errors.New("stage requested again")                //The boot ROM rejected or restarted the stage, it doesn't say which
+	ErrBusy        = errors.New("interface claimed by a kernel driver") //i.e. cdc_acm, see SetAutoDetach
+)
+
+// TransferError describes a failed USB transfer, retrieve it with errors.As
+type TransferError struct {
+	Op       string //read, write or control
+	Endpoint uint8  //Endpoint address, i.e. 0x02
+	Offset   int    //Offset into the stage being sent, or -1 if not part of a stage
+	Err      error  //Underlying error, usually a gousb.TransferStatus or gousb.Error
+}
+
+func newTransferError(op string, endpoint uint8, err error) *TransferError {
+	return &TransferError{Op: op, Endpoint: endpoint, Offset: -1, Err: err}
+}
+
+func (e *TransferError) Error() string {
+	if e.Offset >= 0 {
+		return fmt.Sprintf("%s on endpoint 0x%02x failed at offset %d: %v", e.Op, e.Endpoint, e.Offset, e.Err)
+	}
+	return fmt.Sprintf("%s on endpoint 0x%02x failed: %v", e.Op, e.Endpoint, e.Err)
+}
+
+func (e *TransferError) Unwrap() error {
+	return e.Err
+}
+
+// Is matches the sentinel that the underlying gousb status maps to
+func (e *TransferError) Is(target error) bool {
+	return target != nil && usbSentinel(e.Err) == target
+}
+
+// usbSentinel maps gousb transfer statuses and libusb error codes to our sentinels, or nil if there is none
+func usbSentinel(err error) error {
+	var status gousb.TransferStatus
+	if errors.As(err, &status) {
+		switch status {
+		case gousb.TransferStall:
+			return ErrStall
+		case gousb.TransferTimedOut:
+			return ErrTimeout
+		case gousb.TransferNoDevice:
+			return ErrNoDevice
+		}
+		return nil
+	}
+
+	var code gousb.Error
+	if errors.As(err, &code) {
+		switch code {
+		case gousb.ErrorPipe:
+			return ErrStall
+		case gousb.ErrorTimeout:
+			return ErrTimeout
+		case gousb.ErrorNoDevice:
+			return ErrNoDevice
+		}
+	}
+	return nil
+}
@@ -0,0 +1,161 @@
+package tensorutils
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// EventKind is what happened on a transport
+type EventKind int
+
+const (
+	EventConnected    EventKind = iota //The device was opened, or reopened after re-enumeration
+	EventMessage                       //A complete message was received
+	EventStalled                       //A transfer stalled
+	EventReset                         //A recovery action succeeded, see Action
+	EventDisconnected                  //The device went away
+	EventClosed                        //The device was closed by its owner
+)
+
+var eventKindNames = map[EventKind]string{
+	EventConnected:    "connected",
+	EventMessage:      "message",
+	EventStalled:      "stalled",
+	EventReset:        "reset",
+	EventDisconnected: "disconnected",
+	EventClosed:       "closed",
+}
+
+func (kind EventKind) String() string {
+	if name, exists := eventKindNames[kind]; exists {
+		return name
+	}
+	return fmt.Sprintf("event(%d)", int(kind))
+}
+
+func (kind EventKind) MarshalText() ([]byte, error) {
+	return []byte(kind.String()), nil
+}
+
+// Event is published on a Bus by both transports
+type Event struct {
+	Kind      EventKind
+	Time      time.Time
+	Transport string         //usb or serial
+	Device    string         //Description of the device, as returned by GetDeviceInfo or the serial port
+	Serial    string         //USB serial number of the device, when known
+	Chip      string         //Chip ID the device announced in its last stage request, when known
+	Message   *Message       //Set for EventMessage
+	Action    RecoveryAction //Set for EventReset
+	Endpoint  uint8          //Set for USB transfer events
+	Err       error          //Set for EventStalled and EventDisconnected when known
+}
+
+func (event Event) String() string {
+	s := fmt.Sprintf("%s %s", event.Transport, event.Kind)
+	switch event.Kind {
+	case EventMessage:
+		s += ": " + event.Message.String()
+	case EventReset:
+		s += ": " + event.Action.String()
+	}
+	if event.Endpoint != 0 {
+		s += fmt.Sprintf(" endpoint 0x%02x", event.Endpoint)
+	}
+	if event.Err != nil {
+		s += fmt.Sprintf(" (%v)", event.Err)
+	}
+	return s
+}
+
+func (event Event) MarshalJSON() ([]byte, error) {
+	v := struct {
+		Kind      EventKind `json:"kind"`
+		Time      time.Time `json:"time"`
+		Transport string    `json:"transport"`
+		Device    string    `json:"device,omitempty"`
+		Serial    string    `json:"serial,omitempty"`
+		Chip      string    `json:"chip,omitempty"`
+		Message   string    `json:"message,omitempty"`
+		Action    string    `json:"action,omitempty"`
+		Endpoint  string    `json:"endpoint,omitempty"`
+		Error     string    `json:"error,omitempty"`
+	}{Kind: event.Kind, Time: event.Time, Transport: event.Transport, Device: event.Device, Serial: event.Serial, Chip: event.Chip}
+	if event.Message != nil {
+		v.Message = event.Message.String()
+	}
+	if event.Kind == EventReset {
+		v.Action = event.Action.String()
+	}
+	if event.Endpoint != 0 {
+		v.Endpoint = endpointField(event.Endpoint)
+	}
+	if event.Err != nil {
+		v.Error = event.Err.Error()
+	}
+	return json.Marshal(v)
+}
+
+// Bus fans events out to subscriptions, each with its own bounded queue, so flashing logic, loggers, UIs and
+// recorders all see every event without taking it from one another
+type Bus struct {
+	mutex      sync.Mutex
+	publishing sync.Mutex //Keeps events in order across publishing goroutines
+	subs       []busSubscription
+	dropped    atomic.Uint64
+}
+
+type busSubscription struct {
+	sub   *Subscription[Event]
+	kinds []EventKind //Every kind if empty
+}
+
+// DefaultBus receives the events of the DefaultManager's devices and of simulators
+var DefaultBus = NewBus()
+
+// NewBus returns a bus without subscriptions
+func NewBus() *Bus {
+	return &Bus{}
+}
+
+// Subscribe delivers every event of the given kinds published from now on, or of every kind if none are given.
+// The subscription queues up to size events and handles a full queue according to overflow. With OverflowBlock
+// the transports wait for the subscriber, so it must keep reading until it is closed.
+func (bus *Bus) Subscribe(size int, overflow Overflow, kinds ...EventKind) *Subscription[Event] {
+	bus.mutex.Lock()
+	defer bus.mutex.Unlock()
+	sub := newSubscription[Event](size, overflow, &bus.dropped)
+	sub.remove = func() {
+		bus.mutex.Lock()
+		defer bus.mutex.Unlock()
+		bus.subs = slices.DeleteFunc(bus.subs, func(other busSubscription) bool { return other.sub == sub })
+	}
+	bus.subs = append(bus.subs, busSubscription{sub: sub, kinds: kinds})
+	return sub
+}
+
+// Publish delivers an event to every interested subscription, stamping it with the current time if unset
+func (bus *Bus) Publish(event Event) {
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	bus.publishing.Lock()
+	defer bus.publishing.Unlock()
+	bus.mutex.Lock()
+	subs := slices.Clone(bus.subs)
+	bus.mutex.Unlock()
+	for _, s := range subs {
+		if len(s.kinds) == 0 || slices.Contains(s.kinds, event.Kind) {
+			s.sub.push(event)
+		}
+	}
+}
+
+// Dropped returns how many events subscriptions dropped because their queue was full
+func (bus *Bus) Dropped() uint64 {
+	return bus.dropped.Load()
+}
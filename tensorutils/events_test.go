@@ -0,0 +1,160 @@
+package tensorutils
+
+import (
+	"encoding/json"
+	"errors"
+	"slices"
+	"testing"
+	"time"
+)
+
+// kinds returns the kinds of the events queued on a subscription
+func kinds(sub *Subscription[Event]) []EventKind {
+	var kinds []EventKind
+	for _, event := range queued(sub) {
+		kinds = append(kinds, event.Kind)
+	}
+	return kinds
+}
+
+func TestBusFanOut(t *testing.T) {
+	bus := NewBus()
+	first := bus.Subscribe(8, OverflowDropOldest)
+	second := bus.Subscribe(8, OverflowDropOldest)
+	published := []EventKind{EventConnected, EventMessage, EventStalled, EventClosed}
+	for _, kind := range published {
+		bus.Publish(Event{Kind: kind})
+	}
+	for i, sub := range []*Subscription[Event]{first, second} {
+		events := queued(sub)
+		if len(events) != len(published) {
+			t.Fatalf("subscription %d got %d events, want %d", i, len(events), len(published))
+		}
+		for j, event := range events {
+			if event.Kind != published[j] {
+				t.Errorf("subscription %d event %d = %s, want %s", i, j, event.Kind, published[j])
+			}
+			if event.Time.IsZero() {
+				t.Errorf("subscription %d event %d has no time", i, j)
+			}
+		}
+	}
+
+	stamped := time.Date(2026, 10, 18, 19, 0, 0, 0, time.UTC)
+	bus.Publish(Event{Kind: EventReset, Time: stamped})
+	if event, err := first.Next(time.Second); err != nil || !event.Time.Equal(stamped) {
+		t.Errorf("event with a time = %v, %v, want it kept", event.Time, err)
+	}
+}
+
+func TestBusKinds(t *testing.T) {
+	bus := NewBus()
+	failures := bus.Subscribe(8, OverflowDropOldest, EventStalled, EventDisconnected)
+	all := bus.Subscribe(8, OverflowDropOldest)
+	for _, kind := range []EventKind{EventConnected, EventStalled, EventMessage, EventDisconnected, EventClosed} {
+		bus.Publish(Event{Kind: kind})
+	}
+	if got := kinds(failures); !slices.Equal(got, []EventKind{EventStalled, EventDisconnected}) {
+		t.Errorf("filtered subscription got %v", got)
+	}
+	if got := kinds(all); len(got) != 5 {
+		t.Errorf("unfiltered subscription got %v, want every event", got)
+	}
+}
+
+func TestBusOverflow(t *testing.T) {
+	tests := []struct {
+		overflow Overflow
+		want     []EventKind
+	}{
+		{OverflowDropOldest, []EventKind{EventStalled, EventReset}},
+		{OverflowDropNewest, []EventKind{EventConnected, EventMessage}},
+	}
+	for _, test := range tests {
+		t.Run(test.overflow.String(), func(t *testing.T) {
+			bus := NewBus()
+			sub := bus.Subscribe(2, test.overflow)
+			roomy := bus.Subscribe(8, test.overflow)
+			for _, kind := range []EventKind{EventConnected, EventMessage, EventStalled, EventReset} {
+				bus.Publish(Event{Kind: kind})
+			}
+			if got := kinds(sub); !slices.Equal(got, test.want) {
+				t.Errorf("queued %v, want %v", got, test.want)
+			}
+			if sub.Dropped() != 2 || roomy.Dropped() != 0 || bus.Dropped() != 2 {
+				t.Errorf("dropped %d and %d, bus dropped %d, want 2, 0 and 2", sub.Dropped(), roomy.Dropped(), bus.Dropped())
+			}
+		})
+	}
+}
+
+func TestBusBlock(t *testing.T) {
+	bus := NewBus()
+	sub := bus.Subscribe(1, OverflowBlock)
+	bus.Publish(Event{Kind: EventConnected})
+
+	published := make(chan struct{})
+	go func() {
+		defer close(published)
+		bus.Publish(Event{Kind: EventMessage})
+	}()
+	select {
+	case <-published:
+		t.Fatal("Publish returned while the subscriber's queue was full")
+	case <-time.After(50 * time.Millisecond):
+	}
+	if got := []EventKind{(<-sub.C()).Kind, (<-sub.C()).Kind}; !slices.Equal(got, []EventKind{EventConnected, EventMessage}) {
+		t.Errorf("received %v", got)
+	}
+	within(t, published, "Publish")
+
+	//Closing the subscription releases a blocked publisher
+	bus.Publish(Event{Kind: EventStalled})
+	released := make(chan struct{})
+	go func() {
+		defer close(released)
+		bus.Publish(Event{Kind: EventReset})
+	}()
+	time.Sleep(20 * time.Millisecond)
+	sub.Close()
+	within(t, released, "Publish after Close")
+}
+
+func TestBusUnsubscribe(t *testing.T) {
+	bus := NewBus()
+	gone := bus.Subscribe(8, OverflowBlock)
+	kept := bus.Subscribe(8, OverflowDropOldest)
+	bus.Publish(Event{Kind: EventConnected})
+	gone.Close()
+	gone.Close() //Closing twice is harmless
+	bus.Publish(Event{Kind: EventClosed})
+
+	if got := kinds(gone); !slices.Equal(got, []EventKind{EventConnected}) {
+		t.Errorf("closed subscription got %v, want only what was published before Close", got)
+	}
+	if got := kinds(kept); !slices.Equal(got, []EventKind{EventConnected, EventClosed}) {
+		t.Errorf("remaining subscription got %v", got)
+	}
+	bus.mutex.Lock()
+	subs := len(bus.subs)
+	bus.mutex.Unlock()
+	if subs != 1 {
+		t.Errorf("bus holds %d subscriptions after one was closed, want 1", subs)
+	}
+	if _, err := gone.Next(10 * time.Millisecond); !errors.Is(err, ErrTimeout) {
+		t.Errorf("Next on a closed subscription = %v, want %v", err, ErrTimeout)
+	}
+}
+
+func TestEventJSON(t *testing.T) {
+	event := Event{Kind: EventStalled, Time: time.Date(2026, 10, 18, 19, 0, 0, 0, time.UTC), Transport: "usb",
+		Serial: "09845001", Endpoint: 0x02, Err: ErrStall}
+	p, err := json.Marshal(event)
+	if err != nil {
+		t.Fatalf("Marshal failed: %v", err)
+	}
+	want := `{"kind":"stalled","time":"2026-10-18T19:00:00Z","transport":"usb","serial":"09845001","endpoint":"0x02","error":"severe stall"}`
+	if string(p) != want {
+		t.Errorf("JSON = %s, want %s", p, want)
+	}
+}
@@ -0,0 +1,279 @@
+package tensorutils
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	FBPK_MAGIC       = "FBPK"
+	FBPK_VERSION     = 2
+	FBPK_HEADER_SIZE = 112 //Size of the v2 pack header
+	FBPK_ENTRY_SIZE  = 104 //Size of a v2 entry header
+	FBPK_MAX_ENTRIES = 1024
+
+	FBPK_PARTITION_TABLE = 0 //Entry types
+	FBPK_PARTITION_DATA  = 1
+	FBPK_SIDELOAD_DATA   = 2
+
+	FACTORY_MAX_DEPTH = 2 //Zips nested within the factory zip that are searched for the bootloader
+)
+
+// BootloaderPack is a bootloader image as shipped in factory images, an FBPK container holding every boot stage
+type BootloaderPack struct {
+	Platform string //SoC the pack is built for, i.e. gs101
+	Version  string //Bootloader version, i.e. slider-1.2-8893284
+	Entries  []PackEntry
+
+	r io.ReaderAt
+}
+
+// PackEntry is an image within a bootloader pack
+type PackEntry struct {
+	Type    uint32
+	Name    string
+	Product string
+	Offset  int64
+	Size    int64
+	Slotted bool
+	CRC32   uint32
+}
+
+// ReadBootloaderPack parses the FBPK v2 header and entry table of a bootloader image, leaving the stages in place
+func ReadBootloaderPack(r io.ReaderAt, size int64) (*BootloaderPack, error) {
+	var header struct {
+		Magic           [4]byte
+		Version         uint32
+		HeaderSize      uint32
+		EntryHeaderSize uint32
+		Platform        [16]byte
+		PackVersion     [64]byte
+		SlotType        uint32
+		DataAlign       uint32
+		TotalEntries    uint32
+		TotalSize       uint32
+	}
+	if err := binary.Read(io.NewSectionReader(r, 0, size), binary.LittleEndian, &header); err != nil {
+		return nil, fmt.Errorf("fbpk: failed to read header: %w", err)
+	}
+	if string(header.Magic[:]) != FBPK_MAGIC {
+		return nil, fmt.Errorf("fbpk: not a bootloader pack")
+	}
+	if header.Version != FBPK_VERSION {
+		return nil, fmt.Errorf("fbpk: unsupported version %d", header.Version)
+	}
+	if header.HeaderSize < FBPK_HEADER_SIZE || header.EntryHeaderSize < FBPK_ENTRY_SIZE || header.TotalEntries > FBPK_MAX_ENTRIES {
+		return nil, fmt.Errorf("fbpk: malformed header")
+	}
+
+	pack := &BootloaderPack{Platform: cString(header.Platform[:]), Version: cString(header.PackVersion[:]), r: r}
+	for i := uint32(0); i < header.TotalEntries; i++ {
+		var entry struct {
+			Type    uint32
+			Name    [36]byte
+			Product [40]byte
+			Offset  uint64
+			Size    uint64
+			Slotted uint32
+			CRC32   uint32
+		}
+		offset := int64(header.HeaderSize) + int64(i)*int64(header.EntryHeaderSize)
+		if err := binary.Read(io.NewSectionReader(r, offset, FBPK_ENTRY_SIZE), binary.LittleEndian, &entry); err != nil {
+			return nil, fmt.Errorf("fbpk: failed to read entry %d: %w", i, err)
+		}
+		if entry.Offset > uint64(size) || entry.Size > uint64(size)-entry.Offset {
+			return nil, fmt.Errorf("fbpk: entry %s lies outside of the pack", cString(entry.Name[:]))
+		}
+		pack.Entries = append(pack.Entries, PackEntry{
+			Type:    entry.Type,
+			Name:    cString(entry.Name[:]),
+			Product: cString(entry.Product[:]),
+			Offset:  int64(entry.Offset),
+			Size:    int64(entry.Size),
+			Slotted: entry.Slotted != 0,
+			CRC32:   entry.CRC32,
+		})
+	}
+	return pack, nil
+}
+
+// Stages lists the boot stages in the pack in pack order
+func (pack *BootloaderPack) Stages() []string {
+	var stages []string
+	for _, entry := range pack.Entries {
+		if entry.Type == FBPK_PARTITION_DATA {
+			stages = append(stages, entry.Name)
+		}
+	}
+	return stages
+}
+
+// Stage returns the image of a boot stage, read from the pack as it is sent
+func (pack *BootloaderPack) Stage(name string) (*Image, error) {
+	for _, entry := range pack.Entries {
+		if entry.Type == FBPK_PARTITION_DATA && sameStage(entry.Name, name) {
+			return NewImage(entry.Name, io.NewSectionReader(pack.r, entry.Offset, entry.Size), entry.Size), nil
+		}
+	}
+	return nil, fmt.Errorf("fbpk: no stage %s in the bootloader pack", name)
+}
+
+// StagesFor returns the stages of the profile's boot chain in boot chain order, failing if the pack lacks any
+func (pack *BootloaderPack) StagesFor(profile *Profile) ([]*Image, error) {
+	var images []*Image
+	var missing []string
+	for _, stage := range profile.Stages {
+		img, err := pack.Stage(stage)
+		if err != nil {
+			missing = append(missing, stage)
+			continue
+		}
+		images = append(images, img)
+	}
+	if len(missing) > 0 {
+		return nil, fmt.Errorf("fbpk: the bootloader pack lacks the %s stages %s", profile.Name, strings.Join(missing, ", "))
+	}
+	return images, nil
+}
+
+// Supports reports whether the pack was built for the profile's SoC, packs without a platform support any
+func (pack *BootloaderPack) Supports(profile *Profile) bool {
+	return pack.Platform == "" || strings.EqualFold(pack.Platform, profile.Name)
+}
+
+// Factory is a factory image zip opened in place. Google ships the bootloader pack next to an inner zip holding
+// the other images, both are searched without extracting anything to disk.
+type Factory struct {
+	Path       string
+	Bootloader string //Path of the bootloader pack within the zip, inner zips separated by !/
+	Pack       *BootloaderPack
+
+	file   *os.File
+	images []*Image //Nested zips and the bootloader pack, closed with the factory
+}
+
+// IsFactoryImage reports whether a file looks like a factory image zip
+func IsFactoryImage(name string) bool {
+	if strings.EqualFold(filepath.Ext(name), ".zip") {
+		return true
+	}
+	file, err := os.Open(name)
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+	magic := make([]byte, 4)
+	if _, err := io.ReadFull(file, magic); err != nil {
+		return false
+	}
+	return bytes.Equal(magic, []byte("PK\x03\x04"))
+}
+
+// OpenFactory opens a factory image zip and locates its bootloader pack
+func OpenFactory(name string) (*Factory, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	stat, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	factory := &Factory{Path: name, file: file}
+	archive, err := zip.NewReader(file, stat.Size())
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("factory: %w", err)
+	}
+	img, location, err := factory.findBootloader(archive, file, "", 0)
+	if err == nil && img == nil {
+		err = fmt.Errorf("no bootloader image found")
+	}
+	if err != nil {
+		factory.Close()
+		return nil, fmt.Errorf("factory: %w", err)
+	}
+	factory.Bootloader = location
+	if factory.Pack, err = ReadBootloaderPack(img, img.Size); err != nil {
+		factory.Close()
+		return nil, fmt.Errorf("factory: %s: %w", location, err)
+	}
+	return factory, nil
+}
+
+// findBootloader searches a zip for the bootloader pack, then the zips within it
+func (factory *Factory) findBootloader(archive *zip.Reader, r io.ReaderAt, prefix string, depth int) (*Image, string, error) {
+	for _, file := range archive.File {
+		base := path.Base(file.Name)
+		if strings.HasPrefix(base, "bootloader-") && strings.HasSuffix(base, ".img") {
+			img, err := factory.open(file, r)
+			return img, prefix + file.Name, err
+		}
+	}
+	if depth >= FACTORY_MAX_DEPTH {
+		return nil, "", nil
+	}
+	for _, file := range archive.File {
+		if !strings.HasSuffix(strings.ToLower(file.Name), ".zip") {
+			continue
+		}
+		img, err := factory.open(file, r)
+		if err != nil {
+			return nil, "", err
+		}
+		inner, err := zip.NewReader(img, img.Size)
+		if err != nil {
+			continue //Not a zip after all
+		}
+		found, location, err := factory.findBootloader(inner, img, prefix+file.Name+"!/", depth+1)
+		if found != nil || err != nil {
+			return found, location, err
+		}
+	}
+	return nil, "", nil
+}
+
+// open returns an image of a zip entry. Stored entries are read in place, compressed ones are decompressed
+// as they are read.
+func (factory *Factory) open(file *zip.File, r io.ReaderAt) (*Image, error) {
+	size := int64(file.UncompressedSize64)
+	var img *Image
+	if file.Method == zip.Store {
+		offset, err := file.DataOffset()
+		if err != nil {
+			return nil, err
+		}
+		img = NewImage(path.Base(file.Name), io.NewSectionReader(r, offset, size), size)
+	} else {
+		img = NewStreamImage(path.Base(file.Name), size, file.Open)
+	}
+	factory.images = append(factory.images, img)
+	return img, nil
+}
+
+// Close closes the zip and everything opened within it
+func (factory *Factory) Close() error {
+	var errs []error
+	for _, img := range factory.images {
+		errs = append(errs, img.Close())
+	}
+	errs = append(errs, factory.file.Close())
+	return errors.Join(errs...)
+}
+
+// cString returns the string up to the first NUL byte
+func cString(p []byte) string {
+	if i := bytes.IndexByte(p, 0); i >= 0 {
+		p = p[:i]
+	}
+	return string(p)
+}
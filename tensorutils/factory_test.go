@@ -0,0 +1,230 @@
+package tensorutils
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+type packStage struct {
+	name string
+	data []byte
+}
+
+// buildPack returns an FBPK v2 bootloader pack holding the given stages
+func buildPack(platform string, stages ...packStage) []byte {
+	var body bytes.Buffer
+	offset := FBPK_HEADER_SIZE + len(stages)*FBPK_ENTRY_SIZE
+	header := struct {
+		Magic           [4]byte
+		Version         uint32
+		HeaderSize      uint32
+		EntryHeaderSize uint32
+		Platform        [16]byte
+		PackVersion     [64]byte
+		SlotType        uint32
+		DataAlign       uint32
+		TotalEntries    uint32
+		TotalSize       uint32
+	}{Version: FBPK_VERSION, HeaderSize: FBPK_HEADER_SIZE, EntryHeaderSize: FBPK_ENTRY_SIZE, TotalEntries: uint32(len(stages))}
+	copy(header.Magic[:], FBPK_MAGIC)
+	copy(header.Platform[:], platform)
+	copy(header.PackVersion[:], "test-1.0")
+	binary.Write(&body, binary.LittleEndian, header)
+	for _, stage := range stages {
+		entry := struct {
+			Type    uint32
+			Name    [36]byte
+			Product [40]byte
+			Offset  uint64
+			Size    uint64
+			Slotted uint32
+			CRC32   uint32
+		}{Type: FBPK_PARTITION_DATA, Offset: uint64(offset), Size: uint64(len(stage.data))}
+		copy(entry.Name[:], stage.name)
+		binary.Write(&body, binary.LittleEndian, entry)
+		offset += len(stage.data)
+	}
+	for _, stage := range stages {
+		body.Write(stage.data)
+	}
+	return body.Bytes()
+}
+
+type zipEntry struct {
+	name string
+	data []byte
+}
+
+// buildZip returns a zip of the given entries, stored or deflated
+func buildZip(t *testing.T, store bool, entries ...zipEntry) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	archive := zip.NewWriter(&buf)
+	for _, entry := range entries {
+		method := zip.Deflate
+		if store {
+			method = zip.Store
+		}
+		w, err := archive.CreateHeader(&zip.FileHeader{Name: entry.name, Method: method})
+		if err != nil {
+			t.Fatalf("failed to add %s: %v", entry.name, err)
+		}
+		w.Write(entry.data)
+	}
+	if err := archive.Close(); err != nil {
+		t.Fatalf("failed to build zip: %v", err)
+	}
+	return buf.Bytes()
+}
+
+// writeFactory writes a factory image to a temporary file
+func writeFactory(t *testing.T, data []byte) string {
+	t.Helper()
+	name := filepath.Join(t.TempDir(), "factory.zip")
+	if err := os.WriteFile(name, data, 0o644); err != nil {
+		t.Fatalf("failed to write factory image: %v", err)
+	}
+	return name
+}
+
+func testPack() []byte {
+	return buildPack("gs101",
+		packStage{"bl1", bytes.Repeat([]byte{1}, 100)},
+		packStage{"pbl", bytes.Repeat([]byte{2}, 200)},
+		packStage{"abl", bytes.Repeat([]byte{3}, 300)})
+}
+
+func TestReadBootloaderPack(t *testing.T) {
+	data := testPack()
+	pack, err := ReadBootloaderPack(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatalf("ReadBootloaderPack failed: %v", err)
+	}
+	if pack.Platform != "gs101" || pack.Version != "test-1.0" {
+		t.Errorf("platform %q version %q", pack.Platform, pack.Version)
+	}
+	if stages := strings.Join(pack.Stages(), ","); stages != "bl1,pbl,abl" {
+		t.Errorf("Stages() = %s", stages)
+	}
+
+	//epbl is requested by the boot ROM for the pbl image
+	img, err := pack.Stage("epbl")
+	if err != nil {
+		t.Fatalf("Stage(epbl) failed: %v", err)
+	}
+	if p, err := img.Bytes(); err != nil || !bytes.Equal(p, bytes.Repeat([]byte{2}, 200)) {
+		t.Errorf("Stage(epbl) read %d bytes, err %v", len(p), err)
+	}
+	if _, err := pack.Stage("bl31"); err == nil || !strings.Contains(err.Error(), "no stage bl31") {
+		t.Errorf("Stage(bl31) = %v, want a missing stage error", err)
+	}
+	images, err := pack.StagesFor(&Profile{Name: "short", Stages: []string{"epbl", "bl1", "abl"}})
+	if err != nil {
+		t.Fatalf("StagesFor failed: %v", err)
+	}
+	var names []string
+	for _, img := range images {
+		names = append(names, img.Name)
+	}
+	if got := strings.Join(names, ","); got != "pbl,bl1,abl" {
+		t.Errorf("StagesFor = %s, want the boot chain order", got)
+	}
+	if _, err := pack.StagesFor(ProfileGS101); err == nil || !strings.Contains(err.Error(), "gs101 stages bl2, bl31, tzsw, ldfw, gsa") {
+		t.Errorf("StagesFor(gs101) = %v, want the missing stages named", err)
+	}
+	if !pack.Supports(ProfileGS101) || pack.Supports(ProfileExynos) {
+		t.Error("Supports does not match the pack platform")
+	}
+}
+
+func TestReadBootloaderPackMalformed(t *testing.T) {
+	valid := testPack()
+	badMagic := append([]byte("FBPX"), valid[4:]...)
+	badVersion := bytes.Clone(valid)
+	binary.LittleEndian.PutUint32(badVersion[4:], 3)
+	outside := bytes.Clone(valid)
+	binary.LittleEndian.PutUint64(outside[FBPK_HEADER_SIZE+4+36+40+8:], uint64(len(valid))) //Size of the first entry
+
+	tests := []struct {
+		name string
+		data []byte
+		want string
+	}{
+		{"empty", nil, "failed to read header"},
+		{"truncated header", valid[:FBPK_HEADER_SIZE/2], "failed to read header"},
+		{"truncated entry table", valid[:FBPK_HEADER_SIZE+FBPK_ENTRY_SIZE/2], "failed to read entry 0"},
+		{"bad magic", badMagic, "not a bootloader pack"},
+		{"bad version", badVersion, "unsupported version 3"},
+		{"entry outside of the pack", outside, "entry bl1 lies outside of the pack"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := ReadBootloaderPack(bytes.NewReader(test.data), int64(len(test.data)))
+			if err == nil || !strings.Contains(err.Error(), test.want) {
+				t.Errorf("error = %v, want %q", err, test.want)
+			}
+		})
+	}
+}
+
+func TestOpenFactory(t *testing.T) {
+	pack := zipEntry{"bootloader-test-1.0.img", testPack()}
+	nest := func(store bool, depth int) []byte {
+		data := buildZip(t, store, pack)
+		for i := 0; i < depth; i++ {
+			data = buildZip(t, store, zipEntry{"readme.txt", []byte("not it")}, zipEntry{"image-test.zip", data})
+		}
+		return data
+	}
+
+	tests := []struct {
+		name     string
+		data     []byte
+		location string //Bootloader location, or the error if it fails
+		fails    bool
+	}{
+		{"top level", nest(false, 0), "bootloader-test-1.0.img", false},
+		{"stored inner zip", nest(true, 1), "image-test.zip!/bootloader-test-1.0.img", false},
+		{"deflated at max depth", nest(false, FACTORY_MAX_DEPTH), strings.Repeat("image-test.zip!/", FACTORY_MAX_DEPTH) + "bootloader-test-1.0.img", false},
+		{"over max depth", nest(true, FACTORY_MAX_DEPTH+1), "factory: no bootloader image found", true},
+		{"no bootloader", buildZip(t, false, zipEntry{"boot.img", []byte("boot")}), "factory: no bootloader image found", true},
+		{"truncated bootloader", buildZip(t, true, zipEntry{pack.name, pack.data[:40]}), "factory: bootloader-test-1.0.img: fbpk: failed to read header", true},
+		{"not a zip", []byte("PK\x03\x04 but nothing else"), "factory: zip: not a valid zip file", true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			factory, err := OpenFactory(writeFactory(t, test.data))
+			if test.fails {
+				if err == nil {
+					factory.Close()
+					t.Fatalf("OpenFactory succeeded, want %q", test.location)
+				}
+				if !strings.Contains(err.Error(), test.location) {
+					t.Errorf("error = %v, want %q", err, test.location)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("OpenFactory failed: %v", err)
+			}
+			defer factory.Close()
+			if factory.Bootloader != test.location {
+				t.Errorf("bootloader at %s, want %s", factory.Bootloader, test.location)
+			}
+			img, err := factory.Pack.Stage("abl")
+			if err != nil {
+				t.Fatalf("Stage(abl) failed: %v", err)
+			}
+			p, err := io.ReadAll(img.Reader())
+			if err != nil || !bytes.Equal(p, bytes.Repeat([]byte{3}, 300)) {
+				t.Errorf("abl read %d bytes, err %v", len(p), err)
+			}
+		})
+	}
+}
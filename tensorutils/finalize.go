@@ -0,0 +1,40 @@
+package tensorutils
+
+import (
+	"fmt"
+	"time"
+)
+
+// waitFinalize reads messages until the device accepts or rejects the stage that was just sent.
+// An acknowledgement or a request for the next stage both count as acceptance, a request for the same stage
+// again means the boot ROM rejected or restarted it.
+func waitFinalize(stage string, readMsg func(time.Duration) (*Message, error), timeout time.Duration) (*Message, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		left := time.Until(deadline)
+		if left <= 0 {
+			return nil, fmt.Errorf("stage %s: %w without acknowledgement after %s", stage, ErrTimeout, timeout)
+		}
+
+		msg, err := readMsg(left)
+		if err != nil {
+			return msg, fmt.Errorf("stage %s: failed to read acknowledgement: %w", stage, err)
+		}
+		if msg == nil {
+			continue
+		}
+
+		switch {
+		case msg.IsRequest() && sameStage(msg.Argument(), stage):
+			return msg, fmt.Errorf("stage %s: %w", stage, ErrRerequest)
+		case msg.IsAck(), msg.IsRequest():
+			return msg, nil
+		case msg.IsNak():
+			return msg, fmt.Errorf("stage %s: %w", stage, ErrNak)
+		case msg.IsFailure() && msg.SubCommand() == "header fail":
+			return msg, fmt.Errorf("stage %s: %s: %w", stage, msg.Argument(), ErrHeaderFail)
+		case msg.IsFailure():
+			return msg, fmt.Errorf("stage %s: %s: %w", stage, msg.String(), ErrBootFailure)
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package tensorutils
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// scriptedReader returns the given messages in turn, then err, or waits out the timeout without one
+func scriptedReader(msgs []string, err error) func(time.Duration) (*Message, error) {
+	return func(timeout time.Duration) (*Message, error) {
+		if len(msgs) > 0 {
+			msg := NewMessage([]byte(msgs[0]))
+			msgs = msgs[1:]
+			return msg, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		time.Sleep(timeout)
+		return nil, nil
+	}
+}
+
+func TestWaitFinalize(t *testing.T) {
+	tests := []struct {
+		name    string
+		msgs    []string
+		err     error //Returned by the reader once the messages ran out
+		outcome Outcome
+		want    error //Expected in the error chain, nil once accepted
+	}{
+		{"ack", []string{"eub:ack"}, nil, OutcomeAccepted, nil},
+		{"next stage requested", []string{"eub:req:09845001:pbl"}, nil, OutcomeAccepted, nil},
+		{"next stage after noise", []string{"\r", "exynos_usb_booting", "eub:req:09845001:abl"}, nil, OutcomeAccepted, nil},
+		{"same stage requested", []string{"eub:req:09845001:bl1"}, nil, OutcomeUnknown, ErrRerequest},
+		{"same stage in upper case", []string{"eub:req:09845001:BL1"}, nil, OutcomeUnknown, ErrRerequest},
+		{"nak", []string{"eub:nak"}, nil, OutcomeRejectedHeader, ErrNak},
+		{"header fail", []string{"bl1 header fail"}, nil, OutcomeRejectedHeader, ErrHeaderFail},
+		{"booting failure", []string{"eub:irom_booting_failure"}, nil, OutcomeBootFailure, ErrBootFailure},
+		{"timeout", nil, nil, OutcomeUnknown, ErrTimeout},
+		{"disconnect", []string{"exynos_usb_booting"}, fmt.Errorf("read: %w", ErrNoDevice), OutcomeDisconnected, ErrNoDevice},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			msg, err := waitFinalize("bl1", scriptedReader(test.msgs, test.err), 20*time.Millisecond)
+			if test.want == nil && err != nil || test.want != nil && !errors.Is(err, test.want) {
+				t.Errorf("waitFinalize error = %v, want %v", err, test.want)
+			}
+			res := Classify("bl1", msg, err)
+			if res.Outcome != test.outcome {
+				t.Errorf("outcome = %s, want %s", res.Outcome, test.outcome)
+			}
+			if res.Accepted() != (res.Err == nil) {
+				t.Errorf("accepted %v with error %v", res.Accepted(), res.Err)
+			}
+		})
+	}
+}
+
+func TestClassify(t *testing.T) {
+	tests := []struct {
+		name    string
+		msg     string
+		err     error
+		outcome Outcome
+		want    error
+	}{
+		{"ack", "eub:ack", nil, OutcomeAccepted, nil},
+		{"next stage requested", "eub:req:09845001:epbl", nil, OutcomeAccepted, nil},
+		{"same stage requested", "eub:req:09845001:bl1", nil, OutcomeUnknown, ErrRerequest},
+		{"same stage after a nak", "eub:req:09845001:bl1", fmt.Errorf("stage bl1: %w", ErrNak), OutcomeRejectedHeader, ErrNak},
+		{"header fail", "bl1 header fail", fmt.Errorf("stage bl1: %w", ErrHeaderFail), OutcomeRejectedHeader, ErrHeaderFail},
+		{"booting failure", "eub:irom_booting_failure", fmt.Errorf("stage bl1: %w", ErrBootFailure), OutcomeBootFailure, ErrBootFailure},
+		{"timeout", "", fmt.Errorf("stage bl1: %w", ErrTimeout), OutcomeUnknown, ErrTimeout},
+		{"disconnect", "", fmt.Errorf("stage bl1: %w", ErrNoDevice), OutcomeDisconnected, ErrNoDevice},
+		{"nothing", "", nil, OutcomeUnknown, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			res := Classify("bl1", NewMessage([]byte(test.msg)), test.err)
+			if res.Outcome != test.outcome {
+				t.Errorf("outcome = %s, want %s", res.Outcome, test.outcome)
+			}
+			if test.want != nil && !errors.Is(res.Err, test.want) {
+				t.Errorf("error = %v, want %v", res.Err, test.want)
+			}
+			if res.Accepted() != (res.Err == nil) {
+				t.Errorf("accepted %v with error %v", res.Accepted(), res.Err)
+			}
+		})
+	}
+}
@@ -1,17 +1,18 @@
 package tensorutils
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
+	"io"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/google/gousb"
 )
 
-// ErrStall is a custom error returned when a severe endpoint stall is detected
-// that cannot be cleared by a simple control transfer.
-var ErrStall = fmt.Errorf("severe stall")
-
 const (
 	GS101_VID = 0x18d1
 	GS101_PID = 0x4f00
@@ -29,6 +30,11 @@ const (
 	GS101_ALT = 0
 
 	GS101_TIMEOUT = 5 * time.Second
+	GS101_REENUMERATE_DELAY = 2 * time.Second
+	GS101_SKIP_TIMEOUT = 50 * time.Millisecond
+	GS101_ANNOUNCE_TIMEOUT = 1 * time.Second
+	GS101_LISTEN_BACKOFF = 100 * time.Millisecond
+	GS101_MESSAGE_QUEUE = 256
 
 	// USB Control Request values for ClearFeature
 	LIBUSB_REQUEST_TYPE_STANDARD = 0x00
@@ -37,151 +43,492 @@ const (
 	LIBUSB_ENDPOINT_HALT         = 0x00
 )
 
+// usbHandle is the part of *gousb.Device used after opening, so a Simulator can stand in for it
+type usbHandle interface {
+	Control(rType, request uint8, val, idx uint16, data []byte) (int, error)
+	Reset() error
+	Close() error
+}
+
+// bulkWriter and bulkReader are satisfied by gousb endpoints and by a Simulator
+type bulkWriter interface {
+	WriteContext(ctx context.Context, p []byte) (int, error)
+}
+type bulkReader interface {
+	ReadContext(ctx context.Context, p []byte) (int, error)
+}
+
+// usbBus finds, resets and opens boot ROM devices
+type usbBus interface {
+	open(gs101 *GS101Device) error   //Claims the device and fills in its handles and profile
+	reset(gs101 *GS101Device) error  //Resets the device on the bus and waits for it to re-enumerate
+	present(gs101 *GS101Device) bool //Reports whether the device is currently enumerated
+}
+
 type GS101Device struct {
+	bus      usbBus
 	ctx      *gousb.Context
-	dev      *gousb.Device
+	dev      usbHandle
 	cfg      *gousb.Config
 	bulkIntf *gousb.Interface
 	intIntf  *gousb.Interface
-	outEp    *gousb.OutEndpoint
-	inEp     *gousb.InEndpoint
-	intEp    *gousb.InEndpoint
+	outEp    bulkWriter
+	inEp     bulkReader
+	intEp    bulkReader
+	epOut    uint8
+	epIn     uint8
+	epInt    uint8
 	closed   bool
 	info     string
+	serial   string //USB serial number, empty if it couldn't be read
+	chip     string //Chip ID from the last stage request
+	stream   *Stream                 //Every byte read from bulk IN, parsed into messages
+	messages *Subscription[*Message] //Messages not yet returned by ReadMsg
+	layout   Layout
+	profile  *Profile
+	identity *DeviceIdentity //What the profile was selected from, nil if it was given
+	manager  *Manager //Owns the claim on the device, nil for simulators
+	key      string   //Bus and port path of the claimed device
+	progress Progress
+
+	// Every transfer holds handles for reading, while re-enumeration and Close cancel the transfers in flight
+	// and hold it for writing to swap or release the handles. mutex guards the closed flag, the transfer
+	// context, info, serial, chip and progress, and is never held across a transfer. Bulk IN reads are
+	// serialized by bulkIn, which makes the reader holding it the single producer of the stream.
+	mutex     sync.Mutex
+	handles   sync.RWMutex
+	bulkOut   sync.Mutex         //Keeps concurrent writers from interleaving their chunks
+	bulkIn    sync.Mutex         //Keeps concurrent readers from splitting each other's messages
+	transfers context.Context    //Parent of every transfer on the current handles
+	abort     context.CancelFunc //Cancels transfers
+	workers   sync.WaitGroup     //Background listeners, waited for by Close
+
+	// Retry controls how transfers recover from stalls, it may be changed before starting a transfer
+	Retry RetryPolicy
+	// Logger overrides the package logger set with SetLogger when not nil
+	Logger Logger
+	// Events overrides the bus of the device's manager, or DefaultBus, when not nil
+	Events *Bus
+}
+
+// newDevice returns an unopened device on the given bus
+func newDevice(bus usbBus, manager *Manager, profile *Profile) *GS101Device {
+	gs101 := &GS101Device{bus: bus, manager: manager, profile: profile, Retry: DefaultRetryPolicy, stream: NewStream()}
+	gs101.messages = gs101.stream.SubscribeMessages(GS101_MESSAGE_QUEUE, OverflowDropOldest)
+	gs101.stream.notify = func(msg *Message) {
+		if msg.IsRequest() && msg.Device() != "" {
+			gs101.mutex.Lock()
+			gs101.chip = msg.Device()
+			gs101.mutex.Unlock()
+		}
+		gs101.publish(Event{Kind: EventMessage, Message: msg, Endpoint: gs101.epIn})
+	}
+	return gs101
+}
+
+// autoDetach detaches kernel drivers from the interfaces while they are claimed, see SetAutoDetach
+var autoDetach bool
+
+// SetAutoDetach controls whether kernel drivers such as cdc_acm are detached from the interfaces while the
+// bulk path uses them, and reattached once they are released on Close. Only supported on Linux, set it before
+// opening devices.
+func SetAutoDetach(enabled bool) {
+	autoDetach = enabled
 }
 
-// NewGS101Device initializes the GS101 USB device connection.
+// NewGS101Device initializes the USB device connection, choosing the profile from the device.
 func NewGS101Device() (*GS101Device, error) {
+	return NewDeviceWithProfile(nil)
+}
+
+// NewDeviceWithProfile initializes the USB device connection for the given profile through the DefaultManager.
+// A nil profile picks the first device matching any registered profile and selects the best one for it.
+func NewDeviceWithProfile(profile *Profile) (*GS101Device, error) {
+	return DefaultManager.OpenUSB(profile)
+}
+
+// hostBus is the usbBus backed by libusb
+type hostBus struct{}
+
+func (hostBus) open(gs101 *GS101Device) (err error) {
 	ctx := gousb.NewContext()
 
-	// Open devices matching VID and PID, close others
+	// Open the first unclaimed device matching the profile, or any registered profile. It is claimed before it is
+	// opened, so the manager is only locked while picking it and a slow open doesn't hold up other devices.
+	var key string
+	fresh := false //Claimed by this open rather than before re-enumeration
+	defer func() {
+		if err != nil && fresh {
+			gs101.manager.unclaimUSB(key, gs101)
+		}
+	}()
 	devs, err := ctx.OpenDevices(func(desc *gousb.DeviceDesc) bool {
-		return desc.Vendor == gousb.ID(GS101_VID) && desc.Product == gousb.ID(GS101_PID)
+		if key != "" || !gs101.wants(desc) {
+			return false
+		}
+		if gs101.manager != nil {
+			claimed, free := gs101.manager.claimUSB(usbKey(desc), gs101)
+			if !claimed {
+				return false
+			}
+			fresh = free
+		}
+		key = usbKey(desc)
+		return true
 	})
 	if err != nil {
+		for _, d := range devs {
+			d.Close() //OpenDevices returns the devices it did open along with the error
+		}
 		ctx.Close()
-		return nil, fmt.Errorf("error opening devices: %w", err)
+		return fmt.Errorf("error opening devices: %w", err)
 	}
 	if len(devs) == 0 {
 		ctx.Close()
-		return nil, fmt.Errorf("no GS101 device found")
+		return fmt.Errorf("gs101: %w", ErrNoDevice)
 	}
 	dev := devs[0]
-	for _, d := range devs[1:] {
-		d.Close()
+	if autoDetach {
+		if err := dev.SetAutoDetach(true); err != nil {
+			packageLogger().Log(LogWarn, fmt.Sprintf("Kernel driver auto-detach is not available: %v", err), nil)
+		} else {
+			packageLogger().Log(LogDebug, "Kernel drivers will be detached while the interfaces are claimed", nil)
+		}
+	}
+
+	serial, _ := dev.SerialNumber() //Left empty if it can't be read
+	profile := gs101.profile
+	if profile == nil {
+		//Chosen once, a reopened device keeps its profile
+		product, _ := dev.Product()
+		identity := DeviceIdentity{
+			VID:       uint16(dev.Desc.Vendor),
+			PID:       uint16(dev.Desc.Product),
+			BcdDevice: uint16(dev.Desc.Device),
+			Product:   product,
+			Serial:    serial,
+		}
+		profile = SelectProfile(identity)
+		if profile == nil {
+			dev.Close()
+			ctx.Close()
+			return fmt.Errorf("no profile matches device %04X:%04X serial %s: %w", uint16(dev.Desc.Vendor), uint16(dev.Desc.Product), orUnknown(serial), ErrNoDevice)
+		}
+		gs101.profile, gs101.identity = profile, &identity
+	}
+
+	// Locate the interfaces and endpoints from the descriptors, falling back to the profile's layout
+	layout, err := DiscoverLayout(dev.Desc)
+	if err != nil {
+		layout = profile.Layout
+		packageLogger().Log(LogWarn, fmt.Sprintf("Endpoint discovery failed, using the %s defaults: %v", profile.Name, err), nil)
 	}
 
 	// Open the configuration
-	cfg, err := dev.Config(GS101_CONFIG)
+	cfg, err := dev.Config(layout.Config)
 	if err != nil {
 		dev.Close()
 		ctx.Close()
-		return nil, fmt.Errorf("failed to open configuration %d: %w", GS101_CONFIG, err)
+		return fmt.Errorf("failed to open configuration %d: %w", layout.Config, err)
 	}
 
 	// Open bulk data interface
-	bulkIntf, err := cfg.Interface(GS101_BULK_IFACE, GS101_ALT)
+	bulkIntf, err := cfg.Interface(layout.BulkIface, layout.BulkAlt)
 	if err != nil {
 		cfg.Close()
 		dev.Close()
 		ctx.Close()
-		return nil, fmt.Errorf("failed to open bulk interface %d alt %d: %w", GS101_BULK_IFACE, GS101_ALT, err)
+		return fmt.Errorf("failed to open bulk interface %d alt %d: %w", layout.BulkIface, layout.BulkAlt, claimError(err))
 	}
 
-	// Open interrupt data interface
-	intIntf, err := cfg.Interface(GS101_INT_IFACE, GS101_ALT)
-	if err != nil {
+	// Open interrupt data interface, unless the interrupt endpoint shares the bulk interface or there is none
+	var intIntf *gousb.Interface
+	if layout.IntIface >= 0 && layout.IntIface != layout.BulkIface {
+		intIntf, err = cfg.Interface(layout.IntIface, layout.IntAlt)
+		if err != nil {
+			bulkIntf.Close()
+			cfg.Close()
+			dev.Close()
+			ctx.Close()
+			return fmt.Errorf("failed to open interrupt interface %d alt %d: %w", layout.IntIface, layout.IntAlt, claimError(err))
+		}
+	}
+	closeIntfs := func() {
+		if intIntf != nil {
+			intIntf.Close()
+		}
 		bulkIntf.Close()
-		cfg.Close()
-		dev.Close()
-		ctx.Close()
-		return nil, fmt.Errorf("failed to open interrupt interface %d alt %d: %w", GS101_INT_IFACE, GS101_ALT, err)
 	}
 
 	// Acquire bulk endpoints from the bulk interface
-	outEp, err := bulkIntf.OutEndpoint(int(GS101_EP_OUT & 0x0f))
+	outEp, err := bulkIntf.OutEndpoint(int(layout.EpOut & 0x0f))
 	if err != nil {
-		intIntf.Close()
-		bulkIntf.Close()
+		closeIntfs()
 		cfg.Close()
 		dev.Close()
 		ctx.Close()
-		return nil, fmt.Errorf("failed to open OUT endpoint 0x%02x: %w", GS101_EP_OUT, err)
+		return fmt.Errorf("failed to open OUT endpoint 0x%02x: %w", layout.EpOut, err)
 	}
 
-	inEp, err := bulkIntf.InEndpoint(int(GS101_EP_IN & 0x0f))
+	inEp, err := bulkIntf.InEndpoint(int(layout.EpIn & 0x0f))
 	if err != nil {
-		intIntf.Close()
-		bulkIntf.Close()
+		closeIntfs()
 		cfg.Close()
 		dev.Close()
 		ctx.Close()
-		return nil, fmt.Errorf("failed to open IN endpoint 0x%02x: %w", GS101_EP_IN, err)
+		return fmt.Errorf("failed to open IN endpoint 0x%02x: %w", layout.EpIn, err)
 	}
 
 	// Acquire interrupt endpoint from the interrupt interface
-	intEp, err := intIntf.InEndpoint(int(GS101_EP_INT & 0x0f))
-	if err != nil {
-		intIntf.Close()
-		bulkIntf.Close()
-		cfg.Close()
-		dev.Close()
-		ctx.Close()
-		return nil, fmt.Errorf("failed to open interrupt IN endpoint 0x%02x: %w", GS101_EP_INT, err)
+	var intEp bulkReader
+	if layout.IntIface >= 0 {
+		owner := intIntf
+		if owner == nil {
+			owner = bulkIntf
+		}
+		ep, err := owner.InEndpoint(int(layout.EpInt & 0x0f))
+		if err != nil {
+			closeIntfs()
+			cfg.Close()
+			dev.Close()
+			ctx.Close()
+			return fmt.Errorf("failed to open interrupt IN endpoint 0x%02x: %w", layout.EpInt, err)
+		}
+		intEp = ep
 	}
 
-	serial, err := dev.SerialNumber()
+	gs101.ctx = ctx
+	gs101.dev = dev
+	gs101.cfg = cfg
+	gs101.bulkIntf = bulkIntf
+	gs101.intIntf = intIntf
+	gs101.outEp = outEp
+	gs101.inEp = inEp
+	gs101.intEp = intEp
+	gs101.layout = layout
+	gs101.epOut = uint8(outEp.Desc.Address)
+	gs101.epIn = uint8(inEp.Desc.Address)
+	gs101.epInt = layout.EpInt
+	gs101.setInfo(fmt.Sprintf("%s Device - VID:PID=%04X:%04X Serial:%s", strings.ToUpper(profile.Name),
+		uint16(dev.Desc.Vendor), uint16(dev.Desc.Product), orUnknown(serial)), serial)
+	gs101.key = key
+	return nil
+}
+
+// claimError marks a claim that failed because a kernel driver holds the interface.
+// gousb formats the libusb error into the message, so it is matched by text as well.
+func claimError(err error) error {
+	if errors.Is(err, gousb.ErrorBusy) || strings.Contains(err.Error(), gousb.ErrorBusy.Error()) {
+		return fmt.Errorf("%w: %w", ErrBusy, err)
+	}
+	return err
+}
+
+func (hostBus) reset(gs101 *GS101Device) error {
+	ctx := gousb.NewContext()
+	defer ctx.Close()
+
+	devs, err := ctx.OpenDevices(func(desc *gousb.DeviceDesc) bool {
+		if gs101.key != "" {
+			return usbKey(desc) == gs101.key //Only ever reset the device we claimed
+		}
+		return gs101.wants(desc)
+	})
+	for _, d := range devs {
+		defer d.Close()
+	}
 	if err != nil {
-		serial = "unknown"
+		return fmt.Errorf("error opening devices for reset: %w", err)
+	}
+	if len(devs) == 0 {
+		return fmt.Errorf("no %s device found for reset: %w", gs101.profile.Name, ErrNoDevice)
+	}
+	if err := devs[0].Reset(); err != nil {
+		return fmt.Errorf("failed to reset device: %w", err)
+	}
+
+	// Wait for the device to re-enumerate
+	time.Sleep(gs101.profile.reenumerateDelay())
+	return nil
+}
+
+func (hostBus) present(gs101 *GS101Device) bool {
+	return devicePresent(gs101.wants)
+}
+
+// wants reports whether a device on the bus belongs to the profile, or to any registered profile before one was chosen
+func (gs101 *GS101Device) wants(desc *gousb.DeviceDesc) bool {
+	if gs101.profile != nil {
+		return desc.Vendor == gousb.ID(gs101.profile.VID) && desc.Product == gousb.ID(gs101.profile.PID)
 	}
+	return registeredID(uint16(desc.Vendor), uint16(desc.Product))
+}
 
-	gs101 := &GS101Device{
-		ctx:      ctx,
-		dev:      dev,
-		cfg:      cfg,
-		bulkIntf: bulkIntf,
-		intIntf:  intIntf,
-		outEp:    outEp,
-		inEp:     inEp,
-		intEp:    intEp,
-		closed:   false,
-		info:     fmt.Sprintf("GS101 Device - VID:PID=%04X:%04X Serial:%s", GS101_VID, GS101_PID, serial),
+
+// connect opens the device on its bus and starts a new context for its transfers.
+// The caller must hold the handles for writing.
+func (gs101 *GS101Device) connect() error {
+	if err := gs101.bus.open(gs101); err != nil {
+		return err
 	}
+	gs101.mutex.Lock()
+	defer gs101.mutex.Unlock()
+	gs101.transfers, gs101.abort = context.WithCancel(context.Background())
+	return nil
+}
 
-	fmt.Println("✅ GS101 device connected:", gs101.info)
+// cancelTransfers cancels every transfer in flight, so the handles can be locked for writing without waiting
+// for their timeouts
+func (gs101 *GS101Device) cancelTransfers() {
+	gs101.mutex.Lock()
+	defer gs101.mutex.Unlock()
+	if gs101.abort != nil {
+		gs101.abort()
+	}
+}
 
-	return gs101, nil
+// begin holds the handles for reading during one transfer and returns its context, which is cancelled by
+// Close and re-enumeration. The returned function ends the transfer.
+func (gs101 *GS101Device) begin(timeout time.Duration) (context.Context, func(), error) {
+	gs101.handles.RLock()
+	gs101.mutex.Lock()
+	closed, parent := gs101.closed, gs101.transfers
+	gs101.mutex.Unlock()
+	if closed {
+		gs101.handles.RUnlock()
+		return nil, nil, ErrClosed
+	}
+	if parent == nil {
+		gs101.handles.RUnlock()
+		return nil, nil, ErrNoDevice
+	}
+	ctx, cancel := context.WithTimeout(parent, timeout)
+	return ctx, func() {
+		cancel()
+		gs101.handles.RUnlock()
+	}, nil
+}
+
+// interrupted returns why a transfer's context ended: its timeout, Close, or re-enumeration taking the handles
+func (gs101 *GS101Device) interrupted(ctx context.Context) error {
+	switch {
+	case errors.Is(ctx.Err(), context.DeadlineExceeded):
+		return ErrTimeout
+	case gs101.Closed():
+		return ErrClosed
+	}
+	return ErrNoDevice
 }
 
-// Close releases all USB resources safely.
+// Close cancels the transfers in flight, releases all USB resources and waits for background listeners to stop.
 func (gs101 *GS101Device) Close() error {
+	gs101.mutex.Lock()
 	if gs101.closed {
+		gs101.mutex.Unlock()
 		return nil
 	}
 	gs101.closed = true
+	if gs101.abort != nil {
+		gs101.abort()
+	}
+	gs101.mutex.Unlock()
+
+	gs101.handles.Lock()
+	gs101.release()
+	gs101.handles.Unlock()
+	gs101.workers.Wait()
+	gs101.stream.Close() //No transfer can start anymore, so nothing else writes to it
+
+	if gs101.manager != nil {
+		gs101.manager.releaseUSB(gs101)
+	}
+	gs101.log(LogInfo, strings.ToUpper(gs101.profile.Name)+" device closed", nil)
+	gs101.publish(Event{Kind: EventClosed})
+	return nil
+}
+
+// publish sends an event about the device to its bus
+func (gs101 *GS101Device) publish(event Event) {
+	event.Transport = "usb"
+	gs101.mutex.Lock()
+	event.Device, event.Serial, event.Chip = gs101.info, gs101.serial, gs101.chip
+	gs101.mutex.Unlock()
+	gs101.events().Publish(event)
+}
+
+// events returns the bus the device publishes to
+func (gs101 *GS101Device) events() *Bus {
+	if gs101.Events != nil {
+		return gs101.Events
+	}
+	if gs101.manager != nil && gs101.manager.Events != nil {
+		return gs101.manager.Events
+	}
+	return DefaultBus
+}
+
+// Closed reports whether the device was closed
+func (gs101 *GS101Device) Closed() bool {
+	gs101.mutex.Lock()
+	defer gs101.mutex.Unlock()
+	return gs101.closed
+}
+
+// setInfo replaces the description used in logs and by GetDeviceInfo, and the serial number published with events
+func (gs101 *GS101Device) setInfo(info, serial string) {
+	gs101.mutex.Lock()
+	defer gs101.mutex.Unlock()
+	gs101.info, gs101.serial = info, serial
+}
+
+func orUnknown(s string) string {
+	if s == "" {
+		return "unknown"
+	}
+	return s
+}
+
+// release closes every handle without marking the device closed, so it can be reopened.
+// The caller must hold the handles for writing.
+func (gs101 *GS101Device) release() {
 	if gs101.intIntf != nil {
 		gs101.intIntf.Close()
+		gs101.intIntf = nil
 	}
 	if gs101.bulkIntf != nil {
 		gs101.bulkIntf.Close()
+		gs101.bulkIntf = nil
 	}
 	if gs101.cfg != nil {
 		gs101.cfg.Close()
+		gs101.cfg = nil
 	}
 	if gs101.dev != nil {
 		gs101.dev.Close()
+		gs101.dev = nil
 	}
 	if gs101.ctx != nil {
 		gs101.ctx.Close()
+		gs101.ctx = nil
 	}
-	fmt.Println("🔐 GS101 device closed successfully")
-	return nil
+	gs101.outEp = nil
+	gs101.inEp = nil
+	gs101.intEp = nil
+
+	//Whatever was received from the old handles is stale
+	gs101.stream.Skip()
+	gs101.messages.Drain()
 }
 
 // clearStall sends a control request to clear the stall condition on an endpoint.
 func (gs101 *GS101Device) clearStall(endpointAddress uint8) error {
-	if gs101.closed {
-		return fmt.Errorf("device closed")
+	_, done, err := gs101.begin(gs101.profile.timeout())
+	if err != nil {
+		return err
+	}
+	defer done()
+	if gs101.dev == nil {
+		return ErrNoDevice
 	}
 
 	// This is a standard USB control transfer to clear the HALT feature on an endpoint.
@@ -189,108 +536,458 @@ func (gs101 *GS101Device) clearStall(endpointAddress uint8) error {
 	// bRequest: ClearFeature (0x01)
 	// wValue: Endpoint Halt (0x00)
 	// wIndex: Endpoint Address (e.g., 0x02 for OUT, 0x81 for IN)
-	_, err := gs101.dev.Control(
+	_, err = gs101.dev.Control(
 		(LIBUSB_REQUEST_TYPE_STANDARD | LIBUSB_RECIPIENT_ENDPOINT),
 		LIBUSB_REQUEST_CLEAR_FEATURE,
 		LIBUSB_ENDPOINT_HALT,
 		uint16(endpointAddress),
 		nil,
 	)
+	trace(TraceEvent{Kind: TraceControl, Out: true, Err: err,
+		Setup: fmt.Sprintf("CLEAR_FEATURE(ENDPOINT_HALT) endpoint 0x%02x", endpointAddress)})
 	if err != nil {
-		return fmt.Errorf("failed to clear stall on endpoint 0x%02x: %w", endpointAddress, err)
+		return newTransferError("clear halt", endpointAddress, err)
 	}
 	return nil
 }
 
-// Write sends data to bulk OUT endpoint, with a retry after stall.
+// ClearHalt clears the halt feature on the given endpoint.
+func (gs101 *GS101Device) ClearHalt(endpointAddress uint8) error {
+	return gs101.clearStall(endpointAddress)
+}
+
+// ResetPort resets the device's port while keeping the open handle.
+func (gs101 *GS101Device) ResetPort() error {
+	return gs101.recover(RecoverPortReset, 0)
+}
+
+// Control issues a control transfer on the default endpoint, data is read into for IN requests.
+func (gs101 *GS101Device) Control(rType, request uint8, val, idx uint16, data []byte) (int, error) {
+	_, done, err := gs101.begin(gs101.profile.timeout())
+	if err != nil {
+		return 0, err
+	}
+	defer done()
+	if gs101.dev == nil {
+		return 0, ErrNoDevice
+	}
+	n, err := gs101.dev.Control(rType, request, val, idx, data)
+	trace(TraceEvent{Kind: TraceControl, Out: rType&0x80 == 0, Data: data[:max(n, 0)], Err: err,
+		Setup: fmt.Sprintf("bmRequestType=0x%02x bRequest=0x%02x wValue=0x%04x wIndex=0x%04x", rType, request, val, idx)})
+	if err != nil {
+		return n, newTransferError("control", 0, err)
+	}
+	return n, nil
+}
+
+// Write sends data to bulk OUT endpoint, recovering from stalls according to the retry policy.
 func (gs101 *GS101Device) Write(data []byte) (int, error) {
-	if gs101.closed {
-		return 0, fmt.Errorf("device closed")
+	gs101.bulkOut.Lock()
+	defer gs101.bulkOut.Unlock()
+	return gs101.transfer("write", gs101.Layout().EpOut, true, func() (int, error) {
+		return gs101.write(data)
+	})
+}
+
+// write sends data in a single transfer, the caller must hold bulkOut
+func (gs101 *GS101Device) write(data []byte) (int, error) {
+	ctx, done, err := gs101.begin(gs101.profile.timeout())
+	if err != nil {
+		return 0, err
+	}
+	defer done()
+	if gs101.outEp == nil {
+		return 0, ErrNoDevice
+	}
+	n, err := gs101.outEp.WriteContext(ctx, data)
+	traceUSB(TraceBulk, gs101.epOut, data[:n], err)
+	if err != nil && ctx.Err() != nil {
+		return n, gs101.interrupted(ctx)
+	}
+	return n, err
+}
+
+// Read reads data from the bulk IN endpoint, recovering from stalls according to the retry policy.
+func (gs101 *GS101Device) Read(buf []byte) (int, error) {
+	gs101.bulkIn.Lock()
+	defer gs101.bulkIn.Unlock()
+	return gs101.transfer("read", gs101.Layout().EpIn, true, func() (int, error) {
+		ctx, done, err := gs101.begin(gs101.profile.timeout())
+		if err != nil {
+			return 0, err
+		}
+		defer done()
+		if gs101.inEp == nil {
+			return 0, ErrNoDevice
+		}
+		n, err := gs101.inEp.ReadContext(ctx, buf)
+		traceUSB(TraceBulk, gs101.epIn, buf[:n], err)
+		if n > 0 {
+			gs101.stream.Write(buf[:n])
+		}
+		if err != nil && ctx.Err() != nil {
+			return n, gs101.interrupted(ctx)
+		}
+		return n, err
+	})
+}
+
+// ReadInterrupt reads from interrupt IN endpoint
+func (gs101 *GS101Device) ReadInterrupt() ([]byte, error) {
+	return gs101.readInterrupt(context.Background())
+}
+
+// readInterrupt reads from the interrupt IN endpoint until a notification arrives, the transfer times out or stop is done
+func (gs101 *GS101Device) readInterrupt(stop context.Context) ([]byte, error) {
+	ctx, done, err := gs101.begin(gs101.profile.timeout())
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+	if gs101.intEp == nil {
+		return nil, ErrNoDevice
 	}
-	n, err := gs101.outEp.Write(data)
+	read, cancel := context.WithCancel(ctx)
+	defer context.AfterFunc(stop, cancel)()
+	defer cancel()
+	buf := make([]byte, gs101.layout.IntPktSize)
+	n, err := gs101.intEp.ReadContext(read, buf)
+	traceUSB(TraceInterrupt, gs101.epInt, buf[:n], err)
 	if err != nil {
-		if strings.Contains(err.Error(), "endpoint stalled") {
-			fmt.Printf("⚠️ Endpoint 0x%02x stalled. Attempting to clear stall...\n", gs101.outEp.Desc.Address)
-			if clearErr := gs101.clearStall(uint8(gs101.outEp.Desc.Address)); clearErr != nil {
-				return 0, ErrStall // Return our custom error
+		if stop.Err() != nil {
+			return nil, stop.Err()
+		}
+		if ctx.Err() != nil {
+			return nil, fmt.Errorf("read interrupt: %w", gs101.interrupted(ctx))
+		}
+		return nil, newTransferError("read interrupt", gs101.epInt, err)
+	}
+	return buf[:n], nil
+}
+
+// ListenInterrupt reads the interrupt IN endpoint in the background until ctx is done or the device is closed,
+// calling fn with every notification and every error besides timeouts. Re-enumeration is waited out.
+// fn runs on the listener's goroutine and must not call Close, which waits for the listener to stop.
+func (gs101 *GS101Device) ListenInterrupt(ctx context.Context, fn func(status []byte, err error)) error {
+	gs101.mutex.Lock()
+	defer gs101.mutex.Unlock()
+	if gs101.closed {
+		return ErrClosed
+	}
+	gs101.workers.Add(1)
+	go func() {
+		defer gs101.workers.Done()
+		for ctx.Err() == nil {
+			status, err := gs101.readInterrupt(ctx)
+			switch {
+			case errors.Is(err, ErrClosed):
+				return
+			case errors.Is(err, ErrTimeout):
+				continue
+			}
+			if ctx.Err() != nil {
+				return
 			}
-			fmt.Println("✅ Stall cleared. Retrying write...")
-			// Retry the write after clearing the stall
-			n, err = gs101.outEp.Write(data)
+			fn(status, err)
 			if err != nil {
-				return n, fmt.Errorf("write to OUT endpoint failed after stall clear: %w", err)
+				time.Sleep(GS101_LISTEN_BACKOFF) //Don't spin while the device is gone
 			}
-		} else {
-			return n, fmt.Errorf("write to OUT endpoint failed: %w", err)
+		}
+	}()
+	return nil
+}
+
+// ReadMsg waits up to timeout for the next newline-terminated message on the bulk IN endpoint
+func (gs101 *GS101Device) ReadMsg(timeout time.Duration) (*Message, error) {
+	gs101.bulkIn.Lock()
+	defer gs101.bulkIn.Unlock()
+	deadline := time.Now().Add(timeout)
+	for {
+		if msg := gs101.nextMsg(); msg != nil {
+			return msg, nil
+		}
+		left := time.Until(deadline)
+		if left <= 0 {
+			return nil, fmt.Errorf("%w waiting for message", ErrTimeout)
+		}
+		if err := gs101.readPending(left); err != nil {
+			return nil, err
 		}
 	}
-	return n, nil
 }
 
-// Read reads data from the bulk IN endpoint, with a retry after stall.
-func (gs101 *GS101Device) Read(buf []byte) (int, error) {
-	if gs101.closed {
-		return 0, fmt.Errorf("device closed")
+// readPending waits up to timeout for bulk IN bytes and queues them for nextMsg, the caller must hold bulkIn
+func (gs101 *GS101Device) readPending(timeout time.Duration) error {
+	ctx, done, err := gs101.begin(timeout)
+	if err != nil {
+		return err
+	}
+	defer done()
+	if gs101.inEp == nil {
+		return ErrNoDevice
+	}
+	buf := make([]byte, gs101.layout.BulkPktSize)
+	n, err := gs101.inEp.ReadContext(ctx, buf)
+	if n > 0 || (err != nil && ctx.Err() == nil) {
+		traceUSB(TraceBulk, gs101.epIn, buf[:n], err)
+	}
+	if n > 0 {
+		gs101.stream.Write(buf[:n])
+	}
+	if err != nil && ctx.Err() == nil {
+		return newTransferError("read message", gs101.epIn, err)
+	}
+	if err != nil && errors.Is(gs101.interrupted(ctx), ErrClosed) {
+		return ErrClosed
+	}
+	return nil //Timeouts are left to the caller's deadline, re-enumeration to the next read
+}
+
+// Skip discards everything the device sent so far, so only responses to the next write are read
+func (gs101 *GS101Device) Skip() error {
+	gs101.bulkIn.Lock()
+	defer gs101.bulkIn.Unlock()
+	defer gs101.messages.Drain()
+	defer gs101.stream.Skip()
+	for {
+		if drained, err := gs101.skip(); drained || err != nil {
+			return err
+		}
+	}
+}
+
+// skip discards one bulk IN transfer and reports whether nothing was left to read
+func (gs101 *GS101Device) skip() (bool, error) {
+	ctx, done, err := gs101.begin(GS101_SKIP_TIMEOUT)
+	if err != nil {
+		return false, err
+	}
+	defer done()
+	if gs101.inEp == nil {
+		return false, ErrNoDevice
+	}
+	buf := make([]byte, gs101.layout.BulkPktSize)
+	n, err := gs101.inEp.ReadContext(ctx, buf)
+	if n > 0 || (err != nil && ctx.Err() == nil) {
+		traceUSB(TraceBulk, gs101.epIn, buf[:n], err)
+	}
+	if n > 0 {
+		gs101.stream.Write(buf[:n]) //Subscribers still see what is skipped
 	}
-	n, err := gs101.inEp.Read(buf)
 	if err != nil {
-		if strings.Contains(err.Error(), "endpoint stalled") {
-			fmt.Printf("⚠️ Endpoint 0x%02x stalled. Attempting to clear stall...\n", gs101.inEp.Desc.Address)
-			if clearErr := gs101.clearStall(uint8(gs101.inEp.Desc.Address)); clearErr != nil {
-				return 0, ErrStall // Return our custom error
-			}
-			fmt.Println("✅ Stall cleared. Retrying read...")
-			// Retry the read after clearing the stall
-			n, err = gs101.inEp.Read(buf)
-			if err != nil {
-				return n, fmt.Errorf("read from IN endpoint failed after stall clear: %w", err)
+		if ctx.Err() != nil {
+			if err := gs101.interrupted(ctx); !errors.Is(err, ErrTimeout) {
+				return false, err
 			}
-		} else {
-			return n, fmt.Errorf("read from IN endpoint failed: %w", err)
+			return true, nil //Nothing left to read
 		}
+		return false, newTransferError("skip", gs101.epIn, err)
 	}
-	return n, nil
+	return false, nil
 }
 
-// ReadInterrupt reads from interrupt IN endpoint
-func (gs101 *GS101Device) ReadInterrupt() ([]byte, error) {
-	if gs101.closed {
-		return nil, fmt.Errorf("device closed")
+// nextMsg pops the next complete message received on bulk IN without waiting
+func (gs101 *GS101Device) nextMsg() *Message {
+	var msg *Message
+	select {
+	case msg = <-gs101.messages.C():
+	default:
+	}
+	if msg == nil {
+		return nil
+	}
+	gs101.log(LogDebug, "Received message: "+msg.String(), Fields{FieldEndpoint: endpointField(gs101.Layout().EpIn)})
+	return msg
+}
+
+// Finalize sends the stop frame for the given stage, waits for the device to respond and evaluates the outcome.
+// Without a conclusive message the interrupt endpoint and the bus are checked for a disconnect.
+func (gs101 *GS101Device) Finalize(stage string) *Result {
+	stop, err := GetStopCmd(stage).Bytes()
+	if err == nil {
+		_, err = gs101.Write(stop)
 	}
-	buf := make([]byte, GS101_INT_PKT_SIZE)
-	n, err := gs101.intEp.Read(buf)
 	if err != nil {
-		return nil, fmt.Errorf("read interrupt failed: %w", err)
+		return Classify(stage, nil, fmt.Errorf("failed to send stop frame: %w", err))
 	}
-	return buf[:n], nil
+	msg, err := waitFinalize(stage, gs101.ReadMsg, gs101.profile.timeout())
+	res := Classify(stage, msg, err)
+	gs101.log(LogDebug, "Stage finalized: "+res.String(), Fields{FieldStage: stage})
+	if res.Outcome != OutcomeUnknown {
+		return res
+	}
+
+	if status, err := gs101.ReadInterrupt(); err == nil {
+		res.Notification = status
+		if notification, value, ok := parseNotification(status); ok && notification == CDC_NOTIFY_NETWORK_CONNECTION && value == 0 {
+			res.Outcome = OutcomeDisconnected
+		}
+	} else if errors.Is(err, ErrNoDevice) {
+		res.Outcome = OutcomeDisconnected
+	}
+	if !gs101.bus.present(gs101) {
+		res.Outcome = OutcomeDisconnected
+	}
+	if res.Outcome == OutcomeDisconnected {
+		gs101.publish(Event{Kind: EventDisconnected, Err: res.Err})
+	}
+	return res
+}
+
+// devicePresent reports whether a matching device is currently enumerated on the bus
+func devicePresent(match func(desc *gousb.DeviceDesc) bool) bool {
+	ctx := gousb.NewContext()
+	defer ctx.Close()
+
+	found := false
+	ctx.OpenDevices(func(desc *gousb.DeviceDesc) bool {
+		if match(desc) {
+			found = true
+		}
+		return false //Never open anything, we only want to know it's there
+	})
+	return found
 }
 
-// WriteBootloader sends bootloader to device in chunks respecting packet size
+// WriteBootloader sends bootloader to device in chunks respecting packet size.
 func (gs101 *GS101Device) WriteBootloader(data []byte) error {
-	if gs101.closed {
-		return fmt.Errorf("device closed")
+	return gs101.WriteStage("", data)
+}
+
+// WriteStage sends a named boot stage in chunks respecting packet size, tracking the progress sent.
+// Once the retry policy calls for re-enumeration, the stage is restarted or resumed depending on what
+// the device asks for next. An empty stage name accepts any request as the same stage.
+// Concurrent stages are sent one after the other.
+func (gs101 *GS101Device) WriteStage(stage string, data []byte) error {
+	return gs101.WriteStageFrom(stage, bytes.NewReader(data), int64(len(data)))
+}
+
+// WriteStageFrom is WriteStage for size bytes read from r, which are read one packet at a time as they are sent
+// and read again from where the stage restarts or resumes
+func (gs101 *GS101Device) WriteStageFrom(stage string, r io.ReaderAt, size int64) error {
+	if gs101.Closed() {
+		return ErrClosed
+	}
+	gs101.bulkOut.Lock()
+	defer gs101.bulkOut.Unlock()
+	if err := gs101.Skip(); err != nil {
+		return fmt.Errorf("failed to discard stale messages: %w", err)
+	}
+	data, err := gs101.profile.FrameFrom(r, size)
+	if err != nil {
+		return fmt.Errorf("failed to frame stage: %w", err)
 	}
+	total := int(data.Size())
+	progress := Progress{Stage: stage, Total: total}
+	gs101.setProgress(progress)
+	var buf []byte
 	offset := 0
-	for offset < len(data) {
-		chunkSize := GS101_BULK_PKT_SIZE
-		if len(data)-offset < chunkSize {
-			chunkSize = len(data) - offset
+	for offset < total {
+		layout := gs101.Layout()
+		chunkSize := layout.BulkPktSize
+		if total-offset < chunkSize {
+			chunkSize = total - offset
+		}
+		if len(buf) < chunkSize {
+			buf = make([]byte, chunkSize)
+		}
+		chunk := buf[:chunkSize]
+		if n, err := data.ReadAt(chunk, int64(offset)); n != chunkSize {
+			return fmt.Errorf("failed to read stage at offset %d: %w", offset, err)
+		}
+		n, err := gs101.transfer("write", layout.EpOut, false, func() (int, error) {
+			return gs101.write(chunk)
+		})
+		if errors.Is(err, errNeedsReenumerate) && progress.Restarts+progress.Resumes+1 < gs101.Retry.attempts() {
+			gs101.log(LogWarn, "Bootloader write failed, re-enumerating the device", Fields{FieldStage: stage, FieldOffset: offset})
+			if err := gs101.reenumerate(); err != nil {
+				return fmt.Errorf("bootloader write failed at offset %d: re-enumeration failed: %w", offset, err)
+			}
+			offset, err = gs101.resumePoint(stage, progress.Sent)
+			if err != nil {
+				return fmt.Errorf("bootloader write failed at offset %d: %w", progress.Sent, err)
+			}
+			if offset > 0 {
+				progress.Resumes++
+				gs101.log(LogInfo, "Device re-enumerated, resuming stage", Fields{FieldStage: stage, FieldOffset: offset})
+			} else {
+				progress.Restarts++
+				gs101.log(LogInfo, "Device re-enumerated, restarting stage", Fields{FieldStage: stage, FieldOffset: 0})
+			}
+			progress.Sent = offset
+			gs101.setProgress(progress)
+			continue
 		}
-		n, err := gs101.Write(data[offset : offset+chunkSize])
 		if err != nil {
+			var transferErr *TransferError
+			if errors.As(err, &transferErr) {
+				transferErr.Offset = offset
+			}
 			return fmt.Errorf("bootloader write failed at offset %d: %w", offset, err)
 		}
 		if n != chunkSize {
 			return fmt.Errorf("short write at offset %d: wrote %d of %d bytes", offset, n, chunkSize)
 		}
 		offset += n
+		progress.Sent = offset
+		gs101.setProgress(progress)
 		time.Sleep(50 * time.Millisecond) // optional delay between chunks
 	}
 	return nil
 }
 
+// Profile returns the device profile in use
+func (gs101 *GS101Device) Profile() *Profile {
+	return gs101.profile
+}
+
+// identifyChip waits for the stage request announced after enumeration when a registered profile can only tell
+// the device apart by its chip ID, and switches to the profile selected with it. The request stays queued for
+// ReadMsg. It runs once when the device is opened, before it is handed out.
+func (gs101 *GS101Device) identifyChip() {
+	if gs101.identity == nil || !needsChipID(*gs101.identity) {
+		return
+	}
+	gs101.identity.ChipID = gs101.awaitChip(gs101.profile.announceTimeout())
+	if gs101.identity.ChipID == "" {
+		gs101.log(LogWarn, "The device announced no chip ID, keeping the "+gs101.profile.Name+" profile", nil)
+		return
+	}
+	if profile := SelectProfile(*gs101.identity); profile != nil {
+		gs101.profile = profile
+	}
+}
+
+// awaitChip reads bulk IN until a stage request carried the chip ID or timeout passed, without taking messages
+func (gs101 *GS101Device) awaitChip(timeout time.Duration) string {
+	gs101.bulkIn.Lock()
+	defer gs101.bulkIn.Unlock()
+	deadline := time.Now().Add(timeout)
+	for {
+		gs101.mutex.Lock()
+		chip := gs101.chip
+		gs101.mutex.Unlock()
+		left := time.Until(deadline)
+		if chip != "" || left <= 0 {
+			return chip
+		}
+		if err := gs101.readPending(left); err != nil {
+			return ""
+		}
+	}
+}
+
+// Layout returns the interfaces and endpoints in use, discovered from the descriptors when possible
+func (gs101 *GS101Device) Layout() Layout {
+	gs101.handles.RLock()
+	defer gs101.handles.RUnlock()
+	return gs101.layout
+}
+
 // GetDeviceInfo returns string describing connected device
 func (gs101 *GS101Device) GetDeviceInfo() string {
+	gs101.mutex.Lock()
+	defer gs101.mutex.Unlock()
 	if gs101.closed {
 		return "device closed"
 	}
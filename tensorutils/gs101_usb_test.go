@@ -0,0 +1,209 @@
+package tensorutils
+
+import (
+	"context"
+	"errors"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/gousb"
+)
+
+// notifier sends a serial state notification on the interrupt endpoint every interval
+type notifier struct {
+	interval time.Duration
+}
+
+func (ep notifier) ReadContext(ctx context.Context, p []byte) (int, error) {
+	select {
+	case <-time.After(ep.interval):
+		return copy(p, []byte{0xA1, CDC_NOTIFY_SERIAL_STATE, 0, 0, 0, 0, 2, 0, 3, 0}), nil
+	case <-ctx.Done():
+		return 0, gousb.TransferCancelled
+	}
+}
+
+// hangingOut accepts no data until its transfer is cancelled
+type hangingOut struct {
+	started   chan struct{}
+	cancelled atomic.Int32
+}
+
+func (ep *hangingOut) WriteContext(ctx context.Context, p []byte) (int, error) {
+	ep.started <- struct{}{}
+	<-ctx.Done()
+	ep.cancelled.Add(1)
+	return 0, gousb.TransferCancelled
+}
+
+// replaceEndpoints swaps the device's endpoints as re-enumeration would
+func replaceEndpoints(gs101 *GS101Device, out bulkWriter, interrupt bulkReader) {
+	gs101.handles.Lock()
+	defer gs101.handles.Unlock()
+	if out != nil {
+		gs101.outEp = out
+	}
+	if interrupt != nil {
+		gs101.intEp = interrupt
+	}
+}
+
+// waitGoroutines fails unless the number of goroutines drops back to want
+func waitGoroutines(t *testing.T, want int) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for runtime.NumGoroutine() > want {
+		if time.Now().After(deadline) {
+			t.Errorf("%d goroutines still running, want %d", runtime.NumGoroutine(), want)
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// within fails unless done is closed within a second
+func within(t *testing.T, done <-chan struct{}, what string) {
+	t.Helper()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("%s did not return", what)
+	}
+}
+
+func TestDeviceConcurrentTransfers(t *testing.T) {
+	goroutines := runtime.NumGoroutine()
+	gs101 := openSimulator(t, NewSimulator("bl1"), DefaultRetryPolicy)
+	replaceEndpoints(gs101, nil, notifier{interval: 2 * time.Millisecond})
+
+	var notifications atomic.Int32
+	if err := gs101.ListenInterrupt(context.Background(), func(status []byte, err error) {
+		if err != nil {
+			t.Errorf("listener error: %v", err)
+			return
+		}
+		notifications.Add(1)
+	}); err != nil {
+		t.Fatalf("ListenInterrupt failed: %v", err)
+	}
+
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	wg.Add(3)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 20; i++ {
+			if _, err := gs101.Write(stageData(2)); err != nil {
+				t.Errorf("Write failed: %v", err)
+				return
+			}
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			if _, err := gs101.ReadMsg(5 * time.Millisecond); err != nil && !errors.Is(err, ErrTimeout) {
+				t.Errorf("ReadMsg failed: %v", err)
+				return
+			}
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			gs101.Layout()
+			gs101.Progress()
+			gs101.GetDeviceInfo()
+		}
+	}()
+	time.Sleep(50 * time.Millisecond)
+	close(stop)
+	wg.Wait()
+	//A busy machine may not have run the listener yet
+	for deadline := time.Now().Add(time.Second); notifications.Load() == 0 && time.Now().Before(deadline); {
+		time.Sleep(2 * time.Millisecond)
+	}
+
+	if err := gs101.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	seen := notifications.Load()
+	if seen == 0 {
+		t.Error("the listener saw no notifications")
+	}
+	time.Sleep(20 * time.Millisecond)
+	if notifications.Load() != seen {
+		t.Error("the listener ran after Close returned")
+	}
+	waitGoroutines(t, goroutines)
+}
+
+func TestDeviceCloseMidTransfer(t *testing.T) {
+	goroutines := runtime.NumGoroutine()
+	gs101 := openSimulator(t, NewSimulator("bl1"), RetryPolicy{MaxAttempts: 1})
+	if err := gs101.Skip(); err != nil {
+		t.Fatalf("Skip failed: %v", err)
+	}
+	out := &hangingOut{started: make(chan struct{}, 1)}
+	replaceEndpoints(gs101, out, nil)
+	listening := make(chan struct{})
+	if err := gs101.ListenInterrupt(context.Background(), func([]byte, error) {}); err != nil {
+		t.Fatalf("ListenInterrupt failed: %v", err)
+	}
+	go func() {
+		defer close(listening)
+		gs101.workers.Wait()
+	}()
+
+	var writeErr, readErr error
+	wrote, read := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(wrote)
+		_, writeErr = gs101.Write(stageData(1))
+	}()
+	go func() {
+		defer close(read)
+		_, readErr = gs101.ReadMsg(time.Minute)
+	}()
+	<-out.started
+
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		gs101.Close()
+	}()
+	within(t, closed, "Close")
+	within(t, wrote, "Write")
+	within(t, read, "ReadMsg")
+	within(t, listening, "ListenInterrupt")
+
+	if !errors.Is(writeErr, ErrClosed) {
+		t.Errorf("Write error = %v, want %v", writeErr, ErrClosed)
+	}
+	if !errors.Is(readErr, ErrClosed) {
+		t.Errorf("ReadMsg error = %v, want %v", readErr, ErrClosed)
+	}
+	if out.cancelled.Load() != 1 {
+		t.Errorf("%d transfers cancelled, want 1", out.cancelled.Load())
+	}
+	if _, err := gs101.Write(stageData(1)); !errors.Is(err, ErrClosed) {
+		t.Errorf("Write after Close = %v, want %v", err, ErrClosed)
+	}
+	if err := gs101.ListenInterrupt(context.Background(), func([]byte, error) {}); !errors.Is(err, ErrClosed) {
+		t.Errorf("ListenInterrupt after Close = %v, want %v", err, ErrClosed)
+	}
+	waitGoroutines(t, goroutines)
+}
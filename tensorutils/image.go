@@ -0,0 +1,192 @@
+package tensorutils
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// Image is a boot stage of known size that is read on demand, so a large stage is never held in memory
+// several times over. It can be backed by a file, an archive member, stdin or a byte slice.
+type Image struct {
+	Name string //Stage name, i.e. bl1
+	Size int64
+
+	r      io.ReaderAt
+	closer io.Closer
+}
+
+// NewImage returns an image reading size bytes from r
+func NewImage(name string, r io.ReaderAt, size int64) *Image {
+	img := &Image{Name: name, Size: size, r: r}
+	if closer, ok := r.(io.Closer); ok {
+		img.closer = closer
+	}
+	return img
+}
+
+// NewImageBytes returns an image of data without copying it
+func NewImageBytes(name string, data []byte) *Image {
+	return NewImage(name, bytes.NewReader(data), int64(len(data)))
+}
+
+// NewStreamImage returns an image of size bytes read from a sequential source, such as a compressed archive member.
+// The source is read forward as the image is sent, and opened again whenever an earlier offset is needed,
+// i.e. when a stage is restarted after re-enumeration.
+func NewStreamImage(name string, size int64, open func() (io.ReadCloser, error)) *Image {
+	stream := &streamReaderAt{open: open}
+	return &Image{Name: name, Size: size, r: stream, closer: stream}
+}
+
+// OpenImage opens an image file, or stdin if path is "-". The stage name is derived from the file name,
+// stdin has none. Stdin is read in place if it is redirected from a file, and otherwise spooled to a temporary
+// file, removed when the image is closed, as a pipe can only be read once and its size isn't known up front.
+func OpenImage(path string) (*Image, error) {
+	if path == "-" {
+		return stdinImage()
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	stat, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	if !stat.Mode().IsRegular() {
+		file.Close()
+		return nil, fmt.Errorf("image %s is not a regular file", path)
+	}
+	base := filepath.Base(path)
+	return NewImage(strings.TrimSuffix(base, filepath.Ext(base)), file, stat.Size()), nil
+}
+
+func stdinImage() (*Image, error) {
+	if stat, err := os.Stdin.Stat(); err == nil && stat.Mode().IsRegular() {
+		offset, err := os.Stdin.Seek(0, io.SeekCurrent)
+		if err != nil {
+			offset = 0
+		}
+		return NewImage("", io.NewSectionReader(os.Stdin, offset, stat.Size()-offset), stat.Size()-offset), nil
+	}
+	spool, err := os.CreateTemp("", "tensor-usbdl-stdin-*")
+	if err != nil {
+		return nil, fmt.Errorf("failed to spool image from stdin: %w", err)
+	}
+	size, err := io.Copy(spool, os.Stdin)
+	if err != nil {
+		spoolFile{spool}.Close()
+		return nil, fmt.Errorf("failed to read image from stdin: %w", err)
+	}
+	return NewImage("", spoolFile{spool}, size), nil
+}
+
+// spoolFile is a temporary file that is removed when closed
+type spoolFile struct {
+	*os.File
+}
+
+func (spool spoolFile) Close() error {
+	err := spool.File.Close()
+	os.Remove(spool.Name())
+	return err
+}
+
+// ReadAt reads the image at the given offset, failing with io.EOF past its size
+func (img *Image) ReadAt(p []byte, off int64) (int, error) {
+	if off >= img.Size {
+		return 0, io.EOF
+	}
+	short := false
+	if left := img.Size - off; int64(len(p)) > left {
+		p = p[:left]
+		short = true
+	}
+	n, err := img.r.ReadAt(p, off)
+	if err == io.EOF && n == len(p) {
+		err = nil
+	}
+	if err == nil && short {
+		err = io.EOF
+	}
+	return n, err
+}
+
+// Reader returns a reader over the whole image, independent of other readers
+func (img *Image) Reader() *io.SectionReader {
+	return io.NewSectionReader(img, 0, img.Size)
+}
+
+// Bytes reads the whole image into memory
+func (img *Image) Bytes() ([]byte, error) {
+	data := make([]byte, img.Size)
+	if n, err := img.ReadAt(data, 0); n != len(data) {
+		if err == nil || err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, fmt.Errorf("image %s: read %d of %d bytes: %w", img.Name, n, img.Size, err)
+	}
+	return data, nil
+}
+
+// Close releases the source of the image
+func (img *Image) Close() error {
+	if img.closer == nil {
+		return nil
+	}
+	return img.closer.Close()
+}
+
+// streamReaderAt serves reads at increasing offsets from a sequential source, reopening it to go back
+type streamReaderAt struct {
+	open func() (io.ReadCloser, error)
+
+	mutex  sync.Mutex
+	stream io.ReadCloser
+	offset int64 //Offset of the next byte read from stream
+}
+
+func (s *streamReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.stream == nil || off < s.offset {
+		if s.stream != nil {
+			s.stream.Close()
+			s.stream = nil
+		}
+		stream, err := s.open()
+		if err != nil {
+			return 0, err
+		}
+		s.stream, s.offset = stream, 0
+	}
+	if off > s.offset {
+		skipped, err := io.CopyN(io.Discard, s.stream, off-s.offset)
+		s.offset += skipped
+		if err != nil {
+			return 0, err
+		}
+	}
+	n, err := io.ReadFull(s.stream, p)
+	s.offset += int64(n)
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+	return n, err
+}
+
+func (s *streamReaderAt) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.stream == nil {
+		return nil
+	}
+	err := s.stream.Close()
+	s.stream = nil
+	return err
+}
@@ -0,0 +1,146 @@
+package tensorutils
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestImageReadAt(t *testing.T) {
+	img := NewImage("bl1", strings.NewReader("0123456789 beyond the image"), 10)
+	tests := []struct {
+		off  int64
+		n    int
+		want string
+		err  error
+	}{
+		{0, 10, "0123456789", nil},
+		{4, 3, "456", nil},
+		{8, 5, "89", io.EOF}, //Never past the image size
+		{10, 1, "", io.EOF},
+	}
+	for _, test := range tests {
+		p := make([]byte, test.n)
+		n, err := img.ReadAt(p, test.off)
+		if string(p[:n]) != test.want || err != test.err {
+			t.Errorf("ReadAt(%d bytes at %d) = %q, %v, want %q, %v", test.n, test.off, p[:n], err, test.want, test.err)
+		}
+	}
+	if p, err := io.ReadAll(img.Reader()); err != nil || string(p) != "0123456789" {
+		t.Errorf("Reader read %q, %v", p, err)
+	}
+
+	//A source shorter than the image size
+	short := NewImage("bl1", strings.NewReader("0123"), 10)
+	if _, err := short.Bytes(); err == nil {
+		t.Error("Bytes of a short image succeeded")
+	}
+	p := make([]byte, 6)
+	if n, err := short.ReadAt(p, 2); n != 2 || err != io.EOF {
+		t.Errorf("ReadAt of a short image = %d, %v, want 2, EOF", n, err)
+	}
+}
+
+func TestStreamImage(t *testing.T) {
+	content := "pbl stage read from a compressed archive"
+	opened := 0
+	img := NewStreamImage("pbl", int64(len(content)), func() (io.ReadCloser, error) {
+		opened++
+		return io.NopCloser(strings.NewReader(content)), nil
+	})
+	defer img.Close()
+
+	reads := []struct {
+		off    int64
+		n      int
+		opened int //Times the source was opened after the read
+	}{
+		{0, 4, 1},
+		{4, 6, 1},  //Continues where it left off
+		{20, 5, 1}, //Skips ahead
+		{8, 4, 2},  //Goes back, so the source is opened again
+		{12, 8, 2},
+		{36, 10, 2},
+	}
+	for _, read := range reads {
+		p := make([]byte, read.n)
+		n, err := img.ReadAt(p, read.off)
+		want := content[read.off:min(int(read.off)+read.n, len(content))]
+		if string(p[:n]) != want || (err != nil) != (len(want) < read.n) {
+			t.Errorf("ReadAt(%d bytes at %d) = %q, %v, want %q", read.n, read.off, p[:n], err, want)
+		}
+		if opened != read.opened {
+			t.Errorf("after reading at %d the source was opened %d times, want %d", read.off, opened, read.opened)
+		}
+	}
+	if p, err := img.Bytes(); err != nil || string(p) != content {
+		t.Errorf("Bytes() = %q, %v", p, err)
+	}
+}
+
+// withStdin runs f with stdin replaced by file
+func withStdin(t *testing.T, file *os.File, f func()) {
+	t.Helper()
+	stdin := os.Stdin
+	os.Stdin = file
+	defer func() { os.Stdin = stdin }()
+	f()
+}
+
+func TestOpenImageStdin(t *testing.T) {
+	content := bytes.Repeat([]byte("abl "), 4096)
+
+	//A pipe is spooled to a temporary file that is removed on Close
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("failed to create a pipe: %v", err)
+	}
+	go func() {
+		w.Write(content)
+		w.Close()
+	}()
+	withStdin(t, r, func() {
+		img, err := OpenImage("-")
+		if err != nil {
+			t.Fatalf("OpenImage(-) from a pipe failed: %v", err)
+		}
+		spool := img.closer.(spoolFile).Name()
+		if p, err := img.Bytes(); err != nil || !bytes.Equal(p, content) || img.Size != int64(len(content)) {
+			t.Errorf("piped image read %d of %d bytes, err %v", len(p), img.Size, err)
+		}
+		img.Close()
+		if _, err := os.Stat(spool); !os.IsNotExist(err) {
+			t.Errorf("spool file %s left behind: %v", spool, err)
+		}
+	})
+	r.Close()
+
+	//A redirected file is read in place from its current offset
+	name := filepath.Join(t.TempDir(), "abl.img")
+	os.WriteFile(name, append([]byte("skip"), content...), 0o644)
+	file, err := os.Open(name)
+	if err != nil {
+		t.Fatalf("failed to open %s: %v", name, err)
+	}
+	defer file.Close()
+	file.Seek(4, io.SeekStart)
+	withStdin(t, file, func() {
+		img, err := OpenImage("-")
+		if err != nil {
+			t.Fatalf("OpenImage(-) from a file failed: %v", err)
+		}
+		if _, spooled := img.closer.(spoolFile); spooled {
+			t.Error("a redirected file was spooled")
+		}
+		if p, err := img.Bytes(); err != nil || !bytes.Equal(p, content) {
+			t.Errorf("redirected image read %d bytes, err %v", len(p), err)
+		}
+	})
+
+	if _, err := OpenImage(t.TempDir()); err == nil || !strings.Contains(err.Error(), "not a regular file") {
+		t.Errorf("OpenImage of a directory = %v, want it rejected", err)
+	}
+}
@@ -0,0 +1,97 @@
+package tensorutils
+
+import (
+	"fmt"
+	"sync/atomic"
+)
+
+// LogLevel is the severity of a log entry
+type LogLevel int
+
+const (
+	LogTrace LogLevel = iota
+	LogDebug
+	LogInfo
+	LogWarn
+	LogError
+)
+
+var logLevelNames = map[LogLevel]string{
+	LogTrace: "trace",
+	LogDebug: "debug",
+	LogInfo:  "info",
+	LogWarn:  "warn",
+	LogError: "error",
+}
+
+func (level LogLevel) String() string {
+	if name, exists := logLevelNames[level]; exists {
+		return name
+	}
+	return fmt.Sprintf("level(%d)", int(level))
+}
+
+// Keys for the fields attached to log entries
+const (
+	FieldDevice   = "device"   //Device description, i.e. VID:PID and serial
+	FieldEndpoint = "endpoint" //Endpoint address formatted as 0x02
+	FieldStage    = "stage"    //Boot stage being sent
+	FieldOffset   = "offset"   //Offset into the stage being sent
+	FieldProfile  = "profile"  //Name of the device profile in use
+)
+
+// Fields holds structured context for a log entry
+type Fields map[string]interface{}
+
+// Logger receives log entries from tensorutils, it must be safe for concurrent use
+type Logger interface {
+	Log(level LogLevel, msg string, fields Fields)
+}
+
+// nopLogger discards everything, library users get no output unless they ask for it
+type nopLogger struct{}
+
+func (nopLogger) Log(LogLevel, string, Fields) {}
+
+var logger atomic.Pointer[Logger] //Nil until SetLogger is called
+
+// SetLogger sets the logger used by tensorutils, nil silences it again.
+// It may be called while devices are open, a GS101Device may override it with its own Logger.
+func SetLogger(l Logger) {
+	if l == nil {
+		logger.Store(nil)
+		return
+	}
+	logger.Store(&l)
+}
+
+// packageLogger returns the logger set with SetLogger, one discarding everything if there is none
+func packageLogger() Logger {
+	if l := logger.Load(); l != nil {
+		return *l
+	}
+	return nopLogger{}
+}
+
+// endpointField formats an endpoint address the way the rest of the output does
+func endpointField(endpoint uint8) string {
+	return fmt.Sprintf("0x%02x", endpoint)
+}
+
+// log sends an entry to the device's logger, tagged with the device
+func (gs101 *GS101Device) log(level LogLevel, msg string, fields Fields) {
+	l := gs101.Logger
+	if l == nil {
+		l = packageLogger()
+	}
+	if fields == nil {
+		fields = Fields{}
+	}
+	gs101.mutex.Lock()
+	info := gs101.info
+	gs101.mutex.Unlock()
+	if info != "" {
+		fields[FieldDevice] = info
+	}
+	l.Log(level, msg, fields)
+}
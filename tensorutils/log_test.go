@@ -0,0 +1,111 @@
+package tensorutils
+
+import (
+	"sync"
+	"testing"
+)
+
+// logEntry is a log entry kept by recordingLogger
+type logEntry struct {
+	level  LogLevel
+	msg    string
+	fields Fields
+}
+
+// recordingLogger keeps every entry logged to it
+type recordingLogger struct {
+	mutex   sync.Mutex
+	entries []logEntry
+}
+
+func (l *recordingLogger) Log(level LogLevel, msg string, fields Fields) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.entries = append(l.entries, logEntry{level, msg, fields})
+}
+
+func (l *recordingLogger) logged() []logEntry {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return append([]logEntry(nil), l.entries...)
+}
+
+func TestLogLevelString(t *testing.T) {
+	tests := []struct {
+		level LogLevel
+		want  string
+	}{
+		{LogTrace, "trace"},
+		{LogWarn, "warn"},
+		{LogError, "error"},
+		{LogLevel(9), "level(9)"},
+	}
+	for _, test := range tests {
+		if got := test.level.String(); got != test.want {
+			t.Errorf("LogLevel(%d) = %s, want %s", int(test.level), got, test.want)
+		}
+	}
+}
+
+func TestSetLogger(t *testing.T) {
+	t.Cleanup(func() { SetLogger(nil) })
+	if _, silent := packageLogger().(nopLogger); !silent {
+		t.Errorf("package logger is %T before SetLogger, want it silent", packageLogger())
+	}
+
+	rec := &recordingLogger{}
+	SetLogger(rec)
+	packageLogger().Log(LogInfo, "claimed", Fields{FieldDevice: "ttyACM0"})
+	SetLogger(nil)
+	packageLogger().Log(LogInfo, "dropped", nil)
+	if entries := rec.logged(); len(entries) != 1 || entries[0].msg != "claimed" || entries[0].fields[FieldDevice] != "ttyACM0" {
+		t.Errorf("logged %+v, want only the entry from before SetLogger(nil)", entries)
+	}
+
+	//The logger may be replaced while devices log
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 200; j++ {
+				packageLogger().Log(LogDebug, "busy", nil)
+			}
+		}()
+	}
+	for i := 0; i < 100; i++ {
+		SetLogger(rec)
+		SetLogger(nil)
+	}
+	wg.Wait()
+}
+
+func TestDeviceLog(t *testing.T) {
+	t.Cleanup(func() { SetLogger(nil) })
+	pkg := &recordingLogger{}
+	SetLogger(pkg)
+
+	gs101 := &GS101Device{}
+	gs101.log(LogWarn, "no device yet", nil)
+	gs101.info = "GS101 Device (18d1:4f00)"
+	gs101.log(LogDebug, "sending", Fields{FieldStage: "bl1"})
+
+	entries := pkg.logged()
+	if len(entries) != 2 {
+		t.Fatalf("package logger got %d entries, want 2", len(entries))
+	}
+	if _, tagged := entries[0].fields[FieldDevice]; tagged || entries[0].level != LogWarn {
+		t.Errorf("first entry = %+v, want a warning without a device", entries[0])
+	}
+	if fields := entries[1].fields; fields[FieldDevice] != gs101.info || fields[FieldStage] != "bl1" || entries[1].level != LogDebug {
+		t.Errorf("second entry = %+v, want the stage tagged with the device", entries[1])
+	}
+
+	//The device's own logger takes over from the package logger
+	own := &recordingLogger{}
+	gs101.Logger = own
+	gs101.log(LogInfo, "connected", nil)
+	if len(own.logged()) != 1 || len(pkg.logged()) != 2 {
+		t.Errorf("device logger got %d entries and the package logger %d, want 1 and 2", len(own.logged()), len(pkg.logged()))
+	}
+}
@@ -1,6 +1,9 @@
 package tensorutils
 
-import "strings"
+import (
+	"fmt"
+	"strings"
+)
 
 type Message struct {
 	bytes []byte
@@ -53,6 +56,47 @@ func (msg *Message) Argument() string {
 	return msg.arg
 }
 
+// IsRequest reports whether the device is requesting the next boot stage
+func (msg *Message) IsRequest() bool {
+	return msg.cmd == "eub" && msg.sub == "req"
+}
+
+// IsAck reports whether the device acknowledged the last transfer
+func (msg *Message) IsAck() bool {
+	return msg.cmd == "eub" && msg.sub == "ack"
+}
+
+// IsNak reports whether the device refused the last transfer
+func (msg *Message) IsNak() bool {
+	return msg.cmd == "eub" && msg.sub == "nak"
+}
+
+// IsFailure reports whether the device announced a header or boot failure
+func (msg *Message) IsFailure() bool {
+	return msg.cmd == "error" || strings.HasSuffix(msg.sub, "_failure")
+}
+
+// Describe explains the message in plain words, for reports
+func (msg *Message) Describe() string {
+	switch {
+	case msg.IsRequest():
+		return fmt.Sprintf("device %s requests stage %s", msg.dev, msg.arg)
+	case msg.IsAck():
+		return "the device accepted the stage"
+	case msg.IsNak():
+		return "the device refused the stage"
+	case msg.cmd == "error" && msg.sub == "header fail":
+		return fmt.Sprintf("the device rejected the %s header, the image is corrupt, not signed for this device or the wrong stage", msg.arg)
+	case strings.HasSuffix(msg.sub, "_failure"):
+		what := strings.ReplaceAll(strings.TrimSuffix(msg.sub, "_failure"), "_", " ")
+		if strings.HasPrefix(what, "irom ") {
+			what = "boot ROM " + strings.TrimPrefix(what, "irom ")
+		}
+		return what + " failed"
+	}
+	return msg.String()
+}
+
 func (msg *Message) Bytes() []byte {
 	return msg.bytes
 }
@@ -0,0 +1,373 @@
+package tensorutils
+
+import (
+	"bytes"
+	"embed"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Probe operations
+const (
+	ProbeWrite     = "write"     //Write Hex or Text to bulk OUT
+	ProbeRead      = "read"      //Read up to Length bytes from bulk IN
+	ProbeMessage   = "message"   //Wait for the next message on bulk IN
+	ProbeInterrupt = "interrupt" //Poll interrupt IN
+	ProbeControl   = "control"   //Control transfer, Length bytes for IN requests or Hex for OUT requests
+	ProbeClear     = "clear"     //Clear the halt on Endpoint
+	ProbeReset     = "reset"     //Reset the port
+	ProbeDelay     = "delay"     //Wait for Timeout
+)
+
+// Expected errors for ProbeExpect.Error
+const (
+	ExpectSuccess  = ""
+	ExpectAny      = "any"
+	ExpectTimeout  = "timeout"
+	ExpectStall    = "stall"
+	ExpectNoDevice = "nodevice"
+)
+
+//go:embed probes/*.json
+var bundledProbes embed.FS
+
+// Duration is a time.Duration written as a string such as 500ms in probe and profile files
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(p []byte) error {
+	var s string
+	if err := json.Unmarshal(p, &s); err != nil {
+		return err
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d Duration) String() string {
+	return time.Duration(d).String()
+}
+
+// Number is a 16-bit value written either as a JSON number or as a string such as "0x81" in probe and profile files
+type Number uint16
+
+func (n *Number) UnmarshalJSON(p []byte) error {
+	var s string
+	if err := json.Unmarshal(p, &s); err != nil {
+		s = string(p)
+	}
+	v, err := strconv.ParseUint(s, 0, 16)
+	if err != nil {
+		return err
+	}
+	*n = Number(v)
+	return nil
+}
+
+func (n Number) MarshalJSON() ([]byte, error) {
+	return json.Marshal(fmt.Sprintf("0x%02x", uint16(n)))
+}
+
+// Probe is a declarative sequence of transfers with expectations, used to qualify cables, hubs and hosts
+type Probe struct {
+	Name  string      `json:"name"`
+	Steps []ProbeStep `json:"steps"`
+}
+
+// ProbeStep is a single operation of a probe, see the Probe* operations for which fields apply
+type ProbeStep struct {
+	Name        string       `json:"name"`
+	Op          string       `json:"op"`
+	Hex         string       `json:"hex,omitempty"`
+	Text        string       `json:"text,omitempty"`
+	Length      int          `json:"length,omitempty"`
+	Endpoint    Number       `json:"endpoint,omitempty"`
+	RequestType Number       `json:"request_type,omitempty"`
+	Request     Number       `json:"request,omitempty"`
+	Value       Number       `json:"value,omitempty"`
+	Index       Number       `json:"index,omitempty"`
+	Timeout     Duration     `json:"timeout,omitempty"`
+	Optional    bool         `json:"optional,omitempty"` //A failure is reported as a warning and doesn't fail the probe
+	Expect      *ProbeExpect `json:"expect,omitempty"`
+}
+
+// ProbeExpect holds the expectations on a step's outcome, empty fields aren't checked
+type ProbeExpect struct {
+	Error     string `json:"error,omitempty"`      //See the Expect* errors, success by default
+	Length    int    `json:"length,omitempty"`     //Exact number of bytes transferred
+	MinLength int    `json:"min_length,omitempty"` //Minimum number of bytes transferred
+	Hex       string `json:"hex,omitempty"`        //Bytes the data must start with
+	Text      string `json:"text,omitempty"`       //Text the data must contain
+	Message   string `json:"message,omitempty"`    //request, ack, nak or failure
+	Stage     string `json:"stage,omitempty"`      //Stage a request must ask for
+}
+
+// ParseProbe reads a probe in JSON format and validates its steps
+func ParseProbe(r io.Reader) (*Probe, error) {
+	probe := new(Probe)
+	dec := json.NewDecoder(r)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(probe); err != nil {
+		return nil, fmt.Errorf("probe: %w", err)
+	}
+	for i := range probe.Steps {
+		if err := probe.Steps[i].validate(); err != nil {
+			return nil, fmt.Errorf("probe: step %d (%s): %w", i+1, probe.Steps[i].Name, err)
+		}
+	}
+	return probe, nil
+}
+
+// LoadProbe reads a probe from a file, or the bundled probe of that name such as gs101
+func LoadProbe(path string) (*Probe, error) {
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		if bundled, bundledErr := bundledProbes.Open("probes/" + strings.ToLower(path) + ".json"); bundledErr == nil {
+			defer bundled.Close()
+			return ParseProbe(bundled)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ParseProbe(f)
+}
+
+// DefaultProbe returns the bundled GS101 probe suite
+func DefaultProbe() (*Probe, error) {
+	return LoadProbe("gs101")
+}
+
+func (step *ProbeStep) validate() error {
+	switch step.Op {
+	case ProbeWrite:
+		if step.Hex != "" && step.Text != "" {
+			return fmt.Errorf("write takes either hex or text")
+		}
+	case ProbeRead, ProbeMessage, ProbeInterrupt, ProbeReset, ProbeDelay:
+	case ProbeControl:
+		if step.RequestType > 0xff || step.Request > 0xff {
+			return fmt.Errorf("request_type and request are single bytes")
+		}
+		if step.RequestType&0x80 == 0 && step.Length > 0 {
+			return fmt.Errorf("length only applies to IN control requests")
+		}
+	case ProbeClear:
+		if step.Endpoint == 0 || step.Endpoint > 0xff {
+			return fmt.Errorf("clear needs an endpoint address")
+		}
+	default:
+		return fmt.Errorf("unknown op '%s'", step.Op)
+	}
+	if _, err := step.data(); err != nil {
+		return err
+	}
+	if step.Expect != nil {
+		if _, err := hex.DecodeString(strings.ReplaceAll(step.Expect.Hex, " ", "")); err != nil {
+			return fmt.Errorf("invalid expected hex: %w", err)
+		}
+		switch step.Expect.Error {
+		case ExpectSuccess, ExpectAny, ExpectTimeout, ExpectStall, ExpectNoDevice:
+		default:
+			return fmt.Errorf("unknown expected error '%s'", step.Expect.Error)
+		}
+	}
+	return nil
+}
+
+// data returns the bytes a step sends
+func (step *ProbeStep) data() ([]byte, error) {
+	if step.Text != "" {
+		return []byte(step.Text), nil
+	}
+	p, err := hex.DecodeString(strings.ReplaceAll(step.Hex, " ", ""))
+	if err != nil {
+		return nil, fmt.Errorf("invalid hex: %w", err)
+	}
+	return p, nil
+}
+
+func (step *ProbeStep) timeout(fallback time.Duration) time.Duration {
+	if step.Timeout > 0 {
+		return time.Duration(step.Timeout)
+	}
+	return fallback
+}
+
+// ProbeRetryPolicy makes every failed transfer of a probe fail its step
+var ProbeRetryPolicy = RetryPolicy{MaxAttempts: 1}
+
+// ProbeStatus is the verdict on a single step
+type ProbeStatus int
+
+const (
+	ProbePass ProbeStatus = iota
+	ProbeWarn             //An optional step failed
+	ProbeFail
+)
+
+func (status ProbeStatus) String() string {
+	switch status {
+	case ProbePass:
+		return "PASS"
+	case ProbeWarn:
+		return "WARN"
+	}
+	return "FAIL"
+}
+
+// ProbeResult is the outcome of a single step
+type ProbeResult struct {
+	Step    *ProbeStep
+	Status  ProbeStatus
+	Data    []byte        //Bytes received, or sent by write steps
+	Err     error         //Error returned by the transfer
+	Reason  string        //Why the step failed, empty when it passed
+	Elapsed time.Duration //Time the transfer took
+}
+
+// ProbeReport holds the results of every step of a probe
+type ProbeReport struct {
+	Name    string
+	Results []ProbeResult
+}
+
+// Passed reports whether no required step failed
+func (report *ProbeReport) Passed() bool {
+	return report.Count(ProbeFail) == 0
+}
+
+// Count returns how many steps ended with the given status
+func (report *ProbeReport) Count(status ProbeStatus) int {
+	count := 0
+	for _, res := range report.Results {
+		if res.Status == status {
+			count++
+		}
+	}
+	return count
+}
+
+// RunProbe runs every step of a probe in order with the device's retry policy. Set Retry to ProbeRetryPolicy
+// first so each failure shows up as it happens instead of being recovered from.
+func (gs101 *GS101Device) RunProbe(probe *Probe) *ProbeReport {
+	report := &ProbeReport{Name: probe.Name}
+	for i := range probe.Steps {
+		step := &probe.Steps[i]
+		start := time.Now()
+		data, err := gs101.runStep(step)
+		res := ProbeResult{Step: step, Data: data, Err: err, Elapsed: time.Since(start)}
+		res.Reason = step.check(data, err)
+		if res.Reason != "" {
+			res.Status = ProbeFail
+			if step.Optional {
+				res.Status = ProbeWarn
+			}
+		}
+		gs101.log(LogDebug, fmt.Sprintf("Probe step %s: %s %s", step.Name, res.Status, res.Reason), nil)
+		report.Results = append(report.Results, res)
+	}
+	return report
+}
+
+// runStep performs a step, returning the bytes received or sent
+func (gs101 *GS101Device) runStep(step *ProbeStep) ([]byte, error) {
+	payload, _ := step.data() //Validated when parsed
+	switch step.Op {
+	case ProbeWrite:
+		n, err := gs101.Write(payload)
+		return payload[:n], err
+	case ProbeRead:
+		buf := make([]byte, max(step.Length, gs101.Layout().BulkPktSize)) //Whole packets avoid overflows
+		n, err := gs101.Read(buf)
+		return buf[:n], err
+	case ProbeMessage:
+		msg, err := gs101.ReadMsg(step.timeout(gs101.profile.announceTimeout()))
+		if msg == nil {
+			return nil, err
+		}
+		return msg.Bytes(), err
+	case ProbeInterrupt:
+		return gs101.ReadInterrupt()
+	case ProbeControl:
+		buf := payload
+		if step.RequestType&0x80 != 0 {
+			buf = make([]byte, step.Length)
+		}
+		n, err := gs101.Control(uint8(step.RequestType), uint8(step.Request), uint16(step.Value), uint16(step.Index), buf)
+		return buf[:max(n, 0)], err
+	case ProbeClear:
+		return nil, gs101.ClearHalt(uint8(step.Endpoint))
+	case ProbeReset:
+		return nil, gs101.ResetPort()
+	case ProbeDelay:
+		time.Sleep(step.timeout(0))
+		return nil, nil
+	}
+	return nil, fmt.Errorf("unknown op '%s'", step.Op)
+}
+
+// check compares the outcome of a step with its expectations, returning why it failed or an empty string
+func (step *ProbeStep) check(data []byte, err error) string {
+	expect := step.Expect
+	if expect == nil {
+		expect = &ProbeExpect{}
+	}
+
+	switch expect.Error {
+	case ExpectAny:
+	case ExpectSuccess:
+		if err != nil {
+			return err.Error()
+		}
+	default:
+		sentinel := map[string]error{ExpectTimeout: ErrTimeout, ExpectStall: ErrStall, ExpectNoDevice: ErrNoDevice}[expect.Error]
+		if !errors.Is(err, sentinel) {
+			return fmt.Sprintf("expected %s error, got %v", expect.Error, err)
+		}
+		return ""
+	}
+
+	if expect.Length > 0 && len(data) != expect.Length {
+		return fmt.Sprintf("expected %d bytes, got %d", expect.Length, len(data))
+	}
+	if len(data) < expect.MinLength {
+		return fmt.Sprintf("expected at least %d bytes, got %d", expect.MinLength, len(data))
+	}
+	if want, _ := hex.DecodeString(strings.ReplaceAll(expect.Hex, " ", "")); !bytes.HasPrefix(data, want) {
+		return fmt.Sprintf("expected data starting with %x, got %x", want, data[:min(len(data), len(want))])
+	}
+	if !bytes.Contains(data, []byte(expect.Text)) {
+		return fmt.Sprintf("expected data containing %q", expect.Text)
+	}
+
+	if expect.Message != "" || expect.Stage != "" {
+		msg := NewMessage(data)
+		if msg == nil {
+			return "expected a message, got none"
+		}
+		matches := map[string]bool{"": true, "request": msg.IsRequest(), "ack": msg.IsAck(), "nak": msg.IsNak(), "failure": msg.IsFailure()}
+		if !matches[expect.Message] {
+			return fmt.Sprintf("expected %s message, got %s", expect.Message, msg.String())
+		}
+		if expect.Stage != "" && !sameStage(expect.Stage, msg.Argument()) {
+			return fmt.Sprintf("expected request for stage %s, got %s", expect.Stage, msg.String())
+		}
+	}
+	return ""
+}
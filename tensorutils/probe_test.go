@@ -0,0 +1,195 @@
+package tensorutils
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBundledProbes(t *testing.T) {
+	names, err := fs.Glob(bundledProbes, "probes/*.json")
+	if err != nil || len(names) == 0 {
+		t.Fatalf("no bundled probes: %v", err)
+	}
+	for _, name := range names {
+		f, err := bundledProbes.Open(name)
+		if err != nil {
+			t.Fatalf("failed to open %s: %v", name, err)
+		}
+		probe, err := ParseProbe(f)
+		f.Close()
+		if err != nil {
+			t.Errorf("bundled probe %s doesn't parse: %v", name, err)
+		} else if probe.Name == "" || len(probe.Steps) == 0 {
+			t.Errorf("bundled probe %s has no name or steps", name)
+		}
+	}
+	if probe, err := DefaultProbe(); err != nil || len(probe.Steps) == 0 {
+		t.Errorf("DefaultProbe() = %v, %v", probe, err)
+	}
+}
+
+func TestParseProbe(t *testing.T) {
+	tests := []struct {
+		name  string
+		steps string
+		err   string
+	}{
+		{"every op", `{"op": "write", "hex": "de ad"}, {"op": "read", "length": 512}, {"op": "message", "timeout": "2s"},
+			{"op": "interrupt"}, {"op": "control", "request_type": "0x80", "request": 6, "length": 18}, {"op": "clear", "endpoint": "0x81"},
+			{"op": "reset"}, {"op": "delay", "timeout": "10ms"}`, ""},
+		{"expectations", `{"op": "message", "expect": {"error": "timeout", "hex": "65 75", "message": "request", "stage": "bl1"}}`, ""},
+		{"unknown op", `{"name": "poke", "op": "poke"}`, "step 1 (poke): unknown op 'poke'"},
+		{"hex and text", `{"op": "write", "hex": "00", "text": "a"}`, "write takes either hex or text"},
+		{"invalid hex", `{"op": "write", "hex": "0g"}`, "invalid hex"},
+		{"wide request", `{"op": "control", "request_type": "0x80", "request": "0x100"}`, "single bytes"},
+		{"length of an OUT request", `{"op": "control", "request_type": "0x00", "length": 4}`, "only applies to IN control requests"},
+		{"clear without endpoint", `{"op": "clear"}`, "clear needs an endpoint address"},
+		{"invalid expected hex", `{"op": "read", "expect": {"hex": "xyz"}}`, "invalid expected hex"},
+		{"unknown expected error", `{"op": "read", "expect": {"error": "busy"}}`, "unknown expected error 'busy'"},
+		{"second step", `{"op": "reset"}, {"name": "late", "op": "clear"}`, "step 2 (late)"},
+		{"unknown field", `{"op": "reset", "retries": 3}`, "unknown field"},
+		{"invalid duration", `{"op": "delay", "timeout": "soon"}`, "probe:"},
+		{"invalid number", `{"op": "clear", "endpoint": "0x10000"}`, "probe:"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			probe, err := ParseProbe(strings.NewReader(`{"name": "test", "steps": [` + test.steps + `]}`))
+			if test.err == "" {
+				if err != nil || probe.Name != "test" {
+					t.Errorf("ParseProbe failed: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("ParseProbe error = %v, want %q", err, test.err)
+			}
+		})
+	}
+}
+
+func TestDurationJSON(t *testing.T) {
+	var d Duration
+	if err := json.Unmarshal([]byte(`"1m30s"`), &d); err != nil || time.Duration(d) != 90*time.Second {
+		t.Errorf("Unmarshal(1m30s) = %s, %v", d, err)
+	}
+	if p, err := json.Marshal(Duration(500 * time.Millisecond)); err != nil || string(p) != `"500ms"` {
+		t.Errorf("Marshal(500ms) = %s, %v", p, err)
+	}
+	for _, value := range []string{`"soon"`, `500`, `"5"`} {
+		if err := json.Unmarshal([]byte(value), &d); err == nil {
+			t.Errorf("Unmarshal(%s) succeeded", value)
+		}
+	}
+}
+
+func TestNumberJSON(t *testing.T) {
+	tests := []struct {
+		value string
+		want  Number
+	}{
+		{`129`, 0x81},
+		{`"129"`, 0x81},
+		{`"0x81"`, 0x81},
+		{`"0X4F00"`, 0x4f00},
+		{`"0o17"`, 15},
+		{`65535`, 0xffff},
+	}
+	for _, test := range tests {
+		var n Number
+		if err := json.Unmarshal([]byte(test.value), &n); err != nil || n != test.want {
+			t.Errorf("Unmarshal(%s) = %d, %v, want %d", test.value, n, err, test.want)
+		}
+	}
+	for _, value := range []string{`65536`, `-1`, `"0x"`, `"eighty"`, `1.5`, `true`} {
+		var n Number
+		if err := json.Unmarshal([]byte(value), &n); err == nil {
+			t.Errorf("Unmarshal(%s) = %d, want an error", value, n)
+		}
+	}
+	if p, err := json.Marshal(Number(0x81)); err != nil || string(p) != `"0x81"` {
+		t.Errorf("Marshal(0x81) = %s, %v", p, err)
+	}
+	if p, err := json.Marshal(Number(2)); err != nil || string(p) != `"0x02"` {
+		t.Errorf("Marshal(2) = %s, %v", p, err)
+	}
+}
+
+func TestProbeStepCheck(t *testing.T) {
+	stalled := fmt.Errorf("write failed: %w", ErrStall)
+	request := []byte("eub:req:09845001:bl1")
+	tests := []struct {
+		name   string
+		expect *ProbeExpect
+		data   []byte
+		err    error
+		want   string
+	}{
+		{"success by default", nil, []byte("x"), nil, ""},
+		{"error by default", nil, nil, stalled, "write failed: severe stall"},
+		{"any error", &ProbeExpect{Error: ExpectAny}, nil, stalled, ""},
+		{"any error still checks the data", &ProbeExpect{Error: ExpectAny, MinLength: 1}, nil, stalled, "expected at least 1 bytes, got 0"},
+		{"expected stall", &ProbeExpect{Error: ExpectStall}, nil, stalled, ""},
+		{"expected timeout got stall", &ProbeExpect{Error: ExpectTimeout}, nil, stalled, "expected timeout error, got write failed: severe stall"},
+		{"expected no device got success", &ProbeExpect{Error: ExpectNoDevice}, nil, nil, "expected nodevice error, got <nil>"},
+		{"exact length", &ProbeExpect{Length: 18}, make([]byte, 18), nil, ""},
+		{"wrong length", &ProbeExpect{Length: 18}, make([]byte, 17), nil, "expected 18 bytes, got 17"},
+		{"hex prefix with spaces", &ProbeExpect{Hex: "12 01"}, []byte{0x12, 0x01, 0x00}, nil, ""},
+		{"wrong hex prefix", &ProbeExpect{Hex: "1201"}, []byte{0x12}, nil, "expected data starting with 1201, got 12"},
+		{"text", &ProbeExpect{Text: "req"}, request, nil, ""},
+		{"missing text", &ProbeExpect{Text: "ack"}, request, nil, `expected data containing "ack"`},
+		{"request for the stage", &ProbeExpect{Message: "request", Stage: "bl1"}, request, nil, ""},
+		{"request for an alias", &ProbeExpect{Stage: "pbl"}, []byte("eub:req:09845001:epbl"), nil, ""},
+		{"request for another stage", &ProbeExpect{Message: "request", Stage: "pbl"}, request, nil, "expected request for stage pbl, got"},
+		{"other message", &ProbeExpect{Message: "ack"}, request, nil, "expected ack message, got"},
+		{"nak", &ProbeExpect{Message: "nak"}, []byte("eub:nak"), nil, ""},
+		{"no message", &ProbeExpect{Message: "request"}, nil, nil, "expected a message, got none"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			step := &ProbeStep{Op: ProbeRead, Expect: test.expect}
+			got := step.check(test.data, test.err)
+			if test.want == "" && got != "" || test.want != "" && !strings.HasPrefix(got, test.want) {
+				t.Errorf("check = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestRunProbe(t *testing.T) {
+	probe, err := ParseProbe(strings.NewReader(`{"name": "simulated", "steps": [
+		{"name": "descriptor", "op": "control", "request_type": "0x80", "request": "0x06", "value": "0x0100", "length": 18, "expect": {"hex": "12 01"}},
+		{"name": "announcement", "op": "message", "expect": {"message": "request", "stage": "bl2"}},
+		{"name": "stalled write", "op": "write", "text": "TEST", "expect": {"error": "stall"}},
+		{"name": "quiet", "op": "message", "timeout": "20ms", "optional": true}
+	]}`))
+	if err != nil {
+		t.Fatalf("ParseProbe failed: %v", err)
+	}
+	sim := NewSimulator("bl1")
+	sim.StallAt = []int{0}
+	gs101 := openSimulator(t, sim, ProbeRetryPolicy)
+
+	report := gs101.RunProbe(probe)
+	want := []ProbeStatus{ProbePass, ProbeFail, ProbePass, ProbeWarn}
+	if len(report.Results) != len(want) {
+		t.Fatalf("%d results, want %d", len(report.Results), len(want))
+	}
+	for i, res := range report.Results {
+		if res.Status != want[i] {
+			t.Errorf("step %s = %s (%s), want %s", res.Step.Name, res.Status, res.Reason, want[i])
+		}
+	}
+	if report.Passed() || report.Count(ProbePass) != 2 || report.Count(ProbeWarn) != 1 || report.Count(ProbeFail) != 1 {
+		t.Errorf("report counts %d passed, %d warnings, %d failed", report.Count(ProbePass), report.Count(ProbeWarn), report.Count(ProbeFail))
+	}
+	if actions := sim.Actions(); len(actions) != 0 {
+		t.Errorf("the stall was recovered with %v, want it left to the step", actions)
+	}
+	if gs101.Retry.MaxAttempts != ProbeRetryPolicy.MaxAttempts {
+		t.Errorf("RunProbe changed the retry policy to %s", gs101.Retry)
+	}
+}
@@ -0,0 +1,376 @@
+package tensorutils
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Framing is how a stage is wrapped before it is sent over USB
+type Framing string
+
+const (
+	FramingRaw Framing = "raw" //The image is sent as is
+	FramingDNW Framing = "dnw" //The image is wrapped in a DNW frame, see NewFrame
+)
+
+// Profile describes a supported SoC: how to recognize it, where its endpoints are and how to talk to it.
+// Zero fields of user profiles fall back to the GS101 values.
+type Profile struct {
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+
+	//Matching, VID and PID are required and every other criterion that is set must match too
+	VID       Number   `json:"vid"`
+	PID       Number   `json:"pid"`
+	BcdDevice Number   `json:"bcd_device,omitempty"` //Device release from the device descriptor
+	Product   string   `json:"product,omitempty"`    //Substring of the product string descriptor
+	ChipIDs   []string `json:"chip_ids,omitempty"`   //Prefixes of the chip ID the device announces in its stage requests
+	Explicit  bool     `json:"explicit,omitempty"`   //Only used when picked by name, never selected from a device
+
+	Layout           Layout   `json:"layout"` //Used when the descriptors can't be read
+	Framing          Framing  `json:"framing,omitempty"`
+	Timeout          Duration `json:"timeout,omitempty"`           //Per transfer and for stage acknowledgements
+	AnnounceTimeout  Duration `json:"announce_timeout,omitempty"`  //How long to wait for a stage request after enumeration
+	ReenumerateDelay Duration `json:"reenumerate_delay,omitempty"` //How long the device takes to come back after a reset
+	Stages           []string `json:"stages,omitempty"`            //Boot chain in the order the device requests it
+}
+
+// DeviceIdentity is what a device tells about itself before a profile is chosen
+type DeviceIdentity struct {
+	VID, PID  uint16
+	BcdDevice uint16
+	Product   string
+	Serial    string
+	ChipID    string //From the stage request announced after enumeration, empty until the device sent one
+}
+
+// Built-in profiles. Only GS101 is verified on hardware: the later Tensor generations share its VID:PID, but
+// their boot chains and chip IDs are unknown, so they are left to user profiles.
+var (
+	ProfileGS101 = &Profile{
+		Name:             "gs101",
+		Description:      "Google Tensor GS101 (Pixel 6, 6 Pro, 6a)",
+		VID:              GS101_VID,
+		PID:              GS101_PID,
+		Layout:           DefaultLayout,
+		Framing:          FramingRaw,
+		Timeout:          Duration(GS101_TIMEOUT),
+		AnnounceTimeout:  Duration(GS101_ANNOUNCE_TIMEOUT),
+		ReenumerateDelay: Duration(GS101_REENUMERATE_DELAY),
+		Stages:           []string{"pbl", "bl1", "bl2", "bl31", "tzsw", "ldfw", "gsa", "abl"},
+	}
+	ProfileExynos = &Profile{
+		Name:        "exynos",
+		Description: "Generic Samsung Exynos iROM USB booting",
+		VID:         0x04e8,
+		PID:         0x1234,
+		Framing:     FramingDNW,
+		Stages:      []string{"bl1", "bl2", "bl31", "tzsw", "bootloader"},
+	}
+)
+
+var (
+	mutexProfiles sync.Mutex
+	profiles      = []*Profile{ProfileGS101, ProfileExynos}
+)
+
+func init() {
+	for _, profile := range profiles {
+		profile.applyDefaults()
+	}
+}
+
+// applyDefaults fills zero fields from the GS101 profile
+func (profile *Profile) applyDefaults() {
+	if profile == ProfileGS101 {
+		return
+	}
+	base := ProfileGS101
+	if profile.Layout.BulkPktSize == 0 {
+		profile.Layout = base.Layout
+	}
+	if profile.Framing == "" {
+		profile.Framing = base.Framing
+	}
+	if profile.Timeout == 0 {
+		profile.Timeout = base.Timeout
+	}
+	if profile.AnnounceTimeout == 0 {
+		profile.AnnounceTimeout = base.AnnounceTimeout
+	}
+	if profile.ReenumerateDelay == 0 {
+		profile.ReenumerateDelay = base.ReenumerateDelay
+	}
+	if len(profile.Stages) == 0 {
+		profile.Stages = base.Stages
+	}
+}
+
+func (profile *Profile) validate() error {
+	if profile.Name == "" {
+		return fmt.Errorf("profile without a name")
+	}
+	if profile.VID == 0 || profile.PID == 0 {
+		return fmt.Errorf("profile %s: vid and pid are required", profile.Name)
+	}
+	switch profile.Framing {
+	case "", FramingRaw, FramingDNW:
+	default:
+		return fmt.Errorf("profile %s: unknown framing '%s'", profile.Name, profile.Framing)
+	}
+	return nil
+}
+
+func (profile *Profile) String() string {
+	return fmt.Sprintf("%s (%04X:%04X) %s", profile.Name, uint16(profile.VID), uint16(profile.PID), profile.Description)
+}
+
+// ID returns the VID:PID pair in the format the serial enumerator uses, i.e. 18D1:4F00
+func (profile *Profile) ID() (vid, pid string) {
+	return fmt.Sprintf("%04X", uint16(profile.VID)), fmt.Sprintf("%04X", uint16(profile.PID))
+}
+
+// HasStage reports whether a stage is part of the profile's boot chain
+func (profile *Profile) HasStage(stage string) bool {
+	for _, s := range profile.Stages {
+		if sameStage(s, stage) {
+			return true
+		}
+	}
+	return false
+}
+
+// Frame wraps a stage according to the profile's framing
+func (profile *Profile) Frame(data []byte) ([]byte, error) {
+	if profile.Framing == FramingDNW {
+		return NewFrame(data).Bytes()
+	}
+	return data, nil
+}
+
+// FrameFrom wraps size bytes read from r according to the profile's framing, reading them as the result is read
+func (profile *Profile) FrameFrom(r io.ReaderAt, size int64) (*io.SectionReader, error) {
+	if profile.Framing == FramingDNW {
+		frame, err := NewFrameFrom(r, size)
+		if err != nil {
+			return nil, err
+		}
+		return frame.Reader(), nil
+	}
+	return io.NewSectionReader(r, 0, size), nil
+}
+
+// matches reports whether a device fits the profile, and how many criteria beyond VID:PID it matched
+func (profile *Profile) matches(id DeviceIdentity) (bool, int) {
+	if uint16(profile.VID) != id.VID || uint16(profile.PID) != id.PID {
+		return false, 0
+	}
+	score := 0
+	if profile.BcdDevice != 0 {
+		if uint16(profile.BcdDevice) != id.BcdDevice {
+			return false, 0
+		}
+		score++
+	}
+	if profile.Product != "" {
+		if !strings.Contains(strings.ToLower(id.Product), strings.ToLower(profile.Product)) {
+			return false, 0
+		}
+		score++
+	}
+	if len(profile.ChipIDs) > 0 {
+		found := false
+		for _, chipID := range profile.ChipIDs {
+			if id.ChipID != "" && strings.HasPrefix(strings.ToLower(id.ChipID), strings.ToLower(chipID)) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false, 0
+		}
+		score++
+	}
+	return true, score
+}
+
+func (profile *Profile) timeout() time.Duration {
+	return time.Duration(profile.Timeout)
+}
+
+func (profile *Profile) announceTimeout() time.Duration {
+	return time.Duration(profile.AnnounceTimeout)
+}
+
+func (profile *Profile) reenumerateDelay() time.Duration {
+	return time.Duration(profile.ReenumerateDelay)
+}
+
+// Profiles returns every registered profile, user profiles first
+func Profiles() []*Profile {
+	mutexProfiles.Lock()
+	defer mutexProfiles.Unlock()
+	return append([]*Profile(nil), profiles...)
+}
+
+// GetProfile returns the registered profile with the given name, or nil
+func GetProfile(name string) *Profile {
+	mutexProfiles.Lock()
+	defer mutexProfiles.Unlock()
+	for _, profile := range profiles {
+		if strings.EqualFold(profile.Name, name) {
+			return profile
+		}
+	}
+	return nil
+}
+
+// RegisterProfile adds a profile ahead of the existing ones, replacing any profile with the same name
+func RegisterProfile(profile *Profile) error {
+	if err := profile.validate(); err != nil {
+		return err
+	}
+	profile.applyDefaults()
+
+	mutexProfiles.Lock()
+	defer mutexProfiles.Unlock()
+	registered := []*Profile{profile}
+	for _, existing := range profiles {
+		if !strings.EqualFold(existing.Name, profile.Name) {
+			registered = append(registered, existing)
+		}
+	}
+	profiles = registered
+	return nil
+}
+
+// LoadProfiles registers the profiles in a JSON file holding either a list of profiles or {"profiles": [...]}
+func LoadProfiles(path string) (int, error) {
+	p, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	var loaded []*Profile
+	if err := json.Unmarshal(p, &loaded); err != nil {
+		var wrapped struct {
+			Profiles []*Profile `json:"profiles"`
+		}
+		if wrappedErr := json.Unmarshal(p, &wrapped); wrappedErr != nil {
+			return 0, fmt.Errorf("profiles: %w", err)
+		}
+		loaded = wrapped.Profiles
+	}
+	//Register in reverse so the first profile in the file ends up with the highest priority
+	for i := len(loaded) - 1; i >= 0; i-- {
+		if err := RegisterProfile(loaded[i]); err != nil {
+			return 0, fmt.Errorf("profiles: %w", err)
+		}
+	}
+	return len(loaded), nil
+}
+
+// SelectProfile picks the most specific registered profile for a device, or nil if none matches.
+// Among equally specific profiles the one registered first wins, explicit profiles are skipped.
+func SelectProfile(id DeviceIdentity) *Profile {
+	mutexProfiles.Lock()
+	defer mutexProfiles.Unlock()
+	var best *Profile
+	bestScore := -1
+	for _, profile := range profiles {
+		if profile.Explicit {
+			continue
+		}
+		if ok, score := profile.matches(id); ok && score > bestScore {
+			best, bestScore = profile, score
+		}
+	}
+	return best
+}
+
+// needsChipID reports whether a registered profile would match the device if its chip ID were known
+func needsChipID(id DeviceIdentity) bool {
+	mutexProfiles.Lock()
+	defer mutexProfiles.Unlock()
+	for _, profile := range profiles {
+		if profile.Explicit || len(profile.ChipIDs) == 0 {
+			continue
+		}
+		anyChip := *profile
+		anyChip.ChipIDs = nil
+		if ok, _ := anyChip.matches(id); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// profilePairs returns the distinct VID:PID pairs of the registered profiles, formatted like devicePairsDNW
+func profilePairs() [][]string {
+	mutexProfiles.Lock()
+	defer mutexProfiles.Unlock()
+	var pairs [][]string
+	seen := make(map[string]bool)
+	for _, profile := range profiles {
+		vid, pid := profile.ID()
+		if !seen[vid+":"+pid] {
+			seen[vid+":"+pid] = true
+			pairs = append(pairs, []string{vid, pid})
+		}
+	}
+	return pairs
+}
+
+// registeredID reports whether any registered profile uses the VID:PID pair
+func registeredID(vid, pid uint16) bool {
+	mutexProfiles.Lock()
+	defer mutexProfiles.Unlock()
+	for _, profile := range profiles {
+		if uint16(profile.VID) == vid && uint16(profile.PID) == pid {
+			return true
+		}
+	}
+	return false
+}
+
+type layoutJSON struct {
+	Config      int    `json:"config"`
+	BulkIface   int    `json:"bulk_iface"`
+	BulkAlt     int    `json:"bulk_alt"`
+	IntIface    int    `json:"int_iface"`
+	IntAlt      int    `json:"int_alt"`
+	EpOut       Number `json:"ep_out"`
+	EpIn        Number `json:"ep_in"`
+	EpInt       Number `json:"ep_int"`
+	BulkPktSize int    `json:"bulk_packet_size"`
+	IntPktSize  int    `json:"int_packet_size"`
+}
+
+// UnmarshalJSON reads a layout from a profile, endpoints may be written as strings such as "0x81"
+func (layout *Layout) UnmarshalJSON(p []byte) error {
+	var aux layoutJSON
+	if err := json.Unmarshal(p, &aux); err != nil {
+		return err
+	}
+	if aux.EpOut > 0xff || aux.EpIn > 0xff || aux.EpInt > 0xff {
+		return fmt.Errorf("endpoint addresses are single bytes")
+	}
+	*layout = Layout{
+		Config: aux.Config, BulkIface: aux.BulkIface, BulkAlt: aux.BulkAlt, IntIface: aux.IntIface, IntAlt: aux.IntAlt,
+		EpOut: uint8(aux.EpOut), EpIn: uint8(aux.EpIn), EpInt: uint8(aux.EpInt),
+		BulkPktSize: aux.BulkPktSize, IntPktSize: aux.IntPktSize,
+	}
+	return nil
+}
+
+func (layout Layout) MarshalJSON() ([]byte, error) {
+	return json.Marshal(layoutJSON{
+		Config: layout.Config, BulkIface: layout.BulkIface, BulkAlt: layout.BulkAlt, IntIface: layout.IntIface, IntAlt: layout.IntAlt,
+		EpOut: Number(layout.EpOut), EpIn: Number(layout.EpIn), EpInt: Number(layout.EpInt),
+		BulkPktSize: layout.BulkPktSize, IntPktSize: layout.IntPktSize,
+	})
+}
@@ -0,0 +1,211 @@
+package tensorutils
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// withProfiles restores the registered profiles once the test is done
+func withProfiles(t *testing.T) {
+	t.Helper()
+	mutexProfiles.Lock()
+	saved := append([]*Profile(nil), profiles...)
+	mutexProfiles.Unlock()
+	t.Cleanup(func() {
+		mutexProfiles.Lock()
+		profiles = saved
+		mutexProfiles.Unlock()
+	})
+}
+
+// register registers profiles in order, failing the test on an invalid one
+func register(t *testing.T, registered ...*Profile) {
+	t.Helper()
+	for _, profile := range registered {
+		if err := RegisterProfile(profile); err != nil {
+			t.Fatalf("RegisterProfile(%s) failed: %v", profile.Name, err)
+		}
+	}
+}
+
+func TestProfileValidate(t *testing.T) {
+	tests := []struct {
+		profile Profile
+		err     string
+	}{
+		{Profile{Name: "board", VID: 0x18d1, PID: 0x4f00}, ""},
+		{Profile{Name: "board", VID: 0x18d1, PID: 0x4f00, Framing: FramingDNW}, ""},
+		{Profile{VID: 0x18d1, PID: 0x4f00}, "profile without a name"},
+		{Profile{Name: "board", PID: 0x4f00}, "vid and pid are required"},
+		{Profile{Name: "board", VID: 0x18d1}, "vid and pid are required"},
+		{Profile{Name: "board", VID: 0x18d1, PID: 0x4f00, Framing: "lz4"}, "unknown framing 'lz4'"},
+	}
+	for _, test := range tests {
+		err := test.profile.validate()
+		if test.err == "" && err != nil || test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)) {
+			t.Errorf("validate(%+v) = %v, want %q", test.profile, err, test.err)
+		}
+	}
+}
+
+func TestSelectProfile(t *testing.T) {
+	withProfiles(t)
+	register(t,
+		&Profile{Name: "bench", VID: GS101_VID, PID: GS101_PID, Product: "Bench"},
+		&Profile{Name: "rev2", VID: GS101_VID, PID: GS101_PID, BcdDevice: 0x0200},
+		&Profile{Name: "zuma-dev", VID: GS101_VID, PID: GS101_PID, ChipIDs: []string{"ZUMA", "0a12"}},
+		&Profile{Name: "hidden", VID: GS101_VID, PID: GS101_PID, Product: "Bench", BcdDevice: 0x0200, Explicit: true},
+	)
+	tests := []struct {
+		name string
+		id   DeviceIdentity
+		want string
+	}{
+		{"VID:PID only", DeviceIdentity{VID: GS101_VID, PID: GS101_PID}, "gs101"},
+		{"product substring in another case", DeviceIdentity{VID: GS101_VID, PID: GS101_PID, Product: "USB bench board"}, "bench"},
+		{"bcdDevice", DeviceIdentity{VID: GS101_VID, PID: GS101_PID, BcdDevice: 0x0200}, "rev2"},
+		{"chip ID prefix", DeviceIdentity{VID: GS101_VID, PID: GS101_PID, ChipID: "zuma00ff"}, "zuma-dev"},
+		{"second chip ID", DeviceIdentity{VID: GS101_VID, PID: GS101_PID, ChipID: "0A1234567890ABCD"}, "zuma-dev"},
+		{"chip ID in the serial number only", DeviceIdentity{VID: GS101_VID, PID: GS101_PID, Serial: "ZUMA00FF"}, "gs101"},
+		{"other chip ID", DeviceIdentity{VID: GS101_VID, PID: GS101_PID, ChipID: "09845001"}, "gs101"},
+		{"explicit profiles are skipped", DeviceIdentity{VID: GS101_VID, PID: GS101_PID, Product: "Bench", BcdDevice: 0x0200}, "rev2"},
+		{"other VID:PID", DeviceIdentity{VID: 0x04e8, PID: 0x1234}, "exynos"},
+		{"unknown device", DeviceIdentity{VID: 0x1234, PID: 0x5678}, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := ""
+			if profile := SelectProfile(test.id); profile != nil {
+				got = profile.Name
+			}
+			if got != test.want {
+				t.Errorf("SelectProfile(%+v) = %q, want %q", test.id, got, test.want)
+			}
+		})
+	}
+
+	//Among equally specific profiles the one registered last is ahead
+	register(t, &Profile{Name: "bench2", VID: GS101_VID, PID: GS101_PID, Product: "bench"})
+	if profile := SelectProfile(DeviceIdentity{VID: GS101_VID, PID: GS101_PID, Product: "Bench"}); profile == nil || profile.Name != "bench2" {
+		t.Errorf("tie went to %v, want bench2", profile)
+	}
+
+	if !needsChipID(DeviceIdentity{VID: GS101_VID, PID: GS101_PID}) {
+		t.Error("needsChipID is false for a device a chip ID profile could match")
+	}
+	if needsChipID(DeviceIdentity{VID: 0x04e8, PID: 0x1234}) {
+		t.Error("needsChipID is true for a device no chip ID profile matches")
+	}
+}
+
+func TestLoadProfiles(t *testing.T) {
+	withProfiles(t)
+	dir := t.TempDir()
+	write := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatalf("failed to write %s: %v", name, err)
+		}
+		return path
+	}
+
+	list := write("list.json", `[
+		{"name": "first", "vid": "0x18d1", "pid": "0x4f00", "chip_ids": ["ZUMA"], "timeout": "8s"},
+		{"name": "second", "vid": 6353, "pid": "0x4f00", "framing": "dnw", "stages": ["bl1", "bl2"]}
+	]`)
+	if n, err := LoadProfiles(list); err != nil || n != 2 {
+		t.Fatalf("LoadProfiles of a list = %d, %v", n, err)
+	}
+	registered := Profiles()
+	if registered[0].Name != "first" || registered[1].Name != "second" {
+		t.Errorf("profiles registered as %s, %s, want the file order ahead of the built-in ones", registered[0].Name, registered[1].Name)
+	}
+	first, second := GetProfile("FIRST"), GetProfile("second")
+	if first == nil || second == nil {
+		t.Fatalf("GetProfile found %v and %v", first, second)
+	}
+	if time.Duration(first.Timeout) != 8*time.Second || first.AnnounceTimeout != ProfileGS101.AnnounceTimeout || first.Layout != DefaultLayout {
+		t.Errorf("first profile loaded as %+v, want its timeout and the GS101 defaults", first)
+	}
+	if uint16(second.VID) != GS101_VID || second.Framing != FramingDNW || strings.Join(second.Stages, ",") != "bl1,bl2" {
+		t.Errorf("second profile loaded as %+v", second)
+	}
+
+	//The wrapped form, replacing a built-in profile
+	wrapped := write("wrapped.json", `{"profiles": [{"name": "exynos", "description": "Bench board", "vid": "0x04e8", "pid": "0x1235"}]}`)
+	if n, err := LoadProfiles(wrapped); err != nil || n != 1 {
+		t.Fatalf("LoadProfiles of a wrapped list = %d, %v", n, err)
+	}
+	count := 0
+	for _, profile := range Profiles() {
+		if profile.Name == "exynos" {
+			count++
+		}
+	}
+	if exynos := GetProfile("exynos"); count != 1 || exynos.Description != "Bench board" || uint16(exynos.PID) != 0x1235 {
+		t.Errorf("%d exynos profiles, the one found is %+v", count, exynos)
+	}
+
+	failures := []struct {
+		name, content, err string
+	}{
+		{"syntax.json", `[{"name": "broken",}]`, "profiles:"},
+		{"invalid.json", `[{"name": "nopid", "vid": "0x18d1"}]`, "profile nopid: vid and pid are required"},
+		{"number.json", `[{"name": "big", "vid": "0x18d1", "pid": 70000}]`, "profiles:"},
+		{"duration.json", `[{"name": "slow", "vid": "0x18d1", "pid": "0x4f00", "timeout": "forever"}]`, "profiles:"},
+	}
+	for _, failure := range failures {
+		if _, err := LoadProfiles(write(failure.name, failure.content)); err == nil || !strings.Contains(err.Error(), failure.err) {
+			t.Errorf("LoadProfiles(%s) = %v, want %q", failure.name, err, failure.err)
+		}
+	}
+	if _, err := LoadProfiles(filepath.Join(dir, "missing.json")); !os.IsNotExist(err) {
+		t.Errorf("LoadProfiles of a missing file = %v, want a not exist error", err)
+	}
+}
+
+func TestProfileFromChipID(t *testing.T) {
+	withProfiles(t)
+	register(t, &Profile{Name: "zuma-dev", VID: GS101_VID, PID: GS101_PID, ChipIDs: []string{"ZUMA"},
+		AnnounceTimeout: Duration(200 * time.Millisecond)})
+
+	tests := []struct {
+		serial string
+		want   string
+	}{
+		{"ZUMA00FF", "zuma-dev"},
+		{"09845001", "gs101"},
+	}
+	for _, test := range tests {
+		sim := NewSimulator("bl1")
+		sim.Serial = test.serial
+		gs101, err := sim.Open()
+		if err != nil {
+			t.Fatalf("failed to open simulator: %v", err)
+		}
+		if got := gs101.Profile().Name; got != test.want {
+			t.Errorf("device announcing chip %s uses %s, want %s", test.serial, got, test.want)
+		}
+		//The announcement is still there for whoever flashes the device
+		if msg, err := gs101.ReadMsg(time.Second); err != nil || !msg.IsRequest() || msg.Device() != test.serial || msg.Argument() != "bl1" {
+			t.Errorf("first message = %v, %v, want the stage request", msg, err)
+		}
+		gs101.Close()
+	}
+
+	//A profile given up front is kept whatever the chip ID
+	sim := NewSimulator("bl1")
+	sim.Serial = "ZUMA00FF"
+	sim.Profile = ProfileGS101
+	gs101, err := sim.Open()
+	if err != nil {
+		t.Fatalf("failed to open simulator: %v", err)
+	}
+	defer gs101.Close()
+	if gs101.Profile() != ProfileGS101 {
+		t.Errorf("forced profile replaced by %s", gs101.Profile().Name)
+	}
+}
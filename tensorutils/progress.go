@@ -0,0 +1,94 @@
+package tensorutils
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Progress tracks how much of a stage was sent.
+// The boot ROM only acknowledges a stage once its stop frame is sent, so Sent counts the bytes of completed
+// bulk OUT transfers: they were handed to the host controller, not necessarily consumed by the device.
+type Progress struct {
+	Stage    string
+	Total    int //Size of the stage in bytes
+	Sent     int //Bytes written by completed bulk OUT transfers
+	Restarts int //Times the stage was restarted from the beginning
+	Resumes  int //Times the stage was resumed from the last sent offset
+}
+
+func (progress Progress) String() string {
+	return fmt.Sprintf("stage %s: %d/%d bytes sent, %d restarts, %d resumes",
+		progress.Stage, progress.Sent, progress.Total, progress.Restarts, progress.Resumes)
+}
+
+// StageRequestError is returned when the device asks for a different stage than the one being sent,
+// i.e. after re-enumeration brought it back to an earlier stage of the boot chain
+type StageRequestError struct {
+	Requested   string //Stage the device asked for
+	Interrupted string //Stage that was being sent
+}
+
+func (e *StageRequestError) Error() string {
+	return fmt.Sprintf("device requested stage %s while sending stage %s", e.Requested, e.Interrupted)
+}
+
+// stageAliases maps the names the boot ROM requests to the image names they are usually stored as
+var stageAliases = map[string]string{
+	"epbl": "pbl",
+}
+
+// sameStage reports whether a requested stage and an image stage name refer to the same stage
+func sameStage(requested, stage string) bool {
+	requested, stage = strings.ToLower(requested), strings.ToLower(stage)
+	if alias, exists := stageAliases[requested]; exists {
+		requested = alias
+	}
+	if alias, exists := stageAliases[stage]; exists {
+		stage = alias
+	}
+	return requested == stage
+}
+
+// resumePoint decides where to continue a stage after the device re-enumerated, based on what it asks for next.
+// A request for the same stage means the boot ROM restarted it, a request for another stage is returned as a
+// StageRequestError, and without any request the stage is resumed if the retry policy allows it.
+// Resuming is best-effort: the device never confirms how much of a stage it kept, so it continues from sent.
+func (gs101 *GS101Device) resumePoint(stage string, sent int) (int, error) {
+	deadline := time.Now().Add(gs101.profile.announceTimeout())
+	for {
+		msg, err := gs101.ReadMsg(time.Until(deadline))
+		if errors.Is(err, ErrTimeout) {
+			break
+		}
+		if err != nil {
+			return 0, err
+		}
+		if !msg.IsRequest() {
+			continue
+		}
+		if stage != "" && !sameStage(msg.Argument(), stage) {
+			return 0, &StageRequestError{Requested: msg.Argument(), Interrupted: stage}
+		}
+		return 0, nil
+	}
+
+	if gs101.Retry.Resume {
+		return sent, nil
+	}
+	return 0, nil
+}
+
+// Progress returns the progress of the stage currently or last sent by WriteStage, it may be polled while the stage is sent
+func (gs101 *GS101Device) Progress() Progress {
+	gs101.mutex.Lock()
+	defer gs101.mutex.Unlock()
+	return gs101.progress
+}
+
+func (gs101 *GS101Device) setProgress(progress Progress) {
+	gs101.mutex.Lock()
+	defer gs101.mutex.Unlock()
+	gs101.progress = progress
+}
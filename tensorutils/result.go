@@ -0,0 +1,96 @@
+package tensorutils
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Outcome classifies how the device responded to a finalized stage
+type Outcome int
+
+const (
+	OutcomeUnknown        Outcome = iota // No conclusive response was seen, or the same stage was requested again
+	OutcomeAccepted                      // eub:ack or a request for the next stage
+	OutcomeRejectedHeader                // eub:nak or a header fail message
+	OutcomeBootFailure                   // The boot ROM reported a booting failure
+	OutcomeDisconnected                  // The device vanished or re-enumerated
+)
+
+var outcomeNames = map[Outcome]string{
+	OutcomeUnknown:        "unknown",
+	OutcomeAccepted:       "accepted",
+	OutcomeRejectedHeader: "rejected header",
+	OutcomeBootFailure:    "boot failure",
+	OutcomeDisconnected:   "disconnected",
+}
+
+func (o Outcome) String() string {
+	if name, exists := outcomeNames[o]; exists {
+		return name
+	}
+	return fmt.Sprintf("outcome(%d)", int(o))
+}
+
+// Result describes the evaluated outcome of a stage upload
+type Result struct {
+	Stage        string
+	Outcome      Outcome
+	Message      *Message //The message that decided the outcome, if any
+	Notification []byte   //The last interrupt notification read over USB, if any
+	Err          error    //Why the stage was not accepted, nil once accepted
+}
+
+// Accepted reports whether the device accepted the stage
+func (res *Result) Accepted() bool {
+	return res.Outcome == OutcomeAccepted
+}
+
+func (res *Result) String() string {
+	str := fmt.Sprintf("stage %s: %s", res.Stage, res.Outcome)
+	if res.Message != nil {
+		str += fmt.Sprintf(" (%s)", res.Message.String())
+	}
+	return str
+}
+
+// Classify evaluates the final message and error seen while sending a stage
+func Classify(stage string, msg *Message, err error) *Result {
+	res := &Result{Stage: stage, Message: msg, Err: err}
+	switch {
+	case msg != nil && (msg.IsAck() || msg.IsRequest() && !sameStage(msg.Argument(), stage)):
+		res.Outcome = OutcomeAccepted
+		res.Err = nil
+	case msg != nil && msg.IsRequest() && res.Err == nil:
+		//Requested again, the device doesn't say whether it rejected or restarted the stage
+		res.Err = fmt.Errorf("stage %s: %w", stage, ErrRerequest)
+	case errors.Is(err, ErrNak), errors.Is(err, ErrHeaderFail):
+		res.Outcome = OutcomeRejectedHeader
+	case errors.Is(err, ErrBootFailure):
+		res.Outcome = OutcomeBootFailure
+	case errors.Is(err, ErrNoDevice):
+		res.Outcome = OutcomeDisconnected
+	}
+	if res.Outcome != OutcomeAccepted && res.Err == nil {
+		res.Err = fmt.Errorf("stage %s: no conclusive response", stage)
+	}
+	return res
+}
+
+// Notification types sent by a CDC ACM device on its interrupt endpoint
+const (
+	CDC_NOTIFY_NETWORK_CONNECTION = 0x00
+	CDC_NOTIFY_SERIAL_STATE       = 0x20
+)
+
+// parseNotification decodes a CDC notification into its type and value, reporting false if it is malformed
+func parseNotification(p []byte) (notification byte, value uint16, ok bool) {
+	if len(p) < 8 || p[0] != 0xA1 {
+		return 0, 0, false
+	}
+	notification = p[1]
+	value = uint16(p[2]) | uint16(p[3])<<8
+	if notification == CDC_NOTIFY_SERIAL_STATE && len(p) >= 10 {
+		value = uint16(p[8]) | uint16(p[9])<<8
+	}
+	return notification, value, true
+}
@@ -0,0 +1,192 @@
+package tensorutils
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// RecoveryAction is a step taken to recover a USB transfer after it failed
+type RecoveryAction int
+
+const (
+	RecoverClearHalt   RecoveryAction = iota //Clear the halt feature on the failing endpoint
+	RecoverPortReset                         //Reset the port while keeping the open handle
+	RecoverReenumerate                       //Reset the device, wait for it to re-enumerate and reopen it
+)
+
+var recoveryActionNames = map[RecoveryAction]string{
+	RecoverClearHalt:   "clear-halt",
+	RecoverPortReset:   "port-reset",
+	RecoverReenumerate: "reenumerate",
+}
+
+func (action RecoveryAction) String() string {
+	if name, exists := recoveryActionNames[action]; exists {
+		return name
+	}
+	return fmt.Sprintf("action(%d)", int(action))
+}
+
+// ParseRecoveryAction parses the name of a recovery action, i.e. clear-halt
+func ParseRecoveryAction(name string) (RecoveryAction, error) {
+	for action, actionName := range recoveryActionNames {
+		if strings.EqualFold(name, actionName) {
+			return action, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown recovery action '%s'", name)
+}
+
+// RetryPolicy controls how GS101Device recovers from failed transfers.
+// Every failed attempt is followed by the next action in Actions, the last one repeating once exhausted.
+// Re-enumeration restarts the boot ROM, so during a stage the stage is restarted if the device asks for it again,
+// and otherwise only resumed from the last sent offset when Resume is set.
+// Resuming is best-effort, the device does not acknowledge partial stages so bytes in flight may be lost.
+type RetryPolicy struct {
+	MaxAttempts int              //Attempts per transfer including the first, values below 1 mean 1
+	Backoff     time.Duration    //Delay before the first retry, doubled for every following retry
+	MaxBackoff  time.Duration    //Upper bound for the delay, 0 for no bound
+	Actions     []RecoveryAction //Escalating recovery actions taken between attempts
+	Resume      bool             //Continue a stage from the last sent offset after re-enumeration if the device allows it
+}
+
+// DefaultRetryPolicy clears the halt and retries once, then re-enumerates the device and restarts the stage
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts: 3,
+	Actions:     []RecoveryAction{RecoverClearHalt, RecoverReenumerate},
+}
+
+func (policy RetryPolicy) attempts() int {
+	if policy.MaxAttempts < 1 {
+		return 1
+	}
+	return policy.MaxAttempts
+}
+
+// action returns the recovery action taken after the given failed attempt, counting from 1
+func (policy RetryPolicy) action(attempt int) RecoveryAction {
+	if len(policy.Actions) == 0 {
+		return RecoverClearHalt
+	}
+	if attempt > len(policy.Actions) {
+		attempt = len(policy.Actions)
+	}
+	return policy.Actions[attempt-1]
+}
+
+// delay returns how long to wait after the given failed attempt, counting from 1
+func (policy RetryPolicy) delay(attempt int) time.Duration {
+	delay := policy.Backoff
+	for i := 1; i < attempt && delay > 0; i++ {
+		delay *= 2
+		if policy.MaxBackoff > 0 && delay > policy.MaxBackoff {
+			break
+		}
+	}
+	if policy.MaxBackoff > 0 && delay > policy.MaxBackoff {
+		return policy.MaxBackoff
+	}
+	return delay
+}
+
+func (policy RetryPolicy) String() string {
+	actions := make([]string, len(policy.Actions))
+	for i, action := range policy.Actions {
+		actions[i] = action.String()
+	}
+	return fmt.Sprintf("attempts=%d backoff=%s max-backoff=%s actions=%s resume=%t",
+		policy.attempts(), policy.Backoff, policy.MaxBackoff, strings.Join(actions, ","), policy.Resume)
+}
+
+// retryable reports whether recovering the endpoint may let a failed transfer succeed
+func retryable(err error) bool {
+	return errors.Is(err, ErrStall) || errors.Is(err, ErrTimeout) || errors.Is(err, ErrNoDevice)
+}
+
+// errNeedsReenumerate is returned by transfer when the policy calls for re-enumeration but the caller handles it
+var errNeedsReenumerate = errors.New("re-enumeration required")
+
+// transfer runs fn until it succeeds or the retry policy gives up, recovering the endpoint between attempts.
+// Without reenumerate the caller is left to re-enumerate, which is signalled by wrapping errNeedsReenumerate.
+func (gs101 *GS101Device) transfer(op string, endpoint uint8, reenumerate bool, fn func() (int, error)) (int, error) {
+	policy := gs101.Retry
+	for attempt := 1; ; attempt++ {
+		n, err := fn()
+		if err == nil {
+			return n, nil
+		}
+		transferErr := newTransferError(op, endpoint, err)
+		if errors.Is(transferErr, ErrStall) {
+			gs101.publish(Event{Kind: EventStalled, Endpoint: endpoint, Err: transferErr})
+		}
+		if !retryable(transferErr) || attempt >= policy.attempts() {
+			return n, transferErr
+		}
+
+		action := policy.action(attempt)
+		if action == RecoverReenumerate && !reenumerate {
+			return n, fmt.Errorf("%w: %w", errNeedsReenumerate, transferErr)
+		}
+		fields := Fields{FieldEndpoint: endpointField(endpoint)}
+		gs101.log(LogWarn, fmt.Sprintf("%s failed (attempt %d/%d): %v", op, attempt, policy.attempts(), err), fields)
+		if err := gs101.recover(action, endpoint); err != nil {
+			gs101.log(LogError, fmt.Sprintf("Recovery with %s failed: %v", action, err), fields)
+		} else {
+			gs101.log(LogInfo, fmt.Sprintf("Recovered with %s, retrying %s", action, op), fields)
+			gs101.publish(Event{Kind: EventReset, Action: action, Endpoint: endpoint})
+		}
+		if delay := policy.delay(attempt); delay > 0 {
+			time.Sleep(delay)
+		}
+	}
+}
+
+// recover performs a single recovery action on the device
+func (gs101 *GS101Device) recover(action RecoveryAction, endpoint uint8) error {
+	switch action {
+	case RecoverClearHalt:
+		return gs101.clearStall(endpoint)
+	case RecoverPortReset:
+		_, done, err := gs101.begin(gs101.profile.timeout())
+		if err != nil {
+			return err
+		}
+		defer done()
+		if gs101.dev == nil {
+			return ErrNoDevice
+		}
+		return gs101.dev.Reset()
+	case RecoverReenumerate:
+		return gs101.reenumerate()
+	}
+	return fmt.Errorf("unknown recovery action %s", action)
+}
+
+// reenumerate resets the device on the bus and reopens it in place once it is back.
+// Transfers in flight on other goroutines are cancelled and wait for the new handles.
+func (gs101 *GS101Device) reenumerate() error {
+	err := gs101.reconnect()
+	switch {
+	case err == nil:
+		gs101.publish(Event{Kind: EventConnected})
+	case errors.Is(err, ErrNoDevice):
+		gs101.publish(Event{Kind: EventDisconnected, Err: err})
+	}
+	return err
+}
+
+func (gs101 *GS101Device) reconnect() error {
+	gs101.cancelTransfers()
+	gs101.handles.Lock()
+	defer gs101.handles.Unlock()
+	if gs101.Closed() {
+		return ErrClosed
+	}
+	gs101.release()
+	if err := gs101.bus.reset(gs101); err != nil {
+		return err
+	}
+	return gs101.connect()
+}
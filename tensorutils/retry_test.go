@@ -0,0 +1,167 @@
+package tensorutils
+
+import (
+	"errors"
+	"slices"
+	"testing"
+	"time"
+)
+
+// openSimulator opens sim with a short announce timeout and the given retry policy
+func openSimulator(t *testing.T, sim *Simulator, policy RetryPolicy) *GS101Device {
+	t.Helper()
+	profile := *ProfileGS101
+	profile.AnnounceTimeout = Duration(100 * time.Millisecond)
+	sim.Profile = &profile
+	gs101, err := sim.Open()
+	if err != nil {
+		t.Fatalf("failed to open simulator: %v", err)
+	}
+	t.Cleanup(func() { gs101.Close() })
+	gs101.Retry = policy
+	return gs101
+}
+
+// stageData returns a stage spanning the given number of bulk packets
+func stageData(packets int) []byte {
+	data := make([]byte, packets*DefaultLayout.BulkPktSize)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	return data
+}
+
+func TestRetryRecovery(t *testing.T) {
+	clearHalt := RecoverClearHalt.String() + " 0x02"
+	tests := []struct {
+		name     string
+		sim      func(sim *Simulator) //Sets up stalls on a simulator requesting bl1
+		policy   RetryPolicy
+		actions  []string
+		restarts int
+		resumes  int
+	}{
+		{
+			name:    "clear-halt",
+			sim:     func(sim *Simulator) { sim.StallAt = []int{1} },
+			policy:  RetryPolicy{MaxAttempts: 3, Actions: []RecoveryAction{RecoverClearHalt}},
+			actions: []string{clearHalt},
+		},
+		{
+			name:    "clear-halt then port reset",
+			sim:     func(sim *Simulator) { sim.StallAt, sim.StickyStall = []int{1}, true },
+			policy:  RetryPolicy{MaxAttempts: 3, Actions: []RecoveryAction{RecoverClearHalt, RecoverPortReset}},
+			actions: []string{clearHalt, RecoverPortReset.String()},
+		},
+		{
+			name:     "clear-halt then re-enumerate and restart",
+			sim:      func(sim *Simulator) { sim.StallAt, sim.StickyStall = []int{1}, true },
+			policy:   RetryPolicy{MaxAttempts: 3, Actions: []RecoveryAction{RecoverClearHalt, RecoverReenumerate}},
+			actions:  []string{clearHalt, RecoverReenumerate.String()},
+			restarts: 1,
+		},
+		{
+			name:     "full escalation",
+			sim:      func(sim *Simulator) { sim.StallAt, sim.StickyStall = []int{1}, true },
+			policy:   RetryPolicy{MaxAttempts: 4, Actions: []RecoveryAction{RecoverClearHalt, RecoverClearHalt, RecoverReenumerate}},
+			actions:  []string{clearHalt, clearHalt, RecoverReenumerate.String()},
+			restarts: 1,
+		},
+		{
+			name:    "re-enumerate and resume",
+			sim:     func(sim *Simulator) { sim.StallAt, sim.Resumable = []int{1}, true },
+			policy:  RetryPolicy{MaxAttempts: 3, Actions: []RecoveryAction{RecoverReenumerate}, Resume: true},
+			actions: []string{RecoverReenumerate.String()},
+			resumes: 1,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			sim := NewSimulator("bl1")
+			test.sim(sim)
+			gs101 := openSimulator(t, sim, test.policy)
+			data := stageData(3)
+
+			if err := gs101.WriteStage("bl1", data); err != nil {
+				t.Fatalf("WriteStage failed: %v", err)
+			}
+			if actions := sim.Actions(); !slices.Equal(actions, test.actions) {
+				t.Errorf("actions = %q, want %q", actions, test.actions)
+			}
+			progress := gs101.Progress()
+			if progress.Restarts != test.restarts || progress.Resumes != test.resumes {
+				t.Errorf("restarts/resumes = %d/%d, want %d/%d", progress.Restarts, progress.Resumes, test.restarts, test.resumes)
+			}
+			if received := sim.Received(); received != len(data) {
+				t.Errorf("simulator received %d bytes, want %d", received, len(data))
+			}
+		})
+	}
+}
+
+func TestRetryAttemptCap(t *testing.T) {
+	sim := NewSimulator("bl1")
+	sim.StallAt = []int{0, 1, 2, 3, 4, 5}
+	gs101 := openSimulator(t, sim, RetryPolicy{MaxAttempts: 2, Actions: []RecoveryAction{RecoverClearHalt}})
+
+	err := gs101.WriteStage("bl1", stageData(1))
+	if !errors.Is(err, ErrStall) {
+		t.Fatalf("WriteStage error = %v, want ErrStall", err)
+	}
+	if actions := sim.Actions(); len(actions) != 1 {
+		t.Errorf("actions = %q, want a single recovery for 2 attempts", actions)
+	}
+}
+
+func TestRetryStickyStall(t *testing.T) {
+	sim := NewSimulator("bl1")
+	sim.StallAt = []int{1}
+	sim.StickyStall = true
+	gs101 := openSimulator(t, sim, RetryPolicy{MaxAttempts: 3, Actions: []RecoveryAction{RecoverClearHalt}})
+
+	err := gs101.WriteStage("bl1", stageData(2))
+	var transferErr *TransferError
+	if !errors.As(err, &transferErr) {
+		t.Fatalf("WriteStage error = %v, want a *TransferError", err)
+	}
+	if !errors.Is(transferErr, ErrStall) {
+		t.Errorf("transfer error %v does not wrap ErrStall", transferErr)
+	}
+	if transferErr.Op != "write" || transferErr.Endpoint != DefaultLayout.EpOut || transferErr.Offset != DefaultLayout.BulkPktSize {
+		t.Errorf("transfer error = %+v, want a write on 0x%02x at offset %d", transferErr, DefaultLayout.EpOut, DefaultLayout.BulkPktSize)
+	}
+	clearHalt := RecoverClearHalt.String() + " 0x02"
+	if actions, want := sim.Actions(), []string{clearHalt, clearHalt}; !slices.Equal(actions, want) {
+		t.Errorf("actions = %q, want %q", actions, want)
+	}
+}
+
+func TestRetryPolicy(t *testing.T) {
+	policy := RetryPolicy{Backoff: 10 * time.Millisecond, MaxBackoff: 25 * time.Millisecond}
+	for attempt, want := range map[int]time.Duration{1: 10 * time.Millisecond, 2: 20 * time.Millisecond, 3: 25 * time.Millisecond, 10: 25 * time.Millisecond} {
+		if delay := policy.delay(attempt); delay != want {
+			t.Errorf("delay(%d) = %s, want %s", attempt, delay, want)
+		}
+	}
+	unbounded := RetryPolicy{Backoff: 10 * time.Millisecond}
+	if delay := unbounded.delay(4); delay != 80*time.Millisecond {
+		t.Errorf("unbounded delay(4) = %s, want 80ms", delay)
+	}
+	if delay := (RetryPolicy{MaxBackoff: time.Second}).delay(3); delay != 0 {
+		t.Errorf("delay without backoff = %s, want 0", delay)
+	}
+
+	if attempts := (RetryPolicy{}).attempts(); attempts != 1 {
+		t.Errorf("attempts() without MaxAttempts = %d, want 1", attempts)
+	}
+	if action := (RetryPolicy{}).action(1); action != RecoverClearHalt {
+		t.Errorf("action(1) without actions = %s, want %s", action, RecoverClearHalt)
+	}
+	escalating := RetryPolicy{Actions: []RecoveryAction{RecoverClearHalt, RecoverReenumerate}}
+	for attempt, want := range map[int]RecoveryAction{1: RecoverClearHalt, 2: RecoverReenumerate, 5: RecoverReenumerate} {
+		if action := escalating.action(attempt); action != want {
+			t.Errorf("action(%d) = %s, want %s", attempt, action, want)
+		}
+	}
+}
@@ -0,0 +1,225 @@
+package tensorutils
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/google/gousb"
+)
+
+// Simulator is an in-memory GS101 boot ROM for exercising transfers and recovery without hardware.
+// It requests each stage in turn, answers stop frames and injects stalls on chosen bulk OUT transfers.
+type Simulator struct {
+	Stages      []string //Stages requested in order, the stop frame after the last one is answered with eub:ack
+	StallAt     []int    //Bulk OUT transfers that stall, counted from 0 across the whole session
+	StickyStall bool     //Stalls survive clear-halt and need a port reset or re-enumeration
+	Resumable   bool     //Keep a partial stage across re-enumeration without asking for it again
+	Serial      string
+	Profile     *Profile //Profile the simulated device is opened with, selected like a real device's if nil
+
+	mutex    sync.Mutex
+	writes   int
+	halted   bool
+	stage    int
+	received int    //Bytes received for the current stage
+	output   []byte //Queued bulk IN bytes
+	actions  []string
+	opened   bool
+}
+
+// NewSimulator returns a simulator that requests the given stages in order
+func NewSimulator(stages ...string) *Simulator {
+	return &Simulator{Stages: stages, Serial: "SIMULATED"}
+}
+
+// Open returns a GS101Device backed by the simulator. It identifies as a GS101 device whose chip ID is the
+// serial number.
+func (sim *Simulator) Open() (*GS101Device, error) {
+	profile := sim.Profile
+	var identity *DeviceIdentity
+	if profile == nil {
+		identity = &DeviceIdentity{VID: GS101_VID, PID: GS101_PID, Serial: sim.Serial}
+		if profile = SelectProfile(*identity); profile == nil {
+			profile = ProfileGS101
+		}
+	}
+	gs101 := newDevice(sim, nil, profile)
+	gs101.identity = identity
+	gs101.handles.Lock()
+	err := gs101.connect()
+	gs101.handles.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	gs101.identifyChip()
+	gs101.publish(Event{Kind: EventConnected})
+	return gs101, nil
+}
+
+// Actions returns every recovery action the simulator has seen, in order
+func (sim *Simulator) Actions() []string {
+	sim.mutex.Lock()
+	defer sim.mutex.Unlock()
+	return slices.Clone(sim.actions)
+}
+
+// Received returns how many bytes of the current stage were received
+func (sim *Simulator) Received() int {
+	sim.mutex.Lock()
+	defer sim.mutex.Unlock()
+	return sim.received
+}
+
+func (sim *Simulator) open(gs101 *GS101Device) error {
+	sim.mutex.Lock()
+	defer sim.mutex.Unlock()
+
+	gs101.dev = simHandle{sim}
+	gs101.outEp = simOut{sim}
+	gs101.inEp = simIn{sim}
+	gs101.intEp = simInt{}
+	gs101.layout = gs101.profile.Layout
+	gs101.epOut = gs101.layout.EpOut
+	gs101.epIn = gs101.layout.EpIn
+	gs101.epInt = gs101.layout.EpInt
+	gs101.setInfo(fmt.Sprintf("Simulated %s Device - VID:PID=%04X:%04X Serial:%s", strings.ToUpper(gs101.profile.Name),
+		uint16(gs101.profile.VID), uint16(gs101.profile.PID), sim.Serial), sim.Serial)
+
+	//The boot ROM announces the stage it wants as soon as it enumerates, unless it kept the partial stage
+	if !sim.opened || !sim.Resumable {
+		sim.request()
+	}
+	sim.opened = true
+	return nil
+}
+
+func (sim *Simulator) reset(*GS101Device) error {
+	sim.mutex.Lock()
+	defer sim.mutex.Unlock()
+	sim.actions = append(sim.actions, RecoverReenumerate.String())
+	sim.halted = false
+	if !sim.Resumable {
+		sim.received = 0
+	}
+	sim.output = nil
+	return nil
+}
+
+func (sim *Simulator) present(*GS101Device) bool {
+	return true
+}
+
+// request queues the message for the current stage, the caller must hold the mutex
+func (sim *Simulator) request() {
+	if sim.stage < len(sim.Stages) {
+		sim.output = append(sim.output, fmt.Sprintf("eub:req:%s:%s\n", sim.Serial, sim.Stages[sim.stage])...)
+		return
+	}
+	sim.output = append(sim.output, "eub:ack\n"...)
+}
+
+func (sim *Simulator) currentStage() string {
+	if sim.stage < len(sim.Stages) {
+		return sim.Stages[sim.stage]
+	}
+	return ""
+}
+
+type simHandle struct {
+	sim *Simulator
+}
+
+func (h simHandle) Control(rType, request uint8, val, idx uint16, data []byte) (int, error) {
+	h.sim.mutex.Lock()
+	defer h.sim.mutex.Unlock()
+	if rType == (LIBUSB_REQUEST_TYPE_STANDARD|LIBUSB_RECIPIENT_ENDPOINT) && request == LIBUSB_REQUEST_CLEAR_FEATURE && val == LIBUSB_ENDPOINT_HALT {
+		h.sim.actions = append(h.sim.actions, fmt.Sprintf("%s 0x%02x", RecoverClearHalt, idx))
+		if !h.sim.StickyStall {
+			h.sim.halted = false
+		}
+		return 0, nil
+	}
+	if rType == 0x80 && request == 0x06 && val == 0x0100 {
+		//GET_DESCRIPTOR for the device descriptor
+		vid, pid := uint16(GS101_VID), uint16(GS101_PID)
+		if h.sim.Profile != nil {
+			vid, pid = uint16(h.sim.Profile.VID), uint16(h.sim.Profile.PID)
+		}
+		desc := []byte{0x12, 0x01, 0x00, 0x02, 0x02, 0x00, 0x00, 0x40, byte(vid), byte(vid >> 8), byte(pid), byte(pid >> 8), 0x00, 0x01, 0x01, 0x02, 0x03, 0x01}
+		return copy(data, desc), nil
+	}
+	return 0, gousb.ErrorNotSupported
+}
+
+func (h simHandle) Reset() error {
+	h.sim.mutex.Lock()
+	defer h.sim.mutex.Unlock()
+	h.sim.actions = append(h.sim.actions, RecoverPortReset.String())
+	h.sim.halted = false
+	return nil
+}
+
+func (h simHandle) Close() error {
+	return nil
+}
+
+type simOut struct {
+	sim *Simulator
+}
+
+func (ep simOut) WriteContext(ctx context.Context, p []byte) (int, error) {
+	sim := ep.sim
+	sim.mutex.Lock()
+	defer sim.mutex.Unlock()
+
+	transfer := sim.writes
+	sim.writes++
+	if sim.halted {
+		return 0, gousb.TransferStall
+	}
+	if slices.Contains(sim.StallAt, transfer) {
+		sim.halted = true
+		return 0, gousb.TransferStall
+	}
+
+	if stop, err := GetStopCmd(sim.currentStage()).Bytes(); err == nil && bytes.Equal(p, stop) {
+		sim.stage++
+		sim.received = 0
+		sim.request()
+		return len(p), nil
+	}
+	sim.received += len(p)
+	return len(p), nil
+}
+
+type simIn struct {
+	sim *Simulator
+}
+
+func (ep simIn) ReadContext(ctx context.Context, p []byte) (int, error) {
+	sim := ep.sim
+	sim.mutex.Lock()
+	if len(sim.output) > 0 {
+		n := copy(p, sim.output)
+		sim.output = sim.output[n:]
+		sim.mutex.Unlock()
+		return n, nil
+	}
+	sim.mutex.Unlock()
+
+	//Nothing else is produced until the host writes again
+	<-ctx.Done()
+	return 0, gousb.TransferCancelled
+}
+
+// simInt never sends a notification
+type simInt struct{}
+
+func (simInt) ReadContext(ctx context.Context, p []byte) (int, error) {
+	<-ctx.Done()
+	return 0, gousb.TransferCancelled
+}
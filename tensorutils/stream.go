@@ -0,0 +1,322 @@
+package tensorutils
+
+import (
+	"fmt"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	STREAM_QUEUE_SIZE  = 64        //Entries queued per subscription when no size is given
+	STREAM_MAX_MESSAGE = 64 * 1024 //Longest unterminated message kept before its bytes are discarded
+)
+
+// Overflow decides what happens when a subscription's queue is full
+type Overflow int
+
+const (
+	OverflowDropOldest Overflow = iota //Drop the oldest queued entry, the subscriber falls behind but keeps the latest data
+	OverflowDropNewest                 //Drop the incoming entry
+	OverflowBlock                      //Make the producer wait, which applies backpressure down to the device
+)
+
+var overflowNames = map[Overflow]string{
+	OverflowDropOldest: "drop-oldest",
+	OverflowDropNewest: "drop-newest",
+	OverflowBlock:      "block",
+}
+
+func (overflow Overflow) String() string {
+	if name, exists := overflowNames[overflow]; exists {
+		return name
+	}
+	return fmt.Sprintf("overflow(%d)", int(overflow))
+}
+
+// StreamStats counts what went through a stream
+type StreamStats struct {
+	Bytes     uint64 //Bytes written to the stream
+	Messages  uint64 //Complete messages parsed from them
+	Discarded uint64 //Bytes of unterminated messages longer than STREAM_MAX_MESSAGE
+	Dropped   uint64 //Entries dropped by subscriptions with a full queue
+}
+
+func (stats StreamStats) String() string {
+	return fmt.Sprintf("%d bytes, %d messages, %d bytes discarded, %d entries dropped", stats.Bytes, stats.Messages, stats.Discarded, stats.Dropped)
+}
+
+// Stream splits the bytes read from a device into newline-terminated messages and fans both out to subscriptions.
+// Every subscription has its own bounded queue, so memory stays bounded however long the session runs.
+// Write and Close are called by a single producer, subscriptions may be added and closed from any goroutine.
+type Stream struct {
+	mutex    sync.Mutex
+	raw      []*Subscription[[]byte]
+	messages []*Subscription[*Message]
+	partial  []byte //Bytes of the message being received
+	closed   bool
+	stats    StreamStats
+	dropped  atomic.Uint64
+	notify   func(msg *Message) //Called by the producer for every message after the subscriptions got it
+}
+
+// NewStream returns an empty stream without subscriptions
+func NewStream() *Stream {
+	return &Stream{}
+}
+
+// Write parses p into messages and delivers the bytes and messages to every subscription.
+// It only waits for subscriptions using OverflowBlock.
+func (s *Stream) Write(p []byte) (int, error) {
+	s.mutex.Lock()
+	if s.closed {
+		s.mutex.Unlock()
+		return 0, ErrClosed
+	}
+	msgs := s.split(p)
+	s.stats.Bytes += uint64(len(p))
+	s.stats.Messages += uint64(len(msgs))
+	raw, subs := slices.Clone(s.raw), slices.Clone(s.messages)
+	s.mutex.Unlock()
+
+	if len(raw) > 0 {
+		chunk := slices.Clone(p) //Shared by the subscriptions, which must not modify it
+		for _, sub := range raw {
+			sub.push(chunk)
+		}
+	}
+	for _, msg := range msgs {
+		for _, sub := range subs {
+			sub.push(msg)
+		}
+		if s.notify != nil {
+			s.notify(msg)
+		}
+	}
+	return len(p), nil
+}
+
+// split appends p to the partial message and returns the messages it completes, the caller must hold the mutex
+func (s *Stream) split(p []byte) []*Message {
+	var msgs []*Message
+	for _, b := range p {
+		if b == '\n' || b == '\r' {
+			if len(s.partial) > 0 {
+				msgs = append(msgs, NewMessage(s.partial))
+				s.partial = nil
+			}
+			continue //Skip empty messages
+		}
+		if len(s.partial) >= STREAM_MAX_MESSAGE {
+			s.stats.Discarded += uint64(len(s.partial))
+			s.partial = nil
+		}
+		s.partial = append(s.partial, b)
+	}
+	return msgs
+}
+
+// Skip discards the partial message, so the next message starts with the next bytes written
+func (s *Stream) Skip() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.partial = nil
+}
+
+// Close delivers what is left of the partial message and closes every subscription's channel
+func (s *Stream) Close() error {
+	s.mutex.Lock()
+	if s.closed {
+		s.mutex.Unlock()
+		return nil
+	}
+	s.closed = true
+	var last *Message
+	if len(s.partial) > 0 {
+		last = NewMessage(s.partial)
+		s.stats.Messages++
+		s.partial = nil
+	}
+	raw, subs := s.raw, s.messages
+	s.raw, s.messages = nil, nil
+	s.mutex.Unlock()
+
+	for _, sub := range subs {
+		if last != nil {
+			sub.push(last)
+		}
+		sub.end()
+	}
+	if last != nil && s.notify != nil {
+		s.notify(last)
+	}
+	for _, sub := range raw {
+		sub.end()
+	}
+	return nil
+}
+
+// Stats returns the counters of the stream
+func (s *Stream) Stats() StreamStats {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	stats := s.stats
+	stats.Dropped = s.dropped.Load()
+	return stats
+}
+
+// SubscribeRaw delivers every chunk of bytes written from now on, queueing up to size chunks
+func (s *Stream) SubscribeRaw(size int, overflow Overflow) *Subscription[[]byte] {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	sub := newSubscription[[]byte](size, overflow, &s.dropped)
+	sub.remove = func() {
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		s.raw = slices.DeleteFunc(s.raw, func(other *Subscription[[]byte]) bool { return other == sub })
+	}
+	if s.closed {
+		sub.end()
+		return sub
+	}
+	s.raw = append(s.raw, sub)
+	return sub
+}
+
+// SubscribeMessages delivers every message completed from now on, queueing up to size messages
+func (s *Stream) SubscribeMessages(size int, overflow Overflow) *Subscription[*Message] {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	sub := newSubscription[*Message](size, overflow, &s.dropped)
+	sub.remove = func() {
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		s.messages = slices.DeleteFunc(s.messages, func(other *Subscription[*Message]) bool { return other == sub })
+	}
+	if s.closed {
+		sub.end()
+		return sub
+	}
+	s.messages = append(s.messages, sub)
+	return sub
+}
+
+// Subscription is a bounded queue of entries delivered by a producer
+type Subscription[T any] struct {
+	queue    chan T
+	overflow Overflow
+	done     chan struct{} //Closed by Close, releases a blocked producer
+	closing  sync.Once
+	ending   sync.Once
+	dropped  atomic.Uint64
+	total    *atomic.Uint64 //Drops of every subscription of the producer
+	remove   func()
+}
+
+func newSubscription[T any](size int, overflow Overflow, total *atomic.Uint64) *Subscription[T] {
+	if size < 1 {
+		size = STREAM_QUEUE_SIZE
+	}
+	return &Subscription[T]{queue: make(chan T, size), overflow: overflow, done: make(chan struct{}), total: total}
+}
+
+// C returns the channel entries are delivered on, it is closed once the producer is closed
+func (sub *Subscription[T]) C() <-chan T {
+	return sub.queue
+}
+
+// Next waits up to timeout for the next entry, failing with ErrTimeout or, once the producer is closed, ErrClosed
+func (sub *Subscription[T]) Next(timeout time.Duration) (T, error) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case v, ok := <-sub.queue:
+		if !ok {
+			return v, ErrClosed
+		}
+		return v, nil
+	case <-timer.C:
+		var zero T
+		return zero, ErrTimeout
+	}
+}
+
+// Drain discards every queued entry
+func (sub *Subscription[T]) Drain() {
+	for {
+		select {
+		case _, ok := <-sub.queue:
+			if !ok {
+				return
+			}
+		default:
+			return
+		}
+	}
+}
+
+// Dropped returns how many entries were dropped because the queue was full
+func (sub *Subscription[T]) Dropped() uint64 {
+	return sub.dropped.Load()
+}
+
+// Close stops the delivery of new entries and releases a producer blocked on the subscription
+func (sub *Subscription[T]) Close() {
+	sub.closing.Do(func() {
+		close(sub.done)
+		if sub.remove != nil {
+			sub.remove()
+		}
+	})
+}
+
+// push queues v according to the overflow policy, it is only called by the producer
+func (sub *Subscription[T]) push(v T) {
+	select {
+	case <-sub.done:
+		return
+	default:
+	}
+	switch sub.overflow {
+	case OverflowBlock:
+		select {
+		case sub.queue <- v:
+		case <-sub.done:
+		}
+		return
+	case OverflowDropNewest:
+		select {
+		case sub.queue <- v:
+		default:
+			sub.drop()
+		}
+		return
+	}
+	for {
+		select {
+		case sub.queue <- v:
+			return
+		default:
+		}
+		select {
+		case <-sub.queue:
+			sub.drop()
+		default: //The subscriber made room in the meantime
+		}
+	}
+}
+
+func (sub *Subscription[T]) drop() {
+	sub.dropped.Add(1)
+	if sub.total != nil {
+		sub.total.Add(1)
+	}
+}
+
+// end closes the channel once the producer is done, it is only called by the producer
+func (sub *Subscription[T]) end() {
+	sub.ending.Do(func() {
+		close(sub.queue)
+	})
+}
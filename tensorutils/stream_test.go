@@ -0,0 +1,129 @@
+package tensorutils
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+// queued drains what is queued on a subscription without waiting
+func queued[T any](sub *Subscription[T]) []T {
+	var entries []T
+	for {
+		select {
+		case v, ok := <-sub.C():
+			if !ok {
+				return entries
+			}
+			entries = append(entries, v)
+		default:
+			return entries
+		}
+	}
+}
+
+func chunks(raw [][]byte) []string {
+	var s []string
+	for _, chunk := range raw {
+		s = append(s, string(chunk))
+	}
+	return s
+}
+
+func TestStreamOverflowDrop(t *testing.T) {
+	tests := []struct {
+		overflow Overflow
+		want     []string
+	}{
+		{OverflowDropOldest, []string{"b", "c"}},
+		{OverflowDropNewest, []string{"a", "b"}},
+	}
+	for _, test := range tests {
+		t.Run(test.overflow.String(), func(t *testing.T) {
+			s := NewStream()
+			sub := s.SubscribeRaw(2, test.overflow)
+			for _, p := range []string{"a", "b", "c"} {
+				if _, err := s.Write([]byte(p)); err != nil {
+					t.Fatalf("Write failed: %v", err)
+				}
+			}
+			if got := chunks(queued(sub)); !slices.Equal(got, test.want) {
+				t.Errorf("queued %q, want %q", got, test.want)
+			}
+			if sub.Dropped() != 1 || s.Stats().Dropped != 1 {
+				t.Errorf("dropped %d, stream dropped %d, want 1", sub.Dropped(), s.Stats().Dropped)
+			}
+		})
+	}
+}
+
+func TestStreamOverflowBlock(t *testing.T) {
+	s := NewStream()
+	sub := s.SubscribeRaw(1, OverflowBlock)
+	s.Write([]byte("a"))
+
+	wrote := make(chan struct{})
+	go func() {
+		s.Write([]byte("b"))
+		close(wrote)
+	}()
+	select {
+	case <-wrote:
+		t.Fatal("Write returned while the queue was full")
+	case <-time.After(50 * time.Millisecond):
+	}
+	if chunk := <-sub.C(); string(chunk) != "a" {
+		t.Errorf("first chunk %q, want a", chunk)
+	}
+	select {
+	case <-wrote:
+	case <-time.After(time.Second):
+		t.Fatal("Write still blocked after the queue was drained")
+	}
+	if chunk := <-sub.C(); string(chunk) != "b" {
+		t.Errorf("second chunk %q, want b", chunk)
+	}
+	if sub.Dropped() != 0 {
+		t.Errorf("dropped %d, want 0", sub.Dropped())
+	}
+
+	//Closing the subscription releases a blocked producer
+	s.Write([]byte("c"))
+	released := make(chan struct{})
+	go func() {
+		s.Write([]byte("d"))
+		close(released)
+	}()
+	time.Sleep(20 * time.Millisecond)
+	sub.Close()
+	select {
+	case <-released:
+	case <-time.After(time.Second):
+		t.Fatal("Write still blocked after the subscription was closed")
+	}
+}
+
+func TestStreamMessages(t *testing.T) {
+	s := NewStream()
+	msgs := s.SubscribeMessages(0, OverflowDropOldest)
+	written := []string{"eub:req:SIMULATED:bl1\r\neub:a", "ck\n\npartial"}
+	for _, p := range written {
+		s.Write([]byte(p))
+	}
+	s.Close()
+
+	var got []string
+	for msg := range msgs.C() {
+		got = append(got, msg.String())
+	}
+	want := []string{"eub:req:SIMULATED:bl1", "eub:ack", "partial"}
+	if !slices.Equal(got, want) {
+		t.Errorf("messages %q, want %q", got, want)
+	}
+	if stats := s.Stats(); stats.Messages != 3 || stats.Bytes != uint64(len(written[0])+len(written[1])) {
+		t.Errorf("stats = %s", stats)
+	}
+	if _, err := s.Write([]byte("late")); err != ErrClosed {
+		t.Errorf("Write after Close = %v, want ErrClosed", err)
+	}
+}
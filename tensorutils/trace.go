@@ -0,0 +1,212 @@
+package tensorutils
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Transfer kinds reported in a TraceEvent
+const (
+	TraceBulk      = "bulk"
+	TraceInterrupt = "interrupt"
+	TraceControl   = "control"
+	TraceSerial    = "serial"
+)
+
+// TraceEvent describes a single transfer on the wire
+type TraceEvent struct {
+	Time     time.Time
+	Kind     string //bulk, interrupt, control or serial
+	Out      bool   //Host to device
+	Endpoint uint8  //Endpoint address, 0 for control and serial transfers
+	Port     string //Serial port name, empty for USB transfers
+	Setup    string //Decoded setup packet of a control transfer
+	Data     []byte
+	Err      error
+}
+
+// Direction returns OUT for host to device transfers and IN otherwise
+func (ev *TraceEvent) Direction() string {
+	if ev.Out {
+		return "OUT"
+	}
+	return "IN"
+}
+
+// Tracer receives every transfer while tracing is enabled, it must be safe for concurrent use
+type Tracer interface {
+	Trace(ev *TraceEvent)
+}
+
+var tracer atomic.Pointer[Tracer] //Nil while tracing is disabled
+
+// SetTracer enables protocol tracing for every device, nil disables it again.
+// It may be called while transfers are running.
+func SetTracer(t Tracer) {
+	if t == nil {
+		tracer.Store(nil)
+		return
+	}
+	tracer.Store(&t)
+}
+
+// trace reports a transfer to the tracer, copying the data since buffers are reused
+func trace(ev TraceEvent) {
+	t := tracer.Load()
+	if t == nil {
+		return
+	}
+	ev.Time = time.Now()
+	ev.Data = append([]byte(nil), ev.Data...)
+	(*t).Trace(&ev)
+}
+
+// traceUSB reports a USB transfer, the direction follows from the endpoint address
+func traceUSB(kind string, endpoint uint8, data []byte, err error) {
+	trace(TraceEvent{Kind: kind, Out: endpoint&0x80 == 0, Endpoint: endpoint, Data: data, Err: err})
+}
+
+// HexTracer writes each transfer as a header line, an annotated hex dump and any decoded frames or messages
+type HexTracer struct {
+	Limit int //Bytes dumped per transfer, 0 for all of them
+
+	mutex sync.Mutex
+	out   io.Writer
+}
+
+// NewHexTracer returns a HexTracer writing to out
+func NewHexTracer(out io.Writer, limit int) *HexTracer {
+	return &HexTracer{Limit: limit, out: out}
+}
+
+func (t *HexTracer) Trace(ev *TraceEvent) {
+	var sb strings.Builder
+	sb.WriteString(ev.Time.Format("15:04:05.000000"))
+	fmt.Fprintf(&sb, " %-9s %-3s", ev.Kind, ev.Direction())
+	switch {
+	case ev.Port != "":
+		fmt.Fprintf(&sb, " %s", ev.Port)
+	case ev.Kind != TraceControl:
+		fmt.Fprintf(&sb, " ep 0x%02x", ev.Endpoint)
+	}
+	fmt.Fprintf(&sb, " len %d", len(ev.Data))
+	if ev.Setup != "" {
+		fmt.Fprintf(&sb, " [%s]", ev.Setup)
+	}
+	if ev.Err != nil {
+		fmt.Fprintf(&sb, " error: %v", ev.Err)
+	}
+	sb.WriteByte('\n')
+
+	data := ev.Data
+	if t.Limit > 0 && len(data) > t.Limit {
+		data = data[:t.Limit]
+	}
+	sb.WriteString(HexDump(data, "    "))
+	if len(data) < len(ev.Data) {
+		fmt.Fprintf(&sb, "    ... %d more bytes\n", len(ev.Data)-len(data))
+	}
+	for _, note := range Annotate(ev.Data) {
+		fmt.Fprintf(&sb, "    = %s\n", note)
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	io.WriteString(t.out, sb.String())
+}
+
+// HexDump formats p as offset, 16 hex bytes and their printable characters per line
+func HexDump(p []byte, indent string) string {
+	var sb strings.Builder
+	for off := 0; off < len(p); off += 16 {
+		line := p[off:min(off+16, len(p))]
+		fmt.Fprintf(&sb, "%s%04x  ", indent, off)
+		for i := 0; i < 16; i++ {
+			if i < len(line) {
+				fmt.Fprintf(&sb, "%02x ", line[i])
+			} else {
+				sb.WriteString("   ")
+			}
+			if i == 7 {
+				sb.WriteByte(' ')
+			}
+		}
+		sb.WriteString(" |")
+		for _, b := range line {
+			if b < 0x20 || b > 0x7e {
+				b = '.'
+			}
+			sb.WriteByte(b)
+		}
+		sb.WriteString("|\n")
+	}
+	return sb.String()
+}
+
+// Annotate decodes recognized DNW frames and device messages in a transfer
+func Annotate(p []byte) []string {
+	if bytes.HasPrefix(p, OpDNW) {
+		return []string{annotateFrame(p)}
+	}
+
+	var notes []string
+	for _, line := range bytes.FieldsFunc(p, func(r rune) bool { return r == '\r' || r == '\n' }) {
+		if !printable(line) {
+			continue
+		}
+		msg := NewMessage(line)
+		switch {
+		case msg.IsRequest():
+			notes = append(notes, fmt.Sprintf("message: request for stage %s from %s", msg.Argument(), msg.Device()))
+		case msg.IsAck():
+			notes = append(notes, "message: ack")
+		case msg.IsNak():
+			notes = append(notes, "message: nak")
+		case msg.IsFailure():
+			notes = append(notes, "message: failure: "+msg.String())
+		case msg.SubCommand() != "":
+			notes = append(notes, "message: "+msg.String())
+		}
+	}
+	return notes
+}
+
+// annotateFrame decodes a frame starting with OpDNW
+func annotateFrame(p []byte) string {
+	for stage, cmd := range stopCmds {
+		if stop, err := cmd.Bytes(); err == nil && bytes.Equal(p, stop) {
+			return fmt.Sprintf("DNW stop frame for stage %s", stage)
+		}
+	}
+	if stop, _ := CmdStop.Bytes(); bytes.Equal(p, stop) {
+		return "DNW stop frame"
+	}
+	if len(p) < len(OpDNW)+4 {
+		return "DNW frame, truncated header"
+	}
+	length := int(int32(binary.LittleEndian.Uint32(p[len(OpDNW):])))
+	payload := length - len(OpDNW) - 4 - 2
+	if payload < 0 {
+		return fmt.Sprintf("DNW frame, length %d", length)
+	}
+	if length != len(p) {
+		return fmt.Sprintf("DNW frame, length %d (%d payload bytes), %d bytes in this transfer", length, payload, len(p))
+	}
+	return fmt.Sprintf("DNW frame, length %d (%d payload bytes), crc %02x %02x", length, payload, p[len(p)-2], p[len(p)-1])
+}
+
+// printable reports whether a line looks like text rather than binary data
+func printable(line []byte) bool {
+	for _, b := range line {
+		if b < 0x20 || b > 0x7e {
+			return false
+		}
+	}
+	return len(line) > 0
+}
@@ -0,0 +1,160 @@
+package tensorutils
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// countingTracer counts the transfers traced through it
+type countingTracer struct {
+	count atomic.Int32
+}
+
+func (t *countingTracer) Trace(ev *TraceEvent) {
+	t.count.Add(1)
+}
+
+// frameBytes returns the bytes of cmd, failing the test if they can't be read
+func frameBytes(t *testing.T, cmd *Command) []byte {
+	t.Helper()
+	p, err := cmd.Bytes()
+	if err != nil {
+		t.Fatalf("failed to read frame: %v", err)
+	}
+	return p
+}
+
+func TestHexDump(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		want string
+	}{
+		{"empty", nil, ""},
+		{"full line", []byte("0123456789abcdef"),
+			"  0000  30 31 32 33 34 35 36 37  38 39 61 62 63 64 65 66  |0123456789abcdef|\n"},
+		{"partial line", []byte("eub\x00\xff"),
+			"  0000  65 75 62 00 ff                                    |eub..|\n"},
+		{"second line", []byte("0123456789abcdef\r\nAB"),
+			"  0000  30 31 32 33 34 35 36 37  38 39 61 62 63 64 65 66  |0123456789abcdef|\n" +
+				"  0010  0d 0a 41 42                                       |..AB|\n"},
+	}
+	for _, test := range tests {
+		if got := HexDump(test.data, "  "); got != test.want {
+			t.Errorf("HexDump of %s =\n%q\nwant\n%q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestAnnotate(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		want []string
+	}{
+		{"request", []byte("eub:req:09845001:bl1\n"), []string{"message: request for stage bl1 from 09845001"}},
+		{"ack and nak in one transfer", []byte("eub:ack\r\neub:nak\r\n"), []string{"message: ack", "message: nak"}},
+		{"header failure", []byte("bl2 header fail\n"), []string{"message: failure: bl2 header fail"}},
+		{"other message", []byte("eub:log:hello"), []string{"message: eub:log:hello"}},
+		{"plain text", []byte("hello\n"), nil},
+		{"binary data", []byte{0x12, 0x01, 0x00, 0x02}, nil},
+		{"binary line among messages", []byte("eub:ack\n\x00\x01:\x02\n"), []string{"message: ack"}},
+		{"DNW frame", frameBytes(t, NewFrame([]byte("eub:req:x:y"))), []string{"DNW frame, length 21 (11 payload bytes), crc 23 04"}},
+	}
+	for _, test := range tests {
+		if got := Annotate(test.data); !slices.Equal(got, test.want) {
+			t.Errorf("Annotate of %s = %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestAnnotateFrame(t *testing.T) {
+	stop := NewCommand(OpDNW, []byte{0xff, 0xff, 0xff, 0xff}, nil, []byte("\x02\x00"))
+	RegisterStopCmd("TEST", stop)
+	t.Cleanup(func() { delete(stopCmds, "test") })
+
+	frame := frameBytes(t, NewFrame([]byte("abc")))
+	short := append(append([]byte(nil), OpDNW...), binary.LittleEndian.AppendUint32(nil, 4)...)
+	tests := []struct {
+		name string
+		data []byte
+		want string
+	}{
+		{"whole frame", frame, "DNW frame, length 13 (3 payload bytes), crc 26 01"},
+		{"first transfer of a frame", frame[:10], "DNW frame, length 13 (3 payload bytes), 10 bytes in this transfer"},
+		{"truncated header", frame[:6], "DNW frame, truncated header"},
+		{"length shorter than the header", short, "DNW frame, length 4"},
+		{"stop frame", frameBytes(t, CmdStop), "DNW stop frame"},
+		{"stage stop frame", frameBytes(t, stop), "DNW stop frame for stage test"},
+	}
+	for _, test := range tests {
+		if got := annotateFrame(test.data); got != test.want {
+			t.Errorf("annotateFrame of the %s = %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestHexTracer(t *testing.T) {
+	var out bytes.Buffer
+	tracer := NewHexTracer(&out, 4)
+	tracer.Trace(&TraceEvent{Kind: TraceBulk, Out: true, Endpoint: 0x02, Data: frameBytes(t, NewFrame([]byte("abc")))})
+	tracer.Trace(&TraceEvent{Kind: TraceControl, Setup: "GET_DESCRIPTOR device", Err: errors.New("pipe error")})
+	tracer.Trace(&TraceEvent{Kind: TraceSerial, Port: "/dev/ttyACM0", Data: []byte("eub:ack\n")})
+
+	lines := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")
+	want := []string{
+		" bulk      OUT ep 0x02 len 13",
+		"    0000  1b 44 4e 57                                       |.DNW|",
+		"    ... 9 more bytes",
+		"    = DNW frame, length 13 (3 payload bytes), crc 26 01",
+		" control   IN  len 0 [GET_DESCRIPTOR device] error: pipe error",
+		" serial    IN  /dev/ttyACM0 len 8",
+		"    0000  65 75 62 3a                                       |eub:|",
+		"    ... 4 more bytes",
+		"    = message: ack",
+	}
+	if len(lines) != len(want) {
+		t.Fatalf("trace has %d lines, want %d:\n%s", len(lines), len(want), out.String())
+	}
+	for i, line := range lines {
+		//Header lines start with the time
+		if !strings.HasSuffix(line, want[i]) {
+			t.Errorf("line %d = %q, want %q", i, line, want[i])
+		}
+	}
+}
+
+func TestSetTracer(t *testing.T) {
+	t.Cleanup(func() { SetTracer(nil) })
+	counter := &countingTracer{}
+	SetTracer(counter)
+	traceUSB(TraceBulk, 0x81, []byte("eub:ack"), nil)
+	SetTracer(nil)
+	traceUSB(TraceBulk, 0x81, []byte("eub:ack"), nil)
+	if n := counter.count.Load(); n != 1 {
+		t.Errorf("%d transfers traced, want 1", n)
+	}
+
+	//Tracing may be switched while transfers are running
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 200; j++ {
+				traceUSB(TraceBulk, 0x02, []byte{byte(j)}, nil)
+			}
+		}()
+	}
+	for i := 0; i < 100; i++ {
+		SetTracer(counter)
+		SetTracer(nil)
+	}
+	wg.Wait()
+}